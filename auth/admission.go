@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits how many expensive requests, e.g password hashing, run at once. Requests beyond the limit wait in a bounded
+// queue; when the queue is full, or a request waits too long, it is shed with a 503 and Retry-After, so a burst of
+// sign ups degrades into fast errors rather than slow responses for everyone. Safe for concurrent use.
+type AdmissionLimiter struct {
+	// Requests allowed to run at once. Defaults to 8.
+	Concurrency int
+	// Requests allowed to wait for a slot. Defaults to Concurrency.
+	Queue int
+	// How long a request may wait for a slot. Defaults to 2 seconds.
+	MaxWait time.Duration
+
+	once    sync.Once
+	slots   chan struct{}
+	mu      sync.Mutex
+	waiting int
+}
+
+func (l *AdmissionLimiter) init() {
+	n := l.Concurrency
+	if n <= 0 {
+		n = 8
+	}
+	l.slots = make(chan struct{}, n)
+}
+
+func (l *AdmissionLimiter) queue() int {
+	if l.Queue > 0 {
+		return l.Queue
+	}
+	if l.Concurrency > 0 {
+		return l.Concurrency
+	}
+	return 8
+}
+
+func (l *AdmissionLimiter) maxWait() time.Duration {
+	if l.MaxWait == 0 {
+		return 2 * time.Second
+	}
+	return l.MaxWait
+}
+
+// Waits for a slot, returning false if the request should be shed. Call release when done if it returns true.
+func (l *AdmissionLimiter) acquire(r *http.Request) bool {
+	l.once.Do(l.init)
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	l.mu.Lock()
+	if l.waiting >= l.queue() {
+		l.mu.Unlock()
+		return false
+	}
+	l.waiting++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+	timer := time.NewTimer(l.maxWait())
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (l *AdmissionLimiter) release() {
+	<-l.slots
+}
+
+// Wraps a handler so that requests other than GET and HEAD are admitted through the limiter. Rendering pages is cheap,
+// so only submissions are limited.
+func (l *AdmissionLimiter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !l.acquire(r) {
+			w.Header().Set("Retry-After", strconv.Itoa(int((l.maxWait()+time.Second-1)/time.Second)))
+			http.Error(w, "server busy, try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+		h.ServeHTTP(w, r)
+	})
+}
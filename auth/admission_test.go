@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionLimiter(t *testing.T) {
+	l := &AdmissionLimiter{Concurrency: 1, Queue: 1, MaxWait: time.Second}
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			return
+		}
+		entered <- struct{}{}
+		<-unblock
+	}))
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/login", nil))
+		return w
+	}
+
+	first := make(chan int)
+	go func() { first <- post().Code }()
+	<-entered
+	second := make(chan int)
+	go func() { second <- post().Code }()
+	for {
+		l.mu.Lock()
+		waiting := l.waiting
+		l.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, so this is shed immediately.
+	w := post()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 503 with Retry-After, got %v %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// GETs aren't limited.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: expected 200, got %v", w.Code)
+	}
+
+	unblock <- struct{}{}
+	if code := <-first; code != http.StatusOK {
+		t.Fatalf("first: expected 200, got %v", code)
+	}
+	<-entered
+	unblock <- struct{}{}
+	if code := <-second; code != http.StatusOK {
+		t.Fatalf("queued: expected 200, got %v", code)
+	}
+}
+
+func TestAdmissionLimiterMaxWait(t *testing.T) {
+	l := &AdmissionLimiter{Concurrency: 1, MaxWait: 10 * time.Millisecond}
+	unblock := make(chan struct{})
+	entered := make(chan struct{})
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-unblock
+	}))
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/signup", nil))
+	<-entered
+	defer close(unblock)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/signup", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after waiting, got %v", w.Code)
+	}
+}
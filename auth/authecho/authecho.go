@@ -0,0 +1,19 @@
+// Package authecho adapts auth.AuthFilter to echo, for services built on echo rather than net/http handlers. Kept in a
+// separate module, so only its users download echo.
+package authecho
+
+import (
+	"github.com/hherman1/auth/auth"
+	"github.com/labstack/echo/v4"
+)
+
+// Returns echo middleware which requires a valid token, as AuthFilter.Handler does. Requests it refuses get the filter's
+// response, and the next handler isn't called. Handlers find the token with Token.
+func Middleware(f auth.AuthFilter) echo.MiddlewareFunc {
+	return echo.WrapMiddleware(f.Middleware)
+}
+
+// Returns the token Middleware validated, or false if the request didn't pass through it.
+func Token(c echo.Context) (auth.Token, bool) {
+	return auth.TokenFromContext(c.Request().Context())
+}
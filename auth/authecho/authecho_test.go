@@ -0,0 +1,46 @@
+package authecho
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hherman1/auth/auth"
+	"github.com/hherman1/auth/auth/authtest"
+	"github.com/labstack/echo/v4"
+)
+
+func TestMiddleware(t *testing.T) {
+	a := &authtest.MemoryAuthenticator{}
+	ctx := context.Background()
+	if err := a.Register(ctx, "a@b.com", "pw"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	token, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	e := echo.New()
+	e.Use(Middleware(auth.AuthFilter{Validator: a, LoginURL: "/login"}))
+	e.GET("/secured", func(c echo.Context) error {
+		tok, ok := Token(c)
+		if !ok || tok != token {
+			t.Errorf("expected the request's token, got %v %v", tok, ok)
+		}
+		return c.String(http.StatusOK, "ok")
+	})
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/secured", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login?redirect=%2Fsecured" {
+		t.Fatalf("logged out: expected a redirect to log in, got %v %v", w.Code, w.Header())
+	}
+	r := httptest.NewRequest("GET", "/secured", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_token", Value: token.String()})
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("logged in: expected the handler, got %v %v", w.Code, w.Body)
+	}
+}
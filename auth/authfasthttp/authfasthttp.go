@@ -0,0 +1,73 @@
+// Package authfasthttp adapts auth.AuthFilter to fasthttp, for services which don't use net/http. Each request is
+// converted to a net/http request for the filter, which costs an allocation or two, but not a round trip. Lives in its
+// own module, along with its fasthttp dependency.
+package authfasthttp
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/hherman1/auth/auth"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+const tokenKey = "auth_token"
+
+// Wraps a handler to require a valid token, as AuthFilter.Handler does. Requests it refuses get the filter's response,
+// and the handler isn't called. Headers the filter sets on requests it lets through, e.g refreshed cookies, are kept.
+// Handlers find the token with Token. AuthFilter.Stash can't hand stashed requests back here, since fasthttp requests
+// can't be replaced.
+func Handler(f auth.AuthFilter, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		var r http.Request
+		err := fasthttpadaptor.ConvertRequest(ctx, &r, true)
+		if err != nil {
+			ctx.Error("bad request", fasthttp.StatusBadRequest)
+			return
+		}
+		w := &responseWriter{header: make(http.Header), status: http.StatusOK}
+		passed := false
+		f.Middleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			passed = true
+			t, _ := auth.TokenFromContext(r.Context())
+			ctx.SetUserValue(tokenKey, t)
+		})).ServeHTTP(w, r.WithContext(ctx))
+		for k, vv := range w.header {
+			for _, v := range vv {
+				ctx.Response.Header.Add(k, v)
+			}
+		}
+		if passed {
+			next(ctx)
+			return
+		}
+		ctx.SetStatusCode(w.status)
+		ctx.SetBody(w.body.Bytes())
+	}
+}
+
+// Returns the token Handler validated, or false if the request didn't pass through it.
+func Token(ctx *fasthttp.RequestCtx) (auth.Token, bool) {
+	t, ok := ctx.UserValue(tokenKey).(auth.Token)
+	return t, ok
+}
+
+// Collects the filter's response, so it can be copied to fasthttp's.
+type responseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
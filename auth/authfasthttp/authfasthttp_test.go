@@ -0,0 +1,47 @@
+package authfasthttp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hherman1/auth/auth"
+	"github.com/hherman1/auth/auth/authtest"
+	"github.com/valyala/fasthttp"
+)
+
+func TestHandler(t *testing.T) {
+	a := &authtest.MemoryAuthenticator{}
+	ctx := context.Background()
+	if err := a.Register(ctx, "a@b.com", "pw"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	token, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	h := Handler(auth.AuthFilter{Validator: a, LoginURL: "/login"}, func(ctx *fasthttp.RequestCtx) {
+		tok, ok := Token(ctx)
+		if !ok || tok != token {
+			t.Errorf("expected the request's token, got %v %v", tok, ok)
+		}
+		ctx.SetBodyString("ok")
+	})
+	do := func(cookie string) *fasthttp.RequestCtx {
+		var rc fasthttp.RequestCtx
+		rc.Request.SetRequestURI("/secured")
+		if cookie != "" {
+			rc.Request.Header.SetCookie("auth_token", cookie)
+		}
+		h(&rc)
+		return &rc
+	}
+
+	rc := do("")
+	if rc.Response.StatusCode() != fasthttp.StatusFound || string(rc.Response.Header.Peek("Location")) != "/login?redirect=%2Fsecured" {
+		t.Fatalf("logged out: expected a redirect to log in, got %v", rc.Response.String())
+	}
+	rc = do(token.String())
+	if rc.Response.StatusCode() != fasthttp.StatusOK || string(rc.Response.Body()) != "ok" {
+		t.Fatalf("logged in: expected the handler, got %v", rc.Response.String())
+	}
+}
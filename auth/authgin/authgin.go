@@ -0,0 +1,32 @@
+// Package authgin adapts auth.AuthFilter to gin, for services built on gin rather than net/http handlers. Gin comes
+// with this module only, not with auth.
+package authgin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hherman1/auth/auth"
+)
+
+// Returns gin middleware which requires a valid token, as AuthFilter.Handler does. Requests it refuses are aborted with
+// the filter's response. Handlers find the token with Token.
+func Middleware(f auth.AuthFilter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		passed := false
+		f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			passed = true
+			c.Request = r
+		})).ServeHTTP(c.Writer, c.Request)
+		if !passed {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Returns the token Middleware validated, or false if the request didn't pass through it.
+func Token(c *gin.Context) (auth.Token, bool) {
+	return auth.TokenFromContext(c.Request.Context())
+}
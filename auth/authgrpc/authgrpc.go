@@ -0,0 +1,190 @@
+// Package authgrpc serves an auth.Authenticator over gRPC, for services in other languages which can't use the auth
+// package or its HTTP pages. The service is defined in authpb/auth.proto.
+package authgrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/hherman1/auth/auth"
+	"github.com/hherman1/auth/auth/authgrpc/authpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Implements authpb.AuthServer with an Authenticator, e.g the same DBAuthenticator serving the HTTP pages, so tokens
+// issued by either are accepted by both. Validate and ValidateBatch require an Authenticator implementing
+// auth.BatchValidator, and Revoke auth.Revoker; without them they fail with UNIMPLEMENTED. Serve it with
+// authpb.RegisterAuthServer.
+type Server struct {
+	authpb.UnimplementedAuthServer
+
+	Authenticator auth.Authenticator
+	// Called with each token revoked, e.g to drop it from a CachedValidator, as AuthServer.OnRevoke.
+	OnRevoke func(auth.Token)
+}
+
+func (s *Server) Authenticate(ctx context.Context, req *authpb.AuthenticateRequest) (*authpb.AuthenticateResponse, error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		ctx = auth.WithClientIP(ctx, peerIP(p.Addr))
+	}
+	if ua := metadata.ValueFromIncomingContext(ctx, "user-agent"); len(ua) > 0 {
+		ctx = auth.WithUserAgent(ctx, ua[0])
+	}
+	t, expires, err := s.Authenticator.Authenticate(ctx, req.GetEmail(), req.GetPassword())
+	if err != nil {
+		return nil, s.status("authenticate", err)
+	}
+	text, err := s.encode(ctx, t)
+	if err != nil {
+		return nil, s.status("authenticate: encode token", err)
+	}
+	return &authpb.AuthenticateResponse{Token: text, Expires: timestamppb.New(expires)}, nil
+}
+
+func (s *Server) Register(ctx context.Context, req *authpb.RegisterRequest) (*authpb.RegisterResponse, error) {
+	err := s.Authenticator.Register(ctx, req.GetEmail(), req.GetPassword())
+	if err != nil {
+		return nil, s.status("register", err)
+	}
+	return &authpb.RegisterResponse{}, nil
+}
+
+func (s *Server) Validate(ctx context.Context, req *authpb.ValidateRequest) (*authpb.ValidateResponse, error) {
+	bv, ok := s.Authenticator.(auth.BatchValidator)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "authenticator %T does not report users", s.Authenticator)
+	}
+	t, err := s.decode(ctx, req.GetToken())
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, auth.ErrInvalidToken.Error())
+	}
+	res, err := bv.ValidateBatch(ctx, []auth.Token{t})
+	if err != nil {
+		return nil, s.status("validate", err)
+	}
+	if res[0].Err != nil {
+		return nil, s.status("validate", res[0].Err)
+	}
+	return &authpb.ValidateResponse{Uid: res[0].UID}, nil
+}
+
+// The most tokens ValidateBatch checks in one call.
+const maxBatch = 1000
+
+func (s *Server) ValidateBatch(ctx context.Context, req *authpb.ValidateBatchRequest) (*authpb.ValidateBatchResponse, error) {
+	bv, ok := s.Authenticator.(auth.BatchValidator)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "authenticator %T does not report users", s.Authenticator)
+	}
+	if len(req.GetTokens()) > maxBatch {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %v tokens may be validated at once, got %v", maxBatch,
+			len(req.GetTokens()))
+	}
+	results := make([]*authpb.ValidateResult, len(req.GetTokens()))
+	// Tokens which can't be read are invalid, and aren't sent on.
+	var ts []auth.Token
+	var at []int
+	for i, text := range req.GetTokens() {
+		results[i] = &authpb.ValidateResult{}
+		t, err := s.decode(ctx, text)
+		if err == nil {
+			ts, at = append(ts, t), append(at, i)
+		}
+	}
+	if len(ts) > 0 {
+		res, err := bv.ValidateBatch(ctx, ts)
+		if err != nil {
+			return nil, s.status("validate batch", err)
+		}
+		for j, r := range res {
+			if r.Err != nil && !errors.Is(r.Err, auth.ErrInvalidToken) {
+				return nil, s.status("validate batch", r.Err)
+			}
+			results[at[j]].Uid = r.UID
+		}
+	}
+	return &authpb.ValidateBatchResponse{Results: results}, nil
+}
+
+func (s *Server) Revoke(ctx context.Context, req *authpb.RevokeRequest) (*authpb.RevokeResponse, error) {
+	r, ok := s.Authenticator.(auth.Revoker)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "authenticator %T does not revoke tokens", s.Authenticator)
+	}
+	t, err := s.decode(ctx, req.GetToken())
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, auth.ErrInvalidToken.Error())
+	}
+	err = r.Revoke(ctx, t)
+	if err != nil {
+		return nil, s.status("revoke", err)
+	}
+	if s.OnRevoke != nil {
+		s.OnRevoke(t)
+	}
+	return &authpb.RevokeResponse{}, nil
+}
+
+// Returns the token as the HTTP pages would hand it out.
+func (s *Server) encode(ctx context.Context, t auth.Token) (string, error) {
+	if e, ok := s.Authenticator.(auth.TokenEncoder); ok {
+		return e.EncodeToken(ctx, t)
+	}
+	return t.String(), nil
+}
+
+// Reads a token as the HTTP pages hand it out.
+func (s *Server) decode(ctx context.Context, text string) (auth.Token, error) {
+	if e, ok := s.Authenticator.(auth.TokenEncoder); ok {
+		return e.DecodeToken(ctx, text)
+	}
+	var t auth.Token
+	err := t.UnmarshalText([]byte(text))
+	return t, err
+}
+
+// The errors clients can act on, by the code they are returned with. Their messages are safe to show users.
+var codeErrors = []struct {
+	err  error
+	code codes.Code
+}{
+	{auth.ErrBadCredentials, codes.Unauthenticated},
+	{auth.ErrInvalidToken, codes.Unauthenticated},
+	{auth.ErrLockedOut, codes.ResourceExhausted},
+	{auth.ErrRiskTooHigh, codes.PermissionDenied},
+	{auth.ErrSSORequired, codes.PermissionDenied},
+	{auth.ErrEmailRegistered, codes.AlreadyExists},
+	{auth.ErrWeakPassword, codes.InvalidArgument},
+	{auth.ErrDisposableEmail, codes.InvalidArgument},
+	{auth.ErrUndeliverableEmail, codes.InvalidArgument},
+	{auth.ErrCircuitOpen, codes.Unavailable},
+}
+
+// Converts an error to a gRPC status. Unexpected errors are logged and reported as INTERNAL, without details.
+func (s *Server) status(what string, err error) error {
+	for _, ce := range codeErrors {
+		if errors.Is(err, ce.err) {
+			return status.Error(ce.code, err.Error())
+		}
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	log.Printf("error: grpc: %v: %v", what, err)
+	return status.Error(codes.Internal, fmt.Sprintf("%v: internal error", what))
+}
+
+func peerIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
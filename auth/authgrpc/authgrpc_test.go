@@ -0,0 +1,98 @@
+package authgrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hherman1/auth/auth"
+	"github.com/hherman1/auth/auth/authgrpc/authpb"
+	"github.com/hherman1/auth/auth/authtest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	a := auth.DBAuthenticator{DB: authtest.NewDB(t)}
+	revoked := 0
+	g := grpc.NewServer()
+	authpb.RegisterAuthServer(g, &Server{Authenticator: a, OnRevoke: func(auth.Token) { revoked++ }})
+	lis := bufconn.Listen(1 << 20)
+	go g.Serve(lis)
+	defer g.Stop()
+	cc, err := grpc.DialContext(ctx, "bufnet", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer cc.Close()
+	c := authpb.NewAuthClient(cc)
+	expectCode := func(what string, err error, code codes.Code) {
+		t.Helper()
+		if status.Code(err) != code {
+			t.Fatalf("%v: expected %v, got %v", what, code, err)
+		}
+	}
+
+	_, err = c.Register(ctx, &authpb.RegisterRequest{Email: "a@b.com", Password: "pw"})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	_, err = c.Register(ctx, &authpb.RegisterRequest{Email: "a@b.com", Password: "pw"})
+	expectCode("register twice", err, codes.AlreadyExists)
+	_, err = c.Authenticate(ctx, &authpb.AuthenticateRequest{Email: "a@b.com", Password: "wrong"})
+	expectCode("wrong password", err, codes.Unauthenticated)
+	res, err := c.Authenticate(ctx, &authpb.AuthenticateRequest{Email: "a@b.com", Password: "pw"})
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if !res.GetExpires().AsTime().After(time.Now()) {
+		t.Fatalf("expected an expiry, got %v", res.GetExpires())
+	}
+	v, err := c.Validate(ctx, &authpb.ValidateRequest{Token: res.GetToken()})
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if v.GetUid() != "a@b.com" {
+		t.Fatalf("expected the token's user, got %q", v.GetUid())
+	}
+	// The token is as good over HTTP.
+	var tok auth.Token
+	err = tok.UnmarshalText([]byte(res.GetToken()))
+	if err != nil {
+		t.Fatalf("unmarshal token: %v", err)
+	}
+	if err := a.Validate(ctx, tok); err != nil {
+		t.Fatalf("expected the token to be valid for the authenticator, got %v", err)
+	}
+	_, err = c.Validate(ctx, &authpb.ValidateRequest{Token: "nope"})
+	expectCode("garbage token", err, codes.Unauthenticated)
+	batch, err := c.ValidateBatch(ctx, &authpb.ValidateBatchRequest{Tokens: []string{"nope", res.GetToken(), auth.Token{1}.String()}})
+	if err != nil {
+		t.Fatalf("validate batch: %v", err)
+	}
+	var uids []string
+	for _, r := range batch.GetResults() {
+		uids = append(uids, r.GetUid())
+	}
+	if len(uids) != 3 || uids[0] != "" || uids[1] != "a@b.com" || uids[2] != "" {
+		t.Fatalf("validate batch: expected only the issued token's user, got %q", uids)
+	}
+	_, err = c.ValidateBatch(ctx, &authpb.ValidateBatchRequest{Tokens: make([]string, maxBatch+1)})
+	expectCode("oversized batch", err, codes.InvalidArgument)
+
+	_, err = c.Revoke(ctx, &authpb.RevokeRequest{Token: res.GetToken()})
+	if err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if revoked != 1 {
+		t.Fatalf("expected OnRevoke to be called once, was called %v times", revoked)
+	}
+	_, err = c.Validate(ctx, &authpb.ValidateRequest{Token: res.GetToken()})
+	expectCode("revoked token", err, codes.Unauthenticated)
+}
@@ -0,0 +1,4 @@
+// Package authpb holds the protobuf definitions of the auth gRPC service, and the Go code generated from them.
+package authpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative auth.proto
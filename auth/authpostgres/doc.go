@@ -0,0 +1,3 @@
+// Package authpostgres tests auth.PostgresStore against a live Postgres DB. It is its own module, so the auth module
+// doesn't depend on a Postgres driver only its tests use.
+package authpostgres
@@ -0,0 +1,132 @@
+package authpostgres
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hherman1/auth/auth"
+	"github.com/hherman1/auth/auth/authtest"
+
+	_ "github.com/lib/pq"
+)
+
+// Opens the Postgres DB named by AUTH_TEST_POSTGRES_DSN in a new schema, dropped when the test ends, or skips the test
+// if it isn't set, e.g AUTH_TEST_POSTGRES_DSN="postgres://postgres@localhost/postgres?sslmode=disable".
+func newPostgres(t testing.TB) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("AUTH_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("AUTH_TEST_POSTGRES_DSN is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connect to postgres: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	var b [8]byte
+	rand.Read(b[:])
+	schema := "auth_test_" + hex.EncodeToString(b[:])
+	_, err = admin.Exec(`CREATE SCHEMA ` + schema)
+	if err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+	// lib/pq passes options it doesn't know to the server, so every connection uses the schema.
+	switch {
+	case !strings.Contains(dsn, "://"):
+		dsn += " search_path=" + schema
+	case strings.Contains(dsn, "?"):
+		dsn += "&search_path=" + schema
+	default:
+		dsn += "?search_path=" + schema
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connect to postgres: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+var soak = flag.Duration("soak", 0, "Run the chaos test for this long, e.g 10m")
+
+func TestPostgresStore(t *testing.T) {
+	s := auth.PostgresStore{DB: newPostgres(t)}
+	authtest.TestStore(t, s)
+
+	ctx := context.Background()
+	err := s.InsertUser(ctx, "user3", "three@localhost", []byte("hash"))
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	tok := auth.Token{5}
+	err = s.InsertToken(ctx, "user3", tok, time.UnixMilli(0), time.UnixMilli(1000), time.UnixMilli(0))
+	if err != nil {
+		t.Fatalf("insert token: %v", err)
+	}
+	err = s.DeleteUser(ctx, "user3")
+	if err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+	if _, err := s.LookupToken(ctx, tok, time.UnixMilli(500)); err != auth.ErrInvalidToken {
+		t.Fatalf("deleted user's token: expected ErrInvalidToken, got %v", err)
+	}
+	if _, _, err := s.UserHash(ctx, "user3"); !errors.Is(err, auth.ErrBadCredentials) {
+		t.Fatalf("deleted user: expected ErrBadCredentials, got %v", err)
+	}
+	if err := s.DeleteUser(ctx, "user3"); !errors.Is(err, auth.ErrBadCredentials) {
+		t.Fatalf("deleting twice: expected ErrBadCredentials, got %v", err)
+	}
+}
+
+func TestPostgresHashTokenColumn(t *testing.T) {
+	db := newPostgres(t)
+	ctx := context.Background()
+	_, err := db.ExecContext(ctx, `
+CREATE TABLE "USER" (ID TEXT NOT NULL PRIMARY KEY, EMAIL TEXT NOT NULL UNIQUE, BCRYPT BYTEA NOT NULL,
+	VALID BOOLEAN NOT NULL DEFAULT FALSE, PASSWORD_CHANGED_TIME BIGINT NOT NULL DEFAULT 0);
+CREATE TABLE "TOKEN" (UID TEXT NOT NULL REFERENCES "USER"(ID), TOKEN BYTEA NOT NULL PRIMARY KEY,
+	START_TIME BIGINT NOT NULL, END_TIME BIGINT NOT NULL, CREATED_TIME BIGINT NOT NULL);`)
+	if err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+	raw := auth.Token{1, 2, 3}
+	_, err = db.ExecContext(ctx, `INSERT INTO "USER" (ID, EMAIL, BCRYPT) VALUES ('user1', 'a@b.com', '');`)
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO "TOKEN" (UID, TOKEN, START_TIME, END_TIME, CREATED_TIME)
+VALUES ('user1', $1, 0, 1000, 0);`, raw[:])
+	if err != nil {
+		t.Fatalf("insert raw token: %v", err)
+	}
+	s := auth.PostgresStore{DB: db}
+	// Migrating twice is fine
+	for i := 0; i < 2; i++ {
+		err = s.Initialize(ctx)
+		if err != nil {
+			t.Fatalf("initialize %v: %v", i, err)
+		}
+	}
+	uid, err := s.LookupToken(ctx, raw, time.UnixMilli(500))
+	if err != nil || uid != "user1" {
+		t.Fatalf("migrated token: %v %v", uid, err)
+	}
+	var stored []byte
+	err = db.QueryRowContext(ctx, `SELECT TOKEN_HASH FROM "TOKEN"`).Scan(&stored)
+	if err != nil || len(stored) != 32 {
+		t.Fatalf("expected only the token's hash to be stored, got %x %v", stored, err)
+	}
+}
+
+func TestChaosPostgresStore(t *testing.T) {
+	authtest.Chaos(t, auth.PostgresStore{DB: newPostgres(t)}, authtest.ChaosOptions{Duration: *soak})
+}
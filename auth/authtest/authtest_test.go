@@ -0,0 +1,78 @@
+package authtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hherman1/auth/auth"
+)
+
+func TestBuilder(t *testing.T) {
+	db := NewDB(t)
+	ctx := context.Background()
+	u := NewUser().Email("alice@example.com").Tag("vip").MustCreate(t, db)
+	if u.ID != "alice@example.com" {
+		t.Fatalf("expected ID to follow email, got %v", u.ID)
+	}
+	err := auth.Authenticate(ctx, db, u.Email, u.Password)
+	if err != nil {
+		t.Fatalf("authenticate built user: %v", err)
+	}
+	tags, err := auth.UserTags(ctx, db, u.ID)
+	if err != nil || len(tags) != 1 || tags[0] != "vip" {
+		t.Fatalf("tags: %v %v", tags, err)
+	}
+
+	token := MustToken(t, db, u)
+	err = auth.DBAuthenticator{DB: db}.Validate(ctx, token)
+	if err != nil {
+		t.Fatalf("validate built token: %v", err)
+	}
+	if u := NewUser().MustCreate(t, db); u.ID != "user@example.com" {
+		t.Fatalf("expected the default ID to be the default email, got %v", u.ID)
+	}
+}
+
+func TestMemoryAuthenticator(t *testing.T) {
+	m := &MemoryAuthenticator{}
+	var _ auth.Authenticator = m
+	var _ auth.Revoker = m
+	ctx := context.Background()
+	err := m.Register(ctx, "alice@example.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := m.Register(ctx, "alice@example.com", "pw"); err == nil {
+		t.Fatalf("expected duplicate register to fail")
+	}
+	if _, _, err := m.Authenticate(ctx, "alice@example.com", "wrong"); err != auth.ErrBadCredentials {
+		t.Fatalf("wrong password: expected ErrBadCredentials, got %v", err)
+	}
+	token, _, err := m.Authenticate(ctx, "alice@example.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+
+	filter := auth.AuthFilter{Validator: m, LoginURL: "/login"}
+	var got auth.Token
+	h := filter.Handler(func(t auth.Token, w http.ResponseWriter, r *http.Request) { got = t })
+	r := httptest.NewRequest("GET", "/secured", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_token", Value: token.String()})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got != token {
+		t.Fatalf("expected filter to accept the token")
+	}
+
+	err = m.Revoke(ctx, token)
+	if err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := m.Validate(ctx, token); err != auth.ErrInvalidToken {
+		t.Fatalf("revoked: expected ErrInvalidToken, got %v", err)
+	}
+	if uid, err := m.UID(m.Token("bob")); err != nil || uid != "bob" {
+		t.Fatalf("token: got %v %v", uid, err)
+	}
+}
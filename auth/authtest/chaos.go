@@ -0,0 +1,338 @@
+package authtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hherman1/auth/auth"
+)
+
+// Chaos tests run random register, log in, validate, revoke, reap and delete operations against a Store from many
+// goroutines at once, and fail if the store ever breaks an invariant callers rely on, e.g accepting a revoked token.
+// Run them against new Store implementations before trusting them with real users, and for longer, as soak tests, after
+// changing one.
+
+// Implemented by Stores which can delete users, so Chaos can check their tokens stop working.
+type UserDeleter interface {
+	// Deletes the user and their tokens. Returns auth.ErrBadCredentials if there is no such user.
+	DeleteUser(ctx context.Context, uid string) error
+}
+
+// Configures Chaos.
+type ChaosOptions struct {
+	// Goroutines running operations at once. Defaults to 8.
+	Workers int
+	// Operations each worker runs. Defaults to 200.
+	Ops int
+	// If set, workers run for this long instead of Ops operations each, for soak tests.
+	Duration time.Duration
+	// Seeds the random operations, so a failing run can be repeated as closely as the scheduler allows. Defaults to the
+	// time, and is logged.
+	Seed int64
+	// How many distinct emails users register with, so registrations collide. Defaults to 16.
+	Emails int
+}
+
+// A token as issued, for checking what the store says about it later.
+type chaosToken struct {
+	t          auth.Token
+	uid        string
+	start, end int64
+}
+
+// What the operations which have completed did, to check the store's answers against.
+type chaosModel struct {
+	mu sync.Mutex
+	// Users inserted, by ID, and the IDs of those since deleted.
+	users   map[string]string
+	deleted map[string]bool
+	tokens  []chaosToken
+	revoked map[auth.Token]bool
+}
+
+type chaos struct {
+	t     testing.TB
+	s     auth.Store
+	opts  ChaosOptions
+	model chaosModel
+	// The time operations run at, in Unix milliseconds. Each operation moves it forward a little, so tokens expire during
+	// the run without waiting for them.
+	clock int64
+	// Numbers user IDs, so a deleted user's ID is never reused.
+	ids int64
+	// Operations which failed because the store was busy, e.g SQLite waited too long for its write lock.
+	busy int64
+}
+
+// Runs random operations against the store from Workers goroutines, failing the test if it breaks an invariant:
+//   - a token is accepted after it expired, was revoked, or its user was deleted
+//   - a token is accepted for another user than it was issued to, or one never issued is accepted
+//   - two users share an email
+//   - an operation fails for any reason besides those the Store interface documents, or the store being busy
+//
+// The store should start empty. Deleting users is only tested if it implements UserDeleter.
+func Chaos(t testing.TB, s auth.Store, opts ChaosOptions) {
+	t.Helper()
+	if opts.Workers == 0 {
+		opts.Workers = 8
+	}
+	if opts.Ops == 0 {
+		opts.Ops = 200
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	if opts.Emails == 0 {
+		opts.Emails = 16
+	}
+	t.Logf("chaos: seed %v", opts.Seed)
+	ctx := context.Background()
+	err := s.Initialize(ctx)
+	if err != nil {
+		t.Fatalf("chaos: initialize: %v", err)
+	}
+	c := &chaos{
+		t:     t,
+		s:     s,
+		opts:  opts,
+		model: chaosModel{users: make(map[string]string), deleted: make(map[string]bool), revoked: make(map[auth.Token]bool)},
+		clock: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli(),
+	}
+	deadline := time.Now().Add(opts.Duration)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func(rng *rand.Rand) {
+			defer wg.Done()
+			for n := 0; opts.Duration > 0 && time.Now().Before(deadline) || opts.Duration == 0 && n < opts.Ops; n++ {
+				c.step(ctx, rng)
+			}
+		}(rand.New(rand.NewSource(opts.Seed + int64(i))))
+	}
+	wg.Wait()
+	if c.busy > 0 {
+		t.Logf("chaos: %v operations found the store busy", c.busy)
+	}
+	c.checkFinal(ctx)
+}
+
+// Fails the test with the error, unless the store was only busy, which a caller would retry.
+func (c *chaos) fail(err error) {
+	if auth.IsBusy(err) {
+		atomic.AddInt64(&c.busy, 1)
+		return
+	}
+	c.t.Errorf("chaos: %v", err)
+}
+
+// Moves the clock forward a little and returns the new time.
+func (c *chaos) tick(rng *rand.Rand) int64 {
+	return atomic.AddInt64(&c.clock, 1+rng.Int63n(20))
+}
+
+func (c *chaos) email(rng *rand.Rand) string {
+	return fmt.Sprintf("chaos%v@example.com", rng.Intn(c.opts.Emails))
+}
+
+// Runs one random operation.
+func (c *chaos) step(ctx context.Context, rng *rand.Rand) {
+	now := c.tick(rng)
+	_, deletes := c.s.(UserDeleter)
+	switch n := rng.Intn(100); {
+	case n < 15:
+		c.register(ctx, rng)
+	case n < 40:
+		c.login(ctx, rng, now)
+	case n < 60:
+		c.validate(ctx, rng, now)
+	case n < 70:
+		c.validateBatch(ctx, rng, now)
+	case n < 80:
+		c.revoke(ctx, rng)
+	case n < 90:
+		err := c.s.ReapTokens(ctx, time.UnixMilli(now-rng.Int63n(200)), time.UnixMilli(now))
+		if err != nil {
+			c.fail(fmt.Errorf("reap: %w", err))
+		}
+	case deletes:
+		c.deleteUser(ctx, rng)
+	default:
+		c.validate(ctx, rng, now)
+	}
+}
+
+func (c *chaos) register(ctx context.Context, rng *rand.Rand) {
+	uid := fmt.Sprintf("chaos-%v", atomic.AddInt64(&c.ids, 1))
+	email := c.email(rng)
+	// Failing is fine, the email may be taken. Whether two users got it is checked at the end.
+	if c.s.InsertUser(ctx, uid, email, []byte("hash")) == nil {
+		c.model.mu.Lock()
+		c.model.users[uid] = email
+		c.model.mu.Unlock()
+	}
+}
+
+func (c *chaos) login(ctx context.Context, rng *rand.Rand, now int64) {
+	email := c.email(rng)
+	uid, _, err := c.s.UserHash(ctx, email)
+	if errors.Is(err, auth.ErrBadCredentials) {
+		return
+	}
+	if err != nil {
+		c.fail(fmt.Errorf("user hash %v: %w", email, err))
+		return
+	}
+	c.model.mu.Lock()
+	got, known := c.model.users[uid]
+	c.model.mu.Unlock()
+	if known && got != email {
+		c.t.Errorf("chaos: looked up %v, got %v, whose email is %v", email, uid, got)
+	}
+	var t auth.Token
+	rng.Read(t[:])
+	tok := chaosToken{t: t, uid: uid, start: now - 1000, end: now + 50 + rng.Int63n(2000)}
+	// Failing is fine, the user may have been deleted since.
+	err = c.s.InsertToken(ctx, uid, t, time.UnixMilli(tok.start), time.UnixMilli(tok.end), time.UnixMilli(now))
+	if err == nil {
+		c.model.mu.Lock()
+		c.model.tokens = append(c.model.tokens, tok)
+		c.model.mu.Unlock()
+	}
+}
+
+// Returns a random issued token, or a never issued one now and then, and whether it must be refused at now given what
+// has happened so far.
+func (c *chaos) pick(rng *rand.Rand, now int64) (chaosToken, bool) {
+	c.model.mu.Lock()
+	defer c.model.mu.Unlock()
+	if len(c.model.tokens) == 0 || rng.Intn(10) == 0 {
+		var t auth.Token
+		rng.Read(t[:])
+		return chaosToken{t: t}, true
+	}
+	tok := c.model.tokens[rng.Intn(len(c.model.tokens))]
+	return tok, c.model.revoked[tok.t] || c.model.deleted[tok.uid] || now < tok.start || now > tok.end
+}
+
+// Fails the test if the store's answer about a token contradicts what was known before asking.
+func (c *chaos) checkLookup(tok chaosToken, mustRefuse bool, uid string, valid bool) {
+	switch {
+	case valid && tok.uid == "":
+		c.t.Errorf("chaos: a token never issued was accepted for %v", uid)
+	case valid && mustRefuse:
+		c.t.Errorf("chaos: token for %v was accepted after it expired, was revoked, or its user was deleted", tok.uid)
+	case valid && uid != tok.uid:
+		c.t.Errorf("chaos: token issued to %v was accepted for %v", tok.uid, uid)
+	}
+}
+
+func (c *chaos) validate(ctx context.Context, rng *rand.Rand, now int64) {
+	tok, mustRefuse := c.pick(rng, now)
+	uid, err := c.s.LookupToken(ctx, tok.t, time.UnixMilli(now))
+	if err != nil && !errors.Is(err, auth.ErrInvalidToken) {
+		c.fail(fmt.Errorf("lookup: %w", err))
+		return
+	}
+	c.checkLookup(tok, mustRefuse, uid, err == nil)
+}
+
+func (c *chaos) validateBatch(ctx context.Context, rng *rand.Rand, now int64) {
+	var toks []chaosToken
+	var refuse []bool
+	var ts []auth.Token
+	for i := rng.Intn(8); i >= 0; i-- {
+		tok, mustRefuse := c.pick(rng, now)
+		toks, refuse, ts = append(toks, tok), append(refuse, mustRefuse), append(ts, tok.t)
+	}
+	uids, err := c.s.LookupTokens(ctx, ts, time.UnixMilli(now))
+	if err != nil {
+		c.fail(fmt.Errorf("lookup batch: %w", err))
+		return
+	}
+	for i, tok := range toks {
+		uid, valid := uids[tok.t]
+		c.checkLookup(tok, refuse[i], uid, valid)
+	}
+}
+
+func (c *chaos) revoke(ctx context.Context, rng *rand.Rand) {
+	c.model.mu.Lock()
+	if len(c.model.tokens) == 0 {
+		c.model.mu.Unlock()
+		return
+	}
+	tok := c.model.tokens[rng.Intn(len(c.model.tokens))]
+	c.model.mu.Unlock()
+	err := c.s.DeleteToken(ctx, tok.t)
+	if err != nil {
+		c.fail(fmt.Errorf("delete token: %w", err))
+		return
+	}
+	c.model.mu.Lock()
+	c.model.revoked[tok.t] = true
+	c.model.mu.Unlock()
+}
+
+func (c *chaos) deleteUser(ctx context.Context, rng *rand.Rand) {
+	c.model.mu.Lock()
+	var live []string
+	for uid := range c.model.users {
+		if !c.model.deleted[uid] {
+			live = append(live, uid)
+		}
+	}
+	c.model.mu.Unlock()
+	if len(live) == 0 {
+		return
+	}
+	// Map order is random, but not seeded; sort for repeatable runs.
+	sort.Strings(live)
+	uid := live[rng.Intn(len(live))]
+	err := c.s.(UserDeleter).DeleteUser(ctx, uid)
+	if errors.Is(err, auth.ErrBadCredentials) {
+		return
+	}
+	if err != nil {
+		c.fail(fmt.Errorf("delete user %v: %w", uid, err))
+		return
+	}
+	c.model.mu.Lock()
+	c.model.deleted[uid] = true
+	c.model.mu.Unlock()
+}
+
+// Checks the invariants once every operation is done, so nothing is in flight.
+func (c *chaos) checkFinal(ctx context.Context) {
+	c.model.mu.Lock()
+	defer c.model.mu.Unlock()
+	for _, tok := range c.model.tokens {
+		if !c.model.revoked[tok.t] && !c.model.deleted[tok.uid] {
+			continue
+		}
+		// Within the token's lifetime, so only revocation or deletion can refuse it.
+		uid, err := c.s.LookupToken(ctx, tok.t, time.UnixMilli(tok.start+1))
+		if err == nil {
+			c.t.Errorf("chaos: token for %v is still valid after it was revoked or its user was deleted", uid)
+		} else if !errors.Is(err, auth.ErrInvalidToken) {
+			c.t.Errorf("chaos: lookup: %v", err)
+		}
+	}
+	owners := make(map[string][]string)
+	for uid, email := range c.model.users {
+		if !c.model.deleted[uid] {
+			owners[email] = append(owners[email], uid)
+		}
+	}
+	for email, uids := range owners {
+		if len(uids) > 1 {
+			c.t.Errorf("chaos: %v users share the email %v: %v", len(uids), email, uids)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package authtest
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/hherman1/auth/auth"
+)
+
+var soak = flag.Duration("soak", 0, "Run the chaos tests for this long each, e.g 10m")
+
+func TestChaosSQLiteStore(t *testing.T) {
+	Chaos(t, auth.SQLiteStore{DB: NewDB(t)}, ChaosOptions{Duration: *soak})
+}
+
+// Seeds which have found bugs, run every time. Scheduling still varies, so these catch regressions often, not always.
+func TestChaosSQLiteStoreSeeds(t *testing.T) {
+	for _, seed := range []int64{
+		// Logging in while the user was deleted issued a token Lookup accepted without a user.
+		1792216007120166271,
+	} {
+		Chaos(t, auth.SQLiteStore{DB: NewDB(t)}, ChaosOptions{Seed: seed})
+	}
+}
@@ -0,0 +1,95 @@
+package authtest
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hherman1/auth/auth"
+)
+
+// An Authenticator and Validator which keeps users and tokens in memory, for unit testing handlers behind an
+// auth.AuthFilter or auth.AuthServer without a DB. Users are keyed by email, which is also their ID, and passwords are
+// kept in plaintext. The zero value is ready to use.
+type MemoryAuthenticator struct {
+	mu        sync.Mutex
+	passwords map[string]string
+	tokens    map[auth.Token]memoryToken
+}
+
+type memoryToken struct {
+	uid     string
+	expires time.Time
+}
+
+func (m *MemoryAuthenticator) Register(ctx context.Context, email, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.passwords[email]; ok {
+		return fmt.Errorf("user %v already exists", email)
+	}
+	if m.passwords == nil {
+		m.passwords = make(map[string]string)
+	}
+	m.passwords[email] = password
+	return nil
+}
+
+// Issues a token valid for 24 hours if the password is right. Returns auth.ErrBadCredentials otherwise.
+func (m *MemoryAuthenticator) Authenticate(ctx context.Context, email, password string) (auth.Token, time.Time, error) {
+	expires := time.Now().Add(24 * time.Hour)
+	m.mu.Lock()
+	want, ok := m.passwords[email]
+	m.mu.Unlock()
+	if !ok || want != password {
+		return auth.Token{}, expires, auth.ErrBadCredentials
+	}
+	return m.issue(email, expires), expires, nil
+}
+
+// Returns auth.ErrInvalidToken unless the token was issued and has not expired or been revoked.
+func (m *MemoryAuthenticator) Validate(ctx context.Context, t auth.Token) error {
+	_, err := m.UID(t)
+	return err
+}
+
+func (m *MemoryAuthenticator) Revoke(ctx context.Context, t auth.Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, t)
+	return nil
+}
+
+// Returns the user a valid token was issued to, or auth.ErrInvalidToken.
+func (m *MemoryAuthenticator) UID(t auth.Token) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt, ok := m.tokens[t]
+	if !ok || !time.Now().Before(mt.expires) {
+		return "", auth.ErrInvalidToken
+	}
+	return mt.uid, nil
+}
+
+// Issues a token for the user valid for the next hour, without needing their password. The user doesn't need to be
+// registered.
+func (m *MemoryAuthenticator) Token(uid string) auth.Token {
+	return m.issue(uid, time.Now().Add(time.Hour))
+}
+
+func (m *MemoryAuthenticator) issue(uid string, expires time.Time) auth.Token {
+	var t auth.Token
+	_, err := rand.Read(t[:])
+	if err != nil {
+		panic(fmt.Sprintf("authtest: read random: %v", err))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens == nil {
+		m.tokens = make(map[auth.Token]memoryToken)
+	}
+	m.tokens[t] = memoryToken{uid: uid, expires: expires}
+	return t
+}
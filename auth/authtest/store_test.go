@@ -0,0 +1,11 @@
+package authtest
+
+import (
+	"testing"
+
+	"github.com/hherman1/auth/auth"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	TestStore(t, auth.SQLiteStore{DB: NewDB(t)})
+}
@@ -0,0 +1,361 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backups of a SQLite DB, for recovering from mistakes like a bulk delete of users or tokens. A backup directory holds
+// full snapshots, taken online with VACUUM INTO, and differential backups, which keep only the pages changed since the
+// latest full snapshot. Restoring at a time rebuilds the DB as of the latest backup taken by then. Take a full snapshot
+// now and then, e.g daily, and differentials in between, e.g hourly; PruneBackups drops the oldest.
+
+// Returned by RestoreBackup when no backup was taken by the requested time.
+var ErrNoBackup = errors.New("no backup taken by then")
+
+// The layout of backup file names, which sorts by time.
+const backupTimeLayout = "20060102T150405.000Z"
+
+const (
+	fullBackupSuffix = ".full.db"
+	diffBackupSuffix = ".diff.gz"
+	diffMagic        = "authdiff"
+	diffVersion      = 1
+)
+
+// A backup in a backup directory.
+type BackupFile struct {
+	Path  string
+	Taken time.Time
+	// Whether this is a full snapshot, rather than a differential.
+	Full bool
+}
+
+// Snapshots the DB into dir. If differential is set and dir already holds a full snapshot, only the pages which differ
+// from the latest one are kept; otherwise the snapshot is kept whole. The DB may be in use meanwhile.
+func Backup(ctx context.Context, db *sql.DB, dir string, differential bool, now time.Time) (BackupFile, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return BackupFile{}, fmt.Errorf("create backup dir: %w", err)
+	}
+	name := "auth-" + now.UTC().Format(backupTimeLayout)
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	defer os.Remove(tmp)
+	_, err = db.ExecContext(ctx, `VACUUM INTO ?;`, tmp)
+	if err != nil {
+		return BackupFile{}, fmt.Errorf("snapshot: %w", err)
+	}
+	var base *BackupFile
+	if differential {
+		backups, err := Backups(dir)
+		if err != nil {
+			return BackupFile{}, err
+		}
+		for i := len(backups) - 1; i >= 0; i-- {
+			if backups[i].Full {
+				base = &backups[i]
+				break
+			}
+		}
+	}
+	if base == nil {
+		b := BackupFile{Path: filepath.Join(dir, name+fullBackupSuffix), Taken: now, Full: true}
+		err = os.Rename(tmp, b.Path)
+		if err != nil {
+			return BackupFile{}, fmt.Errorf("keep snapshot: %w", err)
+		}
+		return b, nil
+	}
+	b := BackupFile{Path: filepath.Join(dir, name+diffBackupSuffix), Taken: now}
+	err = writeDiff(b.Path, *base, tmp)
+	if err != nil {
+		os.Remove(b.Path)
+		return BackupFile{}, err
+	}
+	return b, nil
+}
+
+// Lists the backups in dir, oldest first.
+func Backups(dir string) ([]BackupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("list backups: %w", err)
+	}
+	var backups []BackupFile
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "auth-") {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, "auth-")
+		full := strings.HasSuffix(stamp, fullBackupSuffix)
+		if full {
+			stamp = strings.TrimSuffix(stamp, fullBackupSuffix)
+		} else if strings.HasSuffix(stamp, diffBackupSuffix) {
+			stamp = strings.TrimSuffix(stamp, diffBackupSuffix)
+		} else {
+			continue
+		}
+		taken, err := time.Parse(backupTimeLayout, stamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupFile{Path: filepath.Join(dir, name), Taken: taken, Full: full})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Taken.Before(backups[j].Taken) })
+	return backups, nil
+}
+
+// Deletes all but the latest keep full snapshots, and the differentials based on the deleted ones.
+func PruneBackups(dir string, keep int) error {
+	if keep < 1 {
+		return fmt.Errorf("prune backups: must keep at least one full snapshot, was %v", keep)
+	}
+	backups, err := Backups(dir)
+	if err != nil {
+		return err
+	}
+	var fulls []BackupFile
+	for _, b := range backups {
+		if b.Full {
+			fulls = append(fulls, b)
+		}
+	}
+	if len(fulls) <= keep {
+		return nil
+	}
+	// Differentials are based on the latest full snapshot before them, so everything before the oldest kept one goes.
+	cutoff := fulls[len(fulls)-keep].Taken
+	for _, b := range backups {
+		if !b.Taken.Before(cutoff) {
+			break
+		}
+		err = os.Remove(b.Path)
+		if err != nil {
+			return fmt.Errorf("prune backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// Writes the DB as of the latest backup in dir taken at or before at to path, which must not exist. Returns the backup
+// used, or ErrNoBackup. Stop anything using path first, and check the restored DB before serving from it.
+func RestoreBackup(dir string, at time.Time, path string) (BackupFile, error) {
+	backups, err := Backups(dir)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	var chosen, base *BackupFile
+	for i := range backups {
+		if backups[i].Taken.After(at) {
+			break
+		}
+		if backups[i].Full {
+			base = &backups[i]
+		}
+		chosen = &backups[i]
+	}
+	if chosen == nil {
+		return BackupFile{}, ErrNoBackup
+	}
+	if base == nil {
+		return BackupFile{}, fmt.Errorf("%w: the full snapshot %v is based on was pruned", ErrNoBackup, chosen.Path)
+	}
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		if _, err := os.Stat(p); err == nil {
+			return BackupFile{}, fmt.Errorf("restore: %v exists, move it aside first", p)
+		}
+	}
+	tmp := path + ".restoring"
+	defer os.Remove(tmp)
+	err = copyFile(base.Path, tmp)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	if !chosen.Full {
+		err = applyDiff(chosen.Path, base.Taken, tmp)
+		if err != nil {
+			return BackupFile{}, err
+		}
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return BackupFile{}, fmt.Errorf("restore: %w", err)
+	}
+	return *chosen, nil
+}
+
+// Returns the page size from a SQLite file's header.
+func sqlitePageSize(f *os.File) (int, error) {
+	header := make([]byte, 100)
+	_, err := f.ReadAt(header, 0)
+	if err != nil {
+		return 0, fmt.Errorf("read sqlite header: %w", err)
+	}
+	if !bytes.HasPrefix(header, []byte("SQLite format 3\x00")) {
+		return 0, fmt.Errorf("%v is not a SQLite DB", f.Name())
+	}
+	size := int(binary.BigEndian.Uint16(header[16:18]))
+	if size == 1 {
+		size = 65536
+	}
+	return size, nil
+}
+
+// Starts a differential backup, encoded big endian.
+type diffHeader struct {
+	Magic   [8]byte
+	Version uint32
+	// When the full snapshot it is based on was taken, in Unix milliseconds.
+	Base     int64
+	PageSize uint32
+	// The size of the DB it restores.
+	Size int64
+}
+
+// Writes the pages of the snapshot which differ from the base full snapshot to path, gzipped. After the diffHeader,
+// each changed page follows its 0 based number, as a big endian uint32.
+func writeDiff(path string, base BackupFile, snapshot string) error {
+	snap, err := os.Open(snapshot)
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer snap.Close()
+	old, err := os.Open(base.Path)
+	if err != nil {
+		return fmt.Errorf("open base snapshot: %w", err)
+	}
+	defer old.Close()
+	pageSize, err := sqlitePageSize(snap)
+	if err != nil {
+		return err
+	}
+	info, err := snap.Stat()
+	if err != nil {
+		return fmt.Errorf("stat snapshot: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("create differential: %w", err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	header := diffHeader{Version: diffVersion, Base: base.Taken.UnixMilli(), PageSize: uint32(pageSize), Size: info.Size()}
+	copy(header.Magic[:], diffMagic)
+	err = binary.Write(zw, binary.BigEndian, header)
+	if err != nil {
+		return fmt.Errorf("write differential: %w", err)
+	}
+	page, oldPage := make([]byte, pageSize), make([]byte, pageSize)
+	for n := int64(0); n*int64(pageSize) < info.Size(); n++ {
+		_, err = snap.ReadAt(page, n*int64(pageSize))
+		if err != nil {
+			return fmt.Errorf("read snapshot: %w", err)
+		}
+		read, err := old.ReadAt(oldPage, n*int64(pageSize))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read base snapshot: %w", err)
+		}
+		if read == pageSize && bytes.Equal(page, oldPage) {
+			continue
+		}
+		err = binary.Write(zw, binary.BigEndian, uint32(n))
+		if err == nil {
+			_, err = zw.Write(page)
+		}
+		if err != nil {
+			return fmt.Errorf("write differential: %w", err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("write differential: %w", err)
+	}
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("sync differential: %w", err)
+	}
+	return f.Close()
+}
+
+// Applies a differential to a copy of the full snapshot it is based on.
+func applyDiff(path string, base time.Time, db string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open differential: %w", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("read differential: %w", err)
+	}
+	var header diffHeader
+	err = binary.Read(zr, binary.BigEndian, &header)
+	if err != nil {
+		return fmt.Errorf("read differential: %w", err)
+	}
+	if string(header.Magic[:]) != diffMagic || header.Version != diffVersion {
+		return fmt.Errorf("%v is not a differential backup", path)
+	}
+	if header.Base != base.UnixMilli() {
+		return fmt.Errorf("%v is based on the snapshot from %v, not %v", path, time.UnixMilli(header.Base).UTC(), base.UTC())
+	}
+	out, err := os.OpenFile(db, os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open restored db: %w", err)
+	}
+	defer out.Close()
+	page := make([]byte, header.PageSize)
+	for {
+		var n uint32
+		err = binary.Read(zr, binary.BigEndian, &n)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			_, err = io.ReadFull(zr, page)
+		}
+		if err != nil {
+			return fmt.Errorf("read differential: %w", err)
+		}
+		_, err = out.WriteAt(page, int64(n)*int64(header.PageSize))
+		if err != nil {
+			return fmt.Errorf("write restored db: %w", err)
+		}
+	}
+	err = out.Truncate(header.Size)
+	if err != nil {
+		return fmt.Errorf("truncate restored db: %w", err)
+	}
+	return out.Close()
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("open backup: %w", err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("create restored db: %w", err)
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return fmt.Errorf("copy backup: %w", err)
+	}
+	return dst.Close()
+}
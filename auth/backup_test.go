@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	db := newDB(t, "backup")
+	ctx := context.Background()
+	dir := t.TempDir()
+	register := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			err := RegisterUserWith(ctx, db, PasswordOptions{}, fmt.Sprintf("u%v", i), fmt.Sprintf("u%v@b.com", i), "pw")
+			if err != nil {
+				t.Fatalf("register: %v", err)
+			}
+		}
+	}
+	backup := func(differential bool, at time.Time) BackupFile {
+		t.Helper()
+		b, err := Backup(ctx, db, dir, differential, at)
+		if err != nil {
+			t.Fatalf("backup: %v", err)
+		}
+		return b
+	}
+	users := func(path string) int {
+		t.Helper()
+		restored, err := sql.Open("sqlite", path)
+		if err != nil {
+			t.Fatalf("open restored db: %v", err)
+		}
+		defer restored.Close()
+		var check string
+		err = restored.QueryRow(`PRAGMA integrity_check;`).Scan(&check)
+		if err != nil || check != "ok" {
+			t.Fatalf("expected the restored db to be intact, got %v %v", check, err)
+		}
+		var n int
+		err = restored.QueryRow(`SELECT COUNT(*) FROM USER;`).Scan(&n)
+		if err != nil {
+			t.Fatalf("count users: %v", err)
+		}
+		return n
+	}
+	restore := func(at time.Time) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "restored.db")
+		_, err := RestoreBackup(dir, at, path)
+		if err != nil {
+			t.Fatalf("restore at %v: %v", at, err)
+		}
+		return path
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	register(0, 5)
+	// Without a full snapshot to differ from, the first backup is full anyway.
+	if b := backup(true, start); !b.Full {
+		t.Fatalf("expected a full snapshot first, got %+v", b)
+	}
+	register(5, 20)
+	diff := backup(true, start.Add(time.Hour))
+	if diff.Full {
+		t.Fatalf("expected a differential, got %+v", diff)
+	}
+	_, err := db.ExecContext(ctx, `DELETE FROM USER;`)
+	if err != nil {
+		t.Fatalf("delete users: %v", err)
+	}
+	backup(true, start.Add(2*time.Hour))
+
+	for _, c := range []struct {
+		at   time.Duration
+		want int
+	}{
+		{0, 5},
+		{90 * time.Minute, 20},
+		{3 * time.Hour, 0},
+	} {
+		if got := users(restore(start.Add(c.at))); got != c.want {
+			t.Errorf("restore at %v: expected %v users, got %v", c.at, c.want, got)
+		}
+	}
+	if _, err := RestoreBackup(dir, start.Add(-time.Hour), filepath.Join(t.TempDir(), "restored.db")); !errors.Is(err, ErrNoBackup) {
+		t.Fatalf("expected no backup before the first, got %v", err)
+	}
+	if _, err := RestoreBackup(dir, start, filepath.Join(dir, filepath.Base(diff.Path))); err == nil {
+		t.Fatalf("expected restoring over an existing file to be refused")
+	}
+
+	// Pruning keeps the latest full snapshot, and only the differentials after it.
+	register(0, 3)
+	backup(false, start.Add(3*time.Hour))
+	backup(true, start.Add(4*time.Hour))
+	err = PruneBackups(dir, 1)
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	backups, err := Backups(dir)
+	if err != nil {
+		t.Fatalf("list backups: %v", err)
+	}
+	if len(backups) != 2 || !backups[0].Full || !backups[0].Taken.Equal(start.Add(3*time.Hour)) {
+		t.Fatalf("expected the latest full snapshot and its differential, got %+v", backups)
+	}
+	if got := users(restore(start.Add(5 * time.Hour))); got != 3 {
+		t.Fatalf("expected 3 users after pruning, got %v", got)
+	}
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Tokens remember the IP and user agent they were issued to, see WithClientIP and WithUserAgent. AuthFilter.Binding
+// can refuse tokens presented by any other client, so a stolen cookie is useless away from the victim's machine. Clients
+// whose address changes, e.g phones moving between networks, have to log in again, so bind to a network prefix rather
+// than the whole address where that matters.
+
+// Returned when a token is presented by a different client than it was issued to, see TokenBinding.
+var ErrClientMismatch = errors.New("token presented by a different client than it was issued to")
+
+// The client a token was issued to. Empty fields weren't recorded.
+type TokenClient struct {
+	IP        string
+	UserAgent string
+}
+
+// Returns the client the token was issued to, or ErrInvalidToken if there is no such token.
+func LookupTokenClient(ctx context.Context, db conn, t Token) (TokenClient, error) {
+	hash := sha256.Sum256(t[:])
+	var ip, ua sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT IP, USER_AGENT FROM TOKEN WHERE TOKEN_HASH=?`, hash[:]).Scan(&ip, &ua)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TokenClient{}, ErrInvalidToken
+	}
+	if err != nil {
+		return TokenClient{}, fmt.Errorf("parse token client: %w", err)
+	}
+	return TokenClient{IP: ip.String, UserAgent: ua.String}, nil
+}
+
+// Returns the client the refresh token was issued to, or ErrInvalidToken if there is no such refresh token.
+func LookupRefreshTokenClient(ctx context.Context, db conn, refresh Token) (TokenClient, error) {
+	hash := sha256.Sum256(refresh[:])
+	var ip, ua sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT IP, USER_AGENT FROM REFRESH_TOKEN WHERE TOKEN_HASH=?`, hash[:]).Scan(&ip, &ua)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TokenClient{}, ErrInvalidToken
+	}
+	if err != nil {
+		return TokenClient{}, fmt.Errorf("parse refresh token client: %w", err)
+	}
+	return TokenClient{IP: ip.String, UserAgent: ua.String}, nil
+}
+
+// Implemented by Validators which know which client each token was issued to, for TokenBinding.
+type TokenClientLookup interface {
+	// Returns the client the token was issued to, or ErrInvalidToken if there is no such token.
+	TokenClient(ctx context.Context, t Token) (TokenClient, error)
+}
+
+func (d DBAuthenticator) TokenClient(ctx context.Context, t Token) (TokenClient, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return TokenClient{}, err
+	}
+	return LookupTokenClient(ctx, d.conn(), t)
+}
+
+// Implemented by Refreshers which know which client each refresh token was issued to, for TokenBinding.
+type RefreshClientLookup interface {
+	// Returns the client the refresh token was issued to, or ErrInvalidToken if there is no such refresh token.
+	RefreshTokenClient(ctx context.Context, refresh Token) (TokenClient, error)
+}
+
+func (d DBAuthenticator) RefreshTokenClient(ctx context.Context, refresh Token) (TokenClient, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return TokenClient{}, err
+	}
+	return LookupRefreshTokenClient(ctx, d.conn(), refresh)
+}
+
+// Which parts of the client a token was issued to it must be presented by, see AuthFilter.Binding. Tokens issued
+// without a record of the client, e.g before binding was turned on or by a caller which didn't attach one, are accepted
+// from anywhere. Costs an extra lookup per request.
+type TokenBinding struct {
+	// Refuse tokens from other IPs.
+	IP bool
+	// With IP, how many leading bits of the address must match, e.g 24 to allow moving within an IPv4 /24. Default to
+	// the whole address.
+	IPv4Prefix int
+	IPv6Prefix int
+	// Refuse tokens from other user agents. Browsers change theirs when they update, logging users out.
+	UserAgent bool
+	// Finds who tokens were issued to. Defaults to the AuthFilter's Validator, if it is a TokenClientLookup.
+	Clients TokenClientLookup
+	// Finds who refresh tokens were issued to. Defaults to the Refresher, if it is a RefreshClientLookup.
+	RefreshClients RefreshClientLookup
+}
+
+// Returns whether the request comes from the client, by the parts the binding compares.
+func (b TokenBinding) matches(c TokenClient, r *http.Request) bool {
+	if b.IP && c.IP != "" && !b.sameNetwork(c.IP, requestIP(r)) {
+		return false
+	}
+	if b.UserAgent && c.UserAgent != "" && c.UserAgent != r.UserAgent() {
+		return false
+	}
+	return true
+}
+
+// Returns whether the addresses share the binding's prefix. Unparsable addresses must be equal.
+func (b TokenBinding) sameNetwork(issued, presented string) bool {
+	a, p := net.ParseIP(issued), net.ParseIP(presented)
+	if a == nil || p == nil {
+		return issued == presented
+	}
+	if a4, p4 := a.To4(), p.To4(); a4 != nil || p4 != nil {
+		if a4 == nil || p4 == nil {
+			return false
+		}
+		bits := b.IPv4Prefix
+		if bits == 0 {
+			bits = 32
+		}
+		mask := net.CIDRMask(bits, 32)
+		return a4.Mask(mask).Equal(p4.Mask(mask))
+	}
+	bits := b.IPv6Prefix
+	if bits == 0 {
+		bits = 128
+	}
+	mask := net.CIDRMask(bits, 128)
+	return a.Mask(mask).Equal(p.Mask(mask))
+}
+
+// Returns ErrClientMismatch if the refresh token was issued to a different client than the request's, so a refresh
+// token stolen on its own is as useless as a stolen access token. The refresher finds the client if RefreshClients is
+// unset.
+func (b TokenBinding) checkRefresh(ctx context.Context, r *http.Request, refresh Token, refresher any) error {
+	clients := b.RefreshClients
+	if clients == nil {
+		clients, _ = refresher.(RefreshClientLookup)
+	}
+	if clients == nil {
+		return fmt.Errorf("token binding: refresher %T does not record clients, and no lookup is configured", refresher)
+	}
+	c, err := clients.RefreshTokenClient(ctx, refresh)
+	if err != nil {
+		return fmt.Errorf("token binding: %w", err)
+	}
+	if !b.matches(c, r) {
+		log.Printf("warning: refresh token issued to %v (%q) presented by %v (%q)", c.IP, c.UserAgent, requestIP(r),
+			r.UserAgent())
+		return ErrClientMismatch
+	}
+	return nil
+}
+
+// Returns ErrClientMismatch if the token was issued to a different client than the request's, by the filter's Binding.
+func (a AuthFilter) checkBinding(ctx context.Context, r *http.Request, t Token) error {
+	clients := a.Binding.Clients
+	if clients == nil {
+		clients, _ = a.Validator.(TokenClientLookup)
+	}
+	if clients == nil {
+		return fmt.Errorf("token binding: validator %T does not record clients, and no lookup is configured", a.Validator)
+	}
+	c, err := clients.TokenClient(ctx, t)
+	if err != nil {
+		return fmt.Errorf("token binding: %w", err)
+	}
+	if !a.Binding.matches(c, r) {
+		log.Printf("warning: token issued to %v (%q) presented by %v (%q)", c.IP, c.UserAgent, requestIP(r), r.UserAgent())
+		return ErrClientMismatch
+	}
+	return nil
+}
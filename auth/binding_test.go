@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenBinding(t *testing.T) {
+	db := newDB(t, "binding")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	tok, _, err := a.Authenticate(WithUserAgent(WithClientIP(ctx, "10.0.0.1"), "Laptop"), "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	unbound, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	// A stolen refresh token mustn't get around the binding.
+	refresh, _, err := a.IssueRefresh(WithUserAgent(WithClientIP(ctx, "10.0.0.1"), "Laptop"), tok)
+	if err != nil {
+		t.Fatalf("issue refresh: %v", err)
+	}
+	c, err := a.TokenClient(ctx, tok)
+	if err != nil || c.IP != "10.0.0.1" || c.UserAgent != "Laptop" {
+		t.Fatalf("expected the token's client to be recorded, got %+v %v", c, err)
+	}
+
+	serve := func(b TokenBinding, tok Token, ip, ua string) int {
+		filter := AuthFilter{Validator: a, LoginURL: "/login", Binding: &b, Refresher: a}
+		h := filter.Handler(func(Token, http.ResponseWriter, *http.Request) {})
+		r := httptest.NewRequest("GET", "/secured", nil)
+		r.RemoteAddr = ip + ":1234"
+		r.Header.Set("User-Agent", ua)
+		r.AddCookie(&http.Cookie{Name: "auth_token", Value: tok.String()})
+		r.AddCookie(&http.Cookie{Name: "auth_refresh", Value: refresh.String()})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	for _, c := range []struct {
+		name    string
+		binding TokenBinding
+		tok     Token
+		ip, ua  string
+		want    int
+	}{
+		{"same client", TokenBinding{IP: true, UserAgent: true}, tok, "10.0.0.1", "Laptop", http.StatusOK},
+		{"other ip", TokenBinding{IP: true}, tok, "10.0.0.2", "Laptop", http.StatusFound},
+		{"other ip in prefix", TokenBinding{IP: true, IPv4Prefix: 24}, tok, "10.0.0.2", "Laptop", http.StatusOK},
+		{"other ip outside prefix", TokenBinding{IP: true, IPv4Prefix: 24}, tok, "10.0.1.2", "Laptop", http.StatusFound},
+		{"other ip, unbound", TokenBinding{UserAgent: true}, tok, "10.0.0.2", "Laptop", http.StatusOK},
+		{"other user agent", TokenBinding{UserAgent: true}, tok, "10.0.0.1", "Phone", http.StatusFound},
+		{"unrecorded client", TokenBinding{IP: true, UserAgent: true}, unbound, "10.0.0.2", "Phone", http.StatusOK},
+	} {
+		if got := serve(c.binding, c.tok, c.ip, c.ua); got != c.want {
+			t.Errorf("%v: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+
+	// Nor when it is presented on its own, without the access token.
+	b := TokenBinding{IP: true}
+	refreshOnly := func(h http.Handler, method, path, ip string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = ip + ":1234"
+		r.AddCookie(&http.Cookie{Name: "auth_refresh", Value: refresh.String()})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	filter := AuthFilter{Validator: a, LoginURL: "/login", Binding: &b, Refresher: a}
+	secured := filter.Handler(func(Token, http.ResponseWriter, *http.Request) {})
+	if code := refreshOnly(secured, "GET", "/secured", "10.0.0.2"); code != http.StatusFound {
+		t.Fatalf("refresh token from another ip: expected a redirect to log in, got %v", code)
+	}
+	mux := AuthServer{Authenticator: a, Binding: &b}.Handler("/auth")
+	if code := refreshOnly(mux, "POST", "/auth/refresh", "10.0.0.2"); code != http.StatusUnauthorized {
+		t.Fatalf("refresh route from another ip: expected 401, got %v", code)
+	}
+	if code := refreshOnly(secured, "GET", "/secured", "10.0.0.1"); code != http.StatusOK {
+		t.Fatalf("refresh token from its own ip: expected a refreshed session, got %v", code)
+	}
+}
+
+func TestSameNetwork(t *testing.T) {
+	for _, c := range []struct {
+		binding           TokenBinding
+		issued, presented string
+		want              bool
+	}{
+		{TokenBinding{}, "10.0.0.1", "10.0.0.1", true},
+		{TokenBinding{}, "10.0.0.1", "10.0.0.2", false},
+		{TokenBinding{IPv4Prefix: 16}, "10.0.0.1", "10.0.9.9", true},
+		{TokenBinding{}, "10.0.0.1", "::ffff:10.0.0.1", true},
+		{TokenBinding{}, "10.0.0.1", "2001:db8::1", false},
+		{TokenBinding{IPv6Prefix: 64}, "2001:db8::1", "2001:db8::2", true},
+		{TokenBinding{IPv6Prefix: 64}, "2001:db8::1", "2001:db8:0:1::1", false},
+		{TokenBinding{}, "pipe", "pipe", true},
+	} {
+		if got := c.binding.sameNetwork(c.issued, c.presented); got != c.want {
+			t.Errorf("%+v: %v and %v: expected %v, got %v", c.binding, c.issued, c.presented, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned while a CircuitBreaker is refusing to call its store.
+var ErrCircuitOpen = errors.New("auth store unavailable: circuit open")
+
+// A Validator wrapper which stops calling the backing validator after too many consecutive store failures, so an outage
+// fails fast instead of tying up every request waiting on the store. Invalid tokens are normal answers and do not count as
+// failures, nor do requests whose caller gave up, by cancelling or passing its deadline. While open, Validate returns
+// ErrCircuitOpen, or consults Fallback if set. After Cooldown one trial request is let through, and the circuit closes
+// again if it succeeds. Safe for concurrent use.
+type CircuitBreaker struct {
+	Validator
+	// Consecutive failures needed to open the circuit. Defaults to 5.
+	Threshold int
+	// How long to stay open before letting a trial request through. Defaults to 10 seconds.
+	Cooldown time.Duration
+	// If set, answers requests while the circuit is open, e.g from a cache of recently validated tokens.
+	Fallback Validator
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	// Whether a trial request is in flight while half open.
+	trial bool
+}
+
+func (c *CircuitBreaker) Validate(ctx context.Context, t Token) error {
+	_, err := c.ValidateUser(ctx, t)
+	return err
+}
+
+// Validates the token like Validate, returning its user if the backing validator, or Fallback while open, is a
+// UserValidator.
+func (c *CircuitBreaker) ValidateUser(ctx context.Context, t Token) (User, error) {
+	if !c.acquire(time.Now()) {
+		if c.Fallback != nil {
+			return validateUser(ctx, c.Fallback, t)
+		}
+		return User{}, ErrCircuitOpen
+	}
+	u, err := validateUser(ctx, c.Validator, t)
+	if ctx.Err() != nil {
+		// The caller gave up, or ran out of time, which says nothing about the store.
+		c.release()
+		return u, err
+	}
+	c.record(err == nil || errors.Is(err, ErrInvalidToken), time.Now())
+	return u, err
+}
+
+// Reports whether a request may be sent to the backing validator.
+func (c *CircuitBreaker) acquire(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < c.threshold() {
+		return true
+	}
+	if c.trial || now.Sub(c.openedAt) < c.cooldown() {
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+// Ends a request sent to the backing validator without recording its outcome, so another trial may be sent.
+func (c *CircuitBreaker) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+}
+
+// Records the outcome of a request sent to the backing validator.
+func (c *CircuitBreaker) record(ok bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+	if ok {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.failures >= c.threshold() {
+		c.openedAt = now
+	}
+}
+
+func (c *CircuitBreaker) threshold() int {
+	if c.Threshold <= 0 {
+		return 5
+	}
+	return c.Threshold
+}
+
+func (c *CircuitBreaker) cooldown() time.Duration {
+	if c.Cooldown <= 0 {
+		return 10 * time.Second
+	}
+	return c.Cooldown
+}
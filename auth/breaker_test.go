@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Returns whatever error it is currently set to.
+type stubValidator struct {
+	err   error
+	calls int
+}
+
+func (s *stubValidator) Validate(context.Context, Token) error {
+	s.calls++
+	return s.err
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	store := &stubValidator{err: errors.New("db down")}
+	c := &CircuitBreaker{Validator: store, Threshold: 2, Cooldown: 20 * time.Millisecond}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Validate(ctx, Token{}); err != store.err {
+			t.Fatalf("call %v: expected store error, got %v", i, err)
+		}
+	}
+	// Open: fail fast without calling the store
+	if err := c.Validate(ctx, Token{}); err != ErrCircuitOpen {
+		t.Fatalf("expected open circuit, got %v", err)
+	}
+	if store.calls != 2 {
+		t.Fatalf("expected store not to be called while open, got %v calls", store.calls)
+	}
+	fallback := &stubValidator{}
+	c.Fallback = fallback
+	if err := c.Validate(ctx, Token{}); err != nil || fallback.calls != 1 {
+		t.Fatalf("expected fallback to answer while open, got %v", err)
+	}
+
+	// After the cooldown a trial goes through, and success closes the circuit
+	time.Sleep(30 * time.Millisecond)
+	store.err = ErrInvalidToken
+	if err := c.Validate(ctx, Token{}); err != ErrInvalidToken {
+		t.Fatalf("trial: expected invalid token, got %v", err)
+	}
+	store.err = nil
+	if err := c.Validate(ctx, Token{}); err != nil {
+		t.Fatalf("expected closed circuit, got %v", err)
+	}
+	if store.calls != 4 {
+		t.Fatalf("expected 4 store calls, got %v", store.calls)
+	}
+}
+
+func TestCircuitBreakerIgnoresCancelled(t *testing.T) {
+	store := &stubValidator{err: context.Canceled}
+	c := &CircuitBreaker{Validator: store, Threshold: 2, Cooldown: 20 * time.Millisecond}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		if err := c.Validate(cancelled, Token{}); err != context.Canceled {
+			t.Fatalf("call %v: expected cancelled, got %v", i, err)
+		}
+	}
+	store.err = nil
+	if err := c.Validate(context.Background(), Token{}); err != nil {
+		t.Fatalf("expected cancelled requests not to open the circuit, got %v", err)
+	}
+
+	// A cancelled trial lets the next request try again.
+	store.err = errors.New("db down")
+	for i := 0; i < 2; i++ {
+		c.Validate(context.Background(), Token{})
+	}
+	time.Sleep(30 * time.Millisecond)
+	store.err = context.DeadlineExceeded
+	if err := c.Validate(cancelled, Token{}); err != context.DeadlineExceeded {
+		t.Fatalf("trial: expected the store's error, got %v", err)
+	}
+	store.err = nil
+	if err := c.Validate(context.Background(), Token{}); err != nil {
+		t.Fatalf("expected another trial after a cancelled one, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Break glass access, for when every administrator is locked out or has lost their second factor. An operator with
+// direct access to the DB issues a single use code for an account, e.g with authd -break-glass, and whoever opens its
+// link first is logged in as that account for a short while, bypassing the password, lockouts and risk checks. Issuing
+// and using a code are both recorded in the user's history, and using one notifies the operators.
+
+// Returned when a break glass code is unknown, already used or expired.
+var ErrInvalidBreakGlass = errors.New("invalid, used or expired break glass code")
+
+// A break glass code as recorded, see IssueBreakGlass.
+type BreakGlass struct {
+	UID     string
+	Reason  string
+	Created time.Time
+	Expires time.Time
+}
+
+// Stores a single use break glass code for the account with the given email, and returns it. Only a hash of the code
+// is stored, so print it once and don't keep it. The reason is required, and recorded in the user's history. Returns
+// ErrBadCredentials if there is no such account. Use a transaction, so the code and its event are stored together.
+func IssueBreakGlass(ctx context.Context, db conn, email, reason string, now, expires time.Time) (Token, error) {
+	var code Token
+	if reason == "" {
+		return code, errors.New("break glass: a reason is required")
+	}
+	uid, err := LookupByEmail(ctx, db, email)
+	if err != nil {
+		return code, err
+	}
+	_, err = rand.Read(code[:])
+	if err != nil {
+		return code, fmt.Errorf("read random: %w", err)
+	}
+	codeHash := sha256.Sum256(code[:])
+	_, err = db.ExecContext(ctx, `INSERT INTO BREAK_GLASS (CODE_HASH, UID, REASON, CREATED_TIME, EXPIRES_TIME)
+	VALUES (?, ?, ?, ?, ?);`, codeHash[:], uid, reason, now.UnixMilli(), expires.UnixMilli())
+	if err != nil {
+		return code, fmt.Errorf("insert break glass: %w", err)
+	}
+	err = recordUserEvent(ctx, db, uid, BreakGlassIssued, map[string]string{
+		"reason":  reason,
+		"expires": expires.UTC().Format(time.RFC3339),
+	}, now)
+	if err != nil {
+		return code, err
+	}
+	return code, nil
+}
+
+// Spends a break glass code, issuing a token for its user valid until end. Returns ErrInvalidBreakGlass if the code is
+// unknown, already used or expired. The client's IP, see WithClientIP, is recorded in the user's history. Use a
+// transaction, so the code isn't spent without a token.
+func RedeemBreakGlass(ctx context.Context, db conn, code Token, now, end time.Time) (BreakGlass, Token, error) {
+	var bg BreakGlass
+	codeHash := sha256.Sum256(code[:])
+	res, err := db.ExecContext(ctx, `UPDATE BREAK_GLASS SET USED_TIME=? WHERE CODE_HASH=? AND USED_TIME IS NULL AND
+	EXPIRES_TIME >= ?;`, now.UnixMilli(), codeHash[:], now.UnixMilli())
+	if err != nil {
+		return bg, Token{}, fmt.Errorf("spend break glass: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return bg, Token{}, fmt.Errorf("spend break glass: %w", err)
+	}
+	if n == 0 {
+		return bg, Token{}, ErrInvalidBreakGlass
+	}
+	var created, expires int64
+	err = db.QueryRowContext(ctx, `SELECT UID, REASON, CREATED_TIME, EXPIRES_TIME FROM BREAK_GLASS WHERE CODE_HASH=?`,
+		codeHash[:]).Scan(&bg.UID, &bg.Reason, &created, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return bg, Token{}, ErrInvalidBreakGlass
+	}
+	if err != nil {
+		return bg, Token{}, fmt.Errorf("parse break glass: %w", err)
+	}
+	bg.Created, bg.Expires = time.UnixMilli(created), time.UnixMilli(expires)
+	t, err := GenerateToken(ctx, db, bg.UID, now, end)
+	if err != nil {
+		return bg, t, err
+	}
+	err = recordUserEvent(ctx, db, bg.UID, BreakGlassUsed, map[string]string{"reason": bg.Reason, "ip": ClientIP(ctx)}, now)
+	if err != nil {
+		return bg, t, err
+	}
+	return bg, t, nil
+}
+
+// Drops break glass codes which expired before the given time, spent or not. Their issue and use stay in the user's
+// history, see ReapUserEvents.
+func ReapBreakGlass(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM BREAK_GLASS WHERE EXPIRES_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
+
+// An Authenticator which can log in with break glass codes, for the break glass route.
+type BreakGlassRedeemer interface {
+	// Spends a break glass code, returning a token for its user and its expiry. Returns ErrInvalidBreakGlass if the code
+	// can't be used.
+	RedeemBreakGlass(ctx context.Context, code Token) (Token, time.Time, error)
+}
+
+// Logs in with a break glass code. The session lasts BreakGlassTTL, and the operators are notified.
+func (d DBAuthenticator) RedeemBreakGlass(ctx context.Context, code Token) (Token, time.Time, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Token{}, time.Time{}, err
+	}
+	now := time.Now()
+	ttl := d.BreakGlassTTL
+	if ttl == 0 {
+		ttl = 15 * time.Minute
+	}
+	var bg BreakGlass
+	var t Token
+	err := d.retry(ctx, RetryLogin, func() error {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		bg, t, err = RedeemBreakGlass(ctx, d.wrap(tx), code, now, now.Add(ttl))
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return t, time.Time{}, err
+	}
+	log.Printf("warning: break glass log in as %v from %v: %v", bg.UID, ClientIP(ctx), bg.Reason)
+	notifyAll(ctx, d.Notifiers, Notification{
+		Subject: fmt.Sprintf("Break glass log in as %v", bg.UID),
+		Body: fmt.Sprintf("A break glass code issued %v was used from %v. Reason given: %v", bg.Created.Format(time.RFC3339),
+			ClientIP(ctx), bg.Reason),
+	})
+	return t, now.Add(ttl), nil
+}
+
+// Serves break glass links. GET asks for confirmation, so link previews don't spend the code, and POST logs in.
+func (a AuthServer) breakGlassHandler(w http.ResponseWriter, r *http.Request) {
+	bg, ok := a.Authenticator.(BreakGlassRedeemer)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// The code is in the URL, don't leak it to other sites.
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if r.Method == "GET" {
+		a.render(w, r, http.StatusOK, PageData{Page: "breakglass.html", Title: "Emergency Access",
+			Action: a.link(RouteBreakGlass, r.URL.RawQuery)})
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	var code Token
+	err := code.UnmarshalText([]byte(q.Get("code")))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parse code: %v", err), http.StatusBadRequest)
+		return
+	}
+	t, expires, err := bg.RedeemBreakGlass(withClient(r.Context(), r), code)
+	if errors.Is(err, ErrInvalidBreakGlass) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		a.internalError(w, "break glass", err)
+		return
+	}
+	text, err := encodeToken(r.Context(), a.Authenticator, t)
+	if err != nil {
+		a.internalError(w, "encode token", err)
+		return
+	}
+	// No refresh token, so the session can't outlive the emergency.
+	a.Cookies.setToken(w, text, expires, false)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBreakGlass(t *testing.T) {
+	db := newDB(t, "breakglass")
+	ctx := context.Background()
+	notified := &recordingNotifier{}
+	a := DBAuthenticator{DB: db, Notifiers: []Notifier{notified}}
+	err := a.Register(ctx, "admin@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	now := time.Now()
+	if _, err := IssueBreakGlass(ctx, db, "admin@b.com", "", now, now.Add(time.Hour)); err == nil {
+		t.Fatalf("expected a reason to be required")
+	}
+	if _, err := IssueBreakGlass(ctx, db, "nobody@b.com", "locked out", now, now.Add(time.Hour)); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("expected an unknown user to be refused, got %v", err)
+	}
+	code, err := IssueBreakGlass(ctx, db, "admin@b.com", "lost phone", now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+
+	mux := AuthServer{Authenticator: a}.Handler("/auth")
+	target := "/auth/breakglass?code=" + url.QueryEscape(code.String())
+	serve := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	// Previews of the link don't spend it.
+	if w := serve("GET"); w.Code != http.StatusOK {
+		t.Fatalf("expected the confirmation page, got %v", w.Code)
+	}
+	w := serve("POST")
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected to be logged in, got %v: %v", w.Code, w.Body)
+	}
+	c := responseCookie(w, "auth_token")
+	if c == nil || time.Until(c.Expires) > 16*time.Minute {
+		t.Fatalf("expected a short lived token cookie, got %v", c)
+	}
+	if responseCookie(w, "auth_refresh") != nil {
+		t.Fatalf("expected no refresh token")
+	}
+	var tok Token
+	err = tok.UnmarshalText([]byte(c.Value))
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	if err := a.Validate(ctx, tok); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if w := serve("POST"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected the code to work only once, got %v", w.Code)
+	}
+	if len(notified.sent) != 1 {
+		t.Fatalf("expected the operators to be notified once, got %v", notified.sent)
+	}
+
+	events, err := UserEvents(ctx, db, "admin@b.com")
+	if err != nil {
+		t.Fatalf("events: %v", err)
+	}
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+		if e.Kind == BreakGlassUsed && (e.Data["reason"] != "lost phone" || e.Data["ip"] == "") {
+			t.Fatalf("expected the reason and IP recorded, got %v", e.Data)
+		}
+	}
+	if len(kinds) != 3 || kinds[1] != BreakGlassIssued || kinds[2] != BreakGlassUsed {
+		t.Fatalf("expected the code's issue and use in the history, got %v", kinds)
+	}
+
+	expired, err := IssueBreakGlass(ctx, db, "admin@b.com", "lost phone", now.Add(-time.Hour), now.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	if _, _, err := a.RedeemBreakGlass(ctx, expired); !errors.Is(err, ErrInvalidBreakGlass) {
+		t.Fatalf("expected an expired code to be refused, got %v", err)
+	}
+}
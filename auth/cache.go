@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A Validator wrapper which remembers successful validations for TTL, so busy tokens don't query the store on every
+// request. Only valid tokens are cached. A token revoked elsewhere, e.g by another process, may still be accepted until
+// its entry expires, so keep TTL short; revocations in this process should call Invalidate, or go through Revoke, and
+// those of every token a user has, e.g a password change, InvalidateUser, see DBAuthenticator.OnRevokeUser. Safe for
+// concurrent use.
+type CachedValidator struct {
+	Validator
+	// How long a validation is remembered. Defaults to 5 seconds.
+	TTL time.Duration
+
+	mu        sync.Mutex
+	valid     map[Token]cachedUser
+	lastSweep time.Time
+	// Counts invalidations, so a validation which raced one isn't cached.
+	generation uint64
+}
+
+// A remembered validation, and the user it found, if the backing validator is a UserValidator.
+type cachedUser struct {
+	user    User
+	expires time.Time
+}
+
+func (c *CachedValidator) ttl() time.Duration {
+	if c.TTL == 0 {
+		return 5 * time.Second
+	}
+	return c.TTL
+}
+
+func (c *CachedValidator) Validate(ctx context.Context, t Token) error {
+	_, err := c.ValidateUser(ctx, t)
+	return err
+}
+
+// Validates the token like Validate, remembering its user along with the validation if the backing validator is a
+// UserValidator.
+func (c *CachedValidator) ValidateUser(ctx context.Context, t Token) (User, error) {
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.valid[t]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.user, nil
+	}
+	u, err := validateUser(ctx, c.Validator, t)
+	if err != nil {
+		return u, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The token may have been revoked after the backing validator accepted it.
+	if c.generation != generation {
+		return u, nil
+	}
+	if c.valid == nil {
+		c.valid = make(map[Token]cachedUser)
+	}
+	c.sweep(now)
+	c.valid[t] = cachedUser{user: u, expires: now.Add(c.ttl())}
+	return u, nil
+}
+
+// Forgets the token, so the next validation goes to the backing validator.
+func (c *CachedValidator) Invalidate(t Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	delete(c.valid, t)
+}
+
+// Forgets every token of the user with the given ID, e.g after a password change, which invalidates tokens without
+// naming them. Tokens whose user isn't known, because the backing validator isn't a UserValidator, are forgotten too.
+func (c *CachedValidator) InvalidateUser(uid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for t, cached := range c.valid {
+		if cached.user.ID == uid || cached.user.ID == "" {
+			delete(c.valid, t)
+		}
+	}
+}
+
+// Forgets every token.
+func (c *CachedValidator) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.valid = nil
+}
+
+// Revokes the token with the backing validator, if it is a Revoker, and forgets it. It is forgotten once revoked, so a
+// validation in between can't cache it again.
+func (c *CachedValidator) Revoke(ctx context.Context, t Token) error {
+	r, ok := c.Validator.(Revoker)
+	if !ok {
+		c.Invalidate(t)
+		return nil
+	}
+	err := r.Revoke(ctx, t)
+	c.Invalidate(t)
+	return err
+}
+
+// Drops expired entries, at most once per TTL. Must hold mu.
+func (c *CachedValidator) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl() {
+		return
+	}
+	c.lastSweep = now
+	for t, cached := range c.valid {
+		if !now.Before(cached.expires) {
+			delete(c.valid, t)
+		}
+	}
+}
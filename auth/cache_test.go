@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCachedValidator(t *testing.T) {
+	ctx := context.Background()
+	store := &stubValidator{}
+	c := &CachedValidator{Validator: store, TTL: 20 * time.Millisecond}
+	token := Token{1}
+	for i := 0; i < 3; i++ {
+		if err := c.Validate(ctx, token); err != nil {
+			t.Fatalf("validate: %v", err)
+		}
+	}
+	if store.calls != 1 {
+		t.Fatalf("expected one store call, got %v", store.calls)
+	}
+
+	// Failures aren't cached.
+	store.err = ErrInvalidToken
+	if err := c.Validate(ctx, Token{2}); err != ErrInvalidToken {
+		t.Fatalf("expected invalid token, got %v", err)
+	}
+	if err := c.Validate(ctx, Token{2}); err != ErrInvalidToken || store.calls != 3 {
+		t.Fatalf("expected failures to reach the store, got %v after %v calls", err, store.calls)
+	}
+
+	// Invalidated and expired entries go back to the store.
+	c.Invalidate(token)
+	if err := c.Validate(ctx, token); err != ErrInvalidToken {
+		t.Fatalf("invalidated: expected ErrInvalidToken, got %v", err)
+	}
+	store.err = nil
+	c.Validate(ctx, token)
+	store.err = ErrInvalidToken
+	time.Sleep(30 * time.Millisecond)
+	if err := c.Validate(ctx, token); err != ErrInvalidToken {
+		t.Fatalf("expired: expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestCachedValidatorRevoke(t *testing.T) {
+	db := newDB(t, "cache")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	addUsers(t, db, "test")
+	token, err := GenerateToken(ctx, db, "test", time.UnixMilli(0), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	c := &CachedValidator{Validator: a, TTL: time.Hour}
+	if err := c.Validate(ctx, token); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	err = c.Revoke(ctx, token)
+	if err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := c.Validate(ctx, token); err != ErrInvalidToken {
+		t.Fatalf("revoked: expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestCachedValidatorInvalidateUser(t *testing.T) {
+	db := newDB(t, "cacheuser")
+	ctx := context.Background()
+	c := &CachedValidator{TTL: time.Hour}
+	a := DBAuthenticator{DB: db, OnRevokeUser: c.InvalidateUser}
+	c.Validator = a
+	for _, email := range []string{"a@b.com", "c@d.com"} {
+		if err := a.Register(ctx, email, "pw"); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	}
+	login := func(email string) Token {
+		tok, _, err := a.Authenticate(ctx, email, "pw")
+		if err != nil {
+			t.Fatalf("authenticate: %v", err)
+		}
+		if err := c.Validate(ctx, tok); err != nil {
+			t.Fatalf("validate: %v", err)
+		}
+		return tok
+	}
+	current, other, someoneElse := login("a@b.com"), login("a@b.com"), login("c@d.com")
+	err := a.RevokeAllSessions(ctx, current)
+	if err != nil {
+		t.Fatalf("revoke all sessions: %v", err)
+	}
+	for _, tok := range []Token{current, other} {
+		if err := c.Validate(ctx, tok); err != ErrInvalidToken {
+			t.Fatalf("revoked: expected ErrInvalidToken, got %v", err)
+		}
+	}
+	if err := c.Validate(ctx, someoneElse); err != nil {
+		t.Fatalf("another user's token: %v", err)
+	}
+}
+
+// Compares validating a small set of busy tokens directly against SQLite and through the cache, from many goroutines.
+func BenchmarkValidate(b *testing.B) {
+	db := newDB(b, "bench")
+	ctx := context.Background()
+	tokens := make([]Token, 16)
+	for i := range tokens {
+		var err error
+		tokens[i], err = GenerateToken(ctx, db, "test", time.UnixMilli(0), time.Now().Add(time.Hour))
+		if err != nil {
+			b.Fatalf("generate token: %v", err)
+		}
+	}
+	for _, bench := range []struct {
+		name string
+		v    Validator
+	}{
+		{"db", DBAuthenticator{DB: db}},
+		{"cached", &CachedValidator{Validator: DBAuthenticator{DB: db}}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					err := bench.v.Validate(ctx, tokens[i%len(tokens)])
+					if err != nil {
+						b.Errorf("validate: %v", err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+type clientIPKey struct{}
+
+type rememberMeKey struct{}
+
+type tokenKey struct{}
+
+type userAgentKey struct{}
+
+// Attaches the IP address of the client a request is being made on behalf of, for policies which depend on it.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// Returns the IP address attached by WithClientIP, or "" if there is none.
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// Attaches the user agent of the client a request is being made on behalf of, recorded with the tokens issued to it.
+func WithUserAgent(ctx context.Context, ua string) context.Context {
+	return context.WithValue(ctx, userAgentKey{}, ua)
+}
+
+// Returns the user agent attached by WithUserAgent, or "" if there is none.
+func UserAgent(ctx context.Context) string {
+	ua, _ := ctx.Value(userAgentKey{}).(string)
+	return ua
+}
+
+// Attaches the IP address and user agent of the client making the request.
+func withClient(ctx context.Context, r *http.Request) context.Context {
+	return WithUserAgent(WithClientIP(ctx, requestIP(r)), r.UserAgent())
+}
+
+// Returns the IP address the request came from. Forwarding headers are not trusted, since any client can set them; behind
+// a reverse proxy, rewrite RemoteAddr before it reaches this package.
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Attaches whether the user asked to stay logged in, e.g with the log in page's "Remember me" box, so authenticators can
+// issue a longer lived token.
+func WithRememberMe(ctx context.Context, remember bool) context.Context {
+	return context.WithValue(ctx, rememberMeKey{}, remember)
+}
+
+// Returns whether WithRememberMe asked for a longer lived token.
+func RememberMe(ctx context.Context) bool {
+	remember, _ := rememberMe(ctx)
+	return remember
+}
+
+// Like RememberMe, also returning whether WithRememberMe was used at all.
+func rememberMe(ctx context.Context) (remember, ok bool) {
+	remember, ok = ctx.Value(rememberMeKey{}).(bool)
+	return remember, ok
+}
+
+// Attaches a request's validated token, see AuthFilter.Middleware.
+func WithToken(ctx context.Context, t Token) context.Context {
+	return context.WithValue(ctx, tokenKey{}, t)
+}
+
+// Returns the token attached by WithToken, or false if there is none.
+func TokenFromContext(ctx context.Context) (Token, bool) {
+	t, ok := ctx.Value(tokenKey{}).(Token)
+	return t, ok
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How the token cookies are named and set. The zero value sets "auth_token" and "auth_refresh" cookies for the whole
+// site, Secure, HttpOnly and SameSite=Lax.
+type CookieOptions struct {
+	// Name of the access token cookie. Defaults to "auth_token".
+	Name string
+	// Name of the refresh token cookie. Defaults to "auth_refresh".
+	RefreshName string
+	// If set, the cookies are shared with subdomains of this domain, e.g "example.com", so app.example.com and
+	// api.example.com share sessions. Otherwise only the host which set them gets them.
+	Domain string
+	// The hosts under Domain which may use the shared cookies, e.g "app.example.com". Domain itself always may, and
+	// protected requests to other hosts, or posted from them, are refused, so every subdomain sharing sessions must be
+	// listed. Browsers send the cookies to every subdomain regardless, so keep hosts serving untrusted content, e.g user
+	// uploads, off the parent domain.
+	Subdomains []string
+	// Defaults to "/".
+	Path string
+	// Defaults to http.SameSiteLaxMode, so the cookies survive following a link to the site but not cross site posts.
+	SameSite http.SameSite
+	// Leave out the Secure attribute, so the cookies are sent over plain http, e.g in development.
+	Insecure bool
+	// Leave out the HttpOnly attribute on the access token cookie, for pages whose scripts send the token themselves,
+	// e.g over a WebSocket. The refresh token cookie is always HttpOnly.
+	ScriptAccess bool
+}
+
+func (o CookieOptions) name() string {
+	if o.Name == "" {
+		return "auth_token"
+	}
+	return o.Name
+}
+
+func (o CookieOptions) refreshName() string {
+	if o.RefreshName == "" {
+		return "auth_refresh"
+	}
+	return o.RefreshName
+}
+
+func (o CookieOptions) cookie(name, value string, expires time.Time, httpOnly bool) *http.Cookie {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   o.Domain,
+		Path:     o.Path,
+		Expires:  expires,
+		Secure:   !o.Insecure,
+		HttpOnly: httpOnly,
+		SameSite: o.SameSite,
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.SameSite == 0 {
+		c.SameSite = http.SameSiteLaxMode
+	}
+	if expires.IsZero() {
+		c.MaxAge = -1
+	}
+	return c
+}
+
+// Sets the access token cookie to the token's text, see TokenEncoder. Transient cookies have no expiry, so browsers drop
+// them when they close.
+func (o CookieOptions) setToken(w http.ResponseWriter, text string, expires time.Time, transient bool) {
+	http.SetCookie(w, o.transient(o.cookie(o.name(), text, expires, !o.ScriptAccess), transient))
+}
+
+// Sets the refresh token cookie. Unlike the access token, scripts never need it, so it is always HttpOnly.
+func (o CookieOptions) setRefresh(w http.ResponseWriter, t Token, expires time.Time, transient bool) {
+	http.SetCookie(w, o.transient(o.cookie(o.refreshName(), t.String(), expires, true), transient))
+}
+
+func (o CookieOptions) setSession(w http.ResponseWriter, access string, s Session) {
+	o.setToken(w, access, s.AccessExpires, s.Transient)
+	o.setRefresh(w, s.Refresh, s.RefreshExpires, s.Transient)
+}
+
+// Drops the cookie's expiry if it is transient.
+func (o CookieOptions) transient(c *http.Cookie, transient bool) *http.Cookie {
+	if transient {
+		c.Expires = time.Time{}
+	}
+	return c
+}
+
+// Returns a cookie for this host only, holding the state of a log in in progress at the path for maxAge, or deleting
+// it if maxAge is negative. Secure unless Insecure is set, like the token cookies.
+func (o CookieOptions) stateCookie(name, value, path string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		Secure:   !o.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Deletes both token cookies.
+func (o CookieOptions) clear(w http.ResponseWriter) {
+	http.SetCookie(w, o.cookie(o.name(), "", time.Time{}, !o.ScriptAccess))
+	http.SetCookie(w, o.cookie(o.refreshName(), "", time.Time{}, true))
+}
+
+// Reports whether a host, without its port, may share the cookies set on Domain.
+func (o CookieOptions) trustedHost(host string) bool {
+	domain := strings.ToLower(strings.TrimPrefix(o.Domain, "."))
+	host = strings.ToLower(host)
+	if domain == "" || host == "" {
+		return false
+	}
+	if host == domain {
+		return true
+	}
+	for _, h := range o.Subdomains {
+		if strings.ToLower(h) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether an unsafe request, e.g a POST, came from a page on this host or a trusted host sharing the cookies.
+// SameSite cookies stop other sites forging requests, but every subdomain of a site counts as the same site, so with
+// a shared Domain a page on any subdomain could otherwise post with the user's session. Requests without an Origin or
+// Referer, e.g from non browser clients, are let through.
+func (o CookieOptions) sameOrigin(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == strings.ToLower(hostname(r.Host)) || o.trustedHost(host)
+}
+
+// Wraps a handler to refuse unsafe requests from other origins, see sameOrigin.
+func (o CookieOptions) checkOrigin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !o.sameOrigin(r) {
+			http.Error(w, "cross origin request refused", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Precomputes state used on the login path, so the first login after startup isn't slower than the rest. Optional.
+//
+// Deprecated: unknown users are now rejected by hashing the given password, which needs no precomputed state.
+func WarmUp() {}
+
+// Finds the lowest bcrypt cost, for BcryptHasher, which takes at least target to hash on this machine, up to bcrypt.MaxCost. Each cost step
+// doubles the work, so this takes roughly twice the target duration to run. Intended to be run once at deploy time.
+func CalibrateCost(target time.Duration) (int, error) {
+	password := []byte("calibration password")
+	for cost := bcrypt.MinCost; cost < bcrypt.MaxCost; cost++ {
+		start := time.Now()
+		_, err := bcrypt.GenerateFromPassword(password, cost)
+		if err != nil {
+			return 0, err
+		}
+		if time.Since(start) >= target {
+			return cost, nil
+		}
+	}
+	return bcrypt.MaxCost, nil
+}
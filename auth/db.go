@@ -1,17 +1,19 @@
+// Package auth provides password authentication backed by SQLite: user and token storage, login and sign up pages, and
+// an http filter which protects handlers with the issued tokens. The authd command wraps it as a standalone server.
 package auth
 
 import (
+	"bytes"
 	"context"
-	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
-	"net/mail"
+	"sort"
+	"strings"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Any valid connection type, e.g sql.DB, sql.Tx, sql.Conn.
@@ -26,223 +28,1709 @@ type conn interface {
 
 // An implementation of authentication that uses the DB directly
 type DBAuthenticator struct {
-	db *sql.DB
+	DB *sql.DB
+	// If set, new users are given a generated ID carrying this prefix, e.g "acme_01H...". Otherwise the email is used as
+	// the ID.
+	IDPrefix string
+	// If set, logins are refused when a risk signal about the email or client IP scores at least this much.
+	MaxRisk float64
+	// Extra checks on the email address of new users, e.g MXChecker.
+	EmailCheckers []EmailChecker
+	// Told about security events, e.g blocked logins.
+	Notifiers []Notifier
+	// How long access tokens issued at log in last. Defaults to 24 hours.
+	TokenTTL time.Duration
+	// How long access tokens issued when the user asks to be remembered last, see WithRememberMe. Defaults to TokenTTL.
+	RememberTTL time.Duration
+	// How long a log in with a break glass code lasts. Defaults to 15 minutes.
+	BreakGlassTTL time.Duration
+	// How far before issue new tokens are valid from, so servers with slightly slow clocks accept them. Defaults to a
+	// second.
+	StartSkew time.Duration
+	// How long refresh tokens last. Defaults to 30 days.
+	RefreshTTL time.Duration
+	// Where users and tokens are kept. Defaults to SQLite in DB. Registering, logging in and validating only need the
+	// Store, but other features keep their own tables in DB, and return ErrDBRequired unless it is set and, for those
+	// referring to users or tokens, holds the Store's users and tokens too.
+	Store Store
+	// If set, accounts and IPs with too many failed log ins are locked out for a while.
+	Lockout *LoginLockout
+	// If set, new passwords given at sign up or reset must follow it.
+	PasswordPolicy *PasswordPolicy
+	// How new passwords are hashed. Defaults to BcryptHasher. Hashes by other builtin hashers, or with other parameters,
+	// are still accepted and replaced at the user's next log in, if the Store is a HashReplacer.
+	Hasher Hasher
+	// How writes which find the DB busy are retried, by class: RetryLogin, RetryTokens and RetryAccounts. Defaults to
+	// DefaultRetryPolicies. Classes left out aren't retried.
+	Retry map[string]RetryPolicy
+	// If set, access tokens are handed out as JWTs signed with this key, which services can check without the DB using
+	// JWTValidator. The tokens are still stored, so they can be refreshed, listed and revoked as usual.
+	JWT *JWTKey
+	// Where the auth tables are, if they share the DB with an application.
+	Schema *Schema
+	// If set, validating a token records when it was used, for the sessions page. Requires SQLite in DB.
+	LastUsed *LastUsedTracker
+	// Email domains whose accounts must log in with SSO, e.g the keys of AuthServer.Realms. Authenticate refuses their
+	// passwords with ErrSSORequired, whether the account is named by email or by ID. Requires SQLite in DB, to find the
+	// account's email.
+	SSODomains []string
+	// If set, called with the ID of a user once all their tokens are revoked at once: by a password reset,
+	// RevokeAllSessions or DeleteAccount, e.g CachedValidator.InvalidateUser.
+	OnRevokeUser func(uid string)
 }
 
-func (d DBAuthenticator) Validate(ctx context.Context, t Token) error {
-	_, err := Lookup(ctx, d.db, t, time.Now())
-	if err != nil {
-		return err
+func (d DBAuthenticator) store() Store {
+	if d.Store != nil {
+		return d.Store
+	}
+	return SQLiteStore{DB: d.DB, Schema: d.Schema}
+}
+
+// Returns the DB, in the Schema.
+func (d DBAuthenticator) conn() conn {
+	return d.wrap(d.DB)
+}
+
+// Returns db, or a transaction on it, in the Schema.
+func (d DBAuthenticator) wrap(db conn) conn {
+	return d.Schema.wrap(db)
+}
+
+// Returned by DBAuthenticator features which keep their tables in DB, e.g refresh tokens, when DB isn't set, or when
+// Store keeps users and tokens in another database, which those tables can't be joined with.
+var ErrDBRequired = errors.New("feature requires DBAuthenticator.DB")
+
+// Returns ErrDBRequired unless DB is set, for features whose tables stand alone, e.g risk signals.
+func (d DBAuthenticator) requireDB() error {
+	if d.DB == nil {
+		return fmt.Errorf("%w, which is nil", ErrDBRequired)
 	}
 	return nil
 }
-func (d DBAuthenticator) Register(ctx context.Context, email, password string) error {
-	err := RegisterUser(ctx, d.db, email, email, password)
+
+// Returns ErrDBRequired unless DB is set and the Store keeps users and tokens in it, for features whose tables refer
+// to them, e.g refresh tokens.
+func (d DBAuthenticator) requireSQLiteStore() error {
+	err := d.requireDB()
 	if err != nil {
 		return err
 	}
+	var db *sql.DB
+	switch s := d.Store.(type) {
+	case nil:
+		return nil
+	case SQLiteStore:
+		db = s.DB
+	case *SQLiteStore:
+		db = s.DB
+	}
+	if db != d.DB {
+		return fmt.Errorf("%w to hold users and tokens, but Store keeps them elsewhere", ErrDBRequired)
+	}
 	return nil
 }
 
-func (d DBAuthenticator) Authenticate(ctx context.Context, email, password string) (Token, time.Time, error) {
-	expiration := time.Now().Add(24 * time.Hour)
-	var t Token
+// How long a token issued at log in lasts, depending on whether the user asked to be remembered.
+func (d DBAuthenticator) tokenTTL(ctx context.Context) time.Duration {
+	if d.RememberTTL != 0 && RememberMe(ctx) {
+		return d.RememberTTL
+	}
+	if d.TokenTTL == 0 {
+		return 24 * time.Hour
+	}
+	return d.TokenTTL
+}
 
-	// Begin TX. We want token generation to occur in the same transaction as authentication
-	tx, err := d.db.BeginTx(ctx, nil)
-	if err != nil {
-		return t, expiration, fmt.Errorf("open transaction: %w", err)
+func (d DBAuthenticator) startSkew() time.Duration {
+	if d.StartSkew == 0 {
+		return time.Second
 	}
-	defer tx.Rollback()
-	err = Authenticate(ctx, tx, email, password)
-	if err != nil {
-		return t, expiration, fmt.Errorf("authorization: %w", err)
+	return d.StartSkew
+}
+
+func (d DBAuthenticator) Validate(ctx context.Context, t Token) error {
+	now := time.Now()
+	if d.LastUsed != nil {
+		if err := d.requireSQLiteStore(); err != nil {
+			return err
+		}
 	}
-	uid, err := LookupByEmail(ctx, tx, email)
+	_, err := d.store().LookupToken(ctx, t, now)
 	if err != nil {
-		return t, expiration, fmt.Errorf("lookup email: %w", err)
+		return err
 	}
-	t, err = GenerateToken(ctx, tx, uid, time.Now().Add(-time.Second), expiration)
-	if err != nil {
-		return t, expiration, fmt.Errorf("generate token: %w", err)
+	d.LastUsed.touch(ctx, d.conn(), []Token{t}, now)
+	return nil
+}
+
+// Validates the token like Validate, also returning the roles it carries. With a Store other than the SQLite store,
+// which holds no roles, Roles is nil.
+func (d DBAuthenticator) ValidateUser(ctx context.Context, t Token) (User, error) {
+	now := time.Now()
+	if err := d.requireSQLiteStore(); err != nil {
+		if d.LastUsed != nil {
+			return User{}, err
+		}
+		uid, err := d.store().LookupToken(ctx, t, now)
+		if err != nil {
+			return User{}, err
+		}
+		return User{ID: uid, Token: t}, nil
 	}
-	err = tx.Commit()
+	u, err := lookupUser(ctx, d.conn(), t, now)
 	if err != nil {
-		return t, expiration, fmt.Errorf("commit: %w", err)
+		return u, err
 	}
-	return t, expiration, nil
+	d.LastUsed.touch(ctx, d.conn(), []Token{t}, now)
+	return u, nil
 }
 
-// An authentication token which gives access priveleges for a certain time range.
-type Token [16]byte
-
-func (t Token) String() string {
-	return base64.StdEncoding.EncodeToString(t[:])
+func (d DBAuthenticator) Revoke(ctx context.Context, t Token) error {
+	return d.retry(ctx, RetryTokens, func() error {
+		return d.store().DeleteToken(ctx, t)
+	})
 }
 
-func (t Token) MarshalText() ([]byte, error) {
-	return []byte(t.String()), nil
+func (d DBAuthenticator) refreshTTL() time.Duration {
+	if d.RefreshTTL == 0 {
+		return 30 * 24 * time.Hour
+	}
+	return d.RefreshTTL
 }
 
-func (t *Token) UnmarshalText(text []byte) error {
-	n, err := base64.StdEncoding.Decode(t[:], text)
+func (d DBAuthenticator) IssueRefresh(ctx context.Context, access Token) (Token, time.Time, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Token{}, time.Time{}, err
+	}
+	now := time.Now()
+	expires := now.Add(d.refreshTTL())
+	uid, err := Lookup(ctx, d.conn(), access, now)
 	if err != nil {
-		return fmt.Errorf("token: base64 decode: %w", err)
+		return Token{}, expires, err
 	}
-	if n != 16 {
-		return fmt.Errorf("token: expected 16 bytes, was %v", len(text))
+	var t Token
+	err = d.retry(ctx, RetryTokens, func() (err error) {
+		t, err = IssueRefreshToken(ctx, d.conn(), uid, now, expires)
+		if err != nil {
+			return err
+		}
+		return linkRefreshToken(ctx, d.conn(), t, access)
+	})
+	return t, expires, err
+}
+
+func (d DBAuthenticator) Refresh(ctx context.Context, refresh Token) (Session, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Session{}, err
 	}
-	return nil
+	var s Session
+	err := d.retry(ctx, RetryTokens, func() error {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		// The new token lasts as long as the first one did, so a remembered session stays remembered.
+		ctx, err := withRefreshRememberMe(ctx, d.wrap(tx), refresh)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		s, err = RefreshToken(ctx, d.wrap(tx), refresh, now, now.Add(d.tokenTTL(ctx)), now.Add(d.refreshTTL()))
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
+	return s, err
 }
 
-// Drops all tokens from the DB which expired before the given time. It is recommended that an old time is used, not time.Now(), to manage clock jitter.
-func ReapTokens(ctx context.Context, db conn, olderThan time.Time) error {
-	_, err := db.ExecContext(ctx, `DELETE FROM TOKEN WHERE END_TIME < ?;`, olderThan.UnixMilli())
+func (d DBAuthenticator) RevokeRefresh(ctx context.Context, refresh Token) error {
+	if err := d.requireSQLiteStore(); err != nil {
+		return err
+	}
+	return d.retry(ctx, RetryTokens, func() error {
+		return RevokeRefreshToken(ctx, d.conn(), refresh)
+	})
+}
+
+// Stashes a request for 10 minutes.
+func (d DBAuthenticator) Stash(ctx context.Context, req StashedRequest) (Token, error) {
+	if err := d.requireDB(); err != nil {
+		return Token{}, err
+	}
+	now := time.Now()
+	return StashRequest(ctx, d.conn(), req, now, now.Add(10*time.Minute))
+}
+
+func (d DBAuthenticator) Unstash(ctx context.Context, id Token) (StashedRequest, error) {
+	if err := d.requireDB(); err != nil {
+		return StashedRequest{}, err
+	}
+	return UnstashRequest(ctx, d.conn(), id, time.Now())
+}
+
+// Issues a code valid for a minute.
+func (d DBAuthenticator) IssueCode(ctx context.Context, access Token, challenge string) (Token, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Token{}, err
+	}
+	now := time.Now()
+	uid, err := Lookup(ctx, d.conn(), access, now)
 	if err != nil {
-		return fmt.Errorf("drop rows: %w", err)
+		return Token{}, err
 	}
-	return nil
+	var code Token
+	err = d.retry(ctx, RetryTokens, func() (err error) {
+		code, err = CreateAuthCode(ctx, d.conn(), uid, challenge, now, now.Add(time.Minute))
+		return err
+	})
+	return code, err
 }
 
-// Creates a new token, valid between the given times, for the given user, stores it, and returns it.
-func GenerateToken(ctx context.Context, db conn, uid string, start, end time.Time) (Token, error) {
-	// Make the token
+func (d DBAuthenticator) ExchangeCode(ctx context.Context, code Token, verifier string) (Token, time.Time, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Token{}, time.Time{}, err
+	}
+	now := time.Now()
+	expires := now.Add(d.tokenTTL(ctx))
 	var t Token
-	_, err := rand.Read(t[:])
+	err := d.retry(ctx, RetryTokens, func() error {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		uid, err := ConsumeAuthCode(ctx, d.wrap(tx), code, verifier, now)
+		if errors.Is(err, ErrInvalidAuthCode) {
+			// Spend the code anyway, so a wrong verifier can't be retried.
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("commit: %w", err)
+			}
+			return ErrInvalidAuthCode
+		}
+		if err != nil {
+			return err
+		}
+		t, err = GenerateToken(ctx, d.wrap(tx), uid, now.Add(-d.startSkew()), expires)
+		if err != nil {
+			return fmt.Errorf("generate token: %w", err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return t, fmt.Errorf("read random: %w", err)
+		return Token{}, expires, err
 	}
-	_, err = db.ExecContext(ctx, `INSERT INTO TOKEN (UID, TOKEN, START_TIME, END_TIME)
-	VALUES (?, ?, ?, ?);`,
-		uid, t[:], start.UnixMilli(), end.UnixMilli())
-	if err != nil {
-		return t, fmt.Errorf("insert: %w", err)
+	return t, expires, nil
+}
+
+func (d DBAuthenticator) Client(ctx context.Context, id string) (Client, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Client{}, err
 	}
-	return t, nil
+	return LookupClient(ctx, d.conn(), id)
 }
 
-// Find the user ID for the given email. Returns errBadCredentials if the email doesnt exist.
-func LookupByEmail(ctx context.Context, db conn, email string) (string, error) {
-	row := db.QueryRowContext(ctx, `SELECT ID FROM USER WHERE EMAIL=?`, email)
-	var uid string
-	err := row.Scan(&uid)
-	if errors.Is(err, sql.ErrNoRows) {
-		return "", errBadCredentials
+// Issues a code valid for a minute.
+func (d DBAuthenticator) IssueGrant(ctx context.Context, access Token, g Grant) (Token, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Token{}, err
 	}
+	now := time.Now()
+	uid, err := Lookup(ctx, d.conn(), access, now)
 	if err != nil {
-		return "", fmt.Errorf("parse uid: %w", err)
+		return Token{}, err
 	}
-	return uid, nil
+	g.UID = uid
+	var code Token
+	err = d.retry(ctx, RetryTokens, func() (err error) {
+		code, err = CreateGrantCode(ctx, d.conn(), g, now, now.Add(time.Minute))
+		return err
+	})
+	return code, err
 }
 
-var errInvalidToken = errors.New("invalid token")
+func (d DBAuthenticator) ExchangeGrant(ctx context.Context, clientID, secret string, code Token, redirectURI, verifier string) (ClientSession, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return ClientSession{}, err
+	}
+	now := time.Now()
+	s := ClientSession{Expires: now.Add(d.tokenTTL(ctx))}
+	err := d.retry(ctx, RetryTokens, func() error {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		_, err = AuthenticateClient(ctx, d.wrap(tx), clientID, secret)
+		if err != nil {
+			return err
+		}
+		s.Grant, err = ConsumeGrantCode(ctx, d.wrap(tx), code, clientID, redirectURI, verifier, now)
+		if errors.Is(err, ErrInvalidAuthCode) {
+			// Spend the code anyway, so it can't be retried.
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("commit: %w", err)
+			}
+			return ErrInvalidAuthCode
+		}
+		if err != nil {
+			return err
+		}
+		s.Access, err = GenerateClientToken(ctx, d.wrap(tx), s.Grant, now.Add(-d.startSkew()), s.Expires)
+		if err != nil {
+			return fmt.Errorf("generate token: %w", err)
+		}
+		s.Claims, err = UserClaims(ctx, d.wrap(tx), s.UID, s.Scopes)
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
+	return s, err
+}
 
-// Finds the user ID of the associated USER for the given token, valid at the given time. If it is not a valid token, returns errInvalidToken.
-func Lookup(ctx context.Context, db conn, t Token, now time.Time) (string, error) {
-	row := db.QueryRowContext(ctx, `SELECT UID FROM TOKEN WHERE
-TOKEN=? AND
-START_TIME <= ? AND
-END_TIME >= ?`, t[:], now.UnixMilli(), now.UnixMilli())
-	var uid string
-	err := row.Scan(&uid)
-	if errors.Is(err, sql.ErrNoRows) {
-		return "", errInvalidToken
+func (d DBAuthenticator) UserInfo(ctx context.Context, access Token) (map[string]any, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return nil, err
 	}
+	g, err := LookupClientToken(ctx, d.conn(), access, time.Now())
 	if err != nil {
-		return "", fmt.Errorf("parse uid: %w", err)
+		return nil, err
 	}
-	return uid, nil
+	return UserClaims(ctx, d.conn(), g.UID, g.Scopes)
 }
 
-// User functions
+func (d DBAuthenticator) HasRole(ctx context.Context, t Token, role string) (bool, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return false, err
+	}
+	return TokenHasRole(ctx, d.conn(), t, role)
+}
 
-// Creates a new user. The ID and Email must not already exist. The email must be parsable as an email address.
-func RegisterUser(ctx context.Context, db conn, id, email, password string) error {
-	_, err := mail.ParseAddress(email)
+func (d DBAuthenticator) Expiry(ctx context.Context, access Token) (time.Time, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return time.Time{}, err
+	}
+	return TokenExpiry(ctx, d.conn(), access)
+}
+
+// Validates many tokens in one round trip. The results are in the same order as the given tokens.
+func (d DBAuthenticator) ValidateBatch(ctx context.Context, ts []Token) ([]Result, error) {
+	now := time.Now()
+	if d.LastUsed != nil {
+		if err := d.requireSQLiteStore(); err != nil {
+			return nil, err
+		}
+	}
+	uids, err := d.store().LookupTokens(ctx, ts, now)
 	if err != nil {
-		return fmt.Errorf("parsing email address '%v': %w", email, err)
+		return nil, err
+	}
+	res := make([]Result, len(ts))
+	valid := make([]Token, 0, len(uids))
+	for i, t := range ts {
+		uid, ok := uids[t]
+		if !ok {
+			res[i].Err = ErrInvalidToken
+			continue
+		}
+		res[i].UID = uid
+		valid = append(valid, t)
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	d.LastUsed.touch(ctx, d.conn(), valid, now)
+	return res, nil
+}
+
+// Creates a user with a password. Returns ErrEmailRegistered if the email is taken.
+func (d DBAuthenticator) Register(ctx context.Context, email, password string) error {
+	err := d.checkEmail(ctx, email)
 	if err != nil {
-		return fmt.Errorf("hash pw: %w", err)
+		return err
 	}
-	_, err = db.ExecContext(ctx, `INSERT INTO USER(id, email, bcrypt) VALUES (?,?,?);`, id, email, hash)
+	err = d.checkPassword(password)
 	if err != nil {
-		return fmt.Errorf("insert user: %w", err)
+		return err
 	}
-	return nil
+	_, _, err = d.store().UserHash(ctx, email)
+	if err == nil {
+		return ErrEmailRegistered
+	}
+	if !errors.Is(err, ErrBadCredentials) {
+		return fmt.Errorf("lookup email: %w", err)
+	}
+	id, err := d.newUserID(email)
+	if err != nil {
+		return err
+	}
+	hash, err := hashNewUser(d.hasher(), email, password)
+	if err != nil {
+		return err
+	}
+	return d.retry(ctx, RetryAccounts, func() error {
+		return d.store().InsertUser(ctx, id, email, hash)
+	})
 }
 
-var errBadCredentials = errors.New("failed to authenticate, username or password is incorrect")
+// Stores a sign up awaiting email verification for 24 hours, and returns the code which completes it.
+func (d DBAuthenticator) BeginRegister(ctx context.Context, email, password string) (Token, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Token{}, err
+	}
+	err := d.checkEmail(ctx, email)
+	if err != nil {
+		return Token{}, err
+	}
+	err = d.checkPassword(password)
+	if err != nil {
+		return Token{}, err
+	}
+	now := time.Now()
+	var code Token
+	err = d.retry(ctx, RetryAccounts, func() (err error) {
+		code, err = CreatePendingSignupWith(ctx, d.conn(), d.passwordOptions(), email, password, now, now.Add(24*time.Hour))
+		return err
+	})
+	return code, err
+}
 
-// Checks if these are valid credentials for a user. You should call this before issuing a token. Authenticating by
-// ID or by email are both fine. If there is a problem with the credentials then errBadCredentials will be returned.
-func Authenticate(ctx context.Context, db conn, idOrEmail, password string) error {
-	row := db.QueryRowContext(ctx, `SELECT BCRYPT FROM USER WHERE
-	ID = ? OR
-	EMAIL = ?;`, idOrEmail, idOrEmail)
+// Stores a password reset valid for 1 hour, and returns the code which completes it. Every request is recorded for
+// ResetReport, including those for unknown accounts.
+func (d DBAuthenticator) BeginPasswordReset(ctx context.Context, email string) (Token, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Token{}, err
+	}
+	now := time.Now()
+	var code Token
+	err := d.retry(ctx, RetryAccounts, func() (err error) {
+		code, err = CreatePasswordReset(ctx, d.conn(), email, now, now.Add(time.Hour))
+		return err
+	})
+	outcome := ResetSent
+	switch {
+	case errors.Is(err, ErrBadCredentials):
+		outcome = ResetUnknownAccount
+	case errors.Is(err, ErrResetThrottled):
+		outcome = ResetThrottled
+	case err != nil:
+		return code, err
+	}
+	// Concurrent resets, e.g from the forgot page's background goroutines, can find the DB busy.
+	rerr := d.retry(ctx, RetryAccounts, func() error {
+		return RecordResetRequest(ctx, d.conn(), email, ClientIP(ctx), outcome, now)
+	})
+	if rerr != nil {
+		log.Printf("error: record reset request: %v", rerr)
+	}
+	return code, err
+}
 
-	var hash []byte
-	err := row.Scan(&hash)
-	if errors.Is(err, sql.ErrNoRows) {
-		return errBadCredentials
+// Sets the new password for a password reset.
+func (d DBAuthenticator) CompletePasswordReset(ctx context.Context, code Token, password string) error {
+	if err := d.requireSQLiteStore(); err != nil {
+		return err
 	}
+	// Checked first, so a rejected password doesn't spend the code.
+	err := d.checkPassword(password)
 	if err != nil {
-		return fmt.Errorf("parse bcrypt: %w", err)
-	}
-	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
-	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-		return errBadCredentials
+		return err
 	}
+	var uid string
+	err = d.retry(ctx, RetryAccounts, func() error {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		uid, err = ConsumePasswordResetWith(ctx, d.wrap(tx), d.passwordOptions(), code, password, time.Now())
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("compare password to hash: %w", err)
+		return err
 	}
+	d.revokedUser(uid)
 	return nil
 }
 
-// Ensures all our tables exist
-func Initialize(ctx context.Context, db conn) error {
-	steps := []struct {
-		Name  string
-		Query string
-	}{
-		{
-			Name: "user",
-			Query: `
-CREATE TABLE IF NOT EXISTS USER (
-	ID TEXT NOT NULL PRIMARY KEY,
-	EMAIL TEXT NOT NULL UNIQUE,
-	BCRYPT BLOB NOT NULL,
-	VALID BOOLEAN DEFAULT FALSE NOT NULL
-);`,
-		},
-
-		{
-			Name: "token",
-			Query: `
--- Tokens represent ephemeral access grants for a particular user. Currently tokens are randomly generated.
-CREATE TABLE IF NOT EXISTS TOKEN (
-	UID TEXT NOT NULL,
-	TOKEN BLOB NOT NULL PRIMARY KEY,
-
-	-- When this token is valid between.
-	START_TIME INTEGER NOT NULL,
-	END_TIME INTEGER NOT NULL,
+// Issues a token for a user an identity provider vouched for, found by email. If there is no user with the email, one is
+// created without a password, and provisioned with its roles and attributes, unless p.Deny. With p.SyncGroups, existing
+// users' roles are brought in line with their groups. An account with a password is linked the first time, recorded as
+// an AccountLinked event: if its email was never verified, whoever set the password may not own the address, so the
+// password is removed and the account's sessions revoked. Everything happens in one transaction.
+func (d DBAuthenticator) FederatedLogin(ctx context.Context, id FederatedIdentity, p Provisioning) (Token, time.Time, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Token{}, time.Time{}, err
+	}
+	var t Token
+	var expiration time.Time
+	err := d.retry(ctx, RetryAccounts, func() error {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		now := time.Now()
+		expiration = now.Add(d.tokenTTL(ctx))
+		uid, err := d.federatedUser(ctx, d.wrap(tx), id, p, now)
+		if err != nil {
+			return err
+		}
+		t, err = newToken()
+		if err != nil {
+			return err
+		}
+		err = insertToken(ctx, d.wrap(tx), uid, t, now.Add(-d.startSkew()), expiration, now)
+		if err != nil {
+			return fmt.Errorf("generate token: %w", err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
+	return t, expiration, err
+}
 
-	-- TODO: ACLs?
+// Returns the ID of the user with the identity's email, creating, linking or syncing them as FederatedLogin describes.
+func (d DBAuthenticator) federatedUser(ctx context.Context, db conn, id FederatedIdentity, p Provisioning, now time.Time) (string, error) {
+	var uid string
+	var hash []byte
+	var verified bool
+	err := db.QueryRowContext(ctx, `SELECT ID, BCRYPT, VALID FROM USER WHERE EMAIL=?;`, id.Email).Scan(&uid, &hash, &verified)
+	if errors.Is(err, sql.ErrNoRows) {
+		if p.Deny {
+			log.Printf("refusing sso log in for %v: not provisioned", id.Email)
+			return "", ErrNotProvisioned
+		}
+		uid, err = d.newUserID(id.Email)
+		if err != nil {
+			return "", err
+		}
+		// The identity provider verified the email.
+		err = insertUser(ctx, db, uid, id.Email, noPassword, true, now)
+		if err != nil {
+			return "", fmt.Errorf("create user: %w", err)
+		}
+		err = p.provision(ctx, db, uid, id, now)
+		if err != nil {
+			return "", fmt.Errorf("provision %v: %w", uid, err)
+		}
+		return uid, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("lookup user: %w", err)
+	}
+	if len(hash) > 0 && !bytes.Equal(hash, noPassword) {
+		err = linkAccount(ctx, db, uid, id.Email, verified, now)
+		if err != nil {
+			return "", fmt.Errorf("link %v: %w", uid, err)
+		}
+	}
+	if p.SyncGroups {
+		err = p.syncRoles(ctx, db, uid, id, now)
+		if err != nil {
+			return "", fmt.Errorf("sync roles of %v: %w", uid, err)
+		}
+	}
+	return uid, nil
+}
 
-	FOREIGN KEY(UID) REFERENCES USER(ID)
-);
-		`,
-		},
+// Links an identity provider's log in to an account with a password, the first time it is used. Accounts whose email
+// wasn't verified lose their password and sessions, since they may have been registered by someone else in advance.
+func linkAccount(ctx context.Context, db conn, uid, email string, verified bool, now time.Time) error {
+	var linked bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM USER_EVENT WHERE UID=? AND KIND=?);`, uid, AccountLinked).
+		Scan(&linked)
+	if err != nil {
+		return fmt.Errorf("find link: %w", err)
 	}
-	for _, step := range steps {
-		_, err := db.ExecContext(ctx, step.Query)
+	if linked {
+		return nil
+	}
+	data := map[string]string{"email": email, "password_removed": fmt.Sprint(!verified)}
+	if !verified {
+		log.Printf("warning: removing the password of %v, whose unverified email %v logged in through an identity provider", uid, email)
+		_, err = db.ExecContext(ctx, `UPDATE USER SET BCRYPT=?, VALID=TRUE, PASSWORD_CHANGED_TIME=? WHERE ID=?;`,
+			noPassword, now.UnixMilli(), uid)
 		if err != nil {
-			return fmt.Errorf("create tables: %v: %w", step.Name, err)
+			return fmt.Errorf("remove password: %w", err)
+		}
+		err = RevokeAllSessions(ctx, db, uid)
+		if err != nil {
+			return err
 		}
 	}
+	return recordUserEvent(ctx, db, uid, AccountLinked, data, now)
+}
 
+// Collects everything kept about the user of the access token.
+func (d DBAuthenticator) PersonalData(ctx context.Context, access Token) (PersonalData, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return PersonalData{}, err
+	}
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return PersonalData{}, fmt.Errorf("open transaction: %w", err)
+	}
+	defer tx.Rollback()
+	uid, err := Lookup(ctx, d.wrap(tx), access, time.Now())
+	if err != nil {
+		return PersonalData{}, err
+	}
+	return CollectPersonalData(ctx, d.wrap(tx), uid)
+}
+
+// Erases the user of the access token, and everything kept about them.
+func (d DBAuthenticator) DeleteAccount(ctx context.Context, access Token) error {
+	if err := d.requireSQLiteStore(); err != nil {
+		return err
+	}
+	var uid string
+	err := d.retry(ctx, RetryAccounts, func() error {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		uid, err = Lookup(ctx, d.wrap(tx), access, time.Now())
+		if err != nil {
+			return err
+		}
+		err = DeleteUser(ctx, d.wrap(tx), uid)
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.revokedUser(uid)
+	return nil
+}
+
+// Creates the account for a pending sign up.
+func (d DBAuthenticator) CompleteRegister(ctx context.Context, code Token) error {
+	if err := d.requireSQLiteStore(); err != nil {
+		return err
+	}
+	// The email is only known once the code is consumed, so an email based ID is filled in by ConsumePendingSignup.
+	id, err := d.newUserID("")
+	if err != nil {
+		return err
+	}
+	return d.retry(ctx, RetryAccounts, func() error {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		_, err = ConsumePendingSignup(ctx, d.wrap(tx), code, id, time.Now())
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
+}
+
+// Runs the configured email checks for a new user.
+func (d DBAuthenticator) checkEmail(ctx context.Context, email string) error {
+	for _, c := range d.EmailCheckers {
+		err := c.CheckEmail(ctx, email)
+		if err != nil {
+			return fmt.Errorf("check email: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d DBAuthenticator) hasher() Hasher {
+	if d.Hasher == nil {
+		return BcryptHasher{}
+	}
+	return d.Hasher
+}
+
+// The options for the package-level functions to hash and check passwords like d.
+func (d DBAuthenticator) passwordOptions() PasswordOptions {
+	return PasswordOptions{Hasher: d.hasher(), Policy: d.PasswordPolicy}
+}
+
+// Calls OnRevokeUser, if set.
+func (d DBAuthenticator) revokedUser(uid string) {
+	if d.OnRevokeUser != nil {
+		d.OnRevokeUser(uid)
+	}
+}
+
+// Checks a new password against the configured policy.
+func (d DBAuthenticator) checkPassword(password string) error {
+	if d.PasswordPolicy == nil {
+		return nil
+	}
+	return d.PasswordPolicy.Check(password)
+}
+
+// Picks the ID for a new user: generated if there is an IDPrefix, otherwise the email.
+func (d DBAuthenticator) newUserID(email string) (string, error) {
+	if d.IDPrefix == "" {
+		return email, nil
+	}
+	id, err := NewUserID(d.IDPrefix, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("generate id: %w", err)
+	}
+	return id, nil
+}
+
+func (d DBAuthenticator) Authenticate(ctx context.Context, email, password string) (Token, time.Time, error) {
+	ctx, span := startSpan(ctx, "auth.DBAuthenticator.Authenticate")
+	t, expiration, err := d.authenticate(ctx, email, password)
+	endSpan(span, err)
+	return t, expiration, err
+}
+
+func (d DBAuthenticator) authenticate(ctx context.Context, email, password string) (Token, time.Time, error) {
+	expiration := time.Now().Add(d.tokenTTL(ctx))
+	var t Token
+	if d.MaxRisk > 0 || d.Lockout != nil {
+		// Risk signals and failed log ins are kept in DB.
+		if err := d.requireDB(); err != nil {
+			return t, expiration, err
+		}
+	}
+	if d.MaxRisk > 0 {
+		risk, err := HighestRisk(ctx, d.conn(), []string{email, ClientIP(ctx)}, time.Now())
+		if err != nil {
+			return t, expiration, fmt.Errorf("check risk: %w", err)
+		}
+		if risk.Score >= d.MaxRisk {
+			log.Printf("blocking login for %v: risk %v from %v: %v", email, risk.Score, risk.Subject, risk.Reason)
+			notifyAll(ctx, d.Notifiers, Notification{
+				Subject: fmt.Sprintf("Blocked risky login for %v", email),
+				Body:    fmt.Sprintf("Risk %v from %v: %v", risk.Score, risk.Subject, risk.Reason),
+			})
+			return t, expiration, ErrRiskTooHigh
+		}
+	}
+	now := time.Now()
+	if d.Lockout != nil {
+		err := d.checkLockout(ctx, email, now)
+		if err != nil {
+			return t, expiration, err
+		}
+	}
+	store := d.store()
+	uid, hash, err := store.UserHash(ctx, email)
+	if err != nil && !errors.Is(err, ErrBadCredentials) {
+		return t, expiration, fmt.Errorf("lookup user: %w", err)
+	}
+	err = comparePassword(d.hasher(), hash, password)
+	if err != nil {
+		if d.Lockout != nil {
+			if lerr := d.recordFailedLogin(ctx, email, now); lerr != nil {
+				return t, expiration, lerr
+			}
+		}
+		return t, expiration, fmt.Errorf("authorization: %w", err)
+	}
+	// Checked once the account is found, since it may be named by an ID which says nothing about its domain.
+	err = d.checkSSODomain(ctx, uid)
+	if err != nil {
+		return t, expiration, err
+	}
+	if d.Lockout != nil {
+		// Only the account is cleared, so one account the attacker controls can't reset their IP's failures.
+		err = d.retry(ctx, RetryLogin, func() error {
+			return ClearFailedLogins(ctx, d.conn(), "email:"+strings.ToLower(email))
+		})
+		if err != nil {
+			return t, expiration, err
+		}
+	}
+	rehash(ctx, store, d.hasher(), uid, hash, password)
+	t, err = newToken()
+	if err != nil {
+		return t, expiration, err
+	}
+	err = d.retry(ctx, RetryLogin, func() error {
+		return store.InsertToken(ctx, uid, t, now.Add(-d.startSkew()), expiration, now)
+	})
+	if err != nil {
+		return t, expiration, fmt.Errorf("generate token: %w", err)
+	}
+	return t, expiration, nil
+}
+
+// An authentication token which gives access priveleges for a certain time range.
+type Token [16]byte
+
+func (t Token) String() string {
+	return base64.StdEncoding.EncodeToString(t[:])
+}
+
+func (t Token) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *Token) UnmarshalText(text []byte) error {
+	n, err := base64.StdEncoding.Decode(t[:], text)
+	if err != nil {
+		return fmt.Errorf("token: base64 decode: %w", err)
+	}
+	if n != 16 {
+		return fmt.Errorf("token: expected 16 bytes, was %v", len(text))
+	}
+	return nil
+}
+
+// Drops all tokens from the DB which expired before the given time. It is recommended that an old time is used, not
+// now, to manage clock jitter. A time after now returns ErrIllegalTransition, since it would reap active tokens.
+func ReapTokens(ctx context.Context, db conn, olderThan, now time.Time) error {
+	if olderThan.After(now) {
+		return fmt.Errorf("%w: cannot reap tokens which expire before %v, in the future", ErrIllegalTransition, olderThan.UTC())
+	}
+	_, err := db.ExecContext(ctx, `DELETE FROM TOKEN WHERE END_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM SESSION_DATA WHERE TOKEN_HASH NOT IN (SELECT TOKEN_HASH FROM TOKEN);`)
+	if err != nil {
+		return fmt.Errorf("drop session data: %w", err)
+	}
+	return nil
+}
+
+// Deletes the given token, so it can no longer be used. Revoking an unknown token is not an error.
+func RevokeToken(ctx context.Context, db conn, t Token) error {
+	hash := sha256.Sum256(t[:])
+	_, err := revokeTokens(ctx, db, `TOKEN_HASH=?`, hash[:])
+	return err
+}
+
+// Creates a new token, valid between the given times, for the given user, stores it, and returns it.
+func GenerateToken(ctx context.Context, db conn, uid string, start, end time.Time) (t Token, err error) {
+	ctx, span := startSpan(ctx, "auth.GenerateToken")
+	defer func() { endSpan(span, err) }()
+	t, err = newToken()
+	if err != nil {
+		return t, err
+	}
+	return t, insertToken(ctx, db, uid, t, start, end, time.Now())
+}
+
+// Find the user ID for the given email. Returns ErrBadCredentials if the email doesnt exist.
+func LookupByEmail(ctx context.Context, db conn, email string) (string, error) {
+	row := db.QueryRowContext(ctx, `SELECT ID FROM USER WHERE EMAIL=?`, email)
+	var uid string
+	err := row.Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrBadCredentials
+	}
+	if err != nil {
+		return "", fmt.Errorf("parse uid: %w", err)
+	}
+	return uid, nil
+}
+
+// Returned when a token does not exist, has expired, has been superseded by a password change, or its user was deleted.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Tokens created before their user's last password change are no longer valid, so a credential change implicitly ends
+// every older session. Queries using this inner join USER, so a token inserted by a log in racing the user's deletion
+// is never accepted.
+const tokenNotSuperseded = `(USER.PASSWORD_CHANGED_TIME IS NULL OR TOKEN.CREATED_TIME >= USER.PASSWORD_CHANGED_TIME)`
+
+// Which tokens a lookup accepts. Tokens issued to OIDC clients, see GenerateClientToken, are only honoured for what the
+// client was granted, never as the user's own session.
+const (
+	sessionToken = `TOKEN.CLIENT_ID IS NULL`
+	clientToken  = `TOKEN.CLIENT_ID IS NOT NULL`
+	anyToken     = `TRUE`
+)
+
+// Finds the user ID of the associated USER for the given session token, valid at the given time. If it is not a valid
+// token, or was issued to a client, returns ErrInvalidToken.
+func Lookup(ctx context.Context, db conn, t Token, now time.Time) (uid string, err error) {
+	ctx, span := startSpan(ctx, "auth.Lookup")
+	defer func() { endSpan(span, err) }()
+	return lookupToken(ctx, db, t, now, sessionToken)
+}
+
+// Like Lookup, for the kind of token, e.g clientToken.
+func lookupToken(ctx context.Context, db conn, t Token, now time.Time, kind string) (string, error) {
+	hash := sha256.Sum256(t[:])
+	return lookupHash(ctx, db, hash[:], now, kind)
+}
+
+// Like lookupToken, by the token's hash.
+func lookupHash(ctx context.Context, db conn, hash []byte, now time.Time, kind string) (string, error) {
+	row := db.QueryRowContext(ctx, `SELECT UID FROM TOKEN JOIN USER ON USER.ID = TOKEN.UID WHERE
+TOKEN_HASH=? AND
+START_TIME <= ? AND
+END_TIME >= ? AND
+`+tokenNotSuperseded+` AND
+`+kind, hash, now.UnixMilli(), now.UnixMilli())
+	var uid string
+	err := row.Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", fmt.Errorf("parse uid: %w", err)
+	}
+	return uid, nil
+}
+
+// Like Lookup, also finding the roles the token carries in the same query.
+func lookupUser(ctx context.Context, db conn, t Token, now time.Time) (User, error) {
+	hash := sha256.Sum256(t[:])
+	row := db.QueryRowContext(ctx, `SELECT TOKEN.UID, (SELECT group_concat(USER_ROLE.ROLE, ' ') FROM USER_ROLE WHERE
+	USER_ROLE.UID = TOKEN.UID AND
+	(TOKEN.SCOPE IS NULL OR instr(' ' || TOKEN.SCOPE || ' ', ' ' || USER_ROLE.ROLE || ' ') > 0))
+FROM TOKEN JOIN USER ON USER.ID = TOKEN.UID WHERE
+TOKEN_HASH=? AND
+START_TIME <= ? AND
+END_TIME >= ? AND
+`+tokenNotSuperseded+` AND
+`+sessionToken, hash[:], now.UnixMilli(), now.UnixMilli())
+	u := User{Token: t}
+	var roles sql.NullString
+	err := row.Scan(&u.ID, &roles)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrInvalidToken
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("parse user: %w", err)
+	}
+	u.Roles = strings.Fields(roles.String)
+	if u.Roles == nil {
+		u.Roles = []string{}
+	}
+	sort.Strings(u.Roles)
+	return u, nil
+}
+
+// SQLite limits the number of bound parameters in a statement, so batches are queried in chunks of this size.
+const lookupBatchSize = 500
+
+// Like Lookup, but for many tokens in as few queries as possible. Returns the user ID for each token that is valid at the
+// given time. Invalid tokens are absent from the result.
+func LookupBatch(ctx context.Context, db conn, ts []Token, now time.Time) (map[Token]string, error) {
+	uids := make(map[Token]string, len(ts))
+	for start := 0; start < len(ts); start += lookupBatchSize {
+		end := start + lookupBatchSize
+		if end > len(ts) {
+			end = len(ts)
+		}
+		chunk := ts[start:end]
+		args := make([]any, 0, len(chunk)+2)
+		args = append(args, now.UnixMilli(), now.UnixMilli())
+		byHash := make(map[[sha256.Size]byte]Token, len(chunk))
+		for _, t := range chunk {
+			hash := sha256.Sum256(t[:])
+			byHash[hash] = t
+			args = append(args, hash[:])
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+		rows, err := db.QueryContext(ctx, `SELECT TOKEN_HASH, UID FROM TOKEN JOIN USER ON USER.ID = TOKEN.UID WHERE
+START_TIME <= ? AND
+END_TIME >= ? AND
+`+tokenNotSuperseded+` AND
+`+sessionToken+` AND
+TOKEN_HASH IN (`+placeholders+`)`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("query tokens: %w", err)
+		}
+		for rows.Next() {
+			var raw []byte
+			var uid string
+			err = rows.Scan(&raw, &uid)
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scan token: %w", err)
+			}
+			var hash [sha256.Size]byte
+			copy(hash[:], raw)
+			uids[byHash[hash]] = uid
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("iterate tokens: %w", err)
+		}
+	}
+	return uids, nil
+}
+
+// User functions
+
+// How the package-level functions which set or check passwords, e.g RegisterUserWith, hash and check them. The zero
+// value hashes with bcrypt and checks no policy.
+type PasswordOptions struct {
+	// Hashes new passwords. Hashes by any builtin hasher are still accepted. Defaults to BcryptHasher.
+	Hasher Hasher
+	// If set, new passwords must follow it, or a *PasswordPolicyError is returned.
+	Policy *PasswordPolicy
+}
+
+func (o PasswordOptions) hasher() Hasher {
+	if o.Hasher == nil {
+		return BcryptHasher{}
+	}
+	return o.Hasher
+}
+
+func (o PasswordOptions) check(password string) error {
+	if o.Policy == nil {
+		return nil
+	}
+	return o.Policy.Check(password)
+}
+
+// The options used by the package-level functions without them, e.g RegisterUser: bcrypt and DefaultPasswordPolicy.
+func defaultPasswordOptions() PasswordOptions {
+	policy := DefaultPasswordPolicy()
+	return PasswordOptions{Policy: &policy}
+}
+
+// Creates a new user. The ID and Email must not already exist. The email must be parsable as an email address. The
+// password is hashed with bcrypt, and returns a *PasswordPolicyError if it doesn't follow DefaultPasswordPolicy.
+func RegisterUser(ctx context.Context, db conn, id, email, password string) error {
+	return RegisterUserWith(ctx, db, defaultPasswordOptions(), id, email, password)
+}
+
+// Like RegisterUser, but hashes and checks the password as o says.
+func RegisterUserWith(ctx context.Context, db conn, o PasswordOptions, id, email, password string) error {
+	err := o.check(password)
+	if err != nil {
+		return err
+	}
+	hash, err := hashNewUser(o.hasher(), email, password)
+	if err != nil {
+		return err
+	}
+	return insertUser(ctx, db, id, email, hash, false, time.Now())
+}
+
+// Sets a new password for the user, revoking every token issued before now. The password is hashed with
+// bcrypt, and returns a *PasswordPolicyError if it doesn't follow DefaultPasswordPolicy.
+func ChangePassword(ctx context.Context, db conn, uid, password string, now time.Time) error {
+	return ChangePasswordWith(ctx, db, defaultPasswordOptions(), uid, password, now)
+}
+
+// Like ChangePassword, but hashes and checks the password as o says.
+func ChangePasswordWith(ctx context.Context, db conn, o PasswordOptions, uid, password string, now time.Time) error {
+	err := o.check(password)
+	if err != nil {
+		return err
+	}
+	hash, err := o.hasher().Hash(password)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `UPDATE USER SET BCRYPT=?, PASSWORD_CHANGED_TIME=? WHERE ID=?;`, hash, now.UnixMilli(), uid)
+	if err != nil {
+		return fmt.Errorf("update user: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("no user with id '%v'", uid)
+	}
+	// Lookup already refuses them, but revoking drops their session data now rather than once they expire.
+	_, err = revokeTokens(ctx, db, `UID=? AND CREATED_TIME < ?`, uid, now.UnixMilli())
+	if err != nil {
+		return err
+	}
+	return recordUserEvent(ctx, db, uid, PasswordChanged, nil, now)
+}
+
+// Replaces the user's password hash with an equivalent one, e.g by a stronger algorithm, unless it is no longer old.
+// Tokens stay valid, since the password is unchanged.
+func replaceHash(ctx context.Context, db conn, uid string, old, new []byte) error {
+	_, err := db.ExecContext(ctx, `UPDATE USER SET BCRYPT=? WHERE ID=? AND BCRYPT=?;`, new, uid, old)
+	if err != nil {
+		return fmt.Errorf("update user: %w", err)
+	}
+	return nil
+}
+
+// Returned when an email, ID or password is wrong. Deliberately does not say which.
+var ErrBadCredentials = errors.New("failed to authenticate, username or password is incorrect")
+
+// Checks if these are valid credentials for a user, whichever builtin hasher made their hash. You should call this before
+// issuing a token. Authenticating by ID or by email are both fine. If there is a problem with the credentials then
+// ErrBadCredentials will be returned.
+func Authenticate(ctx context.Context, db conn, idOrEmail, password string) error {
+	return AuthenticateWith(ctx, db, PasswordOptions{}, idOrEmail, password)
+}
+
+// Like Authenticate, but also accepts hashes by o.Hasher, which unknown users are checked with too, so they take as long
+// as real ones.
+func AuthenticateWith(ctx context.Context, db conn, o PasswordOptions, idOrEmail, password string) (err error) {
+	ctx, span := startSpan(ctx, "auth.Authenticate")
+	defer func() { endSpan(span, err) }()
+	row := db.QueryRowContext(ctx, `SELECT BCRYPT FROM USER WHERE
+	ID = ? OR
+	EMAIL = ?;`, idOrEmail, idOrEmail)
+
+	var hash []byte
+	err = row.Scan(&hash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("parse bcrypt: %w", err)
+	}
+	// A missing user leaves hash nil, which takes as long to check as a real user.
+	return comparePassword(o.hasher(), hash, password)
+}
+
+// Ensures all our tables exist. To keep them apart from an application's own tables, rename them with options, e.g
+// WithTablePrefix("auth_"), and pass the equivalent Schema to everything else using the DB.
+func Initialize(ctx context.Context, db conn, opts ...InitializeOption) error {
+	if len(opts) > 0 {
+		schema := &Schema{}
+		for _, opt := range opts {
+			opt(schema)
+		}
+		var err error
+		db, err = schema.Wrap(db)
+		if err != nil {
+			return err
+		}
+	}
+	steps := []struct {
+		Name  string
+		Query string
+	}{
+		{
+			Name: "user",
+			Query: `
+CREATE TABLE IF NOT EXISTS USER (
+	ID TEXT NOT NULL PRIMARY KEY,
+	EMAIL TEXT NOT NULL UNIQUE,
+	BCRYPT BLOB NOT NULL,
+	VALID BOOLEAN DEFAULT FALSE NOT NULL,
+	-- When the password was last changed. Tokens created before this are no longer valid.
+	PASSWORD_CHANGED_TIME INTEGER NOT NULL DEFAULT 0
+);`,
+		},
+
+		{
+			Name: "token",
+			Query: `
+-- Tokens represent ephemeral access grants for a particular user. Currently tokens are randomly generated.
+CREATE TABLE IF NOT EXISTS TOKEN (
+	UID TEXT NOT NULL,
+	-- SHA-256 of the token, so a leaked DB can't be used to hijack sessions
+	TOKEN_HASH BLOB NOT NULL PRIMARY KEY,
+
+	-- When this token is valid between.
+	START_TIME INTEGER NOT NULL,
+	END_TIME INTEGER NOT NULL,
+	-- When the token was issued. Unlike START_TIME, this is never backdated to allow for clock skew.
+	CREATED_TIME INTEGER NOT NULL DEFAULT 0,
+
+	-- Space separated roles the token is limited to. NULL carries all of the user's roles.
+	SCOPE TEXT,
+	-- The CLIENT the token was issued to, and the space separated scopes it was granted. NULL for log ins.
+	CLIENT_ID TEXT,
+	CLIENT_SCOPE TEXT,
+
+	-- The IP and user agent the token was issued to, and when it was last used, for the sessions page. NULL if unknown.
+	IP TEXT,
+	USER_AGENT TEXT,
+	LAST_USED_TIME INTEGER,
+	-- The ID of the administrator acting as the user with this token, see ImpersonateUser. NULL for the user's own.
+	IMPERSONATOR TEXT,
+
+	FOREIGN KEY(UID) REFERENCES USER(ID)
+);
+		`,
+		},
+
+		{
+			Name: "stashed_request",
+			Query: `
+-- Requests interrupted by a login redirect, handed back once the user has logged in.
+CREATE TABLE IF NOT EXISTS STASHED_REQUEST (
+	-- SHA-256 of the ID kept in the browser's cookie
+	ID_HASH BLOB NOT NULL PRIMARY KEY,
+	METHOD TEXT NOT NULL,
+	URL TEXT NOT NULL,
+	CONTENT_TYPE TEXT NOT NULL,
+	BODY BLOB NOT NULL,
+	CREATED_TIME INTEGER NOT NULL,
+	EXPIRES_TIME INTEGER NOT NULL
+);`,
+		},
+
+		{
+			Name: "session_data",
+			Query: `
+-- Key/value data applications attach to a TOKEN.
+CREATE TABLE IF NOT EXISTS SESSION_DATA (
+	-- SHA-256 of the token
+	TOKEN_HASH BLOB NOT NULL,
+	KEY TEXT NOT NULL,
+	VALUE BLOB NOT NULL,
+
+	PRIMARY KEY(TOKEN_HASH, KEY)
+);`,
+		},
+
+		{
+			Name: "refresh_token",
+			Query: `
+-- Long lived, single use tokens which can be exchanged for a new TOKEN.
+CREATE TABLE IF NOT EXISTS REFRESH_TOKEN (
+	-- SHA-256 of the token
+	TOKEN_HASH BLOB NOT NULL PRIMARY KEY,
+	UID TEXT NOT NULL,
+	CREATED_TIME INTEGER NOT NULL,
+	EXPIRES_TIME INTEGER NOT NULL,
+	-- SHA-256 of the access token issued alongside it, so revoking that session revokes this too. NULL if unknown.
+	ACCESS_HASH BLOB,
+	-- The client it was issued to, as for TOKEN. NULL if unknown.
+	IP TEXT,
+	USER_AGENT TEXT,
+	-- The administrator acting as the user, copied from the access token, so refreshing keeps the session marked as
+	-- impersonated. NULL for the user's own.
+	IMPERSONATOR TEXT,
+	-- Whether the user asked to be remembered at log in, see WithRememberMe, so refreshing keeps the same TTL and
+	-- cookies. NULL if they weren't asked.
+	REMEMBER BOOLEAN,
+
+	FOREIGN KEY(UID) REFERENCES USER(ID)
+);`,
+		},
+
+		{
+			Name: "auth_code",
+			Query: `
+-- Single use codes handed to native apps after logging in, exchanged for a TOKEN with the PKCE verifier.
+CREATE TABLE IF NOT EXISTS AUTH_CODE (
+	-- SHA-256 of the code
+	CODE_HASH BLOB NOT NULL PRIMARY KEY,
+	UID TEXT NOT NULL,
+	-- S256 challenge the verifier must match
+	CHALLENGE TEXT NOT NULL,
+	CREATED_TIME INTEGER NOT NULL,
+	EXPIRES_TIME INTEGER NOT NULL,
+
+	FOREIGN KEY(UID) REFERENCES USER(ID)
+);`,
+		},
+
+		{
+			Name: "user_role",
+			Query: `
+-- Roles granted to users, e.g "admin".
+CREATE TABLE IF NOT EXISTS USER_ROLE (
+	UID TEXT NOT NULL,
+	ROLE TEXT NOT NULL,
+	CREATED_TIME INTEGER NOT NULL,
+
+	PRIMARY KEY(UID, ROLE),
+	FOREIGN KEY(UID) REFERENCES USER(ID)
+);`,
+		},
+
+		{
+			Name: "role_permission",
+			Query: `
+-- Permissions carried by each role, e.g "users:delete".
+CREATE TABLE IF NOT EXISTS ROLE_PERMISSION (
+	ROLE TEXT NOT NULL,
+	PERMISSION TEXT NOT NULL,
+
+	PRIMARY KEY(ROLE, PERMISSION)
+);`,
+		},
+
+		{
+			Name: "rate_counter",
+			Query: `
+-- Fixed window request counts for rate limiting, shared by every replica using the DB.
+CREATE TABLE IF NOT EXISTS RATE_COUNTER (
+	-- SHA-256 of the route and principal
+	KEY_HASH BLOB NOT NULL PRIMARY KEY,
+	START_TIME INTEGER NOT NULL,
+	END_TIME INTEGER NOT NULL,
+	COUNT INTEGER NOT NULL
+);`,
+		},
+
+		{
+			Name: "user_event",
+			Query: `
+-- Append only history of changes to users, e.g password changes and role grants. Never updated; deleted by retention
+-- and with the user.
+CREATE TABLE IF NOT EXISTS USER_EVENT (
+	UID TEXT NOT NULL,
+	KIND TEXT NOT NULL,
+	-- JSON object of details, e.g the role granted
+	DATA TEXT NOT NULL,
+	CREATED_TIME INTEGER NOT NULL
+);`,
+		},
+
+		{
+			Name:  "user_event_uid",
+			Query: `CREATE INDEX IF NOT EXISTS USER_EVENT_UID ON USER_EVENT (UID, CREATED_TIME);`,
+		},
+
+		{
+			Name: "failed_login",
+			Query: `
+-- Failed log ins per account ("email:...") or client IP ("ip:..."), for locking out brute force attempts.
+CREATE TABLE IF NOT EXISTS FAILED_LOGIN (
+	SUBJECT TEXT NOT NULL PRIMARY KEY,
+	FAILURES INTEGER NOT NULL,
+	LAST_FAILURE_TIME INTEGER NOT NULL,
+	LOCKED_UNTIL_TIME INTEGER NOT NULL
+);`,
+		},
+
+		{
+			Name: "user_note",
+			Query: `
+-- Free text notes left on a user account by administrators. Notes are append only and form a timeline.
+CREATE TABLE IF NOT EXISTS USER_NOTE (
+	UID TEXT NOT NULL,
+	AUTHOR TEXT NOT NULL,
+	NOTE TEXT NOT NULL,
+	CREATED_TIME INTEGER NOT NULL,
+
+	FOREIGN KEY(UID) REFERENCES USER(ID)
+);`,
+		},
+
+		{
+			Name: "user_tag",
+			Query: `
+-- Searchable labels on a user account, e.g "vip" or "fraud-review".
+CREATE TABLE IF NOT EXISTS USER_TAG (
+	UID TEXT NOT NULL,
+	TAG TEXT NOT NULL,
+
+	PRIMARY KEY(UID, TAG),
+	FOREIGN KEY(UID) REFERENCES USER(ID)
+);`,
+		},
+
+		{
+			Name: "user_attribute",
+			Query: `
+-- Profile attributes of a user, e.g a display name copied from their identity provider.
+CREATE TABLE IF NOT EXISTS USER_ATTRIBUTE (
+	UID TEXT NOT NULL,
+	NAME TEXT NOT NULL,
+	VALUE TEXT NOT NULL,
+
+	PRIMARY KEY(UID, NAME),
+	FOREIGN KEY(UID) REFERENCES USER(ID)
+);`,
+		},
+
+		{
+			Name: "pending_signup",
+			Query: `
+-- Sign ups waiting on email verification. The USER row is only created once the emailed code is presented.
+CREATE TABLE IF NOT EXISTS PENDING_SIGNUP (
+	-- SHA-256 of the emailed code
+	CODE_HASH BLOB NOT NULL PRIMARY KEY,
+	EMAIL TEXT NOT NULL,
+	BCRYPT BLOB NOT NULL,
+	CREATED_TIME INTEGER NOT NULL,
+	EXPIRES_TIME INTEGER NOT NULL
+);`,
+		},
+
+		{
+			Name: "password_reset",
+			Query: `
+-- Password resets waiting for the emailed code. An account has at most one live reset.
+CREATE TABLE IF NOT EXISTS PASSWORD_RESET (
+	UID TEXT NOT NULL PRIMARY KEY,
+	-- SHA-256 of the emailed code
+	CODE_HASH BLOB NOT NULL UNIQUE,
+	CREATED_TIME INTEGER NOT NULL,
+	EXPIRES_TIME INTEGER NOT NULL,
+
+	FOREIGN KEY(UID) REFERENCES USER(ID)
+);`,
+		},
+
+		{
+			Name: "reset_request",
+			Query: `
+-- Every password reset request, whether or not it was sent, for spotting account takeover campaigns.
+CREATE TABLE IF NOT EXISTS RESET_REQUEST (
+	EMAIL TEXT NOT NULL,
+	DOMAIN TEXT NOT NULL,
+	-- Empty if the client IP wasn't known
+	IP TEXT NOT NULL,
+	-- sent, unknown_account or throttled
+	OUTCOME TEXT NOT NULL,
+	CREATED_TIME INTEGER NOT NULL
+);`,
+		},
+		{
+			Name:  "reset_request_created",
+			Query: `CREATE INDEX IF NOT EXISTS RESET_REQUEST_CREATED ON RESET_REQUEST (CREATED_TIME);`,
+		},
+
+		{
+			Name: "otp",
+			Query: `
+-- One time passcodes. A subject has at most one live code per purpose.
+CREATE TABLE IF NOT EXISTS OTP (
+	PURPOSE TEXT NOT NULL,
+	SUBJECT TEXT NOT NULL,
+	CODE_HASH BLOB NOT NULL,
+	-- Wrong guesses remaining before the code is invalidated.
+	ATTEMPTS_LEFT INTEGER NOT NULL,
+	EXPIRES_TIME INTEGER NOT NULL,
+
+	PRIMARY KEY(PURPOSE, SUBJECT)
+);`,
+		},
+
+		{
+			Name: "risk_signal",
+			Query: `
+-- Assessments from external fraud systems about an email or IP address, consulted before issuing tokens.
+CREATE TABLE IF NOT EXISTS RISK_SIGNAL (
+	-- Lower cased email or IP address
+	SUBJECT TEXT NOT NULL PRIMARY KEY,
+	SCORE REAL NOT NULL,
+	REASON TEXT NOT NULL,
+	EXPIRES_TIME INTEGER NOT NULL
+);`,
+		},
+
+		{
+			Name: "device_revocation",
+			Query: `
+-- Tombstones for remembered devices. Device grants are signed cookies, so this is the only server side state they have.
+CREATE TABLE IF NOT EXISTS DEVICE_REVOCATION (
+	DEVICE_ID TEXT NOT NULL PRIMARY KEY,
+	UID TEXT NOT NULL,
+	REVOKED_TIME INTEGER NOT NULL,
+	-- When the revoked grant would have expired. After this the tombstone can be dropped.
+	EXPIRES_TIME INTEGER NOT NULL
+);`,
+		},
+
+		{
+			Name: "client",
+			Query: `
+-- Apps which log their users in through this server as an OpenID Connect provider.
+CREATE TABLE IF NOT EXISTS CLIENT (
+	ID TEXT NOT NULL PRIMARY KEY,
+	NAME TEXT NOT NULL,
+	-- SHA-256 of the client secret
+	SECRET_HASH BLOB NOT NULL,
+	-- Space separated URIs codes may be sent to
+	REDIRECT_URIS TEXT NOT NULL,
+	CREATED_TIME INTEGER NOT NULL
+);`,
+		},
+
+		{
+			Name: "grant_code",
+			Query: `
+-- Single use codes from the authorize route, exchanged by a CLIENT for a TOKEN.
+CREATE TABLE IF NOT EXISTS GRANT_CODE (
+	-- SHA-256 of the code
+	CODE_HASH BLOB NOT NULL PRIMARY KEY,
+	CLIENT_ID TEXT NOT NULL,
+	UID TEXT NOT NULL,
+	REDIRECT_URI TEXT NOT NULL,
+	-- Space separated scopes granted
+	SCOPE TEXT NOT NULL,
+	NONCE TEXT NOT NULL,
+	-- S256 challenge the verifier must match, or empty
+	CHALLENGE TEXT NOT NULL,
+	CREATED_TIME INTEGER NOT NULL,
+	EXPIRES_TIME INTEGER NOT NULL,
+
+	FOREIGN KEY(UID) REFERENCES USER(ID),
+	FOREIGN KEY(CLIENT_ID) REFERENCES CLIENT(ID)
+);`,
+		},
+
+		{
+			Name: "break_glass",
+			Query: `
+-- Single use emergency log in codes, issued by an operator with access to the DB. Kept a year after they expire, used
+-- or not, for the audit trail, see DefaultRetention.
+CREATE TABLE IF NOT EXISTS BREAK_GLASS (
+	-- SHA-256 of the code
+	CODE_HASH BLOB NOT NULL PRIMARY KEY,
+	UID TEXT NOT NULL,
+	-- Why the operator needed it
+	REASON TEXT NOT NULL,
+	CREATED_TIME INTEGER NOT NULL,
+	EXPIRES_TIME INTEGER NOT NULL,
+	-- When the code was spent, or NULL
+	USED_TIME INTEGER,
+
+	FOREIGN KEY(UID) REFERENCES USER(ID)
+);`,
+		},
+	}
+	for _, step := range steps {
+		_, err := db.ExecContext(ctx, step.Query)
+		if err != nil {
+			return fmt.Errorf("create tables: %v: %w", step.Name, err)
+		}
+	}
+
+	// Columns added after their table was first released. CREATE TABLE IF NOT EXISTS leaves existing tables alone, so
+	// these are added to older DBs here. New columns must be nullable or have a default.
+	columns := []struct {
+		Table      string
+		Column     string
+		Definition string
+	}{
+		{Table: "USER", Column: "PASSWORD_CHANGED_TIME", Definition: "INTEGER NOT NULL DEFAULT 0"},
+		{Table: "TOKEN", Column: "CREATED_TIME", Definition: "INTEGER NOT NULL DEFAULT 0"},
+		{Table: "TOKEN", Column: "SCOPE", Definition: "TEXT"},
+		{Table: "TOKEN", Column: "CLIENT_ID", Definition: "TEXT"},
+		{Table: "TOKEN", Column: "CLIENT_SCOPE", Definition: "TEXT"},
+		{Table: "TOKEN", Column: "IP", Definition: "TEXT"},
+		{Table: "TOKEN", Column: "USER_AGENT", Definition: "TEXT"},
+		{Table: "TOKEN", Column: "LAST_USED_TIME", Definition: "INTEGER"},
+		{Table: "TOKEN", Column: "IMPERSONATOR", Definition: "TEXT"},
+		{Table: "REFRESH_TOKEN", Column: "ACCESS_HASH", Definition: "BLOB"},
+		{Table: "REFRESH_TOKEN", Column: "IP", Definition: "TEXT"},
+		{Table: "REFRESH_TOKEN", Column: "USER_AGENT", Definition: "TEXT"},
+		{Table: "REFRESH_TOKEN", Column: "IMPERSONATOR", Definition: "TEXT"},
+		{Table: "REFRESH_TOKEN", Column: "REMEMBER", Definition: "BOOLEAN"},
+	}
+	for _, c := range columns {
+		err := addColumn(ctx, db, c.Table, c.Column, c.Definition)
+		if err != nil {
+			return fmt.Errorf("add column: %v.%v: %w", c.Table, c.Column, err)
+		}
+	}
+
+	// Users created before history was recorded get a creation event at the epoch, and their current roles.
+	_, err := db.ExecContext(ctx, `INSERT INTO USER_EVENT (UID, KIND, DATA, CREATED_TIME)
+SELECT ID, ?, json_object('email', EMAIL, 'valid', CASE WHEN VALID THEN 'true' ELSE 'false' END), 0 FROM USER
+WHERE ID NOT IN (SELECT UID FROM USER_EVENT);`, UserCreated)
+	if err != nil {
+		return fmt.Errorf("backfill user events: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO USER_EVENT (UID, KIND, DATA, CREATED_TIME)
+SELECT UID, ?, json_object('role', ROLE), 0 FROM USER_ROLE
+WHERE UID NOT IN (SELECT UID FROM USER_EVENT WHERE KIND != ? OR CREATED_TIME != 0);`, RoleGranted, UserCreated)
+	if err != nil {
+		return fmt.Errorf("backfill role events: %w", err)
+	}
+
+	// Tokens used to be stored raw, in TOKEN columns.
+	for _, table := range []string{"TOKEN", "SESSION_DATA"} {
+		err := hashTokenColumn(ctx, db, table)
+		if err != nil {
+			return fmt.Errorf("hash tokens: %v: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+// Replaces raw tokens in the table's TOKEN column with their SHA-256, and renames the column to TOKEN_HASH. Does nothing
+// if the table has already been migrated. Safe to rerun if interrupted, since hashes are longer than tokens.
+func hashTokenColumn(ctx context.Context, db conn, table string) error {
+	row := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM pragma_table_info('%v') WHERE name='TOKEN'`, table))
+	var n int
+	err := row.Scan(&n)
+	if err != nil {
+		return fmt.Errorf("check existing columns: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT DISTINCT TOKEN FROM %v WHERE LENGTH(TOKEN) = ?`, table), len(Token{}))
+	if err != nil {
+		return fmt.Errorf("query raw tokens: %w", err)
+	}
+	var raws [][]byte
+	for rows.Next() {
+		var raw []byte
+		err = rows.Scan(&raw)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("scan token: %w", err)
+		}
+		raws = append(raws, raw)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("iterate tokens: %w", err)
+	}
+	for _, raw := range raws {
+		hash := sha256.Sum256(raw)
+		_, err = db.ExecContext(ctx, fmt.Sprintf(`UPDATE %v SET TOKEN=? WHERE TOKEN=?;`, table), hash[:], raw)
+		if err != nil {
+			return fmt.Errorf("update token: %w", err)
+		}
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %v RENAME COLUMN TOKEN TO TOKEN_HASH;`, table))
+	if err != nil {
+		return fmt.Errorf("rename column: %w", err)
+	}
+	return nil
+}
+
+// Adds a column to a table, unless it already exists.
+func addColumn(ctx context.Context, db conn, table, column, definition string) error {
+	row := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM pragma_table_info('%v') WHERE name=?`, table), column)
+	var n int
+	err := row.Scan(&n)
+	if err != nil {
+		return fmt.Errorf("check existing columns: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %v ADD COLUMN %v %v;`, table, column, definition))
+	if err != nil {
+		return fmt.Errorf("alter table: %w", err)
+	}
 	return nil
 }
 
@@ -1,18 +1,23 @@
 package auth
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"fmt"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	_ "modernc.org/sqlite"
 )
 
 func TestTokenGeneration(t *testing.T) {
 	db := newDB(t, "token")
 	ctx := context.Background()
+	addUsers(t, db, "test")
 
 	token, err := GenerateToken(ctx, db, "test", time.UnixMilli(0), time.UnixMilli(1000))
 	if err != nil {
@@ -28,7 +33,7 @@ func TestTokenGeneration(t *testing.T) {
 	}
 	// invalid token
 	uid, err = Lookup(ctx, db, token, time.UnixMilli(5000))
-	if err != errInvalidToken {
+	if err != ErrInvalidToken {
 		t.Fatalf("expected invalid token error, got uid='%v', err='%v'", uid, err)
 	}
 }
@@ -36,6 +41,7 @@ func TestTokenGeneration(t *testing.T) {
 func TestTokenReap(t *testing.T) {
 	db := newDB(t, "token")
 	ctx := context.Background()
+	addUsers(t, db, "test")
 
 	tokenOld, err := GenerateToken(ctx, db, "test", time.UnixMilli(0), time.UnixMilli(1000))
 	if err != nil {
@@ -59,7 +65,7 @@ func TestTokenReap(t *testing.T) {
 	valid("new", tokenNew, time.UnixMilli(500))
 
 	// Remove em
-	err = ReapTokens(ctx, db, time.UnixMilli(1500))
+	err = ReapTokens(ctx, db, time.UnixMilli(1500), time.Now())
 	if err != nil {
 		t.Fatalf("reaping: %v", err)
 	}
@@ -69,7 +75,7 @@ func TestTokenReap(t *testing.T) {
 
 	// but old is gone
 	uid, err := Lookup(ctx, db, tokenOld, time.UnixMilli(500))
-	if err != errInvalidToken {
+	if err != ErrInvalidToken {
 		t.Fatalf("expected invalid token error, got uid='%v', err='%v'", uid, err)
 	}
 }
@@ -77,19 +83,19 @@ func TestTokenReap(t *testing.T) {
 func TestDuplicateUser(t *testing.T) {
 	db := newDB(t, "user")
 	ctx := context.Background()
-	err := RegisterUser(ctx, db, "user1", "lol@localhost", "pw1")
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
 	if err != nil {
 		t.Fatalf("register user: %v", err)
 	}
-	err = RegisterUser(ctx, db, "user1", "test@gmail.com", "pw1")
+	err = RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "test@gmail.com", "pw1")
 	if err == nil {
 		t.Fatal("duplicate user ID succeeded")
 	}
-	err = RegisterUser(ctx, db, "user2", "lol@localhost", "pw1")
+	err = RegisterUserWith(ctx, db, PasswordOptions{}, "user2", "lol@localhost", "pw1")
 	if err == nil {
 		t.Fatal("duplicate user Email succeeded")
 	}
-	err = RegisterUser(ctx, db, "user3", "looool@icloud.com", "pw1")
+	err = RegisterUserWith(ctx, db, PasswordOptions{}, "user3", "looool@icloud.com", "pw1")
 	if err != nil {
 		t.Fatalf("register non duplicate user: %v", err)
 	}
@@ -98,7 +104,7 @@ func TestDuplicateUser(t *testing.T) {
 func TestAuth(t *testing.T) {
 	db := newDB(t, "auth")
 	ctx := context.Background()
-	err := RegisterUser(ctx, db, "user1", "lol@localhost", "pw1")
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
 	if err != nil {
 		t.Fatalf("register user: %v", err)
 	}
@@ -125,16 +131,246 @@ func TestAuth(t *testing.T) {
 }
 
 // Generates a new DB file in a temporary location, and creates all system tables
-func newDB(t *testing.T, name string) *sql.DB {
+func newDB(t testing.TB, name string) *sql.DB {
 	t.Helper()
 	p := filepath.Join(t.TempDir(), name)
 	db, err := sql.Open("sqlite", p)
 	if err != nil {
 		t.Fatalf("connect to SQLite3 DB '%v': %v", p, err)
 	}
-	err = initialize(context.Background(), db)
+	err = Initialize(context.Background(), db)
 	if err != nil {
 		t.Fatalf("initialize DB: %v", err)
 	}
 	return db
 }
+
+// Stores users with the given IDs, for tests which issue them tokens directly. Tokens are only valid while their user
+// exists.
+func addUsers(t testing.TB, db conn, uids ...string) {
+	t.Helper()
+	for _, uid := range uids {
+		err := insertUser(context.Background(), db, uid, uid+"@example.com", []byte("no password"), true, time.Now())
+		if err != nil {
+			t.Fatalf("add user %v: %v", uid, err)
+		}
+	}
+}
+
+func TestGeneratedUserID(t *testing.T) {
+	db := newDB(t, "id")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db, IDPrefix: "acme"}
+	err := a.Register(ctx, "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	uid, err := LookupByEmail(ctx, db, "lol@localhost")
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if !strings.HasPrefix(uid, "acme_") || len(uid) != len("acme_")+26 {
+		t.Fatalf("expected generated acme_ id, got '%v'", uid)
+	}
+
+	// IDs sort by creation time
+	first, err := NewUserID("acme", time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("new id: %v", err)
+	}
+	second, err := NewUserID("acme", time.UnixMilli(2000))
+	if err != nil {
+		t.Fatalf("new id: %v", err)
+	}
+	if first >= second {
+		t.Fatalf("expected %v < %v", first, second)
+	}
+	_, err = NewUserID("ac_me", time.Now())
+	if err == nil {
+		t.Fatal("prefix with underscore succeeded")
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	db := newDB(t, "batch")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+
+	var ts []Token
+	for i := 0; i < lookupBatchSize+10; i++ {
+		addUsers(t, db, fmt.Sprintf("user%v", i))
+		token, err := GenerateToken(ctx, db, fmt.Sprintf("user%v", i), time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("generate token: %v", err)
+		}
+		ts = append(ts, token)
+	}
+	expired, err := GenerateToken(ctx, db, "expired", time.UnixMilli(0), time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	ts = append(ts, expired, Token{})
+
+	res, err := a.ValidateBatch(ctx, ts)
+	if err != nil {
+		t.Fatalf("validate batch: %v", err)
+	}
+	if len(res) != len(ts) {
+		t.Fatalf("expected %v results, got %v", len(ts), len(res))
+	}
+	for i := 0; i < lookupBatchSize+10; i++ {
+		if res[i].Err != nil || res[i].UID != fmt.Sprintf("user%v", i) {
+			t.Fatalf("result %v: expected user%v, got %+v", i, i, res[i])
+		}
+	}
+	for _, r := range res[len(res)-2:] {
+		if r.Err != ErrInvalidToken {
+			t.Fatalf("expected invalid token error, got %+v", r)
+		}
+	}
+}
+
+func TestCalibrateCost(t *testing.T) {
+	cost, err := CalibrateCost(0)
+	if err != nil {
+		t.Fatalf("calibrate: %v", err)
+	}
+	if cost != bcrypt.MinCost {
+		t.Fatalf("expected min cost for zero target, got %v", cost)
+	}
+	cost, err = CalibrateCost(time.Millisecond)
+	if err != nil {
+		t.Fatalf("calibrate: %v", err)
+	}
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		t.Fatalf("cost out of range: %v", cost)
+	}
+}
+
+func TestChangePasswordRevokesTokens(t *testing.T) {
+	db := newDB(t, "password")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register user: %v", err)
+	}
+	now := time.Now()
+	old, err := GenerateToken(ctx, db, "user1", now.Add(-time.Minute), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	err = ChangePasswordWith(ctx, db, PasswordOptions{}, "user1", "pw2", now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("change password: %v", err)
+	}
+	_, err = Lookup(ctx, db, old, now.Add(2*time.Second))
+	if err != ErrInvalidToken {
+		t.Fatalf("token from before password change: expected invalid token, got %v", err)
+	}
+	res, err := DBAuthenticator{DB: db}.ValidateBatch(ctx, []Token{old})
+	if err != nil || res[0].Err != ErrInvalidToken {
+		t.Fatalf("batch: expected invalid token, got %+v %v", res, err)
+	}
+	err = Authenticate(ctx, db, "user1", "pw2")
+	if err != nil {
+		t.Fatalf("authenticate with new password: %v", err)
+	}
+	err = ChangePasswordWith(ctx, db, PasswordOptions{}, "nobody", "pw2", now)
+	if err == nil {
+		t.Fatal("changing password of missing user succeeded")
+	}
+}
+
+func TestInitializeMigratesOldSchema(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "old")
+	db, err := sql.Open("sqlite", p)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ctx := context.Background()
+	_, err = db.ExecContext(ctx, `
+CREATE TABLE USER (ID TEXT NOT NULL PRIMARY KEY, EMAIL TEXT NOT NULL UNIQUE, BCRYPT BLOB NOT NULL, VALID BOOLEAN DEFAULT FALSE NOT NULL);
+CREATE TABLE TOKEN (UID TEXT NOT NULL, TOKEN BLOB NOT NULL PRIMARY KEY, START_TIME INTEGER NOT NULL, END_TIME INTEGER NOT NULL);`)
+	if err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO USER (ID, EMAIL, BCRYPT) VALUES ('user1', 'a@b.com', '');
+INSERT INTO TOKEN (UID, TOKEN, START_TIME, END_TIME) VALUES ('user1', ?, 0, 1000);`, make([]byte, 16))
+	if err != nil {
+		t.Fatalf("insert old token: %v", err)
+	}
+	// Migrating twice is fine
+	for i := 0; i < 2; i++ {
+		err = Initialize(ctx, db)
+		if err != nil {
+			t.Fatalf("initialize %v: %v", i, err)
+		}
+	}
+	uid, err := Lookup(ctx, db, Token{}, time.UnixMilli(500))
+	if err != nil || uid != "user1" {
+		t.Fatalf("old token after migration: %v %v", uid, err)
+	}
+}
+
+func TestTokensStoredHashed(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "raw")
+	db, err := sql.Open("sqlite", p)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ctx := context.Background()
+	_, err = db.ExecContext(ctx, `
+CREATE TABLE TOKEN (UID TEXT NOT NULL, TOKEN BLOB NOT NULL PRIMARY KEY, START_TIME INTEGER NOT NULL, END_TIME INTEGER NOT NULL);
+CREATE TABLE SESSION_DATA (TOKEN BLOB NOT NULL, KEY TEXT NOT NULL, VALUE BLOB NOT NULL, PRIMARY KEY(TOKEN, KEY));`)
+	if err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+	raw := Token{1, 2, 3}
+	_, err = db.ExecContext(ctx, `INSERT INTO TOKEN (UID, TOKEN, START_TIME, END_TIME) VALUES ('user1', ?, 0, 1000);`, raw[:])
+	if err != nil {
+		t.Fatalf("insert raw token: %v", err)
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO SESSION_DATA (TOKEN, KEY, VALUE) VALUES (?, 'cart', 'x');`, raw[:])
+	if err != nil {
+		t.Fatalf("insert raw session data: %v", err)
+	}
+	err = Initialize(ctx, db)
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	addUsers(t, db, "user1")
+
+	// Migrated tokens keep working, but only their hash is stored.
+	uid, err := Lookup(ctx, db, raw, time.UnixMilli(500))
+	if err != nil || uid != "user1" {
+		t.Fatalf("migrated token: %v %v", uid, err)
+	}
+	v, err := SessionValue(ctx, db, raw, "cart")
+	if err != nil || string(v) != "x" {
+		t.Fatalf("migrated session data: %q %v", v, err)
+	}
+	fresh, err := GenerateToken(ctx, db, "user1", time.UnixMilli(0), time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT TOKEN_HASH FROM TOKEN`)
+	if err != nil {
+		t.Fatalf("query tokens: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stored []byte
+		if err := rows.Scan(&stored); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		if bytes.Equal(stored, raw[:]) || bytes.Equal(stored, fresh[:]) {
+			t.Fatalf("raw token stored in DB")
+		}
+		// A leaked hash can't be presented as a token.
+		var leaked Token
+		copy(leaked[:], stored)
+		if _, err := Lookup(ctx, db, leaked, time.UnixMilli(500)); err != ErrInvalidToken {
+			t.Fatalf("leaked hash: expected ErrInvalidToken, got %v", err)
+		}
+	}
+}
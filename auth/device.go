@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Remembered devices. A device grant records that a user has trusted a particular browser, so that a second factor can be
+// skipped on it. Grants live in a signed cookie and are verified without touching the DB, except to check the (small)
+// table of revoked devices.
+
+// Returned when a device grant is forged, corrupted or expired.
+var ErrInvalidDevice = errors.New("invalid device grant")
+
+// A user's trust in a particular device, valid until Expires.
+type DeviceGrant struct {
+	DeviceID string    `json:"d"`
+	UID      string    `json:"u"`
+	Expires  time.Time `json:"e"`
+}
+
+// Creates a grant for a new randomly identified device.
+func NewDeviceGrant(uid string, expires time.Time) (DeviceGrant, error) {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return DeviceGrant{}, fmt.Errorf("read random: %w", err)
+	}
+	return DeviceGrant{
+		DeviceID: base64.RawURLEncoding.EncodeToString(id[:]),
+		UID:      uid,
+		Expires:  expires,
+	}, nil
+}
+
+// Signs and verifies device grants with an HMAC key. The key should be at least 32 random bytes and kept secret;
+// rotating it invalidates every remembered device.
+type DeviceSigner struct {
+	Key []byte
+}
+
+// Encodes the grant as a cookie value: the payload and its HMAC, each base64 encoded.
+func (s DeviceSigner) Sign(g DeviceGrant) (string, error) {
+	if len(s.Key) == 0 {
+		return "", fmt.Errorf("device signer: no key")
+	}
+	payload, err := json.Marshal(g)
+	if err != nil {
+		return "", fmt.Errorf("marshal grant: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload)), nil
+}
+
+// Parses a cookie value produced by Sign, checking the signature and expiry. Returns ErrInvalidDevice if the value was not
+// signed with this key or has expired. This does not check for revocation, see DeviceRevoked.
+func (s DeviceSigner) Verify(value string, now time.Time) (DeviceGrant, error) {
+	var g DeviceGrant
+	if len(s.Key) == 0 {
+		return g, fmt.Errorf("device signer: no key")
+	}
+	encPayload, encMAC, ok := strings.Cut(value, ".")
+	if !ok {
+		return g, ErrInvalidDevice
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return g, ErrInvalidDevice
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encMAC)
+	if err != nil {
+		return g, ErrInvalidDevice
+	}
+	if !hmac.Equal(mac, s.mac(payload)) {
+		return g, ErrInvalidDevice
+	}
+	err = json.Unmarshal(payload, &g)
+	if err != nil {
+		return g, ErrInvalidDevice
+	}
+	if !now.Before(g.Expires) {
+		return g, ErrInvalidDevice
+	}
+	return g, nil
+}
+
+func (s DeviceSigner) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, s.Key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// Tombstones a device, so that grants for it are rejected even though their signatures are still valid.
+func RevokeDevice(ctx context.Context, db conn, g DeviceGrant, now time.Time) error {
+	_, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO DEVICE_REVOCATION (DEVICE_ID, UID, REVOKED_TIME, EXPIRES_TIME)
+	VALUES (?, ?, ?, ?);`, g.DeviceID, g.UID, now.UnixMilli(), g.Expires.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("insert revocation: %w", err)
+	}
+	return nil
+}
+
+// Reports whether the device has been revoked.
+func DeviceRevoked(ctx context.Context, db conn, deviceID string) (bool, error) {
+	row := db.QueryRowContext(ctx, `SELECT 1 FROM DEVICE_REVOCATION WHERE DEVICE_ID=?`, deviceID)
+	var found int
+	err := row.Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("query revocation: %w", err)
+	}
+	return true, nil
+}
+
+// Drops tombstones for grants which have expired anyway, as they can no longer be presented.
+func ReapDeviceRevocations(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM DEVICE_REVOCATION WHERE EXPIRES_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeviceGrant(t *testing.T) {
+	db := newDB(t, "device")
+	ctx := context.Background()
+	s := DeviceSigner{Key: []byte("0123456789abcdef0123456789abcdef")}
+
+	g, err := NewDeviceGrant("user1", time.UnixMilli(10000))
+	if err != nil {
+		t.Fatalf("new grant: %v", err)
+	}
+	cookie, err := s.Sign(g)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	got, err := s.Verify(cookie, time.UnixMilli(5000))
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if got.DeviceID != g.DeviceID || got.UID != "user1" || !got.Expires.Equal(g.Expires) {
+		t.Fatalf("expected %+v, got %+v", g, got)
+	}
+
+	// Expired, tampered, or signed with another key
+	if _, err := s.Verify(cookie, time.UnixMilli(10000)); err != ErrInvalidDevice {
+		t.Fatalf("expired: expected invalid device, got %v", err)
+	}
+	if _, err := s.Verify("x"+cookie, time.UnixMilli(5000)); err != ErrInvalidDevice {
+		t.Fatalf("tampered: expected invalid device, got %v", err)
+	}
+	other := DeviceSigner{Key: []byte("another key")}
+	if _, err := other.Verify(cookie, time.UnixMilli(5000)); err != ErrInvalidDevice {
+		t.Fatalf("other key: expected invalid device, got %v", err)
+	}
+
+	// Revocation
+	revoked, err := DeviceRevoked(ctx, db, g.DeviceID)
+	if err != nil || revoked {
+		t.Fatalf("expected unrevoked device, got %v %v", revoked, err)
+	}
+	err = RevokeDevice(ctx, db, g, time.UnixMilli(6000))
+	if err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	revoked, err = DeviceRevoked(ctx, db, g.DeviceID)
+	if err != nil || !revoked {
+		t.Fatalf("expected revoked device, got %v %v", revoked, err)
+	}
+	err = ReapDeviceRevocations(ctx, db, time.UnixMilli(20000))
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	revoked, err = DeviceRevoked(ctx, db, g.DeviceID)
+	if err != nil || revoked {
+		t.Fatalf("expected reaped tombstone, got %v %v", revoked, err)
+	}
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//go:embed disposable_domains.txt
+var bundledDisposableDomains string
+
+// Returned when an email address belongs to a disposable email provider.
+var ErrDisposableEmail = errors.New("disposable email addresses are not allowed")
+
+// Rejects email addresses at disposable email providers, and their subdomains. Starts from a bundled list, and domains
+// can be added or removed at runtime. Safe for concurrent use.
+type DisposableDomainChecker struct {
+	mu      sync.RWMutex
+	domains map[string]bool
+}
+
+// Creates a checker loaded with the bundled list of disposable domains.
+func NewDisposableDomainChecker() *DisposableDomainChecker {
+	c := &DisposableDomainChecker{domains: make(map[string]bool)}
+	s := bufio.NewScanner(strings.NewReader(bundledDisposableDomains))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		c.domains[strings.ToLower(line)] = true
+	}
+	return c
+}
+
+func (c *DisposableDomainChecker) CheckEmail(ctx context.Context, email string) error {
+	domain, err := emailDomain(email)
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	// Check the domain and each of its parents.
+	for d := domain; d != ""; {
+		if c.domains[d] {
+			return fmt.Errorf("%v: %w", domain, ErrDisposableEmail)
+		}
+		dot := strings.Index(d, ".")
+		if dot < 0 {
+			break
+		}
+		d = d[dot+1:]
+	}
+	return nil
+}
+
+// Blocks the given domains.
+func (c *DisposableDomainChecker) Add(domains ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.domains == nil {
+		c.domains = make(map[string]bool)
+	}
+	for _, d := range domains {
+		c.domains[strings.ToLower(strings.TrimSpace(d))] = true
+	}
+}
+
+// Unblocks the given domains.
+func (c *DisposableDomainChecker) Remove(domains ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range domains {
+		delete(c.domains, strings.ToLower(strings.TrimSpace(d)))
+	}
+}
+
+// Returns the blocked domains, sorted.
+func (c *DisposableDomainChecker) Domains() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	res := make([]string, 0, len(c.domains))
+	for d := range c.domains {
+		res = append(res, d)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Returns an http handler for administering the list, authenticated by the shared secret as a bearer token. GET lists the
+// blocked domains, and POST changes them:
+//
+//	POST {"add": ["spam.example"], "remove": ["mailinator.com"]}
+func (c *DisposableDomainChecker) Handler(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkBearer(w, r, secret) {
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req struct {
+				Add    []string `json:"add"`
+				Remove []string `json:"remove"`
+			}
+			err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("parse body: %v", err), http.StatusBadRequest)
+				return
+			}
+			c.Add(req.Add...)
+			c.Remove(req.Remove...)
+		default:
+			http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Domains())
+	})
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelaxedCanonicalization(t *testing.T) {
+	// The example from RFC 6376 section 3.4.5.
+	if got := relaxedHeader("A", " X") + "\r\n" + relaxedHeader("B ", " Y\t\r\n\tZ  "); got != "a:X\r\nb:Y Z" {
+		t.Fatalf("headers: got %q", got)
+	}
+	if got := relaxedBody(" C \r\nD \t E\r\n\r\n\r\n"); got != " C\r\nD E\r\n" {
+		t.Fatalf("body: got %q", got)
+	}
+	if got := relaxedBody(""); got != "" {
+		t.Fatalf("empty body: got %q", got)
+	}
+}
+
+// Checks the DKIM-Signature on a message produced by SMTPMailer, returning the signed digest and signature.
+func parseSigned(t *testing.T, msg string) (digest []byte, sig []byte, tags map[string]string) {
+	head, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no body in %q", msg)
+	}
+	lines := strings.Split(head, "\r\n")
+	name, value, _ := strings.Cut(lines[0], ": ")
+	if name != "DKIM-Signature" {
+		t.Fatalf("expected DKIM-Signature first, got %q", lines[0])
+	}
+	tags = map[string]string{}
+	for _, tag := range strings.Split(value, "; ") {
+		k, v, _ := strings.Cut(tag, "=")
+		tags[k] = v
+	}
+	bh := sha256.Sum256([]byte(relaxedBody(body)))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bh[:]) {
+		t.Fatalf("body hash mismatch: %v", tags["bh"])
+	}
+	var signed strings.Builder
+	for _, l := range lines[1:] {
+		n, v, _ := strings.Cut(l, ": ")
+		signed.WriteString(relaxedHeader(n, v) + "\r\n")
+	}
+	signed.WriteString(relaxedHeader(name, strings.TrimSuffix(value, tags["b"])))
+	d := sha256.Sum256([]byte(signed.String()))
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatalf("decode b=: %v", err)
+	}
+	return d[:], sig, tags
+}
+
+func TestSMTPMailerDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate rsa key: %v", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	key, err := LoadDKIMKey(pemKey)
+	if err != nil {
+		t.Fatalf("load key: %v", err)
+	}
+	m := SMTPMailer{From: "noreply@example.com", DKIM: &DKIMSigner{Domain: "example.com", Selector: "mail", Key: key}}
+	msg, err := m.message("a@b.com", "Hello", "Hi  there \n\n", time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("message: %v", err)
+	}
+	digest, sig, tags := parseSigned(t, string(msg))
+	if tags["a"] != "rsa-sha256" || tags["d"] != "example.com" || tags["s"] != "mail" {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+	if tags["h"] != "from:to:subject:date:mime-version:content-type" {
+		t.Fatalf("unexpected signed headers %v", tags["h"])
+	}
+	err = rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest, sig)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	// Tampering with the subject breaks the signature.
+	tampered := strings.Replace(string(msg), "Subject: Hello", "Subject: Goodbye", 1)
+	digest, sig, _ = parseSigned(t, tampered)
+	if rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest, sig) == nil {
+		t.Fatalf("expected tampered message to fail verification")
+	}
+
+	pub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ed25519 key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	key, err = LoadDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("load ed25519 key: %v", err)
+	}
+	m.DKIM.Key = key
+	msg, err = m.message("a@b.com", "Hello", "Hi", time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("message: %v", err)
+	}
+	digest, sig, tags = parseSigned(t, string(msg))
+	if tags["a"] != "ed25519-sha256" || !ed25519.Verify(pub, digest, sig) {
+		t.Fatalf("ed25519 signature did not verify")
+	}
+
+	if _, err := LoadDKIMKey([]byte("not a key")); err == nil {
+		t.Fatalf("expected error loading garbage")
+	}
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decides whether an email address may be used to register, beyond being syntactically valid.
+type EmailChecker interface {
+	CheckEmail(ctx context.Context, email string) error
+}
+
+// Returned when an email domain has no mail server.
+var ErrUndeliverableEmail = errors.New("email domain does not accept mail")
+
+// Returns the lower cased domain of an email address.
+func emailDomain(email string) (string, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 || at == len(email)-1 {
+		return "", fmt.Errorf("no domain in email address '%v'", email)
+	}
+	return strings.ToLower(strings.TrimSuffix(email[at+1:], ".")), nil
+}
+
+// Rejects email addresses whose domain can't receive mail, by looking up its MX records (or, failing that, its address
+// records, which mail servers fall back to). Lookups which time out or fail temporarily let the address through, so a
+// DNS hiccup doesn't block registration. Results are cached. Safe for concurrent use.
+type MXChecker struct {
+	// How long a lookup may take. Defaults to 2 seconds.
+	Timeout time.Duration
+	// How long results are cached. Defaults to an hour.
+	CacheTTL time.Duration
+	// Defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+
+	mu    sync.Mutex
+	cache map[string]mxResult
+}
+
+type mxResult struct {
+	deliverable bool
+	expires     time.Time
+}
+
+func (m *MXChecker) CheckEmail(ctx context.Context, email string) error {
+	domain, err := emailDomain(email)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	m.mu.Lock()
+	cached, ok := m.cache[domain]
+	m.mu.Unlock()
+	if !ok || now.After(cached.expires) {
+		deliverable, err := m.lookup(ctx, domain)
+		if err != nil {
+			log.Printf("error: mx check for %v, allowing: %v", domain, err)
+			return nil
+		}
+		cached = mxResult{deliverable: deliverable, expires: now.Add(m.cacheTTL())}
+		m.mu.Lock()
+		if m.cache == nil {
+			m.cache = make(map[string]mxResult)
+		}
+		m.cache[domain] = cached
+		m.mu.Unlock()
+	}
+	if !cached.deliverable {
+		return fmt.Errorf("%v: %w", domain, ErrUndeliverableEmail)
+	}
+	return nil
+}
+
+// Reports whether the domain accepts mail. Returns an error if that couldn't be determined.
+func (m *MXChecker) lookup(ctx context.Context, domain string) (bool, error) {
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resolver := m.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	mxs, err := resolver.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		// A single "." MX is an explicit statement that the domain takes no mail (RFC 7505).
+		if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+			return false, nil
+		}
+		return true, nil
+	}
+	if err != nil && !isNotFound(err) {
+		return false, fmt.Errorf("lookup mx: %w", err)
+	}
+	// No MX, so mail goes to the domain's own address, if it has one (RFC 5321 section 5.1).
+	addrs, err := resolver.LookupHost(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return false, fmt.Errorf("lookup host: %w", err)
+	}
+	return len(addrs) > 0, nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func (m *MXChecker) cacheTTL() time.Duration {
+	if m.CacheTTL <= 0 {
+		return time.Hour
+	}
+	return m.CacheTTL
+}
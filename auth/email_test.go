@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMXChecker(t *testing.T) {
+	ctx := context.Background()
+	// A resolver that can't reach DNS fails open
+	offline := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("offline")
+		},
+	}
+	m := &MXChecker{Resolver: offline, Timeout: 100 * time.Millisecond}
+	err := m.CheckEmail(ctx, "lol@example.com")
+	if err != nil {
+		t.Fatalf("expected lookup failure to allow email, got %v", err)
+	}
+	err = m.CheckEmail(ctx, "no-domain@")
+	if err == nil {
+		t.Fatal("email without domain succeeded")
+	}
+
+	// Cached results are used without a lookup
+	m.cache = map[string]mxResult{
+		"nomail.example": {deliverable: false, expires: time.Now().Add(time.Hour)},
+	}
+	err = m.CheckEmail(ctx, "lol@NoMail.example")
+	if !errors.Is(err, ErrUndeliverableEmail) {
+		t.Fatalf("expected undeliverable email, got %v", err)
+	}
+
+	db := newDB(t, "mx")
+	a := DBAuthenticator{DB: db, EmailCheckers: []EmailChecker{m}}
+	err = a.Register(ctx, "lol@nomail.example", "pw1")
+	if !errors.Is(err, ErrUndeliverableEmail) {
+		t.Fatalf("register: expected undeliverable email, got %v", err)
+	}
+	_, err = a.BeginRegister(ctx, "lol@nomail.example", "pw1")
+	if !errors.Is(err, ErrUndeliverableEmail) {
+		t.Fatalf("begin register: expected undeliverable email, got %v", err)
+	}
+}
+
+func TestDisposableDomains(t *testing.T) {
+	ctx := context.Background()
+	c := NewDisposableDomainChecker()
+	for _, email := range []string{"lol@mailinator.com", "lol@MAILINATOR.com", "lol@eu.mailinator.com"} {
+		err := c.CheckEmail(ctx, email)
+		if !errors.Is(err, ErrDisposableEmail) {
+			t.Fatalf("%v: expected disposable email, got %v", email, err)
+		}
+	}
+	err := c.CheckEmail(ctx, "lol@notmailinator.com")
+	if err != nil {
+		t.Fatalf("lookalike domain: %v", err)
+	}
+
+	h := c.Handler("s3cret")
+	r := httptest.NewRequest("POST", "/disposable", strings.NewReader(`{"add": ["spam.example"], "remove": ["mailinator.com"]}`))
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update list: expected 200, got %v", w.Code)
+	}
+	if err := c.CheckEmail(ctx, "lol@spam.example"); !errors.Is(err, ErrDisposableEmail) {
+		t.Fatalf("added domain: expected disposable email, got %v", err)
+	}
+	if err := c.CheckEmail(ctx, "lol@mailinator.com"); err != nil {
+		t.Fatalf("removed domain: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/disposable", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("no secret: expected 401, got %v", w.Code)
+	}
+}
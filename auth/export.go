@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The current archive format version. Bump this whenever the archive layout changes, and keep Import able to read older
+// versions.
+const archiveVersion = 3
+
+// A portable snapshot of the accounts in a DB, for moving between servers. Tokens are deliberately excluded: they are
+// short lived, and users can simply log in again on the new server.
+type Archive struct {
+	Version  int               `json:"version"`
+	Exported time.Time         `json:"exported"`
+	Users    []ArchivedUser    `json:"users"`
+	Notes    []UserNote        `json:"notes,omitempty"`
+	Tags     []ArchivedUserTag `json:"tags,omitempty"`
+	// Since version 2.
+	Roles       []ArchivedUserRole   `json:"roles,omitempty"`
+	Permissions []ArchivedPermission `json:"permissions,omitempty"`
+	// Since version 3.
+	Attributes []ArchivedUserAttribute `json:"attributes,omitempty"`
+}
+
+// A user row, including its password hash.
+type ArchivedUser struct {
+	ID     string `json:"id"`
+	Email  string `json:"email"`
+	Bcrypt []byte `json:"bcrypt"`
+	Valid  bool   `json:"valid"`
+}
+
+type ArchivedUserTag struct {
+	UID string `json:"uid"`
+	Tag string `json:"tag"`
+}
+
+type ArchivedUserRole struct {
+	UID     string    `json:"uid"`
+	Role    string    `json:"role"`
+	Granted time.Time `json:"granted"`
+}
+
+type ArchivedUserAttribute struct {
+	UID   string `json:"uid"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type ArchivedPermission struct {
+	Role       string `json:"role"`
+	Permission string `json:"permission"`
+}
+
+// Reads every account in the DB into an archive. Use a transaction for a consistent snapshot.
+func Export(ctx context.Context, db conn, now time.Time) (Archive, error) {
+	a := Archive{Version: archiveVersion, Exported: now}
+	rows, err := db.QueryContext(ctx, `SELECT ID, EMAIL, BCRYPT, VALID FROM USER ORDER BY ID;`)
+	if err != nil {
+		return a, fmt.Errorf("fetch users: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u ArchivedUser
+		err = rows.Scan(&u.ID, &u.Email, &u.Bcrypt, &u.Valid)
+		if err != nil {
+			return a, fmt.Errorf("scan user: %w", err)
+		}
+		a.Users = append(a.Users, u)
+	}
+	if err = rows.Err(); err != nil {
+		return a, fmt.Errorf("iterate users: %w", err)
+	}
+
+	for _, u := range a.Users {
+		notes, err := UserNotes(ctx, db, u.ID)
+		if err != nil {
+			return a, fmt.Errorf("notes for %v: %w", u.ID, err)
+		}
+		a.Notes = append(a.Notes, notes...)
+		tags, err := UserTags(ctx, db, u.ID)
+		if err != nil {
+			return a, fmt.Errorf("tags for %v: %w", u.ID, err)
+		}
+		for _, tag := range tags {
+			a.Tags = append(a.Tags, ArchivedUserTag{UID: u.ID, Tag: tag})
+		}
+		attrs, err := UserAttributes(ctx, db, u.ID)
+		if err != nil {
+			return a, fmt.Errorf("attributes for %v: %w", u.ID, err)
+		}
+		names := make([]string, 0, len(attrs))
+		for name := range attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			a.Attributes = append(a.Attributes, ArchivedUserAttribute{UID: u.ID, Name: name, Value: attrs[name]})
+		}
+	}
+
+	roles, err := db.QueryContext(ctx, `SELECT UID, ROLE, CREATED_TIME FROM USER_ROLE ORDER BY UID, ROLE;`)
+	if err != nil {
+		return a, fmt.Errorf("fetch roles: %w", err)
+	}
+	defer roles.Close()
+	for roles.Next() {
+		var r ArchivedUserRole
+		var granted int64
+		err = roles.Scan(&r.UID, &r.Role, &granted)
+		if err != nil {
+			return a, fmt.Errorf("scan role: %w", err)
+		}
+		r.Granted = time.UnixMilli(granted)
+		a.Roles = append(a.Roles, r)
+	}
+	if err = roles.Err(); err != nil {
+		return a, fmt.Errorf("iterate roles: %w", err)
+	}
+	perms, err := db.QueryContext(ctx, `SELECT ROLE, PERMISSION FROM ROLE_PERMISSION ORDER BY ROLE, PERMISSION;`)
+	if err != nil {
+		return a, fmt.Errorf("fetch permissions: %w", err)
+	}
+	defer perms.Close()
+	for perms.Next() {
+		var p ArchivedPermission
+		err = perms.Scan(&p.Role, &p.Permission)
+		if err != nil {
+			return a, fmt.Errorf("scan permission: %w", err)
+		}
+		a.Permissions = append(a.Permissions, p)
+	}
+	if err = perms.Err(); err != nil {
+		return a, fmt.Errorf("iterate permissions: %w", err)
+	}
+	return a, nil
+}
+
+// Loads an archive into the DB. Fails if any user ID or email already exists, so use a transaction to avoid a partial
+// import.
+func Import(ctx context.Context, db conn, a Archive) error {
+	if a.Version < 1 || a.Version > archiveVersion {
+		return fmt.Errorf("unsupported archive version %v", a.Version)
+	}
+	for _, u := range a.Users {
+		err := insertUser(ctx, db, u.ID, u.Email, u.Bcrypt, u.Valid, a.Exported)
+		if err != nil {
+			return fmt.Errorf("insert user %v: %w", u.ID, err)
+		}
+	}
+	for _, n := range a.Notes {
+		err := AddUserNote(ctx, db, n.UID, n.Author, n.Note, n.Created)
+		if err != nil {
+			return fmt.Errorf("note for %v: %w", n.UID, err)
+		}
+	}
+	for _, t := range a.Tags {
+		err := TagUser(ctx, db, t.UID, "import", t.Tag, a.Exported)
+		if err != nil {
+			return fmt.Errorf("tag for %v: %w", t.UID, err)
+		}
+	}
+	for _, attr := range a.Attributes {
+		err := SetUserAttribute(ctx, db, attr.UID, attr.Name, attr.Value)
+		if err != nil {
+			return fmt.Errorf("attribute for %v: %w", attr.UID, err)
+		}
+	}
+	for _, r := range a.Roles {
+		err := GrantRole(ctx, db, r.UID, r.Role, r.Granted)
+		if err != nil {
+			return fmt.Errorf("role for %v: %w", r.UID, err)
+		}
+	}
+	for _, p := range a.Permissions {
+		err := GrantPermission(ctx, db, p.Role, p.Permission)
+		if err != nil {
+			return fmt.Errorf("permission for %v: %w", p.Role, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	src := newDB(t, "src")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, src, PasswordOptions{}, "user1", "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register user: %v", err)
+	}
+	err = AddUserNote(ctx, src, "user1", "admin", "called support", time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("add note: %v", err)
+	}
+	err = TagUser(ctx, src, "user1", "admin", "vip", time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("tag user: %v", err)
+	}
+	err = GrantRole(ctx, src, "user1", "admin", time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("grant role: %v", err)
+	}
+	err = GrantPermission(ctx, src, "admin", "users:delete")
+	if err != nil {
+		t.Fatalf("grant permission: %v", err)
+	}
+	err = SetUserAttribute(ctx, src, "user1", "display_name", "Ada")
+	if err != nil {
+		t.Fatalf("set attribute: %v", err)
+	}
+
+	a, err := Export(ctx, src, time.Now())
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	// Round trip through the on disk format
+	b, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var decoded Archive
+	err = json.Unmarshal(b, &decoded)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	dst := newDB(t, "dst")
+	err = Import(ctx, dst, decoded)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	err = Authenticate(ctx, dst, "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("authenticate imported user: %v", err)
+	}
+	notes, err := UserNotes(ctx, dst, "user1")
+	if err != nil || len(notes) != 1 || notes[0].Note != "called support" {
+		t.Fatalf("imported notes: %v %v", notes, err)
+	}
+	users, err := UsersWithTag(ctx, dst, "vip")
+	if err != nil || len(users) != 1 {
+		t.Fatalf("imported tags: %v %v", users, err)
+	}
+	attrs, err := UserAttributes(ctx, dst, "user1")
+	if err != nil || attrs["display_name"] != "Ada" {
+		t.Fatalf("imported attributes: %v %v", attrs, err)
+	}
+	token, err := GenerateToken(ctx, dst, "user1", time.UnixMilli(0), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	ok, err := TokenHasPermission(ctx, dst, token, "users:delete")
+	if err != nil || !ok {
+		t.Fatalf("imported roles: %v %v", ok, err)
+	}
+
+	// Importing again conflicts
+	err = Import(ctx, dst, decoded)
+	if err == nil {
+		t.Fatal("duplicate import succeeded")
+	}
+	decoded.Version = archiveVersion + 1
+	err = Import(ctx, newDB(t, "future"), decoded)
+	if err == nil {
+		t.Fatal("import of unknown version succeeded")
+	}
+}
+
+func TestImportVersion2(t *testing.T) {
+	var a Archive
+	err := json.Unmarshal([]byte(`{"version": 2, "exported": "2024-01-01T00:00:00Z",
+	"users": [{"id": "user1", "email": "lol@localhost", "bcrypt": "aGFzaA==", "valid": true}],
+	"roles": [{"uid": "user1", "role": "admin", "granted": "2024-01-01T00:00:00Z"}]}`), &a)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	ctx := context.Background()
+	db := newDB(t, "v2")
+	err = Import(ctx, db, a)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	roles, err := UserRoles(ctx, db, "user1")
+	if err != nil || len(roles) != 1 || roles[0] != "admin" {
+		t.Fatalf("imported roles: %v %v", roles, err)
+	}
+	attrs, err := UserAttributes(ctx, db, "user1")
+	if err != nil || len(attrs) != 0 {
+		t.Fatalf("expected no attributes, got %v %v", attrs, err)
+	}
+}
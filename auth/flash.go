@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Flash messages are shown once on the next page, e.g "Password changed, please log in" after a redirect. They live in a
+// short lived signed cookie, so other sites can't plant messages on our pages.
+
+// How long a flash message waits to be shown.
+const flashTTL = time.Minute
+
+// Sets and reads flash messages, signed with an HMAC key. The key should be at least 32 random bytes. Every server
+// showing the messages needs the same key, but since messages are short lived it can be generated at startup.
+type Flasher struct {
+	Key []byte
+}
+
+type flash struct {
+	Message string    `json:"m"`
+	Expires time.Time `json:"e"`
+}
+
+// Sets a message to be shown on the next page which reads it.
+func (f Flasher) Set(w http.ResponseWriter, message string) error {
+	if len(f.Key) == 0 {
+		return fmt.Errorf("flasher: no key")
+	}
+	payload, err := json.Marshal(flash{Message: message, Expires: time.Now().Add(flashTTL)})
+	if err != nil {
+		return fmt.Errorf("marshal flash: %w", err)
+	}
+	value := base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(f.mac(payload))
+	w.Header().Add("Set-Cookie", fmt.Sprintf("auth_flash=%v; Max-Age=%v; Secure; HttpOnly; SameSite=Lax; Path=/", value, int(flashTTL.Seconds())))
+	return nil
+}
+
+// Returns the pending message, if any, and clears it so it is only shown once. Forged or expired messages are ignored.
+func (f Flasher) Pop(w http.ResponseWriter, r *http.Request) string {
+	c, err := r.Cookie("auth_flash")
+	if err != nil {
+		return ""
+	}
+	w.Header().Add("Set-Cookie", "auth_flash=; Max-Age=0; Secure; HttpOnly; Path=/")
+	if len(f.Key) == 0 {
+		return ""
+	}
+	encPayload, encMAC, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return ""
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encMAC)
+	if err != nil || !hmac.Equal(mac, f.mac(payload)) {
+		return ""
+	}
+	var fl flash
+	err = json.Unmarshal(payload, &fl)
+	if err != nil || !time.Now().Before(fl.Expires) {
+		return ""
+	}
+	return fl.Message
+}
+
+func (f Flasher) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, f.Key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
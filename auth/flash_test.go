@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFlash(t *testing.T) {
+	f := Flasher{Key: []byte("0123456789abcdef0123456789abcdef")}
+	w := httptest.NewRecorder()
+	err := f.Set(w, "<b>hello</b>")
+	if err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	c := responseCookie(w, "auth_flash")
+	if c == nil {
+		t.Fatalf("no flash cookie set")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(c)
+	w = httptest.NewRecorder()
+	if got := f.Pop(w, r); got != "<b>hello</b>" {
+		t.Fatalf("pop: got %q", got)
+	}
+	if c := responseCookie(w, "auth_flash"); c == nil || c.MaxAge >= 0 {
+		t.Fatalf("expected pop to clear the cookie")
+	}
+
+	// Messages signed with another key are ignored.
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(c)
+	if got := (Flasher{Key: []byte("another key")}).Pop(httptest.NewRecorder(), r); got != "" {
+		t.Fatalf("forged flash: got %q", got)
+	}
+
+	// The login page shows the message after logout.
+	mux := AuthServer{Authenticator: DBAuthenticator{DB: newDB(t, "flash")}, Flash: &f}.Handler("/auth")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/auth/logout", nil))
+	r = httptest.NewRequest("GET", "/auth/login", nil)
+	r.AddCookie(responseCookie(w, "auth_flash"))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "You have been logged out.") {
+		t.Fatalf("expected flash on login page: %v", w.Body.String())
+	}
+}
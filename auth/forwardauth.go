@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Checks the request's token for a reverse proxy, e.g Traefik's ForwardAuth or nginx's auth_request, so apps behind it
+// need no Go. Responds 200 with the user in X-Auth-User if the access token cookie or bearer token is valid, and 401
+// otherwise. Each "role" in the query must also be carried by the token, or the response is 403. Requires an
+// Authenticator implementing BatchValidator, and RoleChecker for roles.
+func (a AuthServer) checkHandler(w http.ResponseWriter, r *http.Request) {
+	bv, ok := a.Authenticator.(BatchValidator)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	unauthorized := func(err error) {
+		if err != nil {
+			log.Printf("error: check: %v", err)
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, fmt.Sprintf("check: %v", ErrInvalidToken), http.StatusUnauthorized)
+	}
+	var text string
+	found := false
+	for _, source := range []TokenSource{CookieTokenSource(a.Cookies.name()), BearerTokenSource()} {
+		text, found = source(r)
+		if found {
+			break
+		}
+	}
+	if !found {
+		unauthorized(nil)
+		return
+	}
+	t, err := decodeToken(r.Context(), a.Authenticator, text)
+	if err != nil {
+		unauthorized(err)
+		return
+	}
+	res, err := bv.ValidateBatch(r.Context(), []Token{t})
+	if err != nil {
+		a.internalError(w, "check: validate", err)
+		return
+	}
+	if res[0].Err != nil {
+		unauthorized(res[0].Err)
+		return
+	}
+	for _, role := range r.URL.Query()["role"] {
+		rc, ok := a.Authenticator.(RoleChecker)
+		if !ok {
+			a.internalError(w, "check", fmt.Errorf("authenticator %T does not support roles", a.Authenticator))
+			return
+		}
+		has, err := rc.HasRole(r.Context(), t, role)
+		if errors.Is(err, ErrInvalidToken) {
+			unauthorized(err)
+			return
+		}
+		if err != nil {
+			a.internalError(w, "check: has role", err)
+			return
+		}
+		if !has {
+			http.Error(w, fmt.Sprintf("check: missing role %v", role), http.StatusForbidden)
+			return
+		}
+	}
+	w.Header().Set("X-Auth-User", res[0].UID)
+	w.WriteHeader(http.StatusOK)
+}
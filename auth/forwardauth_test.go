@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckRoute(t *testing.T) {
+	db := newDB(t, "forwardauth")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	tok, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	mux := AuthServer{Authenticator: a}.Handler("/auth")
+	check := func(target string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	cookie := http.Header{"Cookie": {"auth_token=" + tok.String()}}
+	for _, tc := range []struct {
+		name   string
+		target string
+		header http.Header
+		code   int
+	}{
+		{"no token", "/auth/check", nil, http.StatusUnauthorized},
+		{"garbage", "/auth/check", http.Header{"Authorization": {"Bearer nope"}}, http.StatusUnauthorized},
+		{"cookie", "/auth/check", cookie, http.StatusOK},
+		{"bearer", "/auth/check", http.Header{"Authorization": {"Bearer " + tok.String()}}, http.StatusOK},
+		{"missing role", "/auth/check?role=admin", cookie, http.StatusForbidden},
+	} {
+		w := check(tc.target, tc.header)
+		if w.Code != tc.code {
+			t.Fatalf("%v: expected %v, got %v: %v", tc.name, tc.code, w.Code, w.Body)
+		}
+		if user := w.Header().Get("X-Auth-User"); tc.code == http.StatusOK && user != "a@b.com" || tc.code != http.StatusOK && user != "" {
+			t.Fatalf("%v: unexpected X-Auth-User %q", tc.name, user)
+		}
+	}
+	err = GrantRole(ctx, db, "a@b.com", "admin", time.Now())
+	if err != nil {
+		t.Fatalf("grant role: %v", err)
+	}
+	if w := check("/auth/check?role=admin", cookie); w.Code != http.StatusOK {
+		t.Fatalf("expected the role to be accepted once granted, got %v", w.Code)
+	}
+	err = a.Revoke(ctx, tok)
+	if err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if w := check("/auth/check", cookie); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a revoked token to be refused, got %v", w.Code)
+	}
+}
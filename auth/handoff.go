@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Handoff lets web apps on other sites, e.g "app.example.net", share the log in of a central auth host, e.g
+// "auth.example.com". Browsers increasingly refuse third party cookies, so the apps can't read the central host's cookie.
+// Instead an app sends users without a session to the central host's handoff route with a PKCE code_challenge. Once
+// they are logged in there, which is immediate if they already were, they come back to the app's callback with a
+// single use code. The app's server exchanges the code and its verifier at the token route for a token of its own, and
+// keeps it in a cookie on its own site. AuthServer.HandoffApps lists the callbacks, and HandoffClient is the app side.
+
+// Sends a logged in user back to a HandoffApps callback with a code for the token route, or has them log in first.
+func (a AuthServer) handoffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	callback, err := url.Parse(q.Get("redirect"))
+	if err != nil || !a.handoffApp(callback) {
+		http.Error(w, "handoff: unregistered redirect", http.StatusBadRequest)
+		return
+	}
+	challenge := q.Get("code_challenge")
+	if challenge == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "handoff: code_challenge with code_challenge_method=S256 required", http.StatusBadRequest)
+		return
+	}
+	ce, ok := a.Authenticator.(CodeExchanger)
+	if !ok {
+		a.internalError(w, "handoff", fmt.Errorf("authenticator %T does not support code exchange", a.Authenticator))
+		return
+	}
+	login := a.link(RouteLogin, url.Values{"redirect": {r.URL.RequestURI()}}.Encode())
+	t, err := a.sessionToken(r)
+	if err != nil {
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+	code, err := ce.IssueCode(r.Context(), t, challenge)
+	if errors.Is(err, ErrInvalidToken) {
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+	if err != nil {
+		a.internalError(w, "handoff: issue code", err)
+		return
+	}
+	cq := callback.Query()
+	cq.Set("code", code.String())
+	callback.RawQuery = cq.Encode()
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+// Reports whether u, ignoring its query, is one of the HandoffApps.
+func (a AuthServer) handoffApp(u *url.URL) bool {
+	if u.Scheme != "https" && u.Scheme != "http" || u.User != nil {
+		return false
+	}
+	callback := *u
+	callback.RawQuery = ""
+	callback.Fragment = ""
+	for _, app := range a.HandoffApps {
+		if callback.String() == app {
+			return true
+		}
+	}
+	return false
+}
+
+// The app side of a handoff from a central auth host. Serve it at the CallbackURL's path, and point the app's
+// AuthFilter.LoginURL at the same path: users arriving with a redirect are sent to the central host, and users coming
+// back with a code get a session cookie on the app's own site, then are sent on to their redirect.
+type HandoffClient struct {
+	// The central host's handoff and token routes, e.g "https://auth.example.com/auth/handoff" and
+	// "https://auth.example.com/auth/token".
+	HandoffURL string
+	TokenURL   string
+	// The full URL this client is served at, as listed in the central host's AuthServer.HandoffApps, e.g
+	// "https://app.example.net/auth/callback".
+	CallbackURL string
+	// How the app's own token cookie is named and set. The app's AuthFilter.Cookies must match.
+	Cookies CookieOptions
+	// Exchanges codes. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+const handoffCookie = "auth_handoff"
+
+func (c HandoffClient) client() *http.Client {
+	if c.Client == nil {
+		return http.DefaultClient
+	}
+	return c.Client
+}
+
+func (c HandoffClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("code") != "" {
+		c.finish(w, r)
+		return
+	}
+	c.start(w, r)
+}
+
+// Sends the user to the central host, remembering the PKCE verifier and where they were going in a short lived cookie,
+// which ties the code they come back with to this browser.
+func (c HandoffClient) start(w http.ResponseWriter, r *http.Request) {
+	verifier, err := newToken()
+	if err != nil {
+		log.Printf("error: start handoff: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	next := r.URL.Query().Get("redirect")
+	if !localPath(next) {
+		next = "/"
+	}
+	http.SetCookie(w, &http.Cookie{Name: handoffCookie, Value: verifier.String() + "." + base64.RawURLEncoding.EncodeToString([]byte(next)),
+		Path: r.URL.Path, MaxAge: 600, Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	q := url.Values{
+		"redirect":              {c.CallbackURL},
+		"code_challenge":        {CodeChallenge(verifier.String())},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, c.HandoffURL+"?"+q.Encode(), http.StatusFound)
+}
+
+// Exchanges the code from the central host for the app's own token.
+func (c HandoffClient) finish(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(handoffCookie)
+	var verifier, next string
+	if err == nil {
+		var rawNext string
+		verifier, rawNext, _ = strings.Cut(cookie.Value, ".")
+		b, derr := base64.RawURLEncoding.DecodeString(rawNext)
+		next, err = string(b), derr
+	}
+	if err != nil || verifier == "" || !localPath(next) {
+		http.Error(w, "handoff: unknown or expired log in attempt, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: handoffCookie, Path: r.URL.Path, MaxAge: -1, Secure: true, HttpOnly: true,
+		SameSite: http.SameSiteLaxMode})
+	body, err := json.Marshal(map[string]string{"code": r.URL.Query().Get("code"), "code_verifier": verifier})
+	if err != nil {
+		log.Printf("error: handoff: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "POST", c.TokenURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("error: handoff: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client().Do(req)
+	if err != nil {
+		log.Printf("error: handoff: exchange code: %v", err)
+		http.Error(w, "handoff: auth server unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		http.Error(w, fmt.Sprintf("handoff: %v", ErrInvalidAuthCode), http.StatusBadRequest)
+		return
+	}
+	var session struct {
+		Token   string `json:"token"`
+		Expires int64  `json:"expires"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(&session)
+		if err == nil && session.Token == "" {
+			err = errors.New("no token")
+		}
+	} else {
+		err = fmt.Errorf("status %v", resp.Status)
+	}
+	if err != nil {
+		log.Printf("error: handoff: exchange code: %v", err)
+		http.Error(w, "handoff: auth server unavailable", http.StatusBadGateway)
+		return
+	}
+	c.Cookies.setToken(w, session.Token, time.Unix(session.Expires, 0), false)
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// Reports whether a redirect is a path on this site, e.g "/settings" but not "//evil.com" or "/\evil.com".
+func localPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.Contains(p, "\\")
+}
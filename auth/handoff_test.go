@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandoff(t *testing.T) {
+	db := newDB(t, "handoff")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	central := AuthServer{Authenticator: a, HandoffApps: []string{"https://app.example.net/auth/callback"}}.Handler("/auth")
+	srv := httptest.NewServer(central)
+	defer srv.Close()
+	app := HandoffClient{
+		HandoffURL:  srv.URL + "/auth/handoff",
+		TokenURL:    srv.URL + "/auth/token",
+		CallbackURL: "https://app.example.net/auth/callback",
+		Client:      srv.Client(),
+	}
+	do := func(h http.Handler, r *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	// Follows a redirect to the central host through its mux, rather than the network.
+	path := func(location string) string {
+		u, err := url.Parse(location)
+		if err != nil {
+			t.Fatalf("parse location: %v", err)
+		}
+		return u.RequestURI()
+	}
+	start := func() (string, *http.Cookie) {
+		w := do(app, httptest.NewRequest("GET", "https://app.example.net/auth/callback?redirect=%2Fdashboard", nil))
+		c := responseCookie(w, "auth_handoff")
+		if w.Code != http.StatusFound || c == nil || !strings.HasPrefix(w.Header().Get("Location"), app.HandoffURL+"?") {
+			t.Fatalf("start: expected a redirect to the central host, got %v %v", w.Code, w.Header())
+		}
+		return path(w.Header().Get("Location")), c
+	}
+
+	handoff, verifier := start()
+	w := do(central, httptest.NewRequest("GET", handoff, nil))
+	login := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(login, "/auth/login?") {
+		t.Fatalf("logged out: expected a redirect to log in, got %v %v", w.Code, login)
+	}
+	form := url.Values{"email": {"a@b.com"}, "password": {"pw"}}
+	r := httptest.NewRequest("POST", login, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = do(central, r)
+	session := responseCookie(w, "auth_token")
+	if w.Code != http.StatusFound || session == nil || w.Header().Get("Location") != handoff {
+		t.Fatalf("log in: expected a redirect back to the handoff, got %v %v", w.Code, w.Header())
+	}
+	w = do(central, httptest.NewRequest("GET", handoff, nil), session)
+	callback := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(callback, app.CallbackURL+"?code=") {
+		t.Fatalf("logged in: expected a redirect to the app with a code, got %v %v", w.Code, callback)
+	}
+
+	_, stranger := start()
+	if w := do(app, httptest.NewRequest("GET", callback, nil), stranger); w.Code != http.StatusBadRequest {
+		t.Fatalf("another browser's attempt should not exchange the code, got %v", w.Code)
+	}
+	handoff, verifier = start()
+	w = do(central, httptest.NewRequest("GET", handoff, nil), session)
+	callback = w.Header().Get("Location")
+	w = do(app, httptest.NewRequest("GET", callback, nil), verifier)
+	token := responseCookie(w, "auth_token")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/dashboard" || token == nil || token.Value == session.Value {
+		t.Fatalf("callback: expected a new session on the app, got %v %v", w.Code, w.Header())
+	}
+	var tok Token
+	if err := tok.UnmarshalText([]byte(token.Value)); err != nil || a.Validate(ctx, tok) != nil {
+		t.Fatalf("app token should be valid: %v", err)
+	}
+	if w := do(app, httptest.NewRequest("GET", callback, nil), verifier); w.Code != http.StatusBadRequest {
+		t.Fatalf("codes should be single use, got %v", w.Code)
+	}
+
+	for _, q := range []string{
+		url.Values{"redirect": {"https://evil.example.net/auth/callback"}, "code_challenge": {"x"}, "code_challenge_method": {"S256"}}.Encode(),
+		url.Values{"redirect": {app.CallbackURL}}.Encode(),
+	} {
+		if w := do(central, httptest.NewRequest("GET", "/auth/handoff?"+q, nil), session); w.Code != http.StatusBadRequest {
+			t.Fatalf("%v: expected 400, got %v", q, w.Code)
+		}
+	}
+}
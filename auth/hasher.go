@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hashes and checks passwords. Hashes must be self describing, recording their algorithm and parameters, so hashes from
+// different hashers or settings can be stored side by side. The USER.BCRYPT column holds them all, despite its name.
+type Hasher interface {
+	// Hashes a password with a fresh salt.
+	Hash(password string) ([]byte, error)
+	// Checks a password against a hash this hasher owns, whatever its parameters. Returns ErrBadCredentials if the
+	// password is wrong.
+	Compare(hash []byte, password string) error
+	// Reports whether the hash is in this hasher's format.
+	Owns(hash []byte) bool
+	// Reports whether a hash this hasher owns was made with other parameters than it uses now, and should be replaced.
+	Outdated(hash []byte) bool
+}
+
+// Hashers which can check passwords whichever hasher is configured, so switching algorithms doesn't lock anyone out.
+var builtinHashers = []Hasher{BcryptHasher{}, Argon2idHasher{}}
+
+// Implemented by Stores which can replace a user's password hash, letting DBAuthenticator upgrade hashes at log in.
+type HashReplacer interface {
+	// Sets the user's hash to new, unless it is no longer old, e.g because the password changed meanwhile.
+	ReplaceHash(ctx context.Context, uid string, old, new []byte) error
+}
+
+// Hashes passwords with bcrypt.
+type BcryptHasher struct {
+	// Defaults to bcrypt.DefaultCost. See CalibrateCost.
+	Cost int
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+func (h BcryptHasher) Hash(password string) ([]byte, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost())
+	if err != nil {
+		return nil, fmt.Errorf("hash pw: %w", err)
+	}
+	return hash, nil
+}
+
+func (h BcryptHasher) Compare(hash []byte, password string) error {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrBadCredentials
+	}
+	if err != nil {
+		return fmt.Errorf("compare password to hash: %w", err)
+	}
+	return nil
+}
+
+func (h BcryptHasher) Owns(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2"))
+}
+
+func (h BcryptHasher) Outdated(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.cost()
+}
+
+// Hashes passwords with Argon2id, in the PHC string format, e.g "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>". The
+// defaults follow RFC 9106's recommendation for memory constrained servers.
+type Argon2idHasher struct {
+	// Passes over memory. Defaults to 3.
+	Time uint32
+	// Memory used, in KiB. Defaults to 64 MiB.
+	Memory uint32
+	// Defaults to 4.
+	Threads uint8
+}
+
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+func (h Argon2idHasher) params() argon2Params {
+	p := argon2Params{time: h.Time, memory: h.Memory, threads: h.Threads}
+	if p.time == 0 {
+		p.time = 3
+	}
+	if p.memory == 0 {
+		p.memory = 64 * 1024
+	}
+	if p.threads == 0 {
+		p.threads = 4
+	}
+	return p
+}
+
+const argon2KeyLen = 32
+
+// Bounds on the parameters of hashes Compare will check, so a hash from elsewhere, e.g an Import, can't make it panic
+// with no threads or exhaust memory. The maximums are well beyond RFC 9106's recommendations.
+const (
+	maxArgon2Time   = 32
+	maxArgon2Memory = 4 * 1024 * 1024
+	minArgon2Salt   = 8
+	minArgon2Key    = 16
+	maxArgon2Key    = 64
+)
+
+// Returns an error if the parameters are out of bounds.
+func (p argon2Params) check() error {
+	switch {
+	case p.time < 1 || p.time > maxArgon2Time:
+		return fmt.Errorf("argon2 time %v is out of bounds, must be from 1 to %v", p.time, maxArgon2Time)
+	case p.threads < 1:
+		return fmt.Errorf("argon2 threads must be at least 1")
+	case p.memory < 8*uint32(p.threads) || p.memory > maxArgon2Memory:
+		return fmt.Errorf("argon2 memory %v KiB is out of bounds, must be from %v to %v", p.memory, 8*uint32(p.threads), maxArgon2Memory)
+	}
+	return nil
+}
+
+func (h Argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("read random: %w", err)
+	}
+	p := h.params()
+	err = p.check()
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, argon2KeyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%v$%v", argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// Splits a hash into its parameters, salt and key.
+func parseArgon2id(hash []byte) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version '%v'", parts[2])
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("parse argon2 parameters: %w", err)
+	}
+	err = p.check()
+	if err != nil {
+		return p, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("decode salt: %w", err)
+	}
+	if len(salt) < minArgon2Salt {
+		return p, nil, nil, fmt.Errorf("argon2 salt is %v bytes, must be at least %v", len(salt), minArgon2Salt)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("decode key: %w", err)
+	}
+	// An empty key would match every password.
+	if len(key) < minArgon2Key || len(key) > maxArgon2Key {
+		return p, nil, nil, fmt.Errorf("argon2 key is %v bytes, must be from %v to %v", len(key), minArgon2Key, maxArgon2Key)
+	}
+	return p, salt, key, nil
+}
+
+func (h Argon2idHasher) Compare(hash []byte, password string) error {
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	given := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(given, key) != 1 {
+		return ErrBadCredentials
+	}
+	return nil
+}
+
+func (h Argon2idHasher) Owns(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$argon2id$"))
+}
+
+func (h Argon2idHasher) Outdated(hash []byte) bool {
+	p, _, key, err := parseArgon2id(hash)
+	return err != nil || p != h.params() || len(key) != argon2KeyLen
+}
+
+// Stored in place of a hash for users without a password, e.g because they log in with SSO. It matches no password.
+var noPassword = []byte("!")
+
+// Checks the password against a user's hash, using h or whichever builtin hasher owns the hash. An empty hash means there
+// is no such user, and noPassword that the user has none: the password is hashed anyway, so timing doesn't reveal which
+// emails are registered. Returns ErrBadCredentials if the password is wrong, or if no hasher recognizes the hash, e.g
+// because it was peppered with another pepper, which is logged.
+func comparePassword(h Hasher, hash []byte, password string) error {
+	if len(hash) == 0 || bytes.Equal(hash, noPassword) {
+		_, err := h.Hash(password)
+		if err != nil {
+			return err
+		}
+		return ErrBadCredentials
+	}
+	if h.Owns(hash) {
+		return h.Compare(hash, password)
+	}
+	for _, b := range builtinHashers {
+		if b.Owns(hash) {
+			return b.Compare(hash, password)
+		}
+	}
+	log.Printf("warning: no hasher recognizes password hash %q, is the pepper or hasher misconfigured?", hashScheme(hash))
+	_, err := h.Hash(password)
+	if err != nil {
+		return err
+	}
+	return ErrBadCredentials
+}
+
+// Returns the leading fields of a hash naming its algorithm, e.g "$pepper$1a2b3c4d", without the salt or key.
+func hashScheme(hash []byte) string {
+	fields := strings.SplitN(string(hash), "$", 4)
+	if len(fields) < 3 || fields[0] != "" {
+		return "unknown"
+	}
+	return "$" + fields[1] + "$" + fields[2]
+}
+
+// Replaces a hash made by another algorithm, or other parameters, with one from h, after the password was checked.
+// Failures are logged rather than returned, since the log in itself succeeded.
+func rehash(ctx context.Context, store Store, h Hasher, uid string, old []byte, password string) {
+	if h.Owns(old) && !h.Outdated(old) {
+		return
+	}
+	r, ok := store.(HashReplacer)
+	if !ok {
+		return
+	}
+	hash, err := h.Hash(password)
+	if err == nil {
+		err = r.ReplaceHash(ctx, uid, old, hash)
+	}
+	if err != nil {
+		log.Printf("error: rehashing password of %v: %v", uid, err)
+	}
+}
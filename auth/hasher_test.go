@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashers(t *testing.T) {
+	for _, h := range []Hasher{BcryptHasher{Cost: bcrypt.MinCost}, Argon2idHasher{Time: 1, Memory: 1024, Threads: 1}} {
+		hash, err := h.Hash("pw")
+		if err != nil {
+			t.Fatalf("%T: hash: %v", h, err)
+		}
+		if !h.Owns(hash) || h.Outdated(hash) {
+			t.Fatalf("%T: expected to own a current hash, got %s", h, hash)
+		}
+		if err = h.Compare(hash, "pw"); err != nil {
+			t.Fatalf("%T: compare: %v", h, err)
+		}
+		if err = h.Compare(hash, "wrong"); !errors.Is(err, ErrBadCredentials) {
+			t.Fatalf("%T: expected bad credentials, got %v", h, err)
+		}
+		again, _ := h.Hash("pw")
+		if bytes.Equal(hash, again) {
+			t.Fatalf("%T: expected a fresh salt per hash", h)
+		}
+	}
+	hash, _ := Argon2idHasher{Time: 1, Memory: 1024, Threads: 1}.Hash("pw")
+	if !(Argon2idHasher{}).Outdated(hash) || (BcryptHasher{}).Owns(hash) {
+		t.Fatalf("expected other parameters to be outdated, and other algorithms not to own it")
+	}
+
+	// Hashes from elsewhere, e.g an Import, with parameters which would panic or exhaust memory are refused.
+	salt, key := "c2FsdHNhbHRzYWx0", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"
+	for _, bad := range []string{
+		"$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$",
+	} {
+		err := (Argon2idHasher{}).Compare([]byte(bad), "pw")
+		if err == nil || errors.Is(err, ErrBadCredentials) {
+			t.Fatalf("%v: expected the parameters to be refused, got %v", bad, err)
+		}
+	}
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	db := newDB(t, "rehash")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "a@b.com", "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	a := DBAuthenticator{DB: db, Hasher: Argon2idHasher{Time: 1, Memory: 1024, Threads: 1}}
+	if _, _, err = a.Authenticate(ctx, "a@b.com", "wrong"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("expected bad credentials, got %v", err)
+	}
+	_, old, _ := a.store().UserHash(ctx, "a@b.com")
+	if !(BcryptHasher{}).Owns(old) {
+		t.Fatalf("expected a failed log in to leave the bcrypt hash, got %s", old)
+	}
+	if _, _, err = a.Authenticate(ctx, "a@b.com", "pw"); err != nil {
+		t.Fatalf("authenticate with bcrypt hash: %v", err)
+	}
+	_, hash, _ := a.store().UserHash(ctx, "a@b.com")
+	if !a.Hasher.Owns(hash) {
+		t.Fatalf("expected the hash to be upgraded to argon2id, got %s", hash)
+	}
+	if _, _, err = a.Authenticate(ctx, "a@b.com", "pw"); err != nil {
+		t.Fatalf("authenticate with argon2id hash: %v", err)
+	}
+
+	// Switching back still accepts the argon2id hash, and downgrades it.
+	a.Hasher = nil
+	if err = Authenticate(ctx, db, "a@b.com", "pw"); err != nil {
+		t.Fatalf("package authenticate with argon2id hash: %v", err)
+	}
+	if _, _, err = a.Authenticate(ctx, "a@b.com", "pw"); err != nil {
+		t.Fatalf("authenticate after switching back: %v", err)
+	}
+	_, hash, _ = a.store().UserHash(ctx, "a@b.com")
+	if !(BcryptHasher{}).Owns(hash) {
+		t.Fatalf("expected a bcrypt hash, got %s", hash)
+	}
+}
+
+func TestPepperedHasher(t *testing.T) {
+	db := newDB(t, "pepper")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "a@b.com", "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	peppered := PepperedHasher{Hasher: BcryptHasher{Cost: bcrypt.MinCost}, Pepper: bytes.Repeat([]byte("k"), 32)}
+	a := DBAuthenticator{DB: db, Hasher: peppered}
+	if _, _, err = a.Authenticate(ctx, "a@b.com", "pw"); err != nil {
+		t.Fatalf("authenticate with unpeppered hash: %v", err)
+	}
+	_, hash, _ := a.store().UserHash(ctx, "a@b.com")
+	if !peppered.Owns(hash) || peppered.Outdated(hash) {
+		t.Fatalf("expected a current peppered hash, got %s", hash)
+	}
+	if _, err = bcrypt.Cost(bytes.TrimPrefix(hash, peppered.prefix())); err != nil {
+		t.Fatalf("expected a bcrypt hash inside, got %s: %v", hash, err)
+	}
+	if _, _, err = a.Authenticate(ctx, "a@b.com", "wrong"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("expected bad credentials, got %v", err)
+	}
+	if _, _, err = a.Authenticate(ctx, "a@b.com", "pw"); err != nil {
+		t.Fatalf("authenticate with peppered hash: %v", err)
+	}
+	// The hash is useless without the pepper.
+	if err = Authenticate(ctx, db, "a@b.com", "pw"); err == nil {
+		t.Fatalf("expected the peppered hash to be unusable without the pepper")
+	}
+	if err = AuthenticateWith(ctx, db, PasswordOptions{Hasher: peppered}, "a@b.com", "pw"); err != nil {
+		t.Fatalf("package authenticate with the pepper: %v", err)
+	}
+	other := PepperedHasher{Hasher: peppered.Hasher, Pepper: bytes.Repeat([]byte("j"), 32)}
+	if other.Owns(hash) {
+		t.Fatalf("expected another pepper not to own the hash")
+	}
+	a.Hasher = other
+	if _, _, err = a.Authenticate(ctx, "a@b.com", "pw"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("another pepper: expected bad credentials, got %v", err)
+	}
+	if err = comparePassword(BcryptHasher{}, []byte("not a hash"), "pw"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("unrecognized hash: expected bad credentials, got %v", err)
+	}
+	a.Hasher = peppered
+
+	// Raising the cost upgrades the hash inside the pepper.
+	a.Hasher = PepperedHasher{Hasher: BcryptHasher{Cost: bcrypt.MinCost + 1}, Pepper: peppered.Pepper}
+	if !a.Hasher.Outdated(hash) {
+		t.Fatalf("expected the lower cost hash to be outdated")
+	}
+	if _, _, err = a.Authenticate(ctx, "a@b.com", "pw"); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	_, hash, _ = a.store().UserHash(ctx, "a@b.com")
+	if cost, _ := bcrypt.Cost(bytes.TrimPrefix(hash, peppered.prefix())); cost != bcrypt.MinCost+1 {
+		t.Fatalf("expected cost %v, got %v", bcrypt.MinCost+1, cost)
+	}
+}
+
+func TestConfiguredHasherEverywhere(t *testing.T) {
+	db := newDB(t, "configuredhasher")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db, Hasher: Argon2idHasher{Time: 1, Memory: 1024, Threads: 1}}
+	code, err := a.BeginRegister(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("begin register: %v", err)
+	}
+	if err = a.CompleteRegister(ctx, code); err != nil {
+		t.Fatalf("complete register: %v", err)
+	}
+	_, hash, _ := a.store().UserHash(ctx, "a@b.com")
+	if !a.Hasher.Owns(hash) {
+		t.Fatalf("expected a sign up to be hashed with argon2id, got %s", hash)
+	}
+
+	a.Hasher = PepperedHasher{Hasher: BcryptHasher{Cost: bcrypt.MinCost}, Pepper: bytes.Repeat([]byte("k"), 32)}
+	code, err = a.BeginPasswordReset(ctx, "a@b.com")
+	if err != nil {
+		t.Fatalf("begin reset: %v", err)
+	}
+	if err = a.CompletePasswordReset(ctx, code, "pw2"); err != nil {
+		t.Fatalf("complete reset: %v", err)
+	}
+	_, hash, _ = a.store().UserHash(ctx, "a@b.com")
+	if !a.Hasher.Owns(hash) {
+		t.Fatalf("expected a reset password to be peppered, got %s", hash)
+	}
+	if _, _, err = a.Authenticate(ctx, "a@b.com", "pw2"); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+}
@@ -2,11 +2,15 @@ package auth
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,70 +27,588 @@ type Validator interface {
 	Validate(context.Context, Token) error
 }
 
+type BatchValidator interface {
+	// Validates each of the given tokens, returning one result per token in the same order. The returned error is only set
+	// if the tokens could not be checked at all.
+	ValidateBatch(context.Context, []Token) ([]Result, error)
+}
+
+// The outcome of validating a single token in a batch.
+type Result struct {
+	// The user the token belongs to, if valid.
+	UID string
+	// Nil if the token is valid.
+	Err error
+}
+
+// An Authenticator which can hold new accounts until their email address is verified.
+type SignupVerifier interface {
+	// Stores a sign up awaiting verification, and returns the code to email to the address.
+	BeginRegister(ctx context.Context, email, password string) (Token, error)
+	// Creates the account for a pending sign up.
+	CompleteRegister(ctx context.Context, code Token) error
+}
+
+// An Authenticator which can invalidate tokens before they expire, e.g on log out.
+type Revoker interface {
+	Revoke(ctx context.Context, t Token) error
+}
+
+// An Authenticator which can reset forgotten passwords.
+type PasswordResetter interface {
+	// Stores a password reset for the account with the given email, and returns the code to email to it. Returns
+	// ErrBadCredentials if there is no such account.
+	BeginPasswordReset(ctx context.Context, email string) (Token, error)
+	// Sets a new password for the account a reset code was issued to.
+	CompletePasswordReset(ctx context.Context, code Token, password string) error
+}
+
+// An Authenticator which issues long lived refresh tokens, so sessions can be extended without logging in again.
+type Refresher interface {
+	// Issues a refresh token for the user of the given access token, returning it and its expiry.
+	IssueRefresh(ctx context.Context, access Token) (Token, time.Time, error)
+	// Spends a refresh token, returning a new access token and refresh token. Returns ErrInvalidToken if it can't be used.
+	Refresh(ctx context.Context, refresh Token) (Session, error)
+	// Deletes a refresh token, e.g on log out.
+	RevokeRefresh(ctx context.Context, refresh Token) error
+	// Returns when a valid access token expires.
+	Expiry(ctx context.Context, access Token) (time.Time, error)
+}
+
+// Finds the token in a request, returning false if it isn't there.
+type TokenSource func(r *http.Request) (string, bool)
+
+// Reads the token from the named cookie.
+func CookieTokenSource(name string) TokenSource {
+	return func(r *http.Request) (string, bool) {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return "", false
+		}
+		return c.Value, true
+	}
+}
+
+// Reads the token from an "Authorization: Bearer <token>" header, for API clients which can't use cookies.
+func BearerTokenSource() TokenSource {
+	return func(r *http.Request) (string, bool) {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return "", false
+		}
+		return strings.TrimSpace(token), true
+	}
+}
+
 type AuthFilter struct {
 	Validator
+	// Where to look for the token, in order. The first source to find one is used. Defaults to the access token cookie,
+	// then the Authorization header.
+	TokenSources []TokenSource
+	// How the token cookies are named and set. Must match AuthServer.Cookies. Unless the request carries an
+	// Authorization header, unsafe requests must come from this host or a trusted host sharing the cookies, and with
+	// Cookies.Domain the request's host must be Domain or one of Cookies.Subdomains.
+	Cookies CookieOptions
 	// Where to redirect if validation fails
 	LoginURL string
+	// If set, limits how often each user may call each route.
+	RateLimiter *RateLimiter
+	// If set, how long validation may take before giving up with a 503, so a slow store doesn't make every protected
+	// endpoint slow.
+	ValidateTimeout time.Duration
+	// If set, an expired or missing access token is replaced using the refresh token cookie instead of redirecting to log
+	// in.
+	Refresher Refresher
+	// If set with Refresher, access tokens are also replaced when they expire within this long, so sessions slide
+	// forward while in use. Costs an extra lookup per request.
+	RefreshWithin time.Duration
+	// If set, tells users their session expired when an invalid token sends them to log in.
+	Flash *Flasher
+	// If set, requests other than GET which are redirected to log in are saved, and handed back when the user returns
+	// to the same URL logged in, for the handler to fill its form in again. See Resumed.
+	Stash RequestStash
+	// The largest body to stash, defaults to 64KiB. Larger requests are lost on redirect.
+	MaxStashBody int64
+	// Checks the roles demanded with RequireRole. Defaults to the Validator, if it is a RoleChecker.
+	Roles RoleChecker
+	// Finds who tokens belong to for UserHandler and RateLimiter. Defaults to the Validator, if it is a BatchValidator.
+	Users BatchValidator
+	// Finds each request's tenant and locale before the token is validated, for the Validator and handler to find in
+	// its context.
+	Resolvers Resolvers
+	// If set, tokens are refused when presented by a different client than they were issued to, and aren't replaced
+	// with the refresh token, which may have been stolen with them. Refresh tokens are refused from other clients too.
+	Binding *TokenBinding
+
+	// Roles every token must carry, set by RequireRole.
+	requiredRoles []string
 }
 
+// Returned by validateRequest when the request carries no token.
+var errNoToken = errors.New("no token in request")
+
 // Wraps an existing handler to require a valid token as an argument to the handler. If there is no token, or an invalid token, set
-// in the request, redirects to the login page and does not execute the handler function.
+// in the request, redirects to the login page and does not execute the handler function. Requests with an Authorization
+// header get a 401 instead.
 func (a AuthFilter) Handler(h func(Token, http.ResponseWriter, *http.Request)) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return a.handle(func(u User, w http.ResponseWriter, r *http.Request) {
+		h(u.Token, w, r)
+	})
+}
+
+// Like Handler, passing the handler the token's user as far as validation found it out: the ID is empty unless the
+// Validator is a UserValidator, or the token was refreshed.
+func (a AuthFilter) handle(h func(User, http.ResponseWriter, *http.Request)) http.Handler {
+	return a.Resolvers.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		redirectURL := fmt.Sprintf("%v?redirect=%v", a.LoginURL, url.QueryEscape(r.URL.String()))
-		c, err := r.Cookie("auth_token")
-		if err != nil {
-			log.Printf("error: redirecting: reading auth_token cookie: %v", err)
-			http.Redirect(w, r, redirectURL, http.StatusFound)
+		ctx := r.Context()
+		if a.ValidateTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, a.ValidateTimeout)
+			defer cancel()
+		}
+		u, err := a.validateRequest(ctx, r)
+		if err == nil && a.Binding != nil {
+			err = a.checkBinding(ctx, r, u.Token)
+		}
+		if errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil || errors.Is(err, ErrCircuitOpen) {
+			log.Printf("error: validation unavailable: %v", err)
+			http.Error(w, "authentication unavailable", http.StatusServiceUnavailable)
 			return
 		}
-		var t Token
-		err = t.UnmarshalText([]byte(c.Value))
-		if err != nil {
-			log.Printf("error: redirecting: parsing auth_token cookie: %v", err)
-			http.Redirect(w, r, redirectURL, http.StatusFound)
+		// API clients sending a header can't follow a login redirect or store refreshed cookies.
+		api := r.Header.Get("Authorization") != ""
+		if !api && a.Cookies.Domain != "" && !a.Cookies.trustedHost(hostname(r.Host)) {
+			http.Error(w, fmt.Sprintf("%v may not use the session", hostname(r.Host)), http.StatusForbidden)
+			return
+		}
+		if !api && !a.Cookies.sameOrigin(r) {
+			http.Error(w, "cross origin request refused", http.StatusForbidden)
+			return
+		}
+		refreshed := false
+		if err != nil && a.Refresher != nil && !api && !errors.Is(err, ErrClientMismatch) {
+			if nt, rerr := a.refresh(ctx, w, r); rerr == nil {
+				u, err, refreshed = User{Token: nt}, nil, true
+			}
+		}
+		if err != nil && api {
+			log.Printf("error: rejecting: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, fmt.Sprintf("authenticate: %v", ErrInvalidToken), http.StatusUnauthorized)
 			return
 		}
-		err = a.Validate(r.Context(), t)
 		if err != nil {
-			log.Printf("error: redirecting: invalid auth_token cookie: %v", err)
+			log.Printf("error: redirecting: %v", err)
+			if a.Flash != nil && !errors.Is(err, errNoToken) {
+				a.Flash.Set(w, "Your session has expired, please log in again.")
+			}
+			if a.Stash != nil && r.Method != "GET" && r.Method != "HEAD" {
+				a.stashRequest(w, r)
+			}
 			http.Redirect(w, r, redirectURL, http.StatusFound)
 			return
 		}
+		if !refreshed && !api && a.Refresher != nil && a.RefreshWithin > 0 {
+			expires, err := a.Refresher.Expiry(ctx, u.Token)
+			if err == nil && time.Until(expires) < a.RefreshWithin {
+				if nt, err := a.refresh(ctx, w, r); err == nil {
+					u = User{ID: u.ID, Token: nt, Roles: u.Roles}
+				}
+			}
+		}
+		if !a.checkRoles(ctx, w, u) {
+			return
+		}
+		if a.RateLimiter != nil && !a.rateLimit(ctx, w, r, u) {
+			return
+		}
+		if a.Stash != nil && !api {
+			r = a.resumeRequest(w, r)
+		}
 		// success, call backing function
-		h(t, w, r)
+		h(u, w, r)
+	}))
+}
+
+// Like Handler, for middleware chains and frameworks built on net/http: the wrapped handler finds the token with
+// TokenFromContext.
+func (a AuthFilter) Middleware(next http.Handler) http.Handler {
+	return a.Handler(func(t Token, w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithToken(r.Context(), t)))
 	})
 }
 
+// Finds and validates the request's token, returning its user if the Validator reports them.
+func (a AuthFilter) validateRequest(ctx context.Context, r *http.Request) (User, error) {
+	var t Token
+	sources := a.TokenSources
+	if sources == nil {
+		sources = []TokenSource{CookieTokenSource(a.Cookies.name()), BearerTokenSource()}
+	}
+	var text string
+	found := false
+	for _, source := range sources {
+		text, found = source(r)
+		if found {
+			break
+		}
+	}
+	if !found {
+		return User{}, errNoToken
+	}
+	if tv, ok := a.Validator.(TextValidator); ok {
+		u, err := tv.ValidateText(ctx, text)
+		if err != nil {
+			return u, fmt.Errorf("invalid token: %w", err)
+		}
+		return u, nil
+	}
+	t, err := decodeToken(ctx, a.Validator, text)
+	if err != nil {
+		return User{Token: t}, fmt.Errorf("parsing token: %w", err)
+	}
+	u, err := validateUser(ctx, a.Validator, t)
+	if err != nil {
+		return User{Token: t}, fmt.Errorf("invalid token: %w", err)
+	}
+	return u, nil
+}
+
+// Replaces the session using the refresh token cookie, returning the new access token.
+func (a AuthFilter) refresh(ctx context.Context, w http.ResponseWriter, r *http.Request) (Token, error) {
+	c, err := r.Cookie(a.Cookies.refreshName())
+	if err != nil {
+		return Token{}, err
+	}
+	var refresh Token
+	err = refresh.UnmarshalText([]byte(c.Value))
+	if err != nil {
+		return Token{}, err
+	}
+	if a.Binding != nil {
+		err = a.Binding.checkRefresh(ctx, r, refresh, a.Refresher)
+		if err != nil {
+			log.Printf("error: refresh session: %v", err)
+			return Token{}, err
+		}
+	}
+	s, err := a.Refresher.Refresh(withClient(ctx, r), refresh)
+	if err != nil {
+		log.Printf("error: refresh session: %v", err)
+		return Token{}, err
+	}
+	access, err := encodeToken(ctx, a.Refresher, s.Access)
+	if err != nil {
+		log.Printf("error: refresh session: encode token: %v", err)
+		return Token{}, err
+	}
+	a.Cookies.setSession(w, access, s)
+	return s.Access, nil
+}
+
 // An auth server which handles login attempts and rendering the login page. This server provides handlers for a login page and a
 // create user page, and supports redirects.
 type AuthServer struct {
 	Authenticator
+	// Include internal error details in responses. Useful in development, but leaks implementation details, so leave this
+	// off in production. Details are always logged.
+	Debug bool
+	// Turn off public sign up, for internal tools where accounts are only created by administrators. The sign up page
+	// responds 404 and is not linked to. Users can still be created with Register or RegisterUser.
+	DisableSignup bool
+	// Require sign ups to prove they own their email address before the account is created. Requires Mailer, BaseURL, and
+	// an Authenticator implementing SignupVerifier.
+	VerifySignups bool
+	// Sends emails to users.
+	Mailer Mailer
+	// The public URL of the server, e.g "https://example.com", used to build links in emails. This must be configured
+	// rather than taken from the request, since the Host header is attacker controlled.
+	BaseURL string
+	// Also issue a refresh token at login, so the session can be extended at the refresh route or by AuthFilter.Refresher.
+	// Requires an Authenticator implementing Refresher.
+	IssueRefreshTokens bool
+	// If set, the refresh route refuses refresh tokens presented by a different client than they were issued to, as
+	// AuthFilter.Binding does.
+	Binding *TokenBinding
+	// If set, pages show a message after redirects, e.g once a password has been changed.
+	Flash *Flasher
+	// If set, called with each token revoked by logging out, e.g CachedValidator.Invalidate.
+	OnRevoke func(Token)
+	// Callback URLs of native apps which log in through the system browser, e.g "myapp://callback". Apps can't read the
+	// browser's cookies, so logging in with one as the redirect passes the token in its query instead. Only exact matches
+	// are followed, and redirects to other schemes besides http and https are refused. Another app may claim the same
+	// scheme, so prefer verified https app links where the platform supports them.
+	AppRedirects []string
+	// Hosts besides this one which the log in page may send users on to, e.g "app.example.com". A leading dot allows
+	// subdomains too, e.g ".example.com". Other redirects to absolute URLs go home instead, so the log in page can't be
+	// used to lend credibility to a phishing site.
+	RedirectHosts []string
+	// Callback URLs of web apps on other sites which share this host's log in, e.g
+	// "https://app.example.net/auth/callback", see HandoffClient. Only exact matches, ignoring the query, are followed.
+	// Requires an Authenticator implementing CodeExchanger.
+	HandoffApps []string
+	// Refuse app redirects without a PKCE code_challenge. With one, apps get a single use code in place of the token,
+	// which only they can exchange at the token route. Requires an Authenticator implementing CodeExchanger.
+	RequirePKCE bool
+	// If set, limits how many log ins, sign ups and password resets are processed at once, since each hashes a password.
+	Admission *AdmissionLimiter
+	// If set, records the availability and latency of every route against its objectives.
+	SLO *SLOTracker
+	// If set, every route is traced with OpenTelemetry, continuing the trace of requests which carry one.
+	Tracing *Tracing
+	// If set, log ins and sign ups it deems suspicious must solve a client puzzle.
+	ProofOfWork *ProofOfWork
+	// If set, every log in goes through this identity provider, and password accounts are disabled.
+	SSO *SSO
+	// Show a "Remember me" box on the log in page, which asks the Authenticator for a longer lived token, see
+	// DBAuthenticator.RememberTTL. Users who leave it unticked get cookies which end with the browser session.
+	RememberMe bool
+	// How the token cookies are named and set. AuthFilter.Cookies must match. Unsafe requests to the auth routes must
+	// come from this host or a trusted host sharing the cookies.
+	Cookies CookieOptions
+	// Identity providers by lower case email domain, e.g "acme.com", for home realm discovery: the log in page first asks
+	// only for the email, then sends users in these domains to their provider, and everyone else on to enter a password.
+	// Users in these domains can't sign up or log in with a password. Ignored if SSO is set. Requires an Authenticator
+	// implementing FederatedAuthenticator. Only the email given is checked here, so also set the DBAuthenticator's
+	// SSODomains, which refuses accounts named by ID, and log ins through other front ends, e.g authgrpc.
+	Realms map[string]*SSO
+	// Social and other OAuth log in providers by name, e.g "github", each served under the OAuth route, e.g
+	// "/auth/oauth/github", and offered on the log in and sign up pages. Ignored if SSO is set.
+	OAuth map[string]*OAuthProvider
+	// If set, this server is an OpenID Connect provider, logging users in to registered Clients.
+	IdentityProvider *IdentityProvider
+	// The page templates, from ParseTemplates. Defaults to the bundled pages.
+	Templates *template.Template
+	// If set, called before each page is rendered, e.g to add branding to PageData.Extra or reword its messages.
+	TemplateData func(r *http.Request, data *PageData)
+	// Finds each request's tenant and locale before it is handled, for pages and the Authenticator to find in its
+	// context.
+	Resolvers Resolvers
+
+	// Paths of the mounted routes by name, set by Mount.
+	routes map[string]string
+}
+
+// Responds with a 500, only revealing the error if in debug mode.
+func (a AuthServer) internalError(w http.ResponseWriter, context string, err error) {
+	log.Printf("error: %v: %v", context, err)
+	if a.Debug {
+		http.Error(w, fmt.Sprintf("%v: %v", context, err), http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+// Sets a message for the next page, if flash messages are on.
+func (a AuthServer) flash(w http.ResponseWriter, message string) {
+	if a.Flash == nil {
+		return
+	}
+	err := a.Flash.Set(w, message)
+	if err != nil {
+		log.Printf("error: set flash: %v", err)
+	}
+}
+
+// Returns and clears the pending flash message, if any.
+func (a AuthServer) popFlash(w http.ResponseWriter, r *http.Request) string {
+	if a.Flash == nil {
+		return ""
+	}
+	return a.Flash.Pop(w, r)
+}
+
+// Names of the routes served by AuthServer, for use with RouteOptions.
+const (
+	RouteLogin   = "login"
+	RouteSignup  = "signup"
+	RouteVerify  = "verify"
+	RouteLogout  = "logout"
+	RouteRefresh = "refresh"
+	RouteForgot  = "forgot"
+	RouteReset   = "reset"
+	RouteToken   = "token"
+	RouteSSO     = "sso"
+	RoutePrivacy = "privacy"
+	RouteHandoff = "handoff"
+	RouteOAuth   = "oauth"
+	RouteCheck   = "check"
+	// Log in with a break glass code, see IssueBreakGlass.
+	RouteBreakGlass = "breakglass"
+	RouteSessions   = "sessions"
+	// Routes of the OpenID Connect provider, see IdentityProvider.
+	RouteAuthorize = "authorize"
+	RouteUserinfo  = "userinfo"
+	RouteJWKS      = "jwks"
+	RouteDiscovery = "discovery"
+)
+
+// Customizes the routes mounted by AuthServer.Mount.
+type RouteOption func(routes map[string]string)
+
+// Serves the named route at the given path, relative to the mount prefix, instead of its default.
+func WithRoutePath(name, path string) RouteOption {
+	return func(routes map[string]string) {
+		routes[name] = path
+	}
+}
+
+// Does not serve the named route at all.
+func WithoutRoute(name string) RouteOption {
+	return func(routes map[string]string) {
+		delete(routes, name)
+	}
 }
 
 // Returns an http handler that manages an auth subtree, adding pages for logging in, signing up, etc.
-func (a AuthServer) Handler(prefix string) http.Handler {
+func (a AuthServer) Handler(prefix string, opts ...RouteOption) http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("/login", http.HandlerFunc(a.loginPageHandler))
-	mux.Handle("/signup", http.HandlerFunc(a.signupPageHandler))
-	return http.StripPrefix(prefix, mux)
+	a.Mount(mux, prefix, opts...)
+	return mux
+}
+
+// Registers the auth pages on the given mux under prefix, e.g "/auth". By default pages are served at "/login",
+// "/signup", "/verify", "/logout", "/refresh", "/forgot", "/reset", "/token", "/sso", "/privacy", "/handoff", "/oauth/",
+// "/check", "/breakglass", "/sessions", "/authorize", "/userinfo", "/jwks" and "/.well-known/openid-configuration"
+// under the prefix, which can be changed with RouteOptions.
+func (a AuthServer) Mount(mux *http.ServeMux, prefix string, opts ...RouteOption) {
+	routes := map[string]string{
+		RouteLogin:      "/login",
+		RouteSignup:     "/signup",
+		RouteVerify:     "/verify",
+		RouteLogout:     "/logout",
+		RouteRefresh:    "/refresh",
+		RouteForgot:     "/forgot",
+		RouteReset:      "/reset",
+		RouteToken:      "/token",
+		RouteSSO:        "/sso",
+		RoutePrivacy:    "/privacy",
+		RouteHandoff:    "/handoff",
+		RouteOAuth:      "/oauth/",
+		RouteCheck:      "/check",
+		RouteBreakGlass: "/breakglass",
+		RouteSessions:   "/sessions",
+
+		RouteAuthorize: "/authorize",
+		RouteUserinfo:  "/userinfo",
+		RouteJWKS:      "/jwks",
+		RouteDiscovery: discoveryPath,
+	}
+	for _, opt := range opts {
+		opt(routes)
+	}
+	a.routes = make(map[string]string, len(routes))
+	for name, path := range routes {
+		a.routes[name] = prefix + path
+	}
+	handlers := map[string]http.HandlerFunc{
+		RouteLogin:      a.loginPageHandler,
+		RouteSignup:     a.signupPageHandler,
+		RouteVerify:     a.verifyHandler,
+		RouteLogout:     a.logoutHandler,
+		RouteRefresh:    a.refreshHandler,
+		RouteForgot:     a.forgotHandler,
+		RouteReset:      a.resetHandler,
+		RouteToken:      a.tokenHandler,
+		RouteSSO:        a.ssoHandler,
+		RoutePrivacy:    a.privacyHandler,
+		RouteHandoff:    a.handoffHandler,
+		RouteOAuth:      a.oauthHandler,
+		RouteCheck:      a.checkHandler,
+		RouteBreakGlass: a.breakGlassHandler,
+		RouteSessions:   a.sessionsHandler,
+
+		RouteAuthorize: a.authorizeHandler,
+		RouteUserinfo:  a.userinfoHandler,
+		RouteJWKS:      a.jwksHandler,
+		RouteDiscovery: a.discoveryHandler,
+	}
+	for name, path := range a.routes {
+		f, ok := handlers[name]
+		if !ok {
+			panic(fmt.Sprintf("auth: unknown route '%v'", name))
+		}
+		if a.SSO != nil && (name == RouteSignup || name == RouteVerify || name == RouteForgot || name == RouteReset || name == RouteOAuth) {
+			f = ssoOnly
+		}
+		var h http.Handler = f
+		if a.Admission != nil && (name == RouteLogin || name == RouteSignup || name == RouteReset) {
+			h = a.Admission.Handler(h)
+		}
+		// Proxies check every request, and nothing changes, so there is no cross site request to refuse.
+		if name != RouteCheck {
+			h = a.Cookies.checkOrigin(h)
+		}
+		h = a.Resolvers.Middleware(h)
+		if a.SLO != nil {
+			h = a.SLO.Track(name, h)
+		}
+		if a.Tracing != nil {
+			h = a.Tracing.Handler(path, h)
+		}
+		mux.Handle(path, h)
+	}
+}
+
+// Returns a link to the named route carrying the given query, or "" if the route is disabled.
+func (a AuthServer) link(name, rawQuery string) string {
+	path, ok := a.routes[name]
+	if !ok || name == RouteSignup && a.DisableSignup || name == RouteForgot && !a.canReset() {
+		return ""
+	}
+	if rawQuery == "" {
+		return path
+	}
+	return path + "?" + rawQuery
+}
+
+// Reports a password rejected by a PasswordPolicy, listing each problem so the user can fix them all at once. Returns
+// false if err is anything else.
+func (a AuthServer) passwordError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	a.render(w, r, http.StatusBadRequest, PageData{Page: "password.html", Title: "Choose a stronger password",
+		Action: r.URL.RequestURI(), Problems: policyErr.Problems})
+	return true
+}
+
+// Errors from signing up which are the user's to fix, shown on the sign up page.
+var signupErrors = []error{ErrWeakPassword, ErrEmailRegistered, ErrDisposableEmail, ErrUndeliverableEmail}
+
+// Renders the sign up page, refilled with the email and showing why the last attempt failed, if it did.
+func (a AuthServer) signupPage(w http.ResponseWriter, r *http.Request, status int, email string, err error) {
+	data := PageData{Page: "signup.html", Title: "Sign Up", Action: a.link(RouteSignup, r.URL.RawQuery), Email: email,
+		ProofOfWork: a.proofOfWorkHTML(), Error: err}
+	var policyErr *PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		data.Error = ErrWeakPassword
+		data.Problems = policyErr.Problems
+	}
+	a.render(w, r, status, data)
+}
+
+// Shows a sign up error on the sign up page if the user can fix it, returning false otherwise.
+func (a AuthServer) signupError(w http.ResponseWriter, r *http.Request, email string, err error) bool {
+	for _, target := range signupErrors {
+		if errors.Is(err, target) {
+			a.signupPage(w, r, http.StatusBadRequest, email, err)
+			return true
+		}
+	}
+	return false
 }
 
 // Handle new users.
 func (a AuthServer) signupPageHandler(w http.ResponseWriter, r *http.Request) {
+	if a.DisableSignup {
+		http.Error(w, "sign up is disabled, ask an administrator for an account", http.StatusNotFound)
+		return
+	}
 	if r.Method == "GET" {
-		w.Write([]byte(fmt.Sprintf(`
-<html>
-	<body>
-		<h1> Sign Up </h1>
-		<form action="signup?%v" method="post">
-			<input name=email type=text placeholder="Email" />
-			<input name=password type=password placeholder="Password" />
-			<input type=submit />
-		</form>
-		<a href="login?%v"> Log In </a>
-	</body>
-</html>`, r.URL.RawQuery, r.URL.RawQuery)))
+		a.signupPage(w, r, http.StatusOK, "", nil)
 		return
 	}
 	if r.Method != "POST" {
@@ -100,9 +622,22 @@ func (a AuthServer) signupPageHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("parse form: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !a.checkProofOfWork(w, r) {
+		return
+	}
 	email := r.PostFormValue("email")
 	password := r.PostFormValue("password")
+	if !a.checkRealm(w, email) {
+		return
+	}
+	if a.VerifySignups {
+		a.beginVerifiedSignup(w, r, email, password)
+		return
+	}
 	err = a.Register(r.Context(), email, password)
+	if a.signupError(w, r, email, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("create user: %v", err), http.StatusBadRequest)
 		return
@@ -110,21 +645,90 @@ func (a AuthServer) signupPageHandler(w http.ResponseWriter, r *http.Request) {
 	a.loginPageHandler(w, r)
 }
 
+// Holds the sign up until the email address is verified, and emails the verification link. The response is the same
+// whether or not the email is already registered.
+func (a AuthServer) beginVerifiedSignup(w http.ResponseWriter, r *http.Request, email, password string) {
+	v, ok := a.Authenticator.(SignupVerifier)
+	if !ok {
+		a.internalError(w, "verify signups", fmt.Errorf("authenticator %T does not support verification", a.Authenticator))
+		return
+	}
+	if a.Mailer == nil || a.BaseURL == "" {
+		a.internalError(w, "verify signups", fmt.Errorf("Mailer and BaseURL must be set"))
+		return
+	}
+	code, err := v.BeginRegister(r.Context(), email, password)
+	if a.signupError(w, r, email, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("create user: %v", err), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	q.Set("code", code.String())
+	link := strings.TrimSuffix(a.BaseURL, "/") + a.link(RouteVerify, q.Encode())
+	err = a.Mailer.Send(r.Context(), email, "Confirm your email address",
+		fmt.Sprintf("Follow this link to finish signing up. It expires in 24 hours.\n\n%v\n\nIf you didn't sign up, you can ignore this email.\n", link))
+	if err != nil {
+		a.internalError(w, "send verification email", err)
+		return
+	}
+	a.render(w, r, http.StatusOK, PageData{Page: "message.html", Title: "Check your email",
+		Message: "We sent you a link to finish signing up."})
+}
+
+// Completes a verified sign up from the emailed link, then sends the user on to log in.
+func (a AuthServer) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	v, ok := a.Authenticator.(SignupVerifier)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	var code Token
+	err := code.UnmarshalText([]byte(q.Get("code")))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parse code: %v", err), http.StatusBadRequest)
+		return
+	}
+	err = v.CompleteRegister(r.Context(), code)
+	if errors.Is(err, ErrInvalidSignupCode) || errors.Is(err, ErrEmailRegistered) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		a.internalError(w, "create user", err)
+		return
+	}
+	q.Del("code")
+	a.flash(w, "Your email is verified, please log in.")
+	http.Redirect(w, r, a.link(RouteLogin, q.Encode()), http.StatusFound)
+}
+
+// Renders the log in page, refilled with the email and showing why the last attempt failed, if it did.
+func (a AuthServer) loginPage(w http.ResponseWriter, r *http.Request, status int, email string, err error) {
+	a.render(w, r, status, PageData{Page: "login.html", Title: "Login", Action: a.link(RouteLogin, r.URL.RawQuery),
+		Email: email, ProofOfWork: a.proofOfWorkHTML(), Error: err})
+}
+
 // We bind `login` as a GET to rendering the login page, and as a POST to assigning a token.
 func (a AuthServer) loginPageHandler(w http.ResponseWriter, r *http.Request) {
+	if a.SSO != nil {
+		a.ssoLoginPage(w, r)
+		return
+	}
 	if r.Method == "GET" {
-		w.Write([]byte(fmt.Sprintf(`
-<html>
-	<body>
-		<h1> Login </h1>
-		<form action="login?%v" method="post">
-			<input name=email type=text placeholder="Email" />
-			<input name=password type=password placeholder="Password" />
-			<input type=submit />
-		</form>
-		<a href="signup?%v"> Sign Up </a>
-	</body>
-</html>`, r.URL.RawQuery, r.URL.RawQuery)))
+		email := r.URL.Query().Get("email")
+		if len(a.Realms) > 0 && email == "" {
+			a.discoveryPage(w, r)
+			return
+		}
+		a.loginPage(w, r, http.StatusOK, email, nil)
 		return
 	}
 	if r.Method != "POST" {
@@ -138,23 +742,384 @@ func (a AuthServer) loginPageHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("parse form: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !a.checkProofOfWork(w, r) {
+		return
+	}
 	email := r.PostFormValue("email")
 	password := r.PostFormValue("password")
-	t, expires, err := a.Authenticate(r.Context(), email, password)
-	if errors.Is(err, errBadCredentials) {
+	if len(a.Realms) > 0 {
+		if _, ok := r.PostForm["password"]; !ok {
+			a.discover(w, r, email)
+			return
+		}
+		if !a.checkRealm(w, email) {
+			return
+		}
+	}
+	ctx := withClient(r.Context(), r)
+	if a.RememberMe {
+		ctx = WithRememberMe(ctx, r.PostFormValue("remember") != "")
+	}
+	t, expires, err := a.Authenticate(ctx, email, password)
+	if errors.Is(err, ErrRiskTooHigh) {
+		a.loginPage(w, r, http.StatusForbidden, email, ErrRiskTooHigh)
+		return
+	}
+	if errors.Is(err, ErrLockedOut) {
+		a.loginPage(w, r, http.StatusTooManyRequests, email, ErrLockedOut)
+		return
+	}
+	if errors.Is(err, ErrSSORequired) {
+		http.Error(w, ErrSSORequired.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrBadCredentials) {
 		// We dont report the whole error to avoid returning info that could distinguish which credentials were bad
-		http.Error(w, fmt.Sprintf("authenticate: %v", errBadCredentials), http.StatusUnauthorized)
+		a.loginPage(w, r, http.StatusUnauthorized, email, ErrBadCredentials)
+		return
+	}
+	if err != nil {
+		a.internalError(w, "authenticate", err)
 		return
 	}
+	// The refresh token, and the cookies, remember whether the user asked to be remembered.
+	a.finishLogin(w, r.WithContext(ctx), r.URL.Query(), t, expires)
+}
+
+// Returns the token in the access token cookie.
+func (a AuthServer) sessionToken(r *http.Request) (Token, error) {
+	c, err := r.Cookie(a.Cookies.name())
 	if err != nil {
-		http.Error(w, fmt.Sprintf("authenticate: %v", err), http.StatusInternalServerError)
+		return Token{}, err
+	}
+	return decodeToken(r.Context(), a.Authenticator, c.Value)
+}
+
+// Sets the cookies for a successful log in, and sends the user on as the log in page's query asked. If the user was
+// asked whether to be remembered and wasn't, the cookies end with the browser session.
+func (a AuthServer) finishLogin(w http.ResponseWriter, r *http.Request, query url.Values, t Token, expires time.Time) {
+	remember, asked := rememberMe(r.Context())
+	transient := asked && !remember
+	redirect, app := a.loginRedirect(query.Get("redirect"), r.Host)
+	q := redirect.Query()
+	text, err := encodeToken(r.Context(), a.Authenticator, t)
+	if err != nil {
+		a.internalError(w, "encode token", err)
 		return
 	}
-	// Success. Set cookie
-	w.Header().Set("Set-Cookie", fmt.Sprintf("auth_token=%v; Expires=%v; Secure; Path=/", t, expires.Format(time.RFC3339)))
-	redirect := r.URL.Query().Get("redirect")
+	challenge := query.Get("code_challenge")
+	if app && (challenge != "" || a.RequirePKCE) {
+		if challenge == "" || query.Get("code_challenge_method") != "S256" {
+			http.Error(w, "app login: code_challenge with code_challenge_method=S256 required", http.StatusBadRequest)
+			return
+		}
+		ce, ok := a.Authenticator.(CodeExchanger)
+		if !ok {
+			a.internalError(w, "issue code", fmt.Errorf("authenticator %T does not support code exchange", a.Authenticator))
+			return
+		}
+		code, err := ce.IssueCode(r.Context(), t, challenge)
+		if err != nil {
+			a.internalError(w, "issue code", err)
+			return
+		}
+		a.Cookies.setToken(w, text, expires, transient)
+		q.Set("code", code.String())
+		redirect.RawQuery = q.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+		return
+	}
+	if a.IssueRefreshTokens {
+		rf, ok := a.Authenticator.(Refresher)
+		if !ok {
+			a.internalError(w, "issue refresh token", fmt.Errorf("authenticator %T does not support refresh tokens", a.Authenticator))
+			return
+		}
+		refresh, refreshExpires, err := rf.IssueRefresh(withClient(r.Context(), r), t)
+		if err != nil {
+			a.internalError(w, "issue refresh token", err)
+			return
+		}
+		a.Cookies.setRefresh(w, refresh, refreshExpires, transient)
+		q.Set("refresh", refresh.String())
+	}
+	a.Cookies.setToken(w, text, expires, transient)
+	if app {
+		q.Set("token", text)
+		q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+		redirect.RawQuery = q.Encode()
+	}
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// Returns where to go after logging in, and whether it is one of the AppRedirects. Defaults to "/". Web redirects must
+// stay on host, the BaseURL's host or one of the RedirectHosts.
+func (a AuthServer) loginRedirect(raw, host string) (*url.URL, bool) {
+	home := &url.URL{Path: "/"}
+	if raw == "" {
+		return home, false
+	}
+	// Browsers treat backslashes like slashes, so "/\evil.com" would leave the site.
+	u, err := url.Parse(raw)
+	if err != nil || strings.Contains(raw, "\\") {
+		return home, false
+	}
+	if u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https" {
+		if !a.allowedRedirect(u, host) {
+			log.Printf("refusing login redirect to %v", raw)
+			return home, false
+		}
+		return u, false
+	}
+	callback := *u
+	callback.RawQuery = ""
+	callback.Fragment = ""
+	for _, app := range a.AppRedirects {
+		if callback.String() == app {
+			return u, true
+		}
+	}
+	log.Printf("refusing login redirect to unregistered app %v", callback.String())
+	return home, false
+}
+
+// Reports whether a web redirect stays on this site or goes to one of the RedirectHosts.
+func (a AuthServer) allowedRedirect(u *url.URL, host string) bool {
+	if u.Scheme == "" && u.Host == "" {
+		// A path on this host. Paths must be absolute, so they can't be mistaken for a host, e.g "evil.com/".
+		return u.Opaque == "" && strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(u.Path, "//")
+	}
+	if u.Host == "" || u.User != nil {
+		return false
+	}
+	to := strings.ToLower(u.Hostname())
+	allowed := append([]string{hostname(host)}, a.RedirectHosts...)
+	if base, err := url.Parse(a.BaseURL); err == nil && a.BaseURL != "" {
+		allowed = append(allowed, base.Hostname())
+	}
+	for _, h := range allowed {
+		h = strings.ToLower(h)
+		if h == "" {
+			continue
+		}
+		if to == h || strings.HasPrefix(h, ".") && (strings.HasSuffix(to, h) || to == h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the host without its port.
+func hostname(host string) string {
+	return (&url.URL{Host: host}).Hostname()
+}
+
+// Reports whether the request bears the secret as a bearer token, writing a 401 if not. An empty secret allows nothing,
+// so an unconfigured endpoint stays closed.
+func checkBearer(w http.ResponseWriter, r *http.Request, secret string) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if secret == "" || subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Revokes the current token and clears the cookie. Only POST logs out, so other sites can't log users out with a link or
+// image; GET renders a button to do so.
+func (a AuthServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		a.render(w, r, http.StatusOK, PageData{Page: "logout.html", Title: "Log Out", Action: a.link(RouteLogout, r.URL.RawQuery)})
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	if t, err := a.sessionToken(r); err == nil {
+		rv, ok := a.Authenticator.(Revoker)
+		if !ok {
+			a.internalError(w, "log out", fmt.Errorf("authenticator %T does not support revocation", a.Authenticator))
+			return
+		}
+		err = rv.Revoke(r.Context(), t)
+		if err != nil {
+			a.internalError(w, "revoke token", err)
+			return
+		}
+		if a.OnRevoke != nil {
+			a.OnRevoke(t)
+		}
+	}
+	if c, err := r.Cookie(a.Cookies.refreshName()); err == nil {
+		var t Token
+		if rf, ok := a.Authenticator.(Refresher); ok && t.UnmarshalText([]byte(c.Value)) == nil {
+			err = rf.RevokeRefresh(r.Context(), t)
+			if err != nil {
+				a.internalError(w, "revoke refresh token", err)
+				return
+			}
+		}
+	}
+	a.Cookies.clear(w)
+	redirect := a.link(RouteLogin, r.URL.RawQuery)
 	if redirect == "" {
 		redirect = "/"
 	}
+	a.flash(w, "You have been logged out.")
 	http.Redirect(w, r, redirect, http.StatusFound)
 }
+
+// Exchanges the refresh token cookie for a new access token and refresh token, set as cookies. Responds 204 on success and
+// 401 if the refresh token can't be used.
+func (a AuthServer) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	rf, ok := a.Authenticator.(Refresher)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var refresh Token
+	c, err := r.Cookie(a.Cookies.refreshName())
+	if err == nil {
+		err = refresh.UnmarshalText([]byte(c.Value))
+	}
+	if err == nil && a.Binding != nil {
+		err = a.Binding.checkRefresh(r.Context(), r, refresh, rf)
+		if err != nil && !errors.Is(err, ErrClientMismatch) && !errors.Is(err, ErrInvalidToken) {
+			a.internalError(w, "refresh", err)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("refresh: %v", ErrInvalidToken), http.StatusUnauthorized)
+		return
+	}
+	s, err := rf.Refresh(withClient(r.Context(), r), refresh)
+	if errors.Is(err, ErrInvalidToken) {
+		http.Error(w, fmt.Sprintf("refresh: %v", ErrInvalidToken), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		a.internalError(w, "refresh", err)
+		return
+	}
+	access, err := encodeToken(r.Context(), a.Authenticator, s.Access)
+	if err != nil {
+		a.internalError(w, "refresh: encode token", err)
+		return
+	}
+	a.Cookies.setSession(w, access, s)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Whether password resets are supported and configured.
+func (a AuthServer) canReset() bool {
+	_, ok := a.Authenticator.(PasswordResetter)
+	return ok && a.Mailer != nil && a.BaseURL != ""
+}
+
+// Asks for the email of an account to reset the password of. The response is the same whether or not the account exists,
+// so the page can't be used to find out which emails are registered.
+func (a AuthServer) forgotHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.canReset() {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "GET" {
+		a.render(w, r, http.StatusOK, PageData{Page: "forgot.html", Title: "Forgot Password", Action: a.link(RouteForgot, r.URL.RawQuery)})
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parse form: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, sso := a.realm(r.PostFormValue("email")); sso != nil {
+		http.Error(w, "your account logs in with SSO, reset your password with your identity provider", http.StatusBadRequest)
+		return
+	}
+	go a.sendPasswordReset(r.PostFormValue("email"), requestIP(r), r.URL.Query())
+	a.render(w, r, http.StatusOK, PageData{Page: "message.html", Title: "Check your email",
+		Message: "If an account exists for that address, we sent it a link to reset the password."})
+}
+
+// Emails a reset link if the account exists. Runs in the background, so response times don't reveal whether it does.
+func (a AuthServer) sendPasswordReset(email, ip string, q url.Values) {
+	ctx, cancel := context.WithTimeout(WithClientIP(context.Background(), ip), time.Minute)
+	defer cancel()
+	code, err := a.Authenticator.(PasswordResetter).BeginPasswordReset(ctx, email)
+	if errors.Is(err, ErrBadCredentials) || errors.Is(err, ErrResetThrottled) {
+		log.Printf("not sending password reset to %v: %v", email, err)
+		return
+	}
+	if err != nil {
+		log.Printf("error: begin password reset: %v", err)
+		return
+	}
+	q.Set("code", code.String())
+	link := strings.TrimSuffix(a.BaseURL, "/") + a.link(RouteReset, q.Encode())
+	err = a.Mailer.Send(ctx, email, "Reset your password",
+		fmt.Sprintf("Follow this link to choose a new password. It expires in 1 hour.\n\n%v\n\nIf you didn't ask to reset your password, you can ignore this email.\n", link))
+	if err != nil {
+		log.Printf("error: send password reset email: %v", err)
+	}
+}
+
+// Sets a new password from the emailed reset link, then sends the user on to log in.
+func (a AuthServer) resetHandler(w http.ResponseWriter, r *http.Request) {
+	v, ok := a.Authenticator.(PasswordResetter)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// The code is in the URL, don't leak it to other sites.
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if r.Method == "GET" {
+		a.render(w, r, http.StatusOK, PageData{Page: "reset.html", Title: "Reset Password", Action: a.link(RouteReset, r.URL.RawQuery)})
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parse form: %v", err), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	var code Token
+	err = code.UnmarshalText([]byte(q.Get("code")))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parse code: %v", err), http.StatusBadRequest)
+		return
+	}
+	password := r.PostFormValue("password")
+	if password == "" {
+		http.Error(w, "password must not be empty", http.StatusBadRequest)
+		return
+	}
+	err = v.CompletePasswordReset(r.Context(), code, password)
+	if a.passwordError(w, r, err) {
+		return
+	}
+	if errors.Is(err, ErrInvalidResetCode) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		a.internalError(w, "reset password", err)
+		return
+	}
+	q.Del("code")
+	a.flash(w, "Your password has been changed, please log in.")
+	http.Redirect(w, r, a.link(RouteLogin, q.Encode()), http.StatusFound)
+}
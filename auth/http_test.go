@@ -0,0 +1,556 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Blocks until the context is done.
+type slowValidator struct{}
+
+func (slowValidator) Validate(ctx context.Context, t Token) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestFilterValidateTimeout(t *testing.T) {
+	filter := AuthFilter{
+		Validator:       slowValidator{},
+		LoginURL:        "/login",
+		ValidateTimeout: 10 * time.Millisecond,
+	}
+	called := false
+	h := filter.Handler(func(Token, http.ResponseWriter, *http.Request) { called = true })
+	r := httptest.NewRequest("GET", "/secured", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_token", Value: Token{1}.String()})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %v", w.Code)
+	}
+	if called {
+		t.Fatal("handler called despite failed validation")
+	}
+}
+
+func TestMountRoutes(t *testing.T) {
+	mux := http.NewServeMux()
+	AuthServer{}.Mount(mux, "/auth", WithRoutePath(RouteLogin, "/signin"), WithoutRoute(RouteSignup))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/auth/signin?redirect=%2Fsecured")
+	if w.Code != http.StatusOK {
+		t.Fatalf("renamed login: expected 200, got %v", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `action="/auth/signin?redirect=%2Fsecured"`) {
+		t.Fatalf("login form should post to the renamed route: %v", body)
+	}
+	if strings.Contains(body, "Sign Up") {
+		t.Fatalf("login page should not link to disabled signup: %v", body)
+	}
+	for _, path := range []string{"/auth/login", "/auth/signup"} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Fatalf("%v: expected 404, got %v", path, w.Code)
+		}
+	}
+}
+
+func TestDisableSignup(t *testing.T) {
+	mux := http.NewServeMux()
+	AuthServer{DisableSignup: true}.Mount(mux, "/auth")
+	for _, method := range []string{"GET", "POST"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, "/auth/signup", nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%v signup: expected 404, got %v", method, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login", nil))
+	if strings.Contains(w.Body.String(), "Sign Up") {
+		t.Fatalf("login page should not link to disabled signup: %v", w.Body.String())
+	}
+}
+
+func TestFormAutocomplete(t *testing.T) {
+	mux := AuthServer{}.Handler("/auth")
+	for path, want := range map[string]string{
+		"/auth/login":  "autocomplete=current-password",
+		"/auth/signup": "autocomplete=new-password",
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		body := w.Body.String()
+		if !strings.Contains(body, want) || !strings.Contains(body, "autocomplete=username") {
+			t.Fatalf("%v: expected username and %v autocomplete: %v", path, want, body)
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	db := newDB(t, "logout")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	token, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	mux := AuthServer{Authenticator: a}.Handler("/auth")
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/logout", nil))
+	if err := a.Validate(ctx, token); err != nil {
+		t.Fatalf("GET should not log out: %v", err)
+	}
+
+	r := httptest.NewRequest("POST", "/auth/logout", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_token", Value: token.String()})
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/auth/login" {
+		t.Fatalf("expected redirect to login, got %v %v", w.Code, w.Header().Get("Location"))
+	}
+	if c := w.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "auth_token=;") || !strings.Contains(c, "Max-Age=0") {
+		t.Fatalf("expected cookie to be cleared, got %v", c)
+	}
+	if err := a.Validate(ctx, token); err != ErrInvalidToken {
+		t.Fatalf("expected revoked token to be invalid, got %v", err)
+	}
+}
+
+// Accepts only the one token.
+type onlyValidator Token
+
+func (o onlyValidator) Validate(ctx context.Context, t Token) error {
+	if t != Token(o) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func TestFilterTokenSources(t *testing.T) {
+	good := Token{1}
+	filter := AuthFilter{Validator: onlyValidator(good), LoginURL: "/login"}
+	serve := func(f AuthFilter, r *http.Request) (*httptest.ResponseRecorder, bool) {
+		called := false
+		w := httptest.NewRecorder()
+		f.Handler(func(Token, http.ResponseWriter, *http.Request) { called = true }).ServeHTTP(w, r)
+		return w, called
+	}
+
+	r := httptest.NewRequest("GET", "/secured", nil)
+	r.Header.Set("Authorization", "Bearer "+good.String())
+	if w, called := serve(filter, r); !called {
+		t.Fatalf("bearer token: expected handler to be called, got %v", w.Code)
+	}
+
+	// API clients get a 401 rather than a login redirect.
+	r = httptest.NewRequest("GET", "/secured", nil)
+	r.Header.Set("Authorization", "Bearer "+Token{2}.String())
+	if w, called := serve(filter, r); called || w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("bad bearer token: expected 401 challenge, got %v %v", w.Code, w.Header())
+	}
+
+	// The first source with a token wins.
+	r = httptest.NewRequest("GET", "/secured", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_token", Value: Token{2}.String()})
+	r.Header.Set("Authorization", "Bearer "+good.String())
+	if w, called := serve(filter, r); called || w.Code != http.StatusUnauthorized {
+		t.Fatalf("cookie should be checked first, got %v", w.Code)
+	}
+	filter.TokenSources = []TokenSource{BearerTokenSource(), CookieTokenSource("auth_token")}
+	if w, called := serve(filter, r); !called {
+		t.Fatalf("bearer first: expected handler to be called, got %v", w.Code)
+	}
+
+	// Sources not configured are ignored.
+	filter.TokenSources = []TokenSource{CookieTokenSource("auth_token")}
+	r = httptest.NewRequest("GET", "/secured", nil)
+	r.Header.Set("Authorization", "Bearer "+good.String())
+	if w, called := serve(filter, r); called || w.Code != http.StatusUnauthorized {
+		t.Fatalf("cookie only: expected bearer token to be ignored, got %v", w.Code)
+	}
+}
+
+func TestFilterMiddleware(t *testing.T) {
+	good := Token{1}
+	filter := AuthFilter{Validator: onlyValidator(good), LoginURL: "/login"}
+	// A stock middleware outside the filter, and another inside it, as in any chain of func(http.Handler) http.Handler.
+	header := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Chain", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	var got Token
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = TokenFromContext(r.Context())
+	})
+	chain := header("outer")(filter.Middleware(header("inner")(handler)))
+
+	r := httptest.NewRequest("GET", "/secured", nil)
+	r.Header.Set("Authorization", "Bearer "+good.String())
+	w := httptest.NewRecorder()
+	chain.ServeHTTP(w, r)
+	if got != good || strings.Join(w.Header()["X-Chain"], ",") != "outer,inner" {
+		t.Fatalf("expected the chain to reach the handler with the token, got %v %v", got, w.Header())
+	}
+	got = Token{}
+	r = httptest.NewRequest("GET", "/secured", nil)
+	w = httptest.NewRecorder()
+	chain.ServeHTTP(w, r)
+	if w.Code != http.StatusFound || got != (Token{}) || strings.Join(w.Header()["X-Chain"], ",") != "outer" {
+		t.Fatalf("expected the chain to stop at the filter, got %v %v", w.Code, w.Header())
+	}
+}
+
+func TestAppRedirects(t *testing.T) {
+	db := newDB(t, "app")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	mux := AuthServer{Authenticator: a, AppRedirects: []string{"myapp://callback"}}.Handler("/auth")
+	login := func(redirect string) *url.URL {
+		form := url.Values{"email": {"a@b.com"}, "password": {"pw"}}
+		r := httptest.NewRequest("POST", "/auth/login?redirect="+url.QueryEscape(redirect), strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("%v: expected redirect, got %v: %v", redirect, w.Code, w.Body)
+		}
+		u, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("%v: parse location: %v", redirect, err)
+		}
+		return u
+	}
+
+	u := login("myapp://callback?state=x")
+	if u.Scheme != "myapp" || u.Query().Get("state") != "x" {
+		t.Fatalf("expected app callback, got %v", u)
+	}
+	var token Token
+	err = token.UnmarshalText([]byte(u.Query().Get("token")))
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	if err := a.Validate(ctx, token); err != nil {
+		t.Fatalf("app token should be valid: %v", err)
+	}
+
+	for _, redirect := range []string{"otherapp://callback", "myapp://callback/other", "javascript:alert(1)"} {
+		if u := login(redirect); u.String() != "/" {
+			t.Fatalf("%v: expected redirect home, got %v", redirect, u)
+		}
+	}
+	if u := login("/secured?x=1"); u.String() != "/secured?x=1" || u.Query().Get("token") != "" {
+		t.Fatalf("expected plain redirect, got %v", u)
+	}
+}
+
+func TestFormErrors(t *testing.T) {
+	db := newDB(t, "form_errors")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db, PasswordPolicy: &PasswordPolicy{MinLength: 8}}
+	err := a.Register(ctx, "a@b.com", "long enough")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := a.Register(ctx, "a@b.com", "long enough"); !errors.Is(err, ErrEmailRegistered) {
+		t.Fatalf("register twice: expected ErrEmailRegistered, got %v", err)
+	}
+	mux := AuthServer{Authenticator: a}.Handler("/auth")
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	for _, tc := range []struct {
+		path, email, password string
+		status                int
+		want                  []string
+	}{
+		{"/auth/login", "a@b.com", "wrong", http.StatusUnauthorized, []string{ErrBadCredentials.Error(), "autocomplete=current-password"}},
+		{"/auth/signup", "a@b.com", "long enough", http.StatusBadRequest, []string{"an account already exists", "autocomplete=new-password"}},
+		{"/auth/signup", "c@d.com", "short", http.StatusBadRequest, []string{ErrWeakPassword.Error(), "Password must be at least 8 characters"}},
+	} {
+		w := post(tc.path, url.Values{"email": {tc.email}, "password": {tc.password}})
+		body := w.Body.String()
+		if w.Code != tc.status {
+			t.Fatalf("%v %v: expected %v, got %v: %v", tc.path, tc.email, tc.status, w.Code, body)
+		}
+		for _, want := range append(tc.want, `role=alert`, fmt.Sprintf(`value="%v"`, tc.email)) {
+			if !strings.Contains(body, want) {
+				t.Fatalf("%v %v: expected the page again with %v: %v", tc.path, tc.email, want, body)
+			}
+		}
+		if strings.Contains(body, tc.password) {
+			t.Fatalf("%v %v: the password should not be refilled: %v", tc.path, tc.email, body)
+		}
+	}
+}
+
+func TestRememberMe(t *testing.T) {
+	db := newDB(t, "remember")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db, TokenTTL: time.Hour, RememberTTL: 30 * 24 * time.Hour, StartSkew: time.Minute}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	mux := AuthServer{Authenticator: a, RememberMe: true, IssueRefreshTokens: true}.Handler("/auth")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login", nil))
+	if !strings.Contains(w.Body.String(), "name=remember type=checkbox") {
+		t.Fatalf("expected a remember me box: %v", w.Body)
+	}
+
+	// Checks the session the response set, and returns its access token, when it expires, and the refresh cookie.
+	session := func(w *httptest.ResponseRecorder, remembered bool) (Token, time.Time, *http.Cookie) {
+		c := responseCookie(w, "auth_token")
+		rc := responseCookie(w, "auth_refresh")
+		var tok Token
+		if c == nil || rc == nil || tok.UnmarshalText([]byte(c.Value)) != nil {
+			t.Fatalf("expected a session, got %v %v", w.Code, w.Header())
+		}
+		expires, err := TokenExpiry(ctx, db, tok)
+		if err != nil {
+			t.Fatalf("token expiry: %v", err)
+		}
+		if remembered && !c.Expires.Equal(expires.Truncate(time.Second)) {
+			t.Fatalf("cookie expires %v, token %v", c.Expires, expires)
+		}
+		if !remembered && (!c.Expires.IsZero() || !rc.Expires.IsZero()) {
+			t.Fatalf("expected cookies ending with the browser session, expire %v and %v", c.Expires, rc.Expires)
+		}
+		return tok, expires, rc
+	}
+	login := func(form url.Values) (Token, time.Time, *http.Cookie) {
+		r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("log in: expected a redirect, got %v %v", w.Code, w.Body)
+		}
+		return session(w, form.Get("remember") != "")
+	}
+	refresh := func(c *http.Cookie, remembered bool) (Token, time.Time, *http.Cookie) {
+		r := httptest.NewRequest("POST", "/auth/refresh", nil)
+		r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("refresh: expected 204, got %v %v", w.Code, w.Body)
+		}
+		return session(w, remembered)
+	}
+	tok, expires, rc := login(url.Values{"email": {"a@b.com"}, "password": {"pw"}})
+	if d := time.Until(expires); d > time.Hour || d < 59*time.Minute {
+		t.Fatalf("expected a token lasting TokenTTL, expires in %v", d)
+	}
+	var start, created int64
+	hash := sha256.Sum256(tok[:])
+	err = db.QueryRow("SELECT START_TIME, CREATED_TIME FROM TOKEN WHERE TOKEN_HASH = ?", hash[:]).Scan(&start, &created)
+	if err != nil {
+		t.Fatalf("query token: %v", err)
+	}
+	if created-start != time.Minute.Milliseconds() {
+		t.Fatalf("expected the token to start StartSkew before it was issued, started %vms before", created-start)
+	}
+	_, expires, _ = refresh(rc, false)
+	if d := time.Until(expires); d > time.Hour {
+		t.Fatalf("expected a refreshed token lasting TokenTTL, expires in %v", d)
+	}
+
+	_, expires, rc = login(url.Values{"email": {"a@b.com"}, "password": {"pw"}, "remember": {"1"}})
+	if d := time.Until(expires); d < 29*24*time.Hour {
+		t.Fatalf("expected a token lasting RememberTTL, expires in %v", d)
+	}
+	_, expires, _ = refresh(rc, true)
+	if d := time.Until(expires); d < 29*24*time.Hour {
+		t.Fatalf("expected a refreshed token lasting RememberTTL, expires in %v", d)
+	}
+}
+
+func TestCookieOptions(t *testing.T) {
+	db := newDB(t, "cookies")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	login := func(server AuthServer) *httptest.ResponseRecorder {
+		form := url.Values{"email": {"a@b.com"}, "password": {"pw"}}
+		r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		server.Handler("/auth").ServeHTTP(w, r)
+		return w
+	}
+
+	c := responseCookie(login(AuthServer{Authenticator: a}), "auth_token")
+	if c == nil || !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode || c.Path != "/" || c.Domain != "" {
+		t.Fatalf("expected a Secure, HttpOnly, SameSite=Lax cookie by default, got %+v", c)
+	}
+
+	opts := CookieOptions{Name: "sid", Domain: "example.com", Path: "/app", SameSite: http.SameSiteStrictMode, Insecure: true, ScriptAccess: true}
+	server := AuthServer{Authenticator: a, Cookies: opts}
+	c = responseCookie(login(server), "sid")
+	if c == nil || c.HttpOnly || c.Secure || c.SameSite != http.SameSiteStrictMode || c.Path != "/app" || c.Domain != "example.com" {
+		t.Fatalf("expected the customized cookie, got %+v", c)
+	}
+	called := false
+	filter := AuthFilter{Validator: a, LoginURL: "/auth/login", Cookies: opts}
+	r := httptest.NewRequest("GET", "/app/secured", nil)
+	r.AddCookie(c)
+	w := httptest.NewRecorder()
+	filter.Handler(func(Token, http.ResponseWriter, *http.Request) { called = true }).ServeHTTP(w, r)
+	if !called {
+		t.Fatalf("expected the filter to accept the renamed cookie, got %v", w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/auth/logout", nil)
+	r.AddCookie(c)
+	w = httptest.NewRecorder()
+	server.Handler("/auth").ServeHTTP(w, r)
+	if cleared := responseCookie(w, "sid"); cleared == nil || cleared.MaxAge >= 0 || cleared.Domain != "example.com" || cleared.Path != "/app" {
+		t.Fatalf("expected log out to clear the renamed cookie, got %+v", cleared)
+	}
+}
+
+func TestLoginRedirect(t *testing.T) {
+	a := AuthServer{BaseURL: "https://auth.example.com", RedirectHosts: []string{"app.example.com", ".example.org"}}
+	for raw, want := range map[string]string{
+		"":                                  "/",
+		"/secured?x=1":                      "/secured?x=1",
+		"https://login.example.com/x":       "https://login.example.com/x",
+		"https://auth.example.com/x":        "https://auth.example.com/x",
+		"https://APP.example.com:8443/":     "https://APP.example.com:8443/",
+		"https://a.example.org/":            "https://a.example.org/",
+		"https://example.org":               "https://example.org",
+		"https://evil.com/":                 "/",
+		"https://evilexample.org/":          "/",
+		"https://app.example.com@evil.com/": "/",
+		"//evil.com":                        "/",
+		"/\\evil.com":                       "/",
+		"/%2F%2Fevil.com":                   "/",
+		"https:evil.com":                    "/",
+		"evil.com/":                         "/",
+		"javascript:alert(1)":               "/",
+	} {
+		u, _ := a.loginRedirect(raw, "login.example.com:443")
+		if u.String() != want {
+			t.Errorf("%v: expected %v, got %v", raw, want, u)
+		}
+	}
+}
+
+func TestSharedCookieDomain(t *testing.T) {
+	db := newDB(t, "shared_cookies")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	opts := CookieOptions{Domain: "example.com", Subdomains: []string{"auth.example.com", "app.example.com", "api.example.com"}}
+	mux := AuthServer{Authenticator: a, Cookies: opts}.Handler("/auth")
+	login := func(origin string) *httptest.ResponseRecorder {
+		form := url.Values{"email": {"a@b.com"}, "password": {"pw"}}
+		r := httptest.NewRequest("POST", "https://auth.example.com/auth/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	for _, origin := range []string{"https://evil.example.com", "https://evil.com", "null"} {
+		if w := login(origin); w.Code != http.StatusForbidden {
+			t.Fatalf("log in from %v: expected 403, got %v", origin, w.Code)
+		}
+	}
+	if w := login(""); w.Code != http.StatusFound {
+		t.Fatalf("log in without an origin: expected redirect, got %v", w.Code)
+	}
+	c := responseCookie(login("https://app.example.com"), "auth_token")
+	if c == nil || c.Domain != "example.com" {
+		t.Fatalf("expected a cookie shared on example.com, got %+v", c)
+	}
+
+	filter := AuthFilter{Validator: a, LoginURL: "https://auth.example.com/auth/login", Cookies: opts}
+	h := filter.Handler(func(Token, http.ResponseWriter, *http.Request) {})
+	for _, tc := range []struct {
+		method, url, origin string
+		want                int
+	}{
+		{"GET", "https://api.example.com/data", "", http.StatusOK},
+		{"GET", "https://blog.example.com/data", "", http.StatusForbidden},
+		{"POST", "https://api.example.com/data", "https://app.example.com", http.StatusOK},
+		{"POST", "https://api.example.com/data", "https://api.example.com", http.StatusOK},
+		{"POST", "https://api.example.com/data", "https://blog.example.com", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(tc.method, tc.url, nil)
+		r.AddCookie(c)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Fatalf("%v %v from %v: expected %v, got %v", tc.method, tc.url, tc.origin, tc.want, w.Code)
+		}
+	}
+
+	// Without Subdomains, only Domain itself is trusted.
+	filter.Cookies = CookieOptions{Domain: "example.com"}
+	h = filter.Handler(func(Token, http.ResponseWriter, *http.Request) {})
+	for _, tc := range []struct {
+		method, url, origin string
+		want                int
+	}{
+		{"GET", "https://example.com/data", "", http.StatusOK},
+		{"GET", "https://app.example.com/data", "", http.StatusForbidden},
+		{"POST", "https://example.com/data", "https://example.com", http.StatusOK},
+		{"POST", "https://example.com/data", "https://app.example.com", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(tc.method, tc.url, nil)
+		r.AddCookie(c)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Fatalf("no subdomains: %v %v from %v: expected %v, got %v", tc.method, tc.url, tc.origin, tc.want, w.Code)
+		}
+	}
+}
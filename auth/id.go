@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// Crockford's base32 alphabet, as used by ULIDs. Lexical order matches numeric order.
+const idAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Generates a new user ID of the form "<prefix>_<ulid>", e.g "acme_01H8XGJWBWBAQ4Z7T5Z4P7C7XQ". The ULID encodes the
+// creation time, so IDs with the same prefix sort by creation order. The prefix may only contain ASCII letters and
+// digits, so the ID can always be split on the first underscore.
+func NewUserID(prefix string, now time.Time) (string, error) {
+	if prefix == "" {
+		return "", fmt.Errorf("empty id prefix")
+	}
+	for _, c := range prefix {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return "", fmt.Errorf("invalid id prefix '%v': must be letters and digits only", prefix)
+		}
+	}
+	// 48 bits of milliseconds followed by 80 random bits.
+	var b [16]byte
+	ms := uint64(now.UnixMilli())
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	_, err := rand.Read(b[6:])
+	if err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+	return prefix + "_" + encodeULID(b), nil
+}
+
+// Encodes 128 bits as 26 base32 characters, most significant first. The leading character only carries 3 bits.
+func encodeULID(b [16]byte) string {
+	var out [26]byte
+	// Walk the bits from least significant, 5 at a time.
+	var acc uint32
+	var bits uint
+	i := len(out) - 1
+	for j := len(b) - 1; j >= 0; j-- {
+		acc |= uint32(b[j]) << bits
+		bits += 8
+		for bits >= 5 {
+			out[i] = idAlphabet[acc&31]
+			i--
+			acc >>= 5
+			bits -= 5
+		}
+	}
+	out[i] = idAlphabet[acc&31]
+	return string(out[:])
+}
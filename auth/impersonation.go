@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Administrators can be issued a token which acts as another user, e.g to see what a support ticket describes. Every
+// page served with such a token should say so, so nobody mistakes it for their own session or forgets to leave it.
+// ImpersonationBanner does this for an application's pages: it adds a Warning header to each response, attaches the
+// Impersonation to the request's context for the application's own templates, and can insert a banner into HTML pages.
+
+// Returned when a token is the user's own, not an administrator acting as them.
+var ErrNotImpersonated = errors.New("token is not impersonating a user")
+
+// Who is acting as whom with an impersonating token. Emails are empty if the user no longer exists.
+type Impersonation struct {
+	// The user whose session it is.
+	UID   string
+	Email string
+	// The administrator acting as them.
+	AdminUID   string
+	AdminEmail string
+}
+
+// Returns the email, or the ID if the email isn't known.
+func displayName(email, uid string) string {
+	if email != "" {
+		return email
+	}
+	return uid
+}
+
+// Returns a value for the Warning header saying who is viewing as whom.
+func (i Impersonation) warning() string {
+	msg := fmt.Sprintf("Impersonated session: %v is viewing as %v", displayName(i.AdminEmail, i.AdminUID),
+		displayName(i.Email, i.UID))
+	return `299 - "` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(msg) + `"`
+}
+
+// Returns a banner saying who is viewing as whom, for the top of a page.
+func (i Impersonation) BannerHTML() template.HTML {
+	return template.HTML(fmt.Sprintf(`<div role="alert" class="auth-impersonation-banner" style="background:#b00020;`+
+		`color:#fff;padding:8px;text-align:center;font-family:sans-serif">Viewing as <strong>%v</strong>. You are signed `+
+		`in as <strong>%v</strong>.</div>`, html.EscapeString(displayName(i.Email, i.UID)),
+		html.EscapeString(displayName(i.AdminEmail, i.AdminUID))))
+}
+
+// Issues a token, valid from now until end, which the administrator acts as the user with, and records it in the user's
+// history. Use a transaction, so a token is never issued without its record.
+func ImpersonateUser(ctx context.Context, db conn, admin, uid string, now, end time.Time) (Token, error) {
+	if admin == uid {
+		return Token{}, fmt.Errorf("impersonate: %v can't impersonate themselves", admin)
+	}
+	t, err := GenerateToken(ctx, db, uid, now, end)
+	if err != nil {
+		return t, err
+	}
+	hash := sha256.Sum256(t[:])
+	_, err = db.ExecContext(ctx, `UPDATE TOKEN SET IMPERSONATOR=? WHERE TOKEN_HASH=?;`, admin, hash[:])
+	if err != nil {
+		return t, fmt.Errorf("set impersonator: %w", err)
+	}
+	err = recordUserEvent(ctx, db, uid, Impersonated, map[string]string{"admin": admin}, now)
+	if err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// Returns who the token acts as and for whom, ErrNotImpersonated if it is the user's own, or ErrInvalidToken if there
+// is no such token or it was issued to a client. Does not check the token is valid; validate it first.
+func LookupImpersonation(ctx context.Context, db conn, t Token) (Impersonation, error) {
+	hash := sha256.Sum256(t[:])
+	var i Impersonation
+	var admin, email, adminEmail sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT TOKEN.UID, TOKEN.IMPERSONATOR, U.EMAIL, A.EMAIL FROM TOKEN
+LEFT JOIN USER U ON U.ID = TOKEN.UID LEFT JOIN USER A ON A.ID = TOKEN.IMPERSONATOR WHERE TOKEN_HASH=? AND `+sessionToken,
+		hash[:]).
+		Scan(&i.UID, &admin, &email, &adminEmail)
+	if errors.Is(err, sql.ErrNoRows) {
+		return i, ErrInvalidToken
+	}
+	if err != nil {
+		return i, fmt.Errorf("parse impersonation: %w", err)
+	}
+	if !admin.Valid {
+		return i, ErrNotImpersonated
+	}
+	i.AdminUID, i.Email, i.AdminEmail = admin.String, email.String, adminEmail.String
+	return i, nil
+}
+
+// Implemented by Validators which know which tokens impersonate their user, for ImpersonationBanner.
+type ImpersonationLookup interface {
+	// Returns who the token acts as and for whom, ErrNotImpersonated if it is the user's own, or ErrInvalidToken if
+	// there is no such token.
+	Impersonation(ctx context.Context, t Token) (Impersonation, error)
+}
+
+func (d DBAuthenticator) Impersonation(ctx context.Context, t Token) (Impersonation, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Impersonation{}, err
+	}
+	return LookupImpersonation(ctx, d.conn(), t)
+}
+
+// Issues the administrator a token acting as the user with the given ID, lasting as long as a log in. Deciding who may
+// impersonate whom is left to the caller, e.g with RequireRole.
+func (d DBAuthenticator) Impersonate(ctx context.Context, admin, uid string) (Token, time.Time, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return Token{}, time.Time{}, err
+	}
+	now := time.Now()
+	expires := now.Add(d.tokenTTL(ctx))
+	var t Token
+	err := d.retry(ctx, RetryTokens, func() error {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		t, err = ImpersonateUser(ctx, d.wrap(tx), admin, uid, now, expires)
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
+	return t, expires, err
+}
+
+type impersonationKey struct{}
+
+// Attaches the impersonation a request is made with, see ImpersonationBanner.
+func WithImpersonation(ctx context.Context, i Impersonation) context.Context {
+	return context.WithValue(ctx, impersonationKey{}, i)
+}
+
+// Returns the impersonation attached by WithImpersonation, or false if the request is the user's own.
+func ImpersonationFromContext(ctx context.Context) (Impersonation, bool) {
+	i, ok := ctx.Value(impersonationKey{}).(Impersonation)
+	return i, ok
+}
+
+// Marks the responses to impersonated requests, see Middleware.
+type ImpersonationBanner struct {
+	Lookup ImpersonationLookup
+	// If set, HTML responses get Impersonation.BannerHTML inserted at the top of their body. Otherwise pages can show it
+	// themselves, from ImpersonationFromContext.
+	HTML bool
+}
+
+// Wraps a handler behind AuthFilter.Middleware so that when the request's token impersonates its user, the response
+// carries a Warning header saying so, e.g `299 - "Impersonated session: admin@example.com is viewing as
+// user@example.com"`, and the Impersonation is attached to the request's context. If the token can't be checked, the
+// request fails rather than risk an unmarked impersonated page.
+func (b ImpersonationBanner) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := TokenFromContext(r.Context())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		i, err := b.Lookup.Impersonation(r.Context(), t)
+		if errors.Is(err, ErrNotImpersonated) || errors.Is(err, ErrInvalidToken) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("error: check impersonation: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Warning", i.warning())
+		r = r.WithContext(WithImpersonation(r.Context(), i))
+		// HEAD responses have no body to put the banner in.
+		if !b.HTML || r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bw := &bannerWriter{ResponseWriter: w, banner: []byte(i.BannerHTML()), status: http.StatusOK}
+		next.ServeHTTP(bw, r)
+		bw.flush()
+	})
+}
+
+// Holds back an HTML response to insert a banner at the top of its body. Other responses, including compressed pages and
+// those without a body, pass straight through.
+type bannerWriter struct {
+	http.ResponseWriter
+	banner []byte
+	status int
+	// Whether the response is HTML, decided by its first WriteHeader or Write.
+	decided, html bool
+	body          bytes.Buffer
+}
+
+func (w *bannerWriter) decide(first []byte, code int) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	if code == http.StatusNotModified || code == http.StatusNoContent || w.Header().Get("Content-Encoding") != "" {
+		return
+	}
+	ct := w.Header().Get("Content-Type")
+	if ct == "" && first != nil {
+		ct = http.DetectContentType(first)
+	}
+	w.html = strings.HasPrefix(ct, "text/html")
+}
+
+func (w *bannerWriter) WriteHeader(code int) {
+	w.decide(nil, code)
+	if !w.html {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+}
+
+func (w *bannerWriter) Write(b []byte) (int, error) {
+	w.decide(b, http.StatusOK)
+	if !w.html {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+// Writes the held back response, with the banner just inside its <body> tag, or at the start if it has none.
+func (w *bannerWriter) flush() {
+	if !w.html {
+		return
+	}
+	page := w.body.Bytes()
+	at := 0
+	if i := bytes.Index(bytes.ToLower(page), []byte("<body")); i >= 0 {
+		if end := bytes.IndexByte(page[i:], '>'); end >= 0 {
+			at = i + end + 1
+		}
+	}
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(page[:at])
+	w.ResponseWriter.Write(w.banner)
+	w.ResponseWriter.Write(page[at:])
+}
+
+// Sends the page so far with its banner, and passes the rest straight through, so streamed pages still stream.
+func (w *bannerWriter) Flush() {
+	w.decide(nil, http.StatusOK)
+	w.flush()
+	w.html = false
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
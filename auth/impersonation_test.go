@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImpersonation(t *testing.T) {
+	db := newDB(t, "impersonation")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	uids := make(map[string]string)
+	for _, email := range []string{"admin@b.com", "user@b.com"} {
+		if err := a.Register(ctx, email, "pw"); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		uid, err := LookupByEmail(ctx, db, email)
+		if err != nil {
+			t.Fatalf("lookup: %v", err)
+		}
+		uids[email] = uid
+	}
+	impersonating, _, err := a.Impersonate(ctx, uids["admin@b.com"], uids["user@b.com"])
+	if err != nil {
+		t.Fatalf("impersonate: %v", err)
+	}
+	own, _, err := a.Authenticate(ctx, "user@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	i, err := a.Impersonation(ctx, impersonating)
+	if err != nil || i.UID != uids["user@b.com"] || i.Email != "user@b.com" || i.AdminEmail != "admin@b.com" {
+		t.Fatalf("unexpected impersonation: %+v %v", i, err)
+	}
+	if _, err := a.Impersonation(ctx, own); !errors.Is(err, ErrNotImpersonated) {
+		t.Fatalf("expected the user's own token not to impersonate, got %v", err)
+	}
+	events, err := UserEvents(ctx, db, uids["user@b.com"])
+	if err != nil || events[len(events)-1].Kind != Impersonated || events[len(events)-1].Data["admin"] != uids["admin@b.com"] {
+		t.Fatalf("expected the impersonation in the user's history, got %+v %v", events, err)
+	}
+
+	filter := AuthFilter{Validator: a}
+	page := func(contentType, body string) http.Handler {
+		return filter.Middleware(ImpersonationBanner{Lookup: a, HTML: true}.Middleware(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				if _, ok := ImpersonationFromContext(r.Context()); ok {
+					w.Header().Set("X-Seen", "1")
+				}
+				fmt.Fprint(w, body)
+			})))
+	}
+	get := func(h http.Handler, t Token) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+t.String())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	html := page("text/html; charset=utf-8", `<html><BODY class="x"><p>hi</p></BODY></html>`)
+	w := get(html, impersonating)
+	want := `299 - "Impersonated session: admin@b.com is viewing as user@b.com"`
+	if w.Header().Get("Warning") != want || w.Header().Get("X-Seen") != "1" {
+		t.Fatalf("expected the warning header and context, got %v", w.Header())
+	}
+	if !strings.HasPrefix(w.Body.String(), `<html><BODY class="x"><div role="alert"`) ||
+		!strings.Contains(w.Body.String(), "Viewing as <strong>user@b.com</strong>") ||
+		!strings.HasSuffix(w.Body.String(), `</div><p>hi</p></BODY></html>`) {
+		t.Fatalf("expected the banner at the top of the body, got %v", w.Body.String())
+	}
+	w = get(page("application/json", `{"a":1}`), impersonating)
+	if w.Body.String() != `{"a":1}` || w.Header().Get("Warning") == "" {
+		t.Fatalf("expected JSON to be left alone but warned about, got %v %v", w.Body.String(), w.Header())
+	}
+	// Compressed pages, and responses without a body, are left alone.
+	w = get(filter.Middleware(ImpersonationBanner{Lookup: a, HTML: true}.Middleware(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			fmt.Fprint(w, "\x1f\x8b")
+		}))), impersonating)
+	if w.Body.String() != "\x1f\x8b" {
+		t.Fatalf("expected a compressed page to be left alone, got %q", w.Body.String())
+	}
+	w = get(filter.Middleware(ImpersonationBanner{Lookup: a, HTML: true}.Middleware(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotModified)
+		}))), impersonating)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected a 304 to be left alone, got %v %q", w.Code, w.Body.String())
+	}
+	// Flushing sends the page so far, banner included.
+	w = get(filter.Middleware(ImpersonationBanner{Lookup: a, HTML: true}.Middleware(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<body>")
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, "<p>later</p>")
+		}))), impersonating)
+	if !w.Flushed || !strings.HasPrefix(w.Body.String(), `<body><div role="alert"`) ||
+		!strings.HasSuffix(w.Body.String(), "</div><p>later</p>") {
+		t.Fatalf("expected a flushed page with its banner, got %v %q", w.Flushed, w.Body.String())
+	}
+
+	w = get(html, own)
+	if w.Header().Get("Warning") != "" || w.Header().Get("X-Seen") != "" || strings.Contains(w.Body.String(), "alert") {
+		t.Fatalf("expected the user's own session to be unmarked, got %v %v", w.Header(), w.Body.String())
+	}
+
+	// Rotating the token keeps it marked.
+	rotated, err := RotateToken(ctx, db, impersonating, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if i, err := a.Impersonation(ctx, rotated); err != nil || i.AdminEmail != "admin@b.com" {
+		t.Fatalf("expected the rotated token to still impersonate, got %+v %v", i, err)
+	}
+
+	// So does refreshing it.
+	refresh, _, err := a.IssueRefresh(ctx, rotated)
+	if err != nil {
+		t.Fatalf("issue refresh: %v", err)
+	}
+	s, err := a.Refresh(ctx, refresh)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if i, err := a.Impersonation(ctx, s.Access); err != nil || i.AdminEmail != "admin@b.com" {
+		t.Fatalf("expected the refreshed token to still impersonate, got %+v %v", i, err)
+	}
+	s, err = a.Refresh(ctx, s.Refresh)
+	if err != nil {
+		t.Fatalf("refresh again: %v", err)
+	}
+	if i, err := a.Impersonation(ctx, s.Access); err != nil || i.AdminEmail != "admin@b.com" {
+		t.Fatalf("expected the token refreshed twice to still impersonate, got %+v %v", i, err)
+	}
+}
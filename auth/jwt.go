@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A key for signing and verifying JWT access tokens. Either an HS256 secret, which everything verifying must share, or
+// an Ed25519 key for EdDSA, whose public half is enough to verify. The token a JWT stands for is sealed inside it with a
+// key derived from the secret or private key, so only the issuer can read it back; everything holding an HS256 secret
+// can, as well as sign JWTs, so prefer Ed25519 wherever verifiers are trusted less than the issuer.
+type JWTKey struct {
+	// HS256 secret, at least 32 bytes. Used in preference to the Ed25519 key if both are set.
+	Secret []byte
+	// EdDSA signing key. Only needed to sign.
+	PrivateKey ed25519.PrivateKey
+	// EdDSA verifying key. Defaults to the public half of PrivateKey.
+	PublicKey ed25519.PublicKey
+}
+
+// What a JWT access token says.
+type JWTClaims struct {
+	// The user, the JWT's "sub".
+	UID string
+	// The session the JWT stands for, its "jti", as ListSessions reports it. Set by Verify; Sign derives it from Token.
+	ID string
+	// The roles the token carried when the JWT was signed, or nil if they weren't given. Granting or revoking a role
+	// doesn't change them until the JWT is replaced.
+	Roles []string
+	// The token the JWT stands for, sealed in its "tok". Verify only returns it if the key can sign, and leaves it zero
+	// given just a public key. Revoking it in the DB doesn't stop the JWT verifying until it expires.
+	Token   Token
+	Issued  time.Time
+	Expires time.Time
+}
+
+type jwtPayload struct {
+	Sub   string   `json:"sub"`
+	JTI   string   `json:"jti"`
+	Roles []string `json:"roles"`
+	Tok   string   `json:"tok"`
+	IAT   int64    `json:"iat"`
+	Exp   int64    `json:"exp"`
+}
+
+func (k JWTKey) alg() (string, error) {
+	switch {
+	case k.Secret != nil && len(k.Secret) < 32:
+		return "", errors.New("jwt: HS256 secret must be at least 32 bytes")
+	case k.Secret != nil:
+		return "HS256", nil
+	// ed25519 panics on keys of the wrong size, e.g a seed passed as the private key.
+	case k.PrivateKey != nil && len(k.PrivateKey) != ed25519.PrivateKeySize:
+		return "", fmt.Errorf("jwt: Ed25519 private key must be %v bytes, got %v", ed25519.PrivateKeySize, len(k.PrivateKey))
+	case k.PublicKey != nil && len(k.PublicKey) != ed25519.PublicKeySize:
+		return "", fmt.Errorf("jwt: Ed25519 public key must be %v bytes, got %v", ed25519.PublicKeySize, len(k.PublicKey))
+	case k.PrivateKey != nil || k.PublicKey != nil:
+		return "EdDSA", nil
+	}
+	return "", errors.New("jwt: no key")
+}
+
+func (k JWTKey) publicKey() ed25519.PublicKey {
+	if k.PublicKey == nil && k.PrivateKey != nil {
+		return k.PrivateKey.Public().(ed25519.PublicKey)
+	}
+	return k.PublicKey
+}
+
+// Returns the signed, compact JWT for the claims.
+func (k JWTKey) Sign(c JWTClaims) (string, error) {
+	alg, err := k.alg()
+	if err != nil {
+		return "", err
+	}
+	if alg == "EdDSA" && k.PrivateKey == nil {
+		return "", errors.New("jwt: signing with EdDSA needs the private key")
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		return "", fmt.Errorf("marshal header: %w", err)
+	}
+	hash := sha256.Sum256(c.Token[:])
+	jti := sessionID(hash[:])
+	tok, err := k.seal(jti, c.Token)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(jwtPayload{Sub: c.UID, JTI: jti, Roles: c.Roles, Tok: tok, IAT: c.Issued.Unix(), Exp: c.Expires.Unix()})
+	if err != nil {
+		return "", fmt.Errorf("marshal claims: %w", err)
+	}
+	signing := b64(header) + "." + b64(payload)
+	return signing + "." + b64(k.signature(alg, signing)), nil
+}
+
+func (k JWTKey) signature(alg, signing string) []byte {
+	if alg == "HS256" {
+		mac := hmac.New(sha256.New, k.Secret)
+		mac.Write([]byte(signing))
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.PrivateKey, []byte(signing))
+}
+
+// Returns the key sealing tokens in JWTs, or nil if this key can only verify.
+func (k JWTKey) sealKey() []byte {
+	var secret []byte
+	switch {
+	case k.Secret != nil:
+		secret = k.Secret
+	case k.PrivateKey != nil:
+		secret = k.PrivateKey.Seed()
+	default:
+		return nil
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("auth jwt token"))
+	return mac.Sum(nil)
+}
+
+// Encrypts the token for the JWT with the given jti, so it can be read back by the issuer but nobody else the JWT is
+// shown to.
+func (k JWTKey) seal(jti string, t Token) (string, error) {
+	aead, err := newJWTCipher(k.sealKey())
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, t[:], []byte(jti))), nil
+}
+
+// Decrypts the token sealed in a JWT with the given jti. Returns ErrInvalidToken if it wasn't sealed for that jti with
+// this key.
+func (k JWTKey) open(jti, sealed string) (Token, error) {
+	var t Token
+	aead, err := newJWTCipher(k.sealKey())
+	if err != nil {
+		return t, err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(b) < aead.NonceSize() {
+		return t, ErrInvalidToken
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(jti))
+	if err != nil || len(plain) != len(t) {
+		return t, ErrInvalidToken
+	}
+	copy(t[:], plain)
+	return t, nil
+}
+
+func newJWTCipher(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, errors.New("jwt: sealing tokens needs the secret or private key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Checks a JWT's signature and expiry, returning its claims. Returns ErrInvalidToken if it is forged, signed with
+// another algorithm than the key's, malformed or expired.
+func (k JWTKey) Verify(text string, now time.Time) (JWTClaims, error) {
+	alg, err := k.alg()
+	if err != nil {
+		return JWTClaims{}, err
+	}
+	parts := strings.Split(text, ".")
+	if len(parts) != 3 {
+		return JWTClaims{}, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(b, &header)
+	}
+	// The key decides the algorithm, never the header, so a public key can't be passed off as an HMAC secret.
+	if err != nil || header.Alg != alg {
+		return JWTClaims{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return JWTClaims{}, ErrInvalidToken
+	}
+	signing := parts[0] + "." + parts[1]
+	if alg == "HS256" && !hmac.Equal(sig, k.signature(alg, signing)) ||
+		alg == "EdDSA" && !ed25519.Verify(k.publicKey(), []byte(signing), sig) {
+		return JWTClaims{}, ErrInvalidToken
+	}
+	var p jwtPayload
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(b, &p)
+	}
+	if err != nil || p.Sub == "" || p.JTI == "" || !now.Before(time.Unix(p.Exp, 0)) {
+		return JWTClaims{}, ErrInvalidToken
+	}
+	c := JWTClaims{UID: p.Sub, ID: p.JTI, Roles: p.Roles, Issued: time.Unix(p.IAT, 0), Expires: time.Unix(p.Exp, 0)}
+	if k.sealKey() != nil {
+		c.Token, err = k.open(p.JTI, p.Tok)
+		if err != nil {
+			return JWTClaims{}, err
+		}
+	}
+	return c, nil
+}
+
+// Reports whether token text is a JWT rather than an opaque token.
+func isJWT(text string) bool {
+	return strings.Count(text, ".") == 2
+}
+
+// An Authenticator which hands out its tokens as text other than Token.String, e.g DBAuthenticator with JWT set.
+// AuthServer uses it wherever it hands out or reads back a token: the cookie, app redirects and the token route.
+type TokenEncoder interface {
+	// Returns the text to hand out for a token.
+	EncodeToken(ctx context.Context, t Token) (string, error)
+	// Returns the token which text stands for. Returns ErrInvalidToken if the text can't be trusted.
+	DecodeToken(ctx context.Context, text string) (Token, error)
+}
+
+// A Validator which checks the token's text rather than the Token, e.g JWTValidator. AuthFilter prefers
+// ValidateText when its Validator has it.
+type TextValidator interface {
+	// Returns the user the text stands for, if it is valid, with Token set, and ID and Roles if they are known.
+	ValidateText(ctx context.Context, text string) (User, error)
+}
+
+// Returns the token text stands for, as enc decodes it if it is a TokenEncoder.
+func decodeToken(ctx context.Context, enc any, text string) (Token, error) {
+	if e, ok := enc.(TokenEncoder); ok {
+		return e.DecodeToken(ctx, text)
+	}
+	var t Token
+	err := t.UnmarshalText([]byte(text))
+	return t, err
+}
+
+// Returns the text to hand out for a token, as enc encodes it if it is a TokenEncoder.
+func encodeToken(ctx context.Context, enc any, t Token) (string, error) {
+	if e, ok := enc.(TokenEncoder); ok {
+		return e.EncodeToken(ctx, t)
+	}
+	return t.String(), nil
+}
+
+// Validates JWT access tokens by their signature and expiry alone, so services can check them without a DB round trip.
+// Revoked tokens keep working until they expire, so keep DBAuthenticator.TokenTTL short and extend sessions with refresh
+// tokens. The user and their roles come from the JWT, for UserHandler and RequireRole. Given just a public key, handlers
+// are passed a stand in for the token derived from the session ID, which tells sessions apart but is not a credential.
+type JWTValidator struct {
+	Key JWTKey
+	// Validates opaque tokens, e.g those issued before switching to JWTs. If nil, they are refused.
+	Fallback Validator
+}
+
+func (v JWTValidator) ValidateText(ctx context.Context, text string) (User, error) {
+	if !isJWT(text) {
+		var t Token
+		if err := t.UnmarshalText([]byte(text)); err != nil {
+			return User{Token: t}, err
+		}
+		if v.Fallback == nil {
+			return User{Token: t}, ErrInvalidToken
+		}
+		return validateUser(ctx, v.Fallback, t)
+	}
+	c, err := v.Key.Verify(text, time.Now())
+	if err != nil {
+		return User{}, err
+	}
+	u := User{ID: c.UID, Token: c.Token, Roles: c.Roles}
+	if u.Token == (Token{}) {
+		id, err := hex.DecodeString(c.ID)
+		if err != nil {
+			return User{}, ErrInvalidToken
+		}
+		copy(u.Token[:], id)
+	}
+	return u, nil
+}
+
+// Validates an opaque token with the Fallback. A JWT can only be checked from its text, see ValidateText.
+func (v JWTValidator) Validate(ctx context.Context, t Token) error {
+	if v.Fallback == nil {
+		return ErrInvalidToken
+	}
+	return v.Fallback.Validate(ctx, t)
+}
+
+// Signs a JWT standing for the token if JWT is set, otherwise returns the opaque token.
+func (d DBAuthenticator) EncodeToken(ctx context.Context, t Token) (string, error) {
+	if d.JWT == nil {
+		return t.String(), nil
+	}
+	if err := d.requireSQLiteStore(); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	u, err := lookupUser(ctx, d.conn(), t, now)
+	if err != nil {
+		return "", err
+	}
+	expires, err := TokenExpiry(ctx, d.conn(), t)
+	if err != nil {
+		return "", err
+	}
+	return d.JWT.Sign(JWTClaims{UID: u.ID, Roles: u.Roles, Token: t, Issued: now, Expires: expires})
+}
+
+// Returns the token a JWT stands for if it verifies, and opaque tokens as they are, so sessions begun before JWT was
+// set carry on.
+func (d DBAuthenticator) DecodeToken(ctx context.Context, text string) (Token, error) {
+	if d.JWT == nil || !isJWT(text) {
+		var t Token
+		err := t.UnmarshalText([]byte(text))
+		return t, err
+	}
+	c, err := d.JWT.Verify(text, time.Now())
+	return c.Token, err
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWTKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	hs := JWTKey{Secret: []byte(strings.Repeat("s", 32))}
+	ed := JWTKey{PrivateKey: priv}
+	now := time.Now()
+	tok, _ := newToken()
+	c := JWTClaims{UID: "a@b.com", Token: tok, Issued: now, Expires: now.Add(time.Hour)}
+	for name, key := range map[string]JWTKey{"HS256": hs, "EdDSA": ed} {
+		jwt, err := key.Sign(c)
+		if err != nil {
+			t.Fatalf("%v: sign: %v", name, err)
+		}
+		got, err := key.Verify(jwt, now)
+		if err != nil || got.UID != c.UID || got.Token != tok || got.Expires.Unix() != c.Expires.Unix() {
+			t.Fatalf("%v: expected the claims back, got %+v %v", name, got, err)
+		}
+		if strings.Contains(jwt, tok.String()) || strings.Contains(jwtPayloadText(t, jwt), tok.String()) {
+			t.Fatalf("%v: expected the token to be sealed, got %v", name, jwtPayloadText(t, jwt))
+		}
+		if _, err := key.Verify(jwt, now.Add(time.Hour)); err != ErrInvalidToken {
+			t.Fatalf("%v: expected an expired JWT to be refused, got %v", name, err)
+		}
+		parts := strings.Split(jwt, ".")
+		forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":9999999999}`)) + "." + parts[2]
+		if _, err := key.Verify(forged, now); err != ErrInvalidToken {
+			t.Fatalf("%v: expected altered claims to be refused, got %v", name, err)
+		}
+	}
+	hash := sha256.Sum256(tok[:])
+	if got, err := (JWTKey{PublicKey: pub}).Verify(mustSign(t, ed, c), now); err != nil || got.Token != (Token{}) || got.ID != sessionID(hash[:]) {
+		t.Fatalf("expected the public key alone to verify, without reading the token, got %+v %v", got, err)
+	}
+	other := JWTKey{Secret: []byte(strings.Repeat("o", 32))}
+	if _, err := other.open(sessionID(hash[:]), jwtPayloadField(t, mustSign(t, hs, c), "tok")); err != ErrInvalidToken {
+		t.Fatalf("expected another key not to open the token, got %v", err)
+	}
+	if _, err := ed.Verify(mustSign(t, hs, c), now); err != ErrInvalidToken {
+		t.Fatalf("expected an HS256 JWT to be refused by an EdDSA key, got %v", err)
+	}
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + strings.Split(mustSign(t, hs, c), ".")[1] + "."
+	if _, err := hs.Verify(none, now); err != ErrInvalidToken {
+		t.Fatalf("expected an unsigned JWT to be refused, got %v", err)
+	}
+	if _, err := (JWTKey{Secret: []byte("short")}).Sign(c); err == nil {
+		t.Fatal("expected a short secret to be refused")
+	}
+	if _, err := (JWTKey{PrivateKey: priv.Seed()}).Sign(c); err == nil {
+		t.Fatal("expected a private key of the wrong size to be refused")
+	}
+	if _, err := (JWTKey{PublicKey: pub[:16]}).Verify(mustSign(t, ed, c), now); err == nil || err == ErrInvalidToken {
+		t.Fatalf("expected a public key of the wrong size to be refused, got %v", err)
+	}
+}
+
+// Returns the decoded claims of a JWT.
+func jwtPayloadText(t *testing.T, jwt string) string {
+	b, err := base64.RawURLEncoding.DecodeString(strings.Split(jwt, ".")[1])
+	if err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	return string(b)
+}
+
+func jwtPayloadField(t *testing.T, jwt, field string) string {
+	var p map[string]any
+	if err := json.Unmarshal([]byte(jwtPayloadText(t, jwt)), &p); err != nil {
+		t.Fatalf("parse payload: %v", err)
+	}
+	v, _ := p[field].(string)
+	return v
+}
+
+func mustSign(t *testing.T, k JWTKey, c JWTClaims) string {
+	jwt, err := k.Sign(c)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return jwt
+}
+
+func TestJWTLogin(t *testing.T) {
+	db := newDB(t, "jwt")
+	ctx := context.Background()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	a := DBAuthenticator{DB: db, JWT: &JWTKey{PrivateKey: priv}}
+	err = a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	mux := AuthServer{Authenticator: a}.Handler("/auth")
+	form := url.Values{"email": {"a@b.com"}, "password": {"pw"}}
+	r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	session := responseCookie(w, "auth_token")
+	if w.Code != http.StatusFound || session == nil || !isJWT(session.Value) {
+		t.Fatalf("log in: expected a JWT cookie, got %v %v", w.Code, w.Header())
+	}
+
+	var seen User
+	serve := func(v Validator, cookie *http.Cookie) int {
+		h := AuthFilter{Validator: v, LoginURL: "/auth/login"}.UserHandler(func(u User, w http.ResponseWriter, r *http.Request) {
+			seen = u
+		})
+		r := httptest.NewRequest("GET", "/secured", nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	stateless := JWTValidator{Key: JWTKey{PublicKey: pub}}
+	if code := serve(stateless, session); code != http.StatusOK || seen.ID != "a@b.com" {
+		t.Fatalf("expected the JWT to validate without the DB, got %v %+v", code, seen)
+	}
+	if _, err := Lookup(ctx, db, seen.Token, time.Now()); err != ErrInvalidToken {
+		t.Fatalf("expected the stateless handler not to get a usable token, got %v", err)
+	}
+	if code := serve(a, session); code != http.StatusOK || seen.ID != "a@b.com" {
+		t.Fatalf("expected the DB to validate the JWT too, got %v %+v", code, seen)
+	}
+	if uid, err := Lookup(ctx, db, seen.Token, time.Now()); err != nil || uid != "a@b.com" {
+		t.Fatalf("expected the issuer to read back the stored token, got %v %v", uid, err)
+	}
+	if err := GrantRole(ctx, db, "a@b.com", "admin", time.Now()); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	text, err := a.EncodeToken(ctx, seen.Token)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	admin := AuthFilter{Validator: stateless, LoginURL: "/auth/login"}.RequireRole("admin").Handler(func(Token, http.ResponseWriter, *http.Request) {})
+	r = httptest.NewRequest("GET", "/admin", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_token", Value: text})
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the JWT's roles to be checked without the DB, got %v", w.Code)
+	}
+	opaque := &http.Cookie{Name: "auth_token", Value: seen.Token.String()}
+	if code := serve(stateless, opaque); code != http.StatusFound {
+		t.Fatalf("expected an opaque token to be refused without a fallback, got %v", code)
+	}
+	if code := serve(JWTValidator{Key: stateless.Key, Fallback: a}, opaque); code != http.StatusOK {
+		t.Fatalf("expected the fallback to validate an opaque token, got %v", code)
+	}
+
+	r = httptest.NewRequest("POST", "/auth/logout", nil)
+	r.AddCookie(session)
+	mux.ServeHTTP(httptest.NewRecorder(), r)
+	if code := serve(a, session); code != http.StatusFound {
+		t.Fatalf("expected the DB to refuse the JWT once logged out, got %v", code)
+	}
+	// Stateless validation only learns of the revocation when the JWT expires.
+	if code := serve(stateless, session); code != http.StatusOK {
+		t.Fatalf("expected the JWT to still validate without the DB, got %v", code)
+	}
+}
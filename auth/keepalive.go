@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// Re-validates the token every interval for the lifetime of a long lived connection, such as a WebSocket or server sent
+// event stream. If the token is revoked or expires, onInvalid is called with the validation error and KeepAlive returns it.
+// Other validation errors (e.g the store being unreachable) are logged and retried on the next tick, so a brief outage
+// does not drop every open connection. Returns nil once the context is done.
+//
+// This blocks, so it is usually run in its own goroutine with onInvalid closing the connection:
+//
+//	go auth.KeepAlive(ctx, validator, t, time.Minute, func(error) { conn.Close() })
+func KeepAlive(ctx context.Context, v Validator, t Token, interval time.Duration, onInvalid func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		err := v.Validate(ctx, t)
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !errors.Is(err, ErrInvalidToken) {
+			log.Printf("error: keepalive: validate token: %v", err)
+			continue
+		}
+		onInvalid(err)
+		return err
+	}
+}
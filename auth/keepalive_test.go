@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A validator which fails after a fixed number of calls.
+type countdownValidator struct {
+	calls  int32
+	failAt int32
+	err    error
+}
+
+func (c *countdownValidator) Validate(ctx context.Context, t Token) error {
+	if atomic.AddInt32(&c.calls, 1) >= c.failAt {
+		return c.err
+	}
+	return nil
+}
+
+func TestKeepAliveRevoked(t *testing.T) {
+	v := &countdownValidator{failAt: 3, err: ErrInvalidToken}
+	closed := make(chan error, 1)
+	err := KeepAlive(context.Background(), v, Token{}, time.Millisecond, func(err error) { closed <- err })
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected invalid token error, got %v", err)
+	}
+	select {
+	case err = <-closed:
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("onInvalid: expected invalid token error, got %v", err)
+		}
+	default:
+		t.Fatal("onInvalid was not called")
+	}
+	if v.calls != 3 {
+		t.Fatalf("expected 3 validations, got %v", v.calls)
+	}
+}
+
+func TestKeepAliveTransientError(t *testing.T) {
+	v := &countdownValidator{failAt: 1, err: errors.New("db unreachable")}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := KeepAlive(ctx, v, Token{}, time.Millisecond, func(err error) {
+		t.Errorf("connection closed on transient error: %v", err)
+	})
+	if err != nil {
+		t.Fatalf("expected nil after context done, got %v", err)
+	}
+	if atomic.LoadInt32(&v.calls) < 2 {
+		t.Fatalf("expected validation to be retried, got %v calls", v.calls)
+	}
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The lifecycle of an access token, as a state machine. A token is issued active, may be extended or rotated while it
+// is, is revoked or expires, and once expired is reaped. The DB functions which move tokens between states, insertToken,
+// ExtendToken, RotateToken, revokeTokens and ReapTokens, refuse transitions TokenState.Next refuses, so features built on
+// tokens can't e.g revive an expired session by extending it. Everything else changing tokens goes through them:
+// RefreshToken rotates the session's access token, and signing out, deleting a user or client, and changing a password
+// revoke tokens.
+
+// Returned for a token transition the lifecycle doesn't allow, e.g reaping a token before it expired.
+var ErrIllegalTransition = errors.New("illegal token transition")
+
+// Where a token is in its lifecycle.
+type TokenState int
+
+const (
+	// Not issued yet.
+	TokenNone TokenState = iota
+	// Accepted by Lookup.
+	TokenActive
+	// Past its end time, but still stored.
+	TokenExpired
+	// Replaced by another token, see RotateToken.
+	TokenRotated
+	TokenRevoked
+	// Deleted after expiring.
+	TokenReaped
+)
+
+func (s TokenState) String() string {
+	switch s {
+	case TokenNone:
+		return "none"
+	case TokenActive:
+		return "active"
+	case TokenExpired:
+		return "expired"
+	case TokenRotated:
+		return "rotated"
+	case TokenRevoked:
+		return "revoked"
+	case TokenReaped:
+		return "reaped"
+	}
+	return fmt.Sprintf("TokenState(%d)", int(s))
+}
+
+// Something which happens to a token.
+type TokenEvent int
+
+const (
+	TokenIssue TokenEvent = iota
+	// Moves the end time later.
+	TokenExtend
+	// Replaces the token with a new one for the same session.
+	TokenRotate
+	TokenRevoke
+	// The end time passes.
+	TokenExpire
+	TokenReap
+)
+
+func (e TokenEvent) String() string {
+	switch e {
+	case TokenIssue:
+		return "issue"
+	case TokenExtend:
+		return "extend"
+	case TokenRotate:
+		return "rotate"
+	case TokenRevoke:
+		return "revoke"
+	case TokenExpire:
+		return "expire"
+	case TokenReap:
+		return "reap"
+	}
+	return fmt.Sprintf("TokenEvent(%d)", int(e))
+}
+
+// Returns the state after the event. Extending or rotating a token which isn't active returns ErrInvalidToken, as
+// those functions do for any invalid token; other transitions out of order return ErrIllegalTransition. Revoking is
+// allowed from every state but TokenNone, so revoking twice, or after a token expired or was reaped, is harmless.
+func (s TokenState) Next(e TokenEvent) (TokenState, error) {
+	switch {
+	case e == TokenIssue && s == TokenNone:
+		return TokenActive, nil
+	case e == TokenExtend && s == TokenActive:
+		return TokenActive, nil
+	case e == TokenRotate && s == TokenActive:
+		return TokenRotated, nil
+	case (e == TokenExtend || e == TokenRotate) && s != TokenNone:
+		return s, ErrInvalidToken
+	case e == TokenRevoke && s != TokenNone:
+		if s == TokenActive || s == TokenExpired {
+			return TokenRevoked, nil
+		}
+		return s, nil
+	case e == TokenExpire && s == TokenActive:
+		return TokenExpired, nil
+	case e == TokenReap && s == TokenExpired:
+		return TokenReaped, nil
+	}
+	return s, fmt.Errorf("%w: cannot %v a token which is %v", ErrIllegalTransition, e, s)
+}
+
+// Moves an active token's end time later, e.g to slide a session forward while it is in use. Returns ErrInvalidToken if
+// the token isn't active at now, and ErrIllegalTransition if end isn't after its current end time.
+func ExtendToken(ctx context.Context, db conn, t Token, now, end time.Time) error {
+	_, err := lookupToken(ctx, db, t, now, anyToken)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(t[:])
+	res, err := db.ExecContext(ctx, `UPDATE TOKEN SET END_TIME=? WHERE TOKEN_HASH=? AND END_TIME >= ? AND END_TIME < ?;`,
+		end.UnixMilli(), hash[:], now.UnixMilli(), end.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("extend token: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("extend token: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: cannot extend a token to end at %v, before it already does", ErrIllegalTransition, end.UTC())
+	}
+	return nil
+}
+
+// Replaces an active token with a new one for the same user, valid from now until end, and revokes it. The new token
+// keeps the old one's scopes, client, impersonator, session data and refresh token, so the session carries on under a
+// token which hasn't been exposed, e.g after an upgrade in privileges. Returns ErrInvalidToken if the token isn't active
+// at now. Use a transaction, so the old token isn't revoked if the new one can't be issued.
+func RotateToken(ctx context.Context, db conn, old Token, now, end time.Time) (Token, error) {
+	oldHash := sha256.Sum256(old[:])
+	return rotateHash(ctx, db, oldHash[:], now, end)
+}
+
+// Like RotateToken, by the old token's hash.
+func rotateHash(ctx context.Context, db conn, oldHash []byte, now, end time.Time) (Token, error) {
+	if !end.After(now) {
+		return Token{}, fmt.Errorf("%w: cannot rotate to a token which ends at %v, before it starts", ErrIllegalTransition,
+			end.UTC())
+	}
+	_, err := lookupHash(ctx, db, oldHash, now, anyToken)
+	if err != nil {
+		return Token{}, err
+	}
+	t, err := newToken()
+	if err != nil {
+		return t, err
+	}
+	hash := sha256.Sum256(t[:])
+	stmts := []struct {
+		what  string
+		query string
+		args  []any
+	}{
+		{"issue token", `INSERT INTO TOKEN (UID, TOKEN_HASH, START_TIME, END_TIME, CREATED_TIME, SCOPE, CLIENT_ID, CLIENT_SCOPE,
+IP, USER_AGENT, LAST_USED_TIME, IMPERSONATOR) SELECT UID, ?, ?, ?, ?, SCOPE, CLIENT_ID, CLIENT_SCOPE, IP, USER_AGENT,
+LAST_USED_TIME, IMPERSONATOR FROM TOKEN WHERE TOKEN_HASH=?;`, []any{hash[:], now.UnixMilli(), end.UnixMilli(), now.UnixMilli(), oldHash}},
+		{"move session data", `UPDATE SESSION_DATA SET TOKEN_HASH=? WHERE TOKEN_HASH=?;`, []any{hash[:], oldHash}},
+		{"relink refresh token", `UPDATE REFRESH_TOKEN SET ACCESS_HASH=? WHERE ACCESS_HASH=?;`, []any{hash[:], oldHash}},
+		{"revoke token", `DELETE FROM TOKEN WHERE TOKEN_HASH=?;`, []any{oldHash}},
+	}
+	for _, stmt := range stmts {
+		_, err = db.ExecContext(ctx, stmt.query, stmt.args...)
+		if err != nil {
+			return Token{}, fmt.Errorf("rotate token: %v: %w", stmt.what, err)
+		}
+	}
+	return t, nil
+}
+
+// Revokes the tokens matching a condition on TOKEN, along with their session data, and returns how many there were.
+// Revoking is allowed from every state, so this needs no check, but every revocation goes through here so they all drop
+// the same things.
+func revokeTokens(ctx context.Context, db conn, where string, args ...any) (int64, error) {
+	_, err := db.ExecContext(ctx, `DELETE FROM SESSION_DATA WHERE TOKEN_HASH IN (SELECT TOKEN_HASH FROM TOKEN WHERE `+
+		where+`);`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("delete session data: %w", err)
+	}
+	res, err := db.ExecContext(ctx, `DELETE FROM TOKEN WHERE `+where+`;`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("delete token: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete token: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestTokenStateNext(t *testing.T) {
+	states := []TokenState{TokenNone, TokenActive, TokenExpired, TokenRotated, TokenRevoked, TokenReaped}
+	events := []TokenEvent{TokenIssue, TokenExtend, TokenRotate, TokenRevoke, TokenExpire, TokenReap}
+	for _, s := range states {
+		for _, e := range events {
+			next, err := s.Next(e)
+			if err != nil && next != s {
+				t.Errorf("%v on %v: expected a refused transition to stay put, got %v", e, s, next)
+			}
+			if err == nil && next == TokenActive && !(e == TokenIssue || e == TokenExtend && s == TokenActive) {
+				t.Errorf("%v on %v: only issuing or extending may make a token active", e, s)
+			}
+			if s == TokenNone && e != TokenIssue && err == nil {
+				t.Errorf("%v on a token never issued: expected it to be refused", e)
+			}
+		}
+	}
+
+	// Whatever happens, a token that was rotated, revoked or reaped never becomes active again.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		s, dead := TokenNone, false
+		for j := 0; j < 20; j++ {
+			s, _ = s.Next(events[rng.Intn(len(events))])
+			dead = dead || s == TokenRotated || s == TokenRevoked || s == TokenReaped
+			if dead && s == TokenActive {
+				t.Fatalf("a dead token became active again")
+			}
+		}
+	}
+}
+
+// A token issued during a lifecycle run, and where the model says it is.
+type modelToken struct {
+	t     Token
+	state TokenState
+	end   int64
+}
+
+// Runs random sequences of lifecycle operations against the DB, and checks that the DB refuses exactly the transitions
+// the state machine does, and that Lookup accepts exactly the tokens the state machine says are active.
+func TestTokenLifecycleProperties(t *testing.T) {
+	db := newDB(t, "lifecycle")
+	ctx := context.Background()
+	addUsers(t, db, "u")
+	for seed := int64(1); seed <= 100; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		now := int64(1000000)
+		var tokens []*modelToken
+		// Checks the DB agrees with the model about an operation's outcome.
+		expect := func(op string, want, got error) {
+			t.Helper()
+			for _, sentinel := range []error{ErrInvalidToken, ErrIllegalTransition} {
+				if errors.Is(want, sentinel) != errors.Is(got, sentinel) {
+					t.Fatalf("seed %v: %v: expected %v, got %v", seed, op, want, got)
+				}
+			}
+			if want == nil && got != nil {
+				t.Fatalf("seed %v: %v: %v", seed, op, got)
+			}
+		}
+		// Applies an event to the model, recording the new state, and returns its error.
+		apply := func(m *modelToken, e TokenEvent) error {
+			next, err := m.state.Next(e)
+			m.state = next
+			return err
+		}
+		pick := func() *modelToken {
+			return tokens[rng.Intn(len(tokens))]
+		}
+
+		for step := 0; step < 40; step++ {
+			switch op := rng.Intn(7); {
+			case op == 0 || len(tokens) == 0:
+				m := &modelToken{end: now + 1 + rng.Int63n(500)}
+				var err error
+				m.t, err = GenerateToken(ctx, db, "u", time.UnixMilli(now-1), time.UnixMilli(m.end))
+				expect("issue", apply(m, TokenIssue), err)
+				tokens = append(tokens, m)
+			case op == 1:
+				_, err := GenerateToken(ctx, db, "u", time.UnixMilli(now), time.UnixMilli(now-rng.Int63n(10)))
+				expect("issue ending before it starts", ErrIllegalTransition, err)
+			case op == 2:
+				m := pick()
+				end := m.end + rng.Int63n(300) - 50
+				err := ExtendToken(ctx, db, m.t, time.UnixMilli(now), time.UnixMilli(end))
+				want := apply(m, TokenExtend)
+				if want == nil && end <= m.end {
+					want = ErrIllegalTransition
+				} else if want == nil {
+					m.end = end
+				}
+				expect("extend", want, err)
+			case op == 3:
+				m := pick()
+				end := now + 1 + rng.Int63n(500)
+				t2, err := RotateToken(ctx, db, m.t, time.UnixMilli(now), time.UnixMilli(end))
+				want := apply(m, TokenRotate)
+				expect("rotate", want, err)
+				if want == nil {
+					tokens = append(tokens, &modelToken{t: t2, state: TokenActive, end: end})
+				}
+			case op == 4:
+				m := pick()
+				expect("revoke", apply(m, TokenRevoke), RevokeToken(ctx, db, m.t))
+			case op == 5:
+				olderThan := now - rng.Int63n(200)
+				expect("reap", nil, ReapTokens(ctx, db, time.UnixMilli(olderThan), time.UnixMilli(now)))
+				for _, m := range tokens {
+					if m.state == TokenExpired && m.end < olderThan {
+						apply(m, TokenReap)
+					}
+				}
+				err := ReapTokens(ctx, db, time.UnixMilli(now+1), time.UnixMilli(now))
+				expect("reap in the future", ErrIllegalTransition, err)
+			default:
+				now += rng.Int63n(200)
+				for _, m := range tokens {
+					if m.state == TokenActive && m.end < now {
+						apply(m, TokenExpire)
+					}
+				}
+			}
+
+			for i, m := range tokens {
+				_, err := Lookup(ctx, db, m.t, time.UnixMilli(now))
+				if (err == nil) != (m.state == TokenActive) {
+					t.Fatalf("seed %v, step %v: token %v is %v, but lookup returned %v", seed, step, i, m.state, err)
+				}
+				_, err = TokenExpiry(ctx, db, m.t)
+				stored := m.state == TokenActive || m.state == TokenExpired
+				if (err == nil) != stored {
+					t.Fatalf("seed %v, step %v: token %v is %v, but its row exists: %v", seed, step, i, m.state, err == nil)
+				}
+			}
+		}
+	}
+}
+
+func TestRotateToken(t *testing.T) {
+	db := newDB(t, "rotate")
+	ctx := context.Background()
+	addUsers(t, db, "u")
+	now := time.Now()
+	for _, role := range []string{"reader", "writer"} {
+		if err := GrantRole(ctx, db, "u", role, now); err != nil {
+			t.Fatalf("grant role: %v", err)
+		}
+	}
+	old, err := GenerateScopedToken(ctx, db, "u", []string{"reader"}, now.Add(-time.Minute), now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	err = SetSessionValue(ctx, db, old, "cart", []byte("3 apples"))
+	if err != nil {
+		t.Fatalf("set session value: %v", err)
+	}
+	rotated, err := RotateToken(ctx, db, old, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if _, err := Lookup(ctx, db, old, now); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected the old token to be revoked, got %v", err)
+	}
+	reader, err := TokenHasRole(ctx, db, rotated, "reader")
+	if err != nil {
+		t.Fatalf("check role: %v", err)
+	}
+	writer, err := TokenHasRole(ctx, db, rotated, "writer")
+	if err != nil || !reader || writer {
+		t.Fatalf("expected the rotated token to keep its scope, got reader %v writer %v %v", reader, writer, err)
+	}
+	v, err := SessionValue(ctx, db, rotated, "cart")
+	if err != nil || string(v) != "3 apples" {
+		t.Fatalf("expected the session data to move to the rotated token, got %q %v", v, err)
+	}
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Brute force protection for log ins. Failures are counted per account and per client IP; past a threshold, log ins for
+// that account or IP are refused for a while, doubling with each further failure.
+
+// Returned when log ins for an account or IP are refused after too many failures.
+var ErrLockedOut = errors.New("too many failed log ins, try again later")
+
+// How log in failures are throttled. The zero value uses the defaults.
+type LoginLockout struct {
+	// Failures for an account before it is locked. Defaults to 5.
+	AccountThreshold int
+	// Failures from an IP before it is locked. Defaults to 20, since many users may share an IP.
+	IPThreshold int
+	// How long the first lockout lasts. Each further failure doubles it. Defaults to a minute.
+	Base time.Duration
+	// The longest lockout. Defaults to an hour.
+	Max time.Duration
+	// Failures are forgotten once none have happened for this long. Defaults to a day.
+	Reset time.Duration
+}
+
+func (l LoginLockout) base() time.Duration {
+	if l.Base == 0 {
+		return time.Minute
+	}
+	return l.Base
+}
+
+func (l LoginLockout) max() time.Duration {
+	if l.Max == 0 {
+		return time.Hour
+	}
+	return l.Max
+}
+
+func (l LoginLockout) reset() time.Duration {
+	if l.Reset == 0 {
+		return 24 * time.Hour
+	}
+	return l.Reset
+}
+
+// Returns how long to lock out a subject after the given number of failures, or 0 if it is below the threshold.
+func (l LoginLockout) lockFor(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	d := l.base()
+	for i := threshold; i < failures && d < l.max(); i++ {
+		d *= 2
+	}
+	if d > l.max() {
+		d = l.max()
+	}
+	return d
+}
+
+// The subjects failures are counted against for a log in.
+func loginSubjects(ctx context.Context, l LoginLockout, email string) []lockoutSubject {
+	threshold := l.AccountThreshold
+	if threshold == 0 {
+		threshold = 5
+	}
+	subjects := []lockoutSubject{{"email:" + strings.ToLower(email), threshold}}
+	if ip := ClientIP(ctx); ip != "" {
+		threshold := l.IPThreshold
+		if threshold == 0 {
+			threshold = 20
+		}
+		subjects = append(subjects, lockoutSubject{"ip:" + ip, threshold})
+	}
+	return subjects
+}
+
+type lockoutSubject struct {
+	name      string
+	threshold int
+}
+
+// Counts a failed log in against the subject, e.g "email:a@b.com", and locks it out if the threshold has been reached.
+// Returns when the subject is locked until, which is the zero time if it isn't.
+func RecordFailedLogin(ctx context.Context, db conn, l LoginLockout, subject string, threshold int, now time.Time) (time.Time, error) {
+	until, _, err := recordFailure(ctx, db, l, subject, threshold, now)
+	return until, err
+}
+
+// Like RecordFailedLogin, but also reports whether this failure started the subject's lockout, rather than extending
+// one already started since its failures were last forgotten.
+func recordFailure(ctx context.Context, db conn, l LoginLockout, subject string, threshold int, now time.Time) (time.Time, bool, error) {
+	row := db.QueryRowContext(ctx, `INSERT INTO FAILED_LOGIN (SUBJECT, FAILURES, LAST_FAILURE_TIME, LOCKED_UNTIL_TIME) VALUES (?, 1, ?, 0)
+ON CONFLICT(SUBJECT) DO UPDATE SET
+	FAILURES = CASE WHEN LAST_FAILURE_TIME < ? THEN 1 ELSE FAILURES + 1 END,
+	LAST_FAILURE_TIME = excluded.LAST_FAILURE_TIME
+RETURNING FAILURES;`, subject, now.UnixMilli(), now.Add(-l.reset()).UnixMilli())
+	var failures int
+	err := row.Scan(&failures)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("count failure: %w", err)
+	}
+	d := l.lockFor(failures, threshold)
+	if d == 0 {
+		return time.Time{}, false, nil
+	}
+	until := now.Add(d)
+	_, err = db.ExecContext(ctx, `UPDATE FAILED_LOGIN SET LOCKED_UNTIL_TIME=? WHERE SUBJECT=?;`, until.UnixMilli(), subject)
+	if err != nil {
+		return until, false, fmt.Errorf("lock: %w", err)
+	}
+	return until, failures == threshold, nil
+}
+
+// Reports whether log ins for the subject are locked out at the given time.
+func LockedOut(ctx context.Context, db conn, subject string, now time.Time) (bool, error) {
+	row := db.QueryRowContext(ctx, `SELECT LOCKED_UNTIL_TIME FROM FAILED_LOGIN WHERE SUBJECT=?`, subject)
+	var until int64
+	err := row.Scan(&until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("parse lockout: %w", err)
+	}
+	return now.UnixMilli() < until, nil
+}
+
+// Forgets the subject's failures, e.g after a successful log in.
+func ClearFailedLogins(ctx context.Context, db conn, subject string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM FAILED_LOGIN WHERE SUBJECT=?;`, subject)
+	if err != nil {
+		return fmt.Errorf("clear failures: %w", err)
+	}
+	return nil
+}
+
+// Drops failure counts with no failures since the given time, once their lockout is over.
+func ReapFailedLogins(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM FAILED_LOGIN WHERE LAST_FAILURE_TIME < ? AND LOCKED_UNTIL_TIME < ?;`,
+		olderThan.UnixMilli(), olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
+
+// Returns ErrLockedOut if the log in's account or IP is locked out.
+func (d DBAuthenticator) checkLockout(ctx context.Context, email string, now time.Time) error {
+	for _, s := range loginSubjects(ctx, *d.Lockout, email) {
+		locked, err := LockedOut(ctx, d.conn(), s.name, now)
+		if err != nil {
+			return fmt.Errorf("check lockout: %w", err)
+		}
+		if locked {
+			return ErrLockedOut
+		}
+	}
+	return nil
+}
+
+// Counts a failed log in against its account and IP. When either becomes locked, operators are notified and a locked
+// account records an event. Further failures only extend the lockout, so they don't notify again until the failures
+// are forgotten, see LoginLockout.Reset.
+func (d DBAuthenticator) recordFailedLogin(ctx context.Context, email string, now time.Time) error {
+	for _, s := range loginSubjects(ctx, *d.Lockout, email) {
+		var until time.Time
+		var locked bool
+		// One transaction, so a retry can't count the failure twice.
+		err := d.retry(ctx, RetryLogin, func() error {
+			tx, err := d.DB.BeginTx(ctx, nil)
+			if err != nil {
+				return fmt.Errorf("open transaction: %w", err)
+			}
+			defer tx.Rollback()
+			until, locked, err = recordFailure(ctx, d.wrap(tx), *d.Lockout, s.name, s.threshold, now)
+			if err != nil {
+				return err
+			}
+			if locked && strings.HasPrefix(s.name, "email:") {
+				err = recordLockedAccount(ctx, d.wrap(tx), email, until, now)
+				if err != nil {
+					return err
+				}
+			}
+			err = tx.Commit()
+			if err != nil {
+				return fmt.Errorf("commit: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if locked {
+			notifyAll(ctx, d.Notifiers, Notification{
+				Subject: fmt.Sprintf("Locked out log ins for %v", s.name),
+				Body:    fmt.Sprintf("Too many failed log ins for %v; locked until %v.", s.name, until.Format(time.RFC3339)),
+			})
+		}
+	}
+	return nil
+}
+
+// Records that the account logged in to as the given ID or email was locked out, if there is one. Emails are compared
+// ignoring case, like the account's lockout.
+func recordLockedAccount(ctx context.Context, db conn, idOrEmail string, until, now time.Time) error {
+	var uid string
+	err := db.QueryRowContext(ctx, `SELECT ID FROM USER WHERE ID = ? OR lower(EMAIL) = ?;`, idOrEmail,
+		strings.ToLower(idOrEmail)).Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetch user: %w", err)
+	}
+	return recordUserEvent(ctx, db, uid, AccountLocked, map[string]string{"until": until.Format(time.RFC3339)}, now)
+}
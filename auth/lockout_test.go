@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockoutBackoff(t *testing.T) {
+	l := LoginLockout{Base: time.Minute, Max: 5 * time.Minute}
+	for failures, want := range []time.Duration{0, 0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		if got := l.lockFor(failures, 3); got != want {
+			t.Fatalf("%v failures: expected %v, got %v", failures, want, got)
+		}
+	}
+}
+
+func TestRecordFailedLogin(t *testing.T) {
+	db := newDB(t, "failed")
+	ctx := context.Background()
+	l := LoginLockout{}
+	now := time.UnixMilli(1000000)
+	for i := 0; i < 2; i++ {
+		until, err := RecordFailedLogin(ctx, db, l, "email:a@b.com", 3, now)
+		if err != nil || !until.IsZero() {
+			t.Fatalf("failure %v: expected no lockout, got %v %v", i, until, err)
+		}
+	}
+	until, err := RecordFailedLogin(ctx, db, l, "email:a@b.com", 3, now)
+	if err != nil || !until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected a minute lockout, got %v %v", until, err)
+	}
+	for at, want := range map[time.Time]bool{now: true, until: false} {
+		locked, err := LockedOut(ctx, db, "email:a@b.com", at)
+		if err != nil || locked != want {
+			t.Fatalf("at %v: expected locked %v, got %v %v", at, want, locked, err)
+		}
+	}
+
+	// Failures are forgotten after a quiet day.
+	later := now.Add(25 * time.Hour)
+	until, err = RecordFailedLogin(ctx, db, l, "email:a@b.com", 3, later)
+	if err != nil || !until.IsZero() {
+		t.Fatalf("after reset: expected no lockout, got %v %v", until, err)
+	}
+}
+
+func TestAuthenticateLockout(t *testing.T) {
+	db := newDB(t, "lockout")
+	ctx := WithClientIP(context.Background(), "10.0.0.1")
+	notifier := &recordingNotifier{}
+	a := DBAuthenticator{DB: db, Lockout: &LoginLockout{AccountThreshold: 2}, Notifiers: []Notifier{notifier}}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, _, err = a.Authenticate(ctx, "A@b.com", "wrong")
+		if !errors.Is(err, ErrBadCredentials) {
+			t.Fatalf("attempt %v: expected bad credentials, got %v", i, err)
+		}
+	}
+	_, _, err = a.Authenticate(ctx, "a@b.com", "pw")
+	if !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("expected locked out even with the right password, got %v", err)
+	}
+	if len(notifier.sent) != 1 {
+		t.Fatalf("expected one lockout notification, got %v", notifier.sent)
+	}
+	// A failure once the lockout is over extends it without notifying again.
+	err = a.recordFailedLogin(ctx, "a@b.com", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("record failure: %v", err)
+	}
+	if len(notifier.sent) != 1 {
+		t.Fatalf("expected no further notifications, got %v", notifier.sent)
+	}
+	uid, err := LookupByEmail(ctx, db, "a@b.com")
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	events, err := UserEvents(ctx, db, uid)
+	if err != nil {
+		t.Fatalf("events: %v", err)
+	}
+	var locks int
+	for _, e := range events {
+		if e.Kind == AccountLocked {
+			locks++
+		}
+	}
+	if locks != 1 {
+		t.Fatalf("expected one lockout event, got %v", events)
+	}
+
+	mux := AuthServer{Authenticator: a}.Handler("/auth")
+	form := url.Values{"email": {"a@b.com"}, "password": {"pw"}}
+	r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %v: %v", w.Code, w.Body)
+	}
+
+	// Other accounts from other IPs are unaffected.
+	err = a.Register(ctx, "c@d.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	_, _, err = a.Authenticate(WithClientIP(context.Background(), "10.0.0.2"), "c@d.com", "pw")
+	if err != nil {
+		t.Fatalf("other account: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Sends emails to users, e.g to verify their address.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// A Mailer which writes messages to the log instead of sending them. For development only.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, to, subject, body string) error {
+	log.Printf("mail to %v: %v\n%v", to, subject, body)
+	return nil
+}
+
+// A Mailer which sends plain text email through an SMTP server.
+type SMTPMailer struct {
+	// host:port of the SMTP server.
+	Addr string
+	// The sender address.
+	From string
+	// Optional credentials, e.g smtp.PlainAuth.
+	Auth smtp.Auth
+	// Optionally signs messages, so they aren't flagged as spam.
+	DKIM *DKIMSigner
+}
+
+func (m SMTPMailer) Send(ctx context.Context, to, subject, body string) error {
+	msg, err := m.message(to, subject, body, time.Now())
+	if err != nil {
+		return err
+	}
+	err = smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, msg)
+	if err != nil {
+		return fmt.Errorf("smtp send to %v: %w", to, err)
+	}
+	return nil
+}
+
+// Formats an RFC 5322 message, DKIM signed if configured.
+func (m SMTPMailer) message(to, subject, body string, now time.Time) ([]byte, error) {
+	for _, h := range []string{m.From, to, subject} {
+		if strings.ContainsAny(h, "\r\n") {
+			return nil, fmt.Errorf("invalid header value %q", h)
+		}
+	}
+	headers := []mailHeader{
+		{"From", m.From},
+		{"To", to},
+		{"Subject", subject},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+	}
+	body = strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+	if m.DKIM != nil {
+		sig, err := m.DKIM.sign(headers, body, now)
+		if err != nil {
+			return nil, err
+		}
+		headers = append([]mailHeader{sig}, headers...)
+	}
+	var b strings.Builder
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%v: %v\r\n", h.name, h.value)
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Administrative notes and tags on user accounts. These are intended for operators only and should never be shown to the
+// user they describe. Every change is recorded in the user's history as an operator event, which is left out of what the
+// user is shown too, see CollectPersonalData. Operators manage them through NotesHandler.
+
+// A note left on a user account.
+type UserNote struct {
+	UID     string
+	Author  string
+	Note    string
+	Created time.Time
+}
+
+// Appends a note to the given user's timeline, and records who added it. Use a transaction, so the note is never stored
+// without its record.
+func AddUserNote(ctx context.Context, db conn, uid, author, note string, now time.Time) error {
+	if strings.TrimSpace(note) == "" {
+		return fmt.Errorf("empty note")
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO USER_NOTE (UID, AUTHOR, NOTE, CREATED_TIME) VALUES (?, ?, ?, ?);`,
+		uid, author, note, now.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("insert note: %w", err)
+	}
+	return recordUserEvent(ctx, db, uid, NoteAdded, map[string]string{"author": author}, now)
+}
+
+// Returns all notes on the given user, oldest first.
+func UserNotes(ctx context.Context, db conn, uid string) ([]UserNote, error) {
+	rows, err := db.QueryContext(ctx, `SELECT UID, AUTHOR, NOTE, CREATED_TIME FROM USER_NOTE WHERE UID=? ORDER BY CREATED_TIME, ROWID;`, uid)
+	if err != nil {
+		return nil, fmt.Errorf("fetch notes: %w", err)
+	}
+	defer rows.Close()
+	var notes []UserNote
+	for rows.Next() {
+		var n UserNote
+		var created int64
+		err = rows.Scan(&n.UID, &n.Author, &n.Note, &created)
+		if err != nil {
+			return nil, fmt.Errorf("scan note: %w", err)
+		}
+		n.Created = time.UnixMilli(created)
+		notes = append(notes, n)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate notes: %w", err)
+	}
+	return notes, nil
+}
+
+// Tags are compared case insensitively, so we store them lower case.
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "", fmt.Errorf("empty tag")
+	}
+	return tag, nil
+}
+
+// Adds a tag to the given user, and records who added it. Tagging a user with a tag they already have is a no-op.
+func TagUser(ctx context.Context, db conn, uid, author, tag string, now time.Time) error {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO USER_TAG (UID, TAG) VALUES (?, ?);`, uid, tag)
+	if err != nil {
+		return fmt.Errorf("insert tag: %w", err)
+	}
+	return recordTagEvent(ctx, db, res, uid, Tagged, author, tag, now)
+}
+
+// Removes a tag from the given user, if present, and records who removed it.
+func UntagUser(ctx context.Context, db conn, uid, author, tag string, now time.Time) error {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `DELETE FROM USER_TAG WHERE UID=? AND TAG=?;`, uid, tag)
+	if err != nil {
+		return fmt.Errorf("delete tag: %w", err)
+	}
+	return recordTagEvent(ctx, db, res, uid, Untagged, author, tag, now)
+}
+
+// Records a tag change in the user's history, if it changed anything.
+func recordTagEvent(ctx context.Context, db conn, res sql.Result, uid, kind, author, tag string, now time.Time) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	return recordUserEvent(ctx, db, uid, kind, map[string]string{"author": author, "tag": tag}, now)
+}
+
+// Returns the tags on the given user, sorted.
+func UserTags(ctx context.Context, db conn, uid string) ([]string, error) {
+	return queryStrings(ctx, db, `SELECT TAG FROM USER_TAG WHERE UID=? ORDER BY TAG;`, uid)
+}
+
+// Returns the IDs of all users with the given tag, sorted.
+func UsersWithTag(ctx context.Context, db conn, tag string) ([]string, error) {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	return queryStrings(ctx, db, `SELECT UID FROM USER_TAG WHERE TAG=? ORDER BY UID;`, tag)
+}
+
+// Runs a query returning a single text column and collects the results.
+func queryStrings(ctx context.Context, db conn, query string, args ...any) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var s string
+		err = rows.Scan(&s)
+		if err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		res = append(res, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate: %w", err)
+	}
+	return res, nil
+}
+
+// What operators see of a user: their notes and tags, and who changed them when.
+type AccountNotes struct {
+	UID   string     `json:"uid"`
+	Notes []UserNote `json:"notes"`
+	Tags  []string   `json:"tags"`
+	// The notes and tags added and removed, oldest first.
+	Audit []UserEvent `json:"audit"`
+}
+
+// Collects the notes and tags on the given user, and their history. Use a transaction for a consistent snapshot.
+func CollectAccountNotes(ctx context.Context, db conn, uid string) (AccountNotes, error) {
+	a := AccountNotes{UID: uid}
+	var err error
+	a.Notes, err = UserNotes(ctx, db, uid)
+	if err != nil {
+		return a, err
+	}
+	a.Tags, err = UserTags(ctx, db, uid)
+	if err != nil {
+		return a, err
+	}
+	events, err := UserEvents(ctx, db, uid)
+	if err != nil {
+		return a, err
+	}
+	for _, e := range events {
+		if operatorEvent(e.Kind) {
+			a.Audit = append(a.Audit, e)
+		}
+	}
+	return a, nil
+}
+
+// Serves the operator API for notes and tags, to requests bearing Secret as a bearer token. GET with "uid" returns the
+// user's AccountNotes, and GET with "tag" the IDs of the users with the tag. POST changes a user and returns their
+// AccountNotes:
+//
+//	POST {"uid": "user1", "author": "alice", "note": "called about billing", "tag": ["vip"], "untag": ["fraud-review"]}
+//
+// The author is who the change is recorded as being made by. Anyone with the secret may name any author, so give each
+// operator tool its own handler and secret if that matters. Browsers, which ask for HTML, are shown the same as a page.
+type NotesHandler struct {
+	DB     *sql.DB
+	Secret string
+	// Where the auth tables are, if they share the DB with an application.
+	Schema *Schema
+	// The pages, see ParseTemplates. Defaults to the bundled ones.
+	Templates *template.Template
+}
+
+func (h NotesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !checkBearer(w, r, h.Secret) {
+		return
+	}
+	ctx := r.Context()
+	var uid string
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query()
+		if tag := q.Get("tag"); tag != "" {
+			users, err := UsersWithTag(ctx, h.Schema.wrap(h.DB), tag)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			h.respond(w, r, PageData{Page: "notes.html", Title: "Users tagged " + tag, Tagged: users}, users)
+			return
+		}
+		uid = q.Get("uid")
+	case "POST":
+		var req struct {
+			UID    string   `json:"uid"`
+			Author string   `json:"author"`
+			Note   string   `json:"note"`
+			Tag    []string `json:"tag"`
+			Untag  []string `json:"untag"`
+		}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("parse body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Author == "" {
+			http.Error(w, "author is required", http.StatusBadRequest)
+			return
+		}
+		err = h.change(ctx, req.UID, req.Author, req.Note, req.Tag, req.Untag)
+		if errors.Is(err, ErrBadCredentials) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		uid = req.UID
+	default:
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	if uid == "" {
+		http.Error(w, "uid or tag is required", http.StatusBadRequest)
+		return
+	}
+	notes, err := CollectAccountNotes(ctx, h.Schema.wrap(h.DB), uid)
+	if err != nil {
+		log.Printf("error: notes: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, r, PageData{Page: "notes.html", Title: "Notes on " + uid, Account: &notes}, notes)
+}
+
+// Adds the note and changes the tags of an existing user, all or nothing. Returns ErrBadCredentials if there is no such
+// user.
+func (h NotesHandler) change(ctx context.Context, uid, author, note string, tag, untag []string) error {
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("open transaction: %w", err)
+	}
+	defer tx.Rollback()
+	db := h.Schema.wrap(tx)
+	var exists bool
+	err = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM USER WHERE ID=?);`, uid).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("fetch user: %w", err)
+	}
+	if !exists {
+		return ErrBadCredentials
+	}
+	now := time.Now()
+	if note != "" {
+		err = AddUserNote(ctx, db, uid, author, note, now)
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range tag {
+		err = TagUser(ctx, db, uid, author, t, now)
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range untag {
+		err = UntagUser(ctx, db, uid, author, t, now)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// Writes v as JSON, or the page to browsers.
+func (h NotesHandler) respond(w http.ResponseWriter, r *http.Request, page PageData, v any) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	t := h.Templates
+	if t == nil {
+		t = defaultTemplates
+	}
+	var b bytes.Buffer
+	err := t.ExecuteTemplate(&b, page.Page, page)
+	if err != nil {
+		log.Printf("error: render %v: %v", page.Page, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserNotes(t *testing.T) {
+	db := newDB(t, "notes")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register user: %v", err)
+	}
+	err = AddUserNote(ctx, db, "user1", "admin", "first", time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("add note: %v", err)
+	}
+	err = AddUserNote(ctx, db, "user1", "admin", "second", time.UnixMilli(2000))
+	if err != nil {
+		t.Fatalf("add note: %v", err)
+	}
+	err = AddUserNote(ctx, db, "user1", "admin", "  ", time.UnixMilli(3000))
+	if err == nil {
+		t.Fatal("empty note succeeded")
+	}
+	notes, err := UserNotes(ctx, db, "user1")
+	if err != nil {
+		t.Fatalf("list notes: %v", err)
+	}
+	if len(notes) != 2 || notes[0].Note != "first" || notes[1].Note != "second" {
+		t.Fatalf("expected notes [first second], got %v", notes)
+	}
+}
+
+func TestUserTags(t *testing.T) {
+	db := newDB(t, "tags")
+	ctx := context.Background()
+	for _, id := range []string{"user1", "user2"} {
+		err := RegisterUserWith(ctx, db, PasswordOptions{}, id, id+"@localhost", "pw1")
+		if err != nil {
+			t.Fatalf("register user: %v", err)
+		}
+	}
+	for _, tag := range []string{"VIP", "vip", "fraud-review"} {
+		err := TagUser(ctx, db, "user1", "admin", tag, time.UnixMilli(1000))
+		if err != nil {
+			t.Fatalf("tag user1 %v: %v", tag, err)
+		}
+	}
+	err := TagUser(ctx, db, "user2", "admin", "vip", time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("tag user2: %v", err)
+	}
+
+	tags, err := UserTags(ctx, db, "user1")
+	if err != nil {
+		t.Fatalf("user tags: %v", err)
+	}
+	if !reflect.DeepEqual(tags, []string{"fraud-review", "vip"}) {
+		t.Fatalf("user1 tags: got %v", tags)
+	}
+	users, err := UsersWithTag(ctx, db, "Vip")
+	if err != nil {
+		t.Fatalf("users with tag: %v", err)
+	}
+	if !reflect.DeepEqual(users, []string{"user1", "user2"}) {
+		t.Fatalf("vip users: got %v", users)
+	}
+
+	err = UntagUser(ctx, db, "user1", "admin", "vip", time.UnixMilli(2000))
+	if err != nil {
+		t.Fatalf("untag: %v", err)
+	}
+	users, err = UsersWithTag(ctx, db, "vip")
+	if err != nil {
+		t.Fatalf("users with tag: %v", err)
+	}
+	if !reflect.DeepEqual(users, []string{"user2"}) {
+		t.Fatalf("vip users after untag: got %v", users)
+	}
+
+	// Each change is recorded once, repeated tags aside.
+	events, err := UserEvents(ctx, db, "user1")
+	if err != nil {
+		t.Fatalf("events: %v", err)
+	}
+	var changes []string
+	for _, e := range events {
+		if operatorEvent(e.Kind) {
+			changes = append(changes, e.Kind+" "+e.Data["tag"]+" by "+e.Data["author"])
+		}
+	}
+	want := []string{"tagged vip by admin", "tagged fraud-review by admin", "untagged vip by admin"}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("expected %v, got %v", want, changes)
+	}
+}
+
+func TestNotesHandler(t *testing.T) {
+	db := newDB(t, "noteshandler")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register user: %v", err)
+	}
+	h := NotesHandler{DB: db, Secret: "s3cret"}
+	do := func(method, target, body, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer s3cret")
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/admin/notes?uid=user1", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the secret, got %v", w.Code)
+	}
+	w = do("POST", "/admin/notes", `{"uid": "nobody", "author": "alice", "tag": ["vip"]}`, "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %v", w.Code)
+	}
+	w = do("POST", "/admin/notes", `{"uid": "user1", "note": "no author"}`, "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without an author, got %v", w.Code)
+	}
+	// A bad tag leaves the note unwritten too.
+	w = do("POST", "/admin/notes", `{"uid": "user1", "author": "alice", "note": "lost", "tag": [" "]}`, "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty tag, got %v", w.Code)
+	}
+
+	w = do("POST", "/admin/notes", `{"uid": "user1", "author": "alice", "note": "called about billing", "tag": ["vip", "fraud-review"]}`, "")
+	var got AccountNotes
+	if err = json.NewDecoder(w.Body).Decode(&got); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %v: %v", w.Code, err)
+	}
+	if len(got.Notes) != 1 || got.Notes[0].Note != "called about billing" || !reflect.DeepEqual(got.Tags, []string{"fraud-review", "vip"}) {
+		t.Fatalf("unexpected notes: %+v", got)
+	}
+	if len(got.Audit) != 3 || got.Audit[0].Kind != NoteAdded || got.Audit[0].Data["author"] != "alice" {
+		t.Fatalf("unexpected audit trail: %+v", got.Audit)
+	}
+
+	w = do("GET", "/admin/notes?tag=VIP", "", "")
+	var users []string
+	if err = json.NewDecoder(w.Body).Decode(&users); err != nil || !reflect.DeepEqual(users, []string{"user1"}) {
+		t.Fatalf("unexpected users %v: %v", users, err)
+	}
+	w = do("GET", "/admin/notes?uid=user1", "", "text/html")
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "called about billing") || !strings.Contains(body, "fraud-review") {
+		t.Fatalf("unexpected page %v: %v", w.Code, body)
+	}
+}
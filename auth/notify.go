@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Security notifications for operators, e.g when a login is blocked.
+
+// A security event worth telling a person about.
+type Notification struct {
+	// A one line summary.
+	Subject string
+	// Details, may be empty.
+	Body string
+}
+
+// Delivers notifications to operators, e.g by email or chat webhook.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Sends each notification to the given sinks, logging rather than returning failures so a broken sink never blocks the
+// event being reported.
+func notifyAll(ctx context.Context, sinks []Notifier, n Notification) {
+	for _, s := range sinks {
+		err := s.Notify(ctx, n)
+		if err != nil {
+			log.Printf("error: notify %T: %v", s, err)
+		}
+	}
+}
+
+// Emails notifications to a fixed address.
+type MailNotifier struct {
+	Mailer Mailer
+	// The operator address to notify.
+	To string
+}
+
+func (m MailNotifier) Notify(ctx context.Context, n Notification) error {
+	return m.Mailer.Send(ctx, m.To, n.Subject, n.Body)
+}
+
+// Posts notifications to a Slack incoming webhook.
+type SlackNotifier struct {
+	// The webhook URL, which is a secret.
+	WebhookURL string
+	// Defaults to a client with a 10s timeout.
+	Client *http.Client
+}
+
+func (s SlackNotifier) Notify(ctx context.Context, n Notification) error {
+	text := n.Subject
+	if n.Body != "" {
+		text = fmt.Sprintf("*%v*\n%v", n.Subject, n.Body)
+	}
+	return postWebhook(ctx, s.Client, s.WebhookURL, map[string]string{"text": text})
+}
+
+// Posts notifications to a Discord webhook.
+type DiscordNotifier struct {
+	// The webhook URL, which is a secret.
+	WebhookURL string
+	// Defaults to a client with a 10s timeout.
+	Client *http.Client
+}
+
+// Discord rejects messages longer than this.
+const discordMaxContent = 2000
+
+func (d DiscordNotifier) Notify(ctx context.Context, n Notification) error {
+	content := n.Subject
+	if n.Body != "" {
+		content = fmt.Sprintf("**%v**\n%v", n.Subject, n.Body)
+	}
+	if r := []rune(content); len(r) > discordMaxContent {
+		content = string(r[:discordMaxContent-1]) + "…"
+	}
+	return postWebhook(ctx, d.Client, d.WebhookURL, map[string]string{"content": content})
+}
+
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// POSTs the payload as JSON, failing on any non 2xx response.
+func postWebhook(ctx context.Context, client *http.Client, webhookURL string, payload any) error {
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encode payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(body))
+	if err != nil {
+		// Don't include the error, it contains the secret URL.
+		return fmt.Errorf("invalid webhook url")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		// Drop the URL from the error, it contains the secret.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("post webhook: %v: %s", resp.Status, msg)
+	}
+	return nil
+}
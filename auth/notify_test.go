@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Collects notifications.
+type recordingNotifier struct {
+	sent []Notification
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, n Notification) error {
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+func TestWebhookNotifiers(t *testing.T) {
+	var got map[string]string
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = nil
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	n := Notification{Subject: "Blocked login", Body: "from 1.2.3.4"}
+
+	err := SlackNotifier{WebhookURL: srv.URL + "/secret"}.Notify(ctx, n)
+	if err != nil {
+		t.Fatalf("slack: %v", err)
+	}
+	if got["text"] != "*Blocked login*\nfrom 1.2.3.4" {
+		t.Fatalf("slack: unexpected payload %v", got)
+	}
+
+	err = DiscordNotifier{WebhookURL: srv.URL + "/secret"}.Notify(ctx, Notification{Subject: strings.Repeat("x", 3000)})
+	if err != nil {
+		t.Fatalf("discord: %v", err)
+	}
+	if n := len([]rune(got["content"])); n != discordMaxContent {
+		t.Fatalf("discord: expected content truncated to %v runes, was %v", discordMaxContent, n)
+	}
+
+	status = http.StatusNotFound
+	err = DiscordNotifier{WebhookURL: srv.URL + "/secret"}.Notify(ctx, n)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected 404 error, got %v", err)
+	}
+
+	// Errors must not leak the webhook URL.
+	err = SlackNotifier{WebhookURL: "http://127.0.0.1:1/secret", Client: &http.Client{Timeout: time.Second}}.Notify(ctx, n)
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Fatalf("expected an error without the URL, got %v", err)
+	}
+}
+
+func TestNotifyBlockedLogin(t *testing.T) {
+	db := newDB(t, "notify")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register user: %v", err)
+	}
+	err = PushRiskSignal(ctx, db, RiskSignal{Subject: "1.2.3.4", Score: 1, Reason: "botnet", Expires: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("push signal: %v", err)
+	}
+	rec := &recordingNotifier{}
+	a := DBAuthenticator{DB: db, MaxRisk: 0.5, Notifiers: []Notifier{rec}}
+	_, _, err = a.Authenticate(WithClientIP(ctx, "1.2.3.4"), "lol@localhost", "pw1")
+	if !errors.Is(err, ErrRiskTooHigh) {
+		t.Fatalf("expected blocked login, got %v", err)
+	}
+	if len(rec.sent) != 1 || !strings.Contains(rec.sent[0].Body, "botnet") {
+		t.Fatalf("expected one notification about the block, got %v", rec.sent)
+	}
+}
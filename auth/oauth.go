@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// A social or other OAuth 2.0 log in provider, e.g Google or GitHub, offered on the log in and sign up pages alongside
+// passwords. Users are matched to accounts by the email the provider verified, so logging in with a provider links it to
+// the existing account with that email, and new users are created without a password following Provisioning. An
+// existing account keeps its password only if its email was verified here too; otherwise the password, which may have
+// been set by someone else, is removed with its sessions, see DBAuthenticator.FederatedLogin. Requires an Authenticator
+// implementing FederatedAuthenticator.
+type OAuthProvider struct {
+	// Text of the log in button, e.g "Continue with GitHub".
+	Label string
+	// The client registered with the provider. The RedirectURL is the provider's page under the OAuth route, e.g
+	// "https://example.com/auth/oauth/github" for the provider named "github".
+	Config oauth2.Config
+	// Returns who the provider says the user is, from its token response. The nonce is the one sent with the
+	// authorization request, for OpenID Connect ID tokens. The identity's Email must be one the provider verified.
+	Identify func(ctx context.Context, tok *oauth2.Token, nonce string) (FederatedIdentity, error)
+	// How users logging in for the first time are created. None are when AuthServer.DisableSignup is set.
+	Provisioning Provisioning
+}
+
+// Returns a provider for an OpenID Connect issuer, from oidc.NewProvider. Users are identified by the ID token, which
+// must vouch for a verified email.
+func OIDCProvider(label string, p *oidc.Provider, clientID, clientSecret, redirectURL string, scopes ...string) *OAuthProvider {
+	sso := &SSO{Provider: p, ClientID: clientID, ClientSecret: clientSecret, RedirectURL: redirectURL, Scopes: scopes}
+	return &OAuthProvider{Label: label, Config: sso.config(), Identify: sso.verify}
+}
+
+// Returns a provider for Google accounts, which use OpenID Connect. Fetches Google's discovery document.
+func GoogleProvider(ctx context.Context, clientID, clientSecret, redirectURL string) (*OAuthProvider, error) {
+	p, err := oidc.NewProvider(ctx, "https://accounts.google.com")
+	if err != nil {
+		return nil, fmt.Errorf("discover google: %w", err)
+	}
+	return OIDCProvider("Continue with Google", p, clientID, clientSecret, redirectURL, "profile"), nil
+}
+
+// Returns a provider for GitHub accounts. GitHub only speaks plain OAuth 2.0, so users are identified by their primary
+// email from its API, which GitHub must have verified.
+func GitHubProvider(clientID, clientSecret, redirectURL string) *OAuthProvider {
+	return &OAuthProvider{
+		Label: "Continue with GitHub",
+		Config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     github.Endpoint,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"read:user", "user:email"},
+		},
+		Identify: githubIdentity("https://api.github.com"),
+	}
+}
+
+// Identifies GitHub users with the API at the given URL. The claims are the user's profile, e.g "login" and "name",
+// besides the email.
+func githubIdentity(api string) func(ctx context.Context, tok *oauth2.Token, nonce string) (FederatedIdentity, error) {
+	return func(ctx context.Context, tok *oauth2.Token, nonce string) (FederatedIdentity, error) {
+		var id FederatedIdentity
+		client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(tok))
+		get := func(path string, v any) error {
+			resp, err := client.Get(api + path)
+			if err != nil {
+				return fmt.Errorf("get %v: %w", path, err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("get %v: %v", path, resp.Status)
+			}
+			err = json.NewDecoder(resp.Body).Decode(v)
+			if err != nil {
+				return fmt.Errorf("parse %v: %w", path, err)
+			}
+			return nil
+		}
+		err := get("/user", &id.Claims)
+		if err != nil {
+			return id, err
+		}
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		err = get("/user/emails", &emails)
+		if err != nil {
+			return id, err
+		}
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				id.Email = e.Email
+			}
+		}
+		if id.Email == "" {
+			return id, fmt.Errorf("github account has no verified primary email")
+		}
+		id.Claims["email"] = id.Email
+		id.Claims["email_verified"] = true
+		return id, nil
+	}
+}
+
+// A button on the log in and sign up pages, see PageData.
+type OAuthLink struct {
+	Label string
+	Href  string
+}
+
+// Returns the buttons for the OAuth providers, sorted by name, carrying the page's query so the log in finishes as
+// asked.
+func (a AuthServer) oauthLinks(rawQuery string) []OAuthLink {
+	prefix, ok := a.routes[RouteOAuth]
+	if !ok || a.SSO != nil {
+		return nil
+	}
+	var names []string
+	for name := range a.OAuth {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var links []OAuthLink
+	for _, name := range names {
+		href := prefix + name
+		if rawQuery != "" {
+			href += "?" + rawQuery
+		}
+		links = append(links, OAuthLink{Label: a.OAuth[name].Label, Href: href})
+	}
+	return links
+}
+
+// Serves each of the OAuth providers under the OAuth route, e.g "/auth/oauth/github": sends the user to the provider,
+// or, when they come back with a code, logs them in.
+func (a AuthServer) oauthHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, a.link(RouteOAuth, ""))
+	p := a.OAuth[name]
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("state") == "" {
+		a.beginFederated(w, r, RouteOAuth, name, p.Config)
+		return
+	}
+	attempt, ok := a.federatedCallback(w, r, RouteOAuth)
+	if !ok {
+		return
+	}
+	if attempt.key != name {
+		http.Error(w, "oauth: unknown or expired log in attempt, please try again", http.StatusBadRequest)
+		return
+	}
+	tok, ok := a.exchangeCode(w, r, RouteOAuth, p.Config, attempt.verifier)
+	if !ok {
+		return
+	}
+	id, err := p.Identify(r.Context(), tok, attempt.nonce)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("oauth: %v", err), http.StatusUnauthorized)
+		return
+	}
+	// Users whose domain has its own identity provider must log in there.
+	if !a.checkRealm(w, id.Email) {
+		return
+	}
+	// With sign up turned off, providers only log in existing users.
+	provisioning := p.Provisioning
+	provisioning.Deny = provisioning.Deny || a.DisableSignup
+	a.federatedLogin(w, r, RouteOAuth, id, provisioning, attempt.query)
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// A minimal GitHub, which logs everyone in as a user with the given emails.
+func fakeGitHub(t *testing.T, emails []map[string]any) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=code1&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "code1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "gh1", "token_type": "bearer"})
+	})
+	authorized := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer gh1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+	mux.HandleFunc("/user", authorized(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"login": "octocat", "name": "Mona"})
+	}))
+	mux.HandleFunc("/user/emails", authorized(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(emails)
+	}))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOAuthLogin(t *testing.T) {
+	db := newDB(t, "oauth")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	// Someone who registered a@b.com without verifying it, and is still logged in.
+	squatter, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	provider, err := oidc.NewProvider(ctx, fakeIdP(t, "new@b.com", map[string]any{"name": "New"}).URL)
+	if err != nil {
+		t.Fatalf("discover provider: %v", err)
+	}
+	gh := fakeGitHub(t, []map[string]any{
+		{"email": "old@b.com", "primary": false, "verified": true},
+		{"email": "a@b.com", "primary": true, "verified": true},
+	})
+	github := GitHubProvider("app", "s3cret", "https://example.com/auth/oauth/github")
+	github.Config.Endpoint = oauth2.Endpoint{AuthURL: gh.URL + "/login/oauth/authorize", TokenURL: gh.URL + "/login/oauth/access_token"}
+	github.Identify = githubIdentity(gh.URL)
+	oauth := map[string]*OAuthProvider{
+		"acme":   OIDCProvider("Continue with Acme", provider, "app", "s3cret", "https://example.com/auth/oauth/acme"),
+		"github": github,
+	}
+	oauth["acme"].Provisioning.Attributes = map[string]string{"name": "display_name"}
+	mux := AuthServer{Authenticator: a, OAuth: oauth}.Handler("/auth")
+	get := func(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	// Starts a log in, follows the provider's redirect, and returns the callback and the state cookie.
+	start := func(target string) (string, *http.Cookie) {
+		w := get(target)
+		state := responseCookie(w, "auth_oauth")
+		if w.Code != http.StatusFound || state == nil || state.Path != "/auth/oauth/" {
+			t.Fatalf("start: expected redirect with a state cookie, got %v: %v", w.Code, w.Header())
+		}
+		resp, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}).Get(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("authorize: %v", err)
+		}
+		resp.Body.Close()
+		callback, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatalf("parse callback: %v", err)
+		}
+		return callback.RequestURI(), state
+	}
+	// Returns who the token cookie in a response belongs to.
+	user := func(w *httptest.ResponseRecorder) string {
+		var tok Token
+		if c := responseCookie(w, "auth_token"); c == nil || tok.UnmarshalText([]byte(c.Value)) != nil {
+			t.Fatalf("expected a token cookie: %v", w.Header())
+		}
+		uid, err := a.store().LookupToken(ctx, tok, time.Now())
+		if err != nil {
+			t.Fatalf("lookup token: %v", err)
+		}
+		return uid
+	}
+
+	for _, page := range []string{"/auth/login?redirect=%2Fsecured", "/auth/signup?redirect=%2Fsecured"} {
+		body := get(page).Body.String()
+		for _, want := range []string{`href="/auth/oauth/acme?redirect=%2Fsecured"> Continue with Acme`, `href="/auth/oauth/github?redirect=%2Fsecured"> Continue with GitHub`} {
+			if !strings.Contains(body, want) {
+				t.Fatalf("%v: expected the page to contain %v: %v", page, want, body)
+			}
+		}
+	}
+	if w := get("/auth/oauth/gitlab"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown provider: expected 404, got %v", w.Code)
+	}
+
+	// New users are created without a password.
+	callback, state := start("/auth/oauth/acme?redirect=%2Fsecured")
+	if w := get(callback); w.Code != http.StatusBadRequest {
+		t.Fatalf("callback without the state cookie: expected 400, got %v", w.Code)
+	}
+	w := get(callback, state)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/secured" {
+		t.Fatalf("callback: expected redirect to /secured, got %v %v: %v", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	if uid := user(w); uid != "new@b.com" {
+		t.Fatalf("expected a token for the new user, got %v", uid)
+	}
+	attrs, err := UserAttributes(ctx, db, "new@b.com")
+	if err != nil || attrs["display_name"] != "New" {
+		t.Fatalf("expected the new user to be provisioned, got %v %v", attrs, err)
+	}
+	if err = Authenticate(ctx, db, "new@b.com", ""); err != ErrBadCredentials {
+		t.Fatalf("expected bad credentials for an OAuth user, got %v", err)
+	}
+
+	// Existing users are linked by the email the provider verified. This one's email was never verified locally, so
+	// whoever set the password may not own it: the password and its sessions are revoked.
+	callback, state = start("/auth/oauth/github")
+	if w := get(strings.Replace(callback, "/github", "/acme", 1), state); w.Code != http.StatusBadRequest {
+		t.Fatalf("callback to another provider: expected 400, got %v", w.Code)
+	}
+	w = get(callback, state)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("callback: expected redirect to /, got %v %v: %v", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	if uid := user(w); uid != "a@b.com" {
+		t.Fatalf("expected a token for the existing user, got %v", uid)
+	}
+	if err = Authenticate(ctx, db, "a@b.com", "pw"); err != ErrBadCredentials {
+		t.Fatalf("expected the unverified password to be removed, got %v", err)
+	}
+	if _, err := Lookup(ctx, db, squatter, time.Now()); err != ErrInvalidToken {
+		t.Fatalf("expected the unverified account's sessions to be revoked, got %v", err)
+	}
+	events, err := UserEvents(ctx, db, "a@b.com")
+	if err != nil || events[len(events)-1].Kind != AccountLinked || events[len(events)-1].Data["password_removed"] != "true" {
+		t.Fatalf("expected the link to be recorded, got %+v %v", events, err)
+	}
+
+	// Accounts whose email was verified keep their password.
+	if err := a.Register(ctx, "v@b.com", "pw"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE USER SET VALID=TRUE WHERE ID=?;`, "v@b.com"); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	oauth["github"].Identify = githubIdentity(fakeGitHub(t, []map[string]any{{"email": "v@b.com", "primary": true, "verified": true}}).URL)
+	if uid := user(get(start("/auth/oauth/github"))); uid != "v@b.com" {
+		t.Fatalf("expected a token for the verified user, got %v", uid)
+	}
+	if err = Authenticate(ctx, db, "v@b.com", "pw"); err != nil {
+		t.Fatalf("expected the verified password to still work, got %v", err)
+	}
+
+	oauth["github"].Provisioning.Deny = true
+	oauth["github"].Identify = githubIdentity(fakeGitHub(t, []map[string]any{{"email": "c@b.com", "primary": true, "verified": true}}).URL)
+	if w := get(start("/auth/oauth/github")); w.Code != http.StatusForbidden {
+		t.Fatalf("denied provisioning: expected 403, got %v: %v", w.Code, w.Body)
+	}
+}
+
+func TestGitHubIdentity(t *testing.T) {
+	ctx := context.Background()
+	tok := &oauth2.Token{AccessToken: "gh1", TokenType: "bearer"}
+	id, err := githubIdentity(fakeGitHub(t, []map[string]any{{"email": "a@b.com", "primary": true, "verified": true}}).URL)(ctx, tok, "")
+	if err != nil || id.Email != "a@b.com" || id.Claims["login"] != "octocat" || id.Claims["email_verified"] != true {
+		t.Fatalf("expected the primary email and profile, got %v %v", id, err)
+	}
+	_, err = githubIdentity(fakeGitHub(t, []map[string]any{{"email": "a@b.com", "primary": true, "verified": false}}).URL)(ctx, tok, "")
+	if err == nil {
+		t.Fatal("expected an unverified email to be refused")
+	}
+	_, err = githubIdentity(fakeGitHub(t, nil).URL)(ctx, &oauth2.Token{AccessToken: "stolen"}, "")
+	if err == nil {
+		t.Fatal("expected a refused token to fail")
+	}
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// One time passcodes. Every flow that sends the user a short numeric code (email codes, SMS, device pairing) should issue
+// and verify it here, so attempt limits and invalidation are enforced the same way everywhere. Codes are scoped by a
+// purpose (e.g "email-login") and a subject (e.g the user ID), and a subject has at most one live code per purpose.
+
+// Returned when a one time passcode is wrong, expired or missing.
+var ErrInvalidOTP = errors.New("invalid or expired code")
+
+// Returned when the last attempt at a one time passcode is used up. The code is no longer valid.
+var ErrOTPAttempts = errors.New("too many attempts, request a new code")
+
+// Creates a random numeric code of the given number of digits, replacing any previous code for the purpose and subject.
+// The code may be tried maxAttempts times before it is invalidated.
+func IssueOTP(ctx context.Context, db conn, purpose, subject string, digits, maxAttempts int, expires time.Time) (string, error) {
+	if digits < 6 || digits > 18 {
+		return "", fmt.Errorf("otp: digits must be between 6 and 18, was %v", digits)
+	}
+	if maxAttempts < 1 {
+		return "", fmt.Errorf("otp: maxAttempts must be positive, was %v", maxAttempts)
+	}
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+	code := fmt.Sprintf("%0*d", digits, n)
+	_, err = db.ExecContext(ctx, `INSERT OR REPLACE INTO OTP (PURPOSE, SUBJECT, CODE_HASH, ATTEMPTS_LEFT, EXPIRES_TIME)
+	VALUES (?, ?, ?, ?, ?);`, purpose, subject, otpHash(purpose, subject, code), maxAttempts, expires.UnixMilli())
+	if err != nil {
+		return "", fmt.Errorf("insert otp: %w", err)
+	}
+	return code, nil
+}
+
+// Checks a code for the purpose and subject. A correct code is consumed. Every wrong guess uses up an attempt, and the
+// code is deleted once they run out, returning ErrOTPAttempts. Returns ErrInvalidOTP for wrong, expired or missing codes.
+// Use a transaction, so concurrent guesses can't share an attempt.
+func VerifyOTP(ctx context.Context, db conn, purpose, subject, code string, now time.Time) error {
+	row := db.QueryRowContext(ctx, `SELECT CODE_HASH, ATTEMPTS_LEFT FROM OTP WHERE
+	PURPOSE=? AND
+	SUBJECT=? AND
+	EXPIRES_TIME >= ?`, purpose, subject, now.UnixMilli())
+	var hash []byte
+	var attempts int
+	err := row.Scan(&hash, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidOTP
+	}
+	if err != nil {
+		return fmt.Errorf("parse otp: %w", err)
+	}
+	if subtle.ConstantTimeCompare(hash, otpHash(purpose, subject, code)) == 1 {
+		_, err = db.ExecContext(ctx, `DELETE FROM OTP WHERE PURPOSE=? AND SUBJECT=?`, purpose, subject)
+		if err != nil {
+			return fmt.Errorf("consume otp: %w", err)
+		}
+		return nil
+	}
+	if attempts <= 1 {
+		_, err = db.ExecContext(ctx, `DELETE FROM OTP WHERE PURPOSE=? AND SUBJECT=?`, purpose, subject)
+		if err != nil {
+			return fmt.Errorf("invalidate otp: %w", err)
+		}
+		return ErrOTPAttempts
+	}
+	_, err = db.ExecContext(ctx, `UPDATE OTP SET ATTEMPTS_LEFT=ATTEMPTS_LEFT-1 WHERE PURPOSE=? AND SUBJECT=?`, purpose, subject)
+	if err != nil {
+		return fmt.Errorf("record attempt: %w", err)
+	}
+	return ErrInvalidOTP
+}
+
+// Codes are hashed with their scope, so a leaked row can't be replayed against another purpose or subject.
+func otpHash(purpose, subject, code string) []byte {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%q %q %q", purpose, subject, code)))
+	return h[:]
+}
+
+// Drops codes which expired before the given time.
+func ReapOTPs(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM OTP WHERE EXPIRES_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOTP(t *testing.T) {
+	db := newDB(t, "otp")
+	ctx := context.Background()
+	now := time.UnixMilli(0)
+	expires := time.UnixMilli(1000)
+
+	code, err := IssueOTP(ctx, db, "email-login", "user1", 6, 3, expires)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	if len(code) != 6 {
+		t.Fatalf("expected 6 digits, got '%v'", code)
+	}
+	// Scoped to purpose and subject
+	if err := VerifyOTP(ctx, db, "sms", "user1", code, now); err != ErrInvalidOTP {
+		t.Fatalf("other purpose: expected invalid code, got %v", err)
+	}
+	if err := VerifyOTP(ctx, db, "email-login", "user2", code, now); err != ErrInvalidOTP {
+		t.Fatalf("other subject: expected invalid code, got %v", err)
+	}
+	if err := VerifyOTP(ctx, db, "email-login", "user1", code, time.UnixMilli(2000)); err != ErrInvalidOTP {
+		t.Fatalf("expired: expected invalid code, got %v", err)
+	}
+	if err := VerifyOTP(ctx, db, "email-login", "user1", code, now); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if err := VerifyOTP(ctx, db, "email-login", "user1", code, now); err != ErrInvalidOTP {
+		t.Fatalf("reuse: expected invalid code, got %v", err)
+	}
+
+	// Attempts run out, invalidating even the right code
+	code, err = IssueOTP(ctx, db, "email-login", "user1", 6, 3, expires)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	wrong := "x"
+	for i := 0; i < 2; i++ {
+		if err := VerifyOTP(ctx, db, "email-login", "user1", wrong, now); err != ErrInvalidOTP {
+			t.Fatalf("guess %v: expected invalid code, got %v", i, err)
+		}
+	}
+	if err := VerifyOTP(ctx, db, "email-login", "user1", wrong, now); err != ErrOTPAttempts {
+		t.Fatalf("last guess: expected too many attempts, got %v", err)
+	}
+	if err := VerifyOTP(ctx, db, "email-login", "user1", code, now); err != ErrInvalidOTP {
+		t.Fatalf("after lockout: expected invalid code, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+)
+
+// Sign ups which are waiting on the registrant to prove they own the email address. The account row is only created once
+// the emailed code is presented, so nobody can squat an address they don't control.
+
+// Returned when a sign up code is unknown, already used or expired.
+var ErrInvalidSignupCode = errors.New("invalid or expired sign up code")
+
+// Returned when signing up with an email which is already registered, or completing a sign up for one registered since.
+var ErrEmailRegistered = errors.New("an account already exists for this email, try logging in")
+
+// Stores a sign up awaiting email verification, and returns the code to send to the email address. The password is hashed
+// immediately, with bcrypt, and only a hash of the code is stored. Returns a *PasswordPolicyError if the password doesn't
+// follow DefaultPasswordPolicy.
+func CreatePendingSignup(ctx context.Context, db conn, email, password string, now, expires time.Time) (Token, error) {
+	return CreatePendingSignupWith(ctx, db, defaultPasswordOptions(), email, password, now, expires)
+}
+
+// Like CreatePendingSignup, but hashes and checks the password as o says.
+func CreatePendingSignupWith(ctx context.Context, db conn, o PasswordOptions, email, password string, now, expires time.Time) (Token, error) {
+	var code Token
+	_, err := mail.ParseAddress(email)
+	if err != nil {
+		return code, fmt.Errorf("parsing email address '%v': %w", email, err)
+	}
+	err = o.check(password)
+	if err != nil {
+		return code, err
+	}
+	hash, err := o.hasher().Hash(password)
+	if err != nil {
+		return code, err
+	}
+	_, err = rand.Read(code[:])
+	if err != nil {
+		return code, fmt.Errorf("read random: %w", err)
+	}
+	codeHash := sha256.Sum256(code[:])
+	_, err = db.ExecContext(ctx, `INSERT INTO PENDING_SIGNUP (CODE_HASH, EMAIL, BCRYPT, CREATED_TIME, EXPIRES_TIME)
+	VALUES (?, ?, ?, ?, ?);`, codeHash[:], email, hash, now.UnixMilli(), expires.UnixMilli())
+	if err != nil {
+		return code, fmt.Errorf("insert pending signup: %w", err)
+	}
+	return code, nil
+}
+
+// Creates the account for a pending sign up with the given ID, marking its email as verified, and returns the email. If
+// the ID is empty, the email is used as the ID. The code can only be used once. Returns ErrInvalidSignupCode if the code
+// is unknown or expired, and ErrEmailRegistered if the email was registered in the meantime. Use a transaction, so the
+// code isn't spent if the account can't be created.
+func ConsumePendingSignup(ctx context.Context, db conn, code Token, id string, now time.Time) (string, error) {
+	codeHash := sha256.Sum256(code[:])
+	row := db.QueryRowContext(ctx, `SELECT EMAIL, BCRYPT FROM PENDING_SIGNUP WHERE CODE_HASH=? AND EXPIRES_TIME >= ?`,
+		codeHash[:], now.UnixMilli())
+	var email string
+	var hash []byte
+	err := row.Scan(&email, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidSignupCode
+	}
+	if err != nil {
+		return "", fmt.Errorf("parse pending signup: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM PENDING_SIGNUP WHERE CODE_HASH=?`, codeHash[:])
+	if err != nil {
+		return "", fmt.Errorf("delete pending signup: %w", err)
+	}
+	_, err = LookupByEmail(ctx, db, email)
+	if err == nil {
+		return "", ErrEmailRegistered
+	}
+	if !errors.Is(err, ErrBadCredentials) {
+		return "", fmt.Errorf("lookup email: %w", err)
+	}
+	if id == "" {
+		id = email
+	}
+	err = insertUser(ctx, db, id, email, hash, true, now)
+	if err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+// Drops pending sign ups which expired before the given time.
+func ReapPendingSignups(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM PENDING_SIGNUP WHERE EXPIRES_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
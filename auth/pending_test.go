@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPendingSignup(t *testing.T) {
+	db := newDB(t, "pending")
+	ctx := context.Background()
+	code, err := CreatePendingSignupWith(ctx, db, PasswordOptions{}, "lol@localhost", "pw1", time.UnixMilli(0), time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("create pending signup: %v", err)
+	}
+	// No account until verified
+	err = Authenticate(ctx, db, "lol@localhost", "pw1")
+	if err != ErrBadCredentials {
+		t.Fatalf("expected no account before verification, got %v", err)
+	}
+	_, err = ConsumePendingSignup(ctx, db, code, "", time.UnixMilli(2000))
+	if err != ErrInvalidSignupCode {
+		t.Fatalf("expired code: expected invalid code, got %v", err)
+	}
+	email, err := ConsumePendingSignup(ctx, db, code, "", time.UnixMilli(500))
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if email != "lol@localhost" {
+		t.Fatalf("expected lol@localhost, got %v", email)
+	}
+	err = Authenticate(ctx, db, "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("authenticate verified user: %v", err)
+	}
+	_, err = ConsumePendingSignup(ctx, db, code, "", time.UnixMilli(500))
+	if err != ErrInvalidSignupCode {
+		t.Fatalf("reused code: expected invalid code, got %v", err)
+	}
+
+	// A second sign up for a registered email can't be completed
+	code, err = CreatePendingSignupWith(ctx, db, PasswordOptions{}, "lol@localhost", "pw2", time.UnixMilli(0), time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("create pending signup: %v", err)
+	}
+	_, err = ConsumePendingSignup(ctx, db, code, "", time.UnixMilli(500))
+	if err != ErrEmailRegistered {
+		t.Fatalf("expected email registered error, got %v", err)
+	}
+}
+
+// Records sent mail.
+type recordingMailer struct {
+	to, subject, body string
+}
+
+func (m *recordingMailer) Send(ctx context.Context, to, subject, body string) error {
+	m.to, m.subject, m.body = to, subject, body
+	return nil
+}
+
+func TestVerifiedSignupFlow(t *testing.T) {
+	db := newDB(t, "verified")
+	mailer := &recordingMailer{}
+	mux := http.NewServeMux()
+	AuthServer{
+		Authenticator: DBAuthenticator{DB: db},
+		VerifySignups: true,
+		Mailer:        mailer,
+		BaseURL:       "https://example.com/",
+	}.Mount(mux, "/auth")
+
+	r := httptest.NewRequest("POST", "/auth/signup?redirect=%2Fsecured", strings.NewReader("email=lol%40localhost&password=pw1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("signup: expected 200, got %v: %v", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Set-Cookie") != "" {
+		t.Fatal("signup should not log in before verification")
+	}
+	if mailer.to != "lol@localhost" {
+		t.Fatalf("expected mail to lol@localhost, got '%v'", mailer.to)
+	}
+	link := regexp.MustCompile(`https://example.com(/auth/verify\?\S+)`).FindStringSubmatch(mailer.body)
+	if link == nil {
+		t.Fatalf("no verification link in mail: %v", mailer.body)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", link[1], nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("verify: expected redirect, got %v: %v", w.Code, w.Body.String())
+	}
+	if loc := w.Header().Get("Location"); loc != "/auth/login?redirect=%2Fsecured" {
+		t.Fatalf("verify: expected redirect to login, got %v", loc)
+	}
+	err := Authenticate(context.Background(), db, "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("authenticate verified user: %v", err)
+	}
+}
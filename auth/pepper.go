@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// Wraps a Hasher so passwords are keyed with a server side secret before hashing, e.g "$pepper$1a2b3c4d$2a$10$...". A
+// stolen DB is then useless without the pepper, which should be kept outside it, e.g in a secret file. Hashes record a
+// fingerprint of the pepper they were made with. Hashes without a pepper are still accepted, and upgraded at log in, but
+// hashes with another pepper can't be checked, so changing the pepper locks out every user who hasn't logged in since.
+type PepperedHasher struct {
+	Hasher
+	// At least 32 random bytes.
+	Pepper []byte
+}
+
+func (h PepperedHasher) prefix() []byte {
+	fingerprint := sha256.Sum256(h.Pepper)
+	return []byte("$pepper$" + hex.EncodeToString(fingerprint[:4]))
+}
+
+// Keys the password with the pepper. The MAC is encoded, since bcrypt stops at a zero byte.
+func (h PepperedHasher) pepper(password string) string {
+	mac := hmac.New(sha256.New, h.Pepper)
+	mac.Write([]byte(password))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (h PepperedHasher) Hash(password string) ([]byte, error) {
+	if len(h.Pepper) == 0 {
+		return nil, fmt.Errorf("pepper is empty")
+	}
+	hash, err := h.Hasher.Hash(h.pepper(password))
+	if err != nil {
+		return nil, err
+	}
+	return append(h.prefix(), hash...), nil
+}
+
+func (h PepperedHasher) Compare(hash []byte, password string) error {
+	return comparePassword(h.Hasher, bytes.TrimPrefix(hash, h.prefix()), h.pepper(password))
+}
+
+// Reports whether the hash was made with this pepper, by any builtin hasher.
+func (h PepperedHasher) Owns(hash []byte) bool {
+	return bytes.HasPrefix(hash, h.prefix())
+}
+
+func (h PepperedHasher) Outdated(hash []byte) bool {
+	inner := bytes.TrimPrefix(hash, h.prefix())
+	return !h.Hasher.Owns(inner) || h.Hasher.Outdated(inner)
+}
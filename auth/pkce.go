@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Authorization codes with PKCE (RFC 7636) for native apps. The app opens the login page in the system browser with a
+// code_challenge, the SHA-256 of a secret verifier it keeps. After logging in, the browser is sent to the app's callback
+// with a single use code rather than a token. The app then exchanges the code and its verifier for a token at the token
+// route, so another app intercepting the callback can't use the code.
+
+// Returned when an authorization code is unknown, spent, expired, or presented with the wrong verifier.
+var ErrInvalidAuthCode = errors.New("invalid or expired authorization code")
+
+// Returns the S256 code challenge for a verifier, as the app sends it to the login page.
+func CodeChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// Stores a single use authorization code for the user, bound to the S256 challenge, and returns it. Only a hash of the
+// code is stored.
+func CreateAuthCode(ctx context.Context, db conn, uid, challenge string, now, expires time.Time) (Token, error) {
+	code, err := newToken()
+	if err != nil {
+		return code, err
+	}
+	codeHash := sha256.Sum256(code[:])
+	_, err = db.ExecContext(ctx, `INSERT INTO AUTH_CODE (CODE_HASH, UID, CHALLENGE, CREATED_TIME, EXPIRES_TIME)
+	VALUES (?, ?, ?, ?, ?);`, codeHash[:], uid, challenge, now.UnixMilli(), expires.UnixMilli())
+	if err != nil {
+		return code, fmt.Errorf("insert auth code: %w", err)
+	}
+	return code, nil
+}
+
+// Spends an authorization code, returning the user it was issued to if the verifier matches its challenge. The code is
+// spent even if the verifier is wrong, so it can't be guessed at. Returns ErrInvalidAuthCode if the code or verifier
+// isn't valid.
+func ConsumeAuthCode(ctx context.Context, db conn, code Token, verifier string, now time.Time) (string, error) {
+	codeHash := sha256.Sum256(code[:])
+	row := db.QueryRowContext(ctx, `SELECT UID, CHALLENGE FROM AUTH_CODE WHERE CODE_HASH=? AND EXPIRES_TIME >= ?`,
+		codeHash[:], now.UnixMilli())
+	var uid, challenge string
+	err := row.Scan(&uid, &challenge)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidAuthCode
+	}
+	if err != nil {
+		return "", fmt.Errorf("parse auth code: %w", err)
+	}
+	// Only one exchange may delete it, so a code raced through the lookup above is still used once.
+	res, err := db.ExecContext(ctx, `DELETE FROM AUTH_CODE WHERE CODE_HASH=?`, codeHash[:])
+	if err != nil {
+		return "", fmt.Errorf("delete auth code: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", fmt.Errorf("delete auth code: %w", err)
+	}
+	if n != 1 {
+		return "", ErrInvalidAuthCode
+	}
+	if subtle.ConstantTimeCompare([]byte(CodeChallenge(verifier)), []byte(challenge)) != 1 {
+		return "", ErrInvalidAuthCode
+	}
+	return uid, nil
+}
+
+// Drops authorization codes which expired before the given time.
+func ReapAuthCodes(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM AUTH_CODE WHERE EXPIRES_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
+
+// Implemented by Authenticators which support the PKCE code exchange for native apps.
+type CodeExchanger interface {
+	// Issues a single use code for the user of a valid access token, bound to the S256 challenge.
+	IssueCode(ctx context.Context, access Token, challenge string) (Token, error)
+	// Exchanges a code and the verifier of its challenge for a new access token. Returns ErrInvalidAuthCode if either
+	// isn't valid.
+	ExchangeCode(ctx context.Context, code Token, verifier string) (Token, time.Time, error)
+}
+
+// Responds to the token route: a JSON body {"code", "code_verifier"} is exchanged for {"token", "expires"}, with the
+// expiry in unix seconds. Forms are from clients of the IdentityProvider, see grantHandler.
+func (a AuthServer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	if isForm(r) {
+		a.grantHandler(w, r)
+		return
+	}
+	ce, ok := a.Authenticator.(CodeExchanger)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var req struct {
+		Code     Token  `json:"code"`
+		Verifier string `json:"code_verifier"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parse body: %v", err), http.StatusBadRequest)
+		return
+	}
+	t, expires, err := ce.ExchangeCode(withClient(r.Context(), r), req.Code, req.Verifier)
+	if errors.Is(err, ErrInvalidAuthCode) {
+		http.Error(w, fmt.Sprintf("exchange code: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		a.internalError(w, "exchange code", err)
+		return
+	}
+	text, err := encodeToken(r.Context(), a.Authenticator, t)
+	if err != nil {
+		a.internalError(w, "exchange code: encode token", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Token   string `json:"token"`
+		Expires int64  `json:"expires"`
+	}{text, expires.Unix()})
+}
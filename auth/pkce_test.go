@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthCode(t *testing.T) {
+	db := newDB(t, "code")
+	ctx := context.Background()
+	challenge := CodeChallenge("verifier")
+	code, err := CreateAuthCode(ctx, db, "user1", challenge, time.UnixMilli(0), time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("create code: %v", err)
+	}
+	_, err = ConsumeAuthCode(ctx, db, code, "verifier", time.UnixMilli(2000))
+	if err != ErrInvalidAuthCode {
+		t.Fatalf("expired: expected ErrInvalidAuthCode, got %v", err)
+	}
+	uid, err := ConsumeAuthCode(ctx, db, code, "verifier", time.UnixMilli(500))
+	if err != nil || uid != "user1" {
+		t.Fatalf("consume: %v %v", uid, err)
+	}
+	_, err = ConsumeAuthCode(ctx, db, code, "verifier", time.UnixMilli(500))
+	if err != ErrInvalidAuthCode {
+		t.Fatalf("spent: expected ErrInvalidAuthCode, got %v", err)
+	}
+
+	// A wrong verifier spends the code too.
+	code, err = CreateAuthCode(ctx, db, "user1", challenge, time.UnixMilli(0), time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("create code: %v", err)
+	}
+	_, err = ConsumeAuthCode(ctx, db, code, "guess", time.UnixMilli(500))
+	if err != ErrInvalidAuthCode {
+		t.Fatalf("wrong verifier: expected ErrInvalidAuthCode, got %v", err)
+	}
+	_, err = ConsumeAuthCode(ctx, db, code, "verifier", time.UnixMilli(500))
+	if err != ErrInvalidAuthCode {
+		t.Fatalf("after wrong verifier: expected ErrInvalidAuthCode, got %v", err)
+	}
+}
+
+func TestPKCELogin(t *testing.T) {
+	db := newDB(t, "pkce")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	mux := AuthServer{Authenticator: a, AppRedirects: []string{"myapp://callback"}, RequirePKCE: true}.Handler("/auth")
+	login := func(query url.Values) *httptest.ResponseRecorder {
+		form := url.Values{"email": {"a@b.com"}, "password": {"pw"}}
+		r := httptest.NewRequest("POST", "/auth/login?"+query.Encode(), strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	exchange := func(code, verifier string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"code": code, "code_verifier": verifier})
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/auth/token", strings.NewReader(string(body))))
+		return w
+	}
+
+	if w := login(url.Values{"redirect": {"myapp://callback"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("without challenge: expected 400, got %v %v", w.Code, w.Header().Get("Location"))
+	}
+	w := login(url.Values{
+		"redirect":              {"myapp://callback"},
+		"code_challenge":        {CodeChallenge("verifier")},
+		"code_challenge_method": {"S256"},
+	})
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %v: %v", w.Code, w.Body)
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parse location: %v", err)
+	}
+	code := u.Query().Get("code")
+	if code == "" || u.Query().Get("token") != "" {
+		t.Fatalf("expected only a code in the callback, got %v", u)
+	}
+
+	w = exchange(code, "verifier")
+	if w.Code != http.StatusOK {
+		t.Fatalf("exchange: expected 200, got %v: %v", w.Code, w.Body)
+	}
+	var resp struct {
+		Token   Token `json:"token"`
+		Expires int64 `json:"expires"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if err := a.Validate(ctx, resp.Token); err != nil {
+		t.Fatalf("exchanged token should be valid: %v", err)
+	}
+	if w := exchange(code, "verifier"); w.Code != http.StatusBadRequest {
+		t.Fatalf("replay: expected 400, got %v", w.Code)
+	}
+}
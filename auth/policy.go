@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:embed common_passwords.txt
+var bundledCommonPasswords string
+
+// Returned, wrapped in a PasswordPolicyError, when a password doesn't meet the policy.
+var ErrWeakPassword = errors.New("password does not meet the policy")
+
+// Describes every way a password falls short of a PasswordPolicy, so they can all be shown to the user at once.
+type PasswordPolicyError struct {
+	Problems []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrWeakPassword, strings.Join(e.Problems, "; "))
+}
+
+func (e *PasswordPolicyError) Unwrap() error {
+	return ErrWeakPassword
+}
+
+// Rules new passwords must follow. The zero value accepts anything.
+type PasswordPolicy struct {
+	// Fewest characters allowed.
+	MinLength int
+	// Fewest character classes (lower case, upper case, digits, other) the password must mix.
+	MinClasses int
+	// Passwords refused outright, compared case insensitively, e.g CommonPasswords().
+	Banned []string
+	// Lowest PasswordStrength allowed, from 0 to 4.
+	MinStrength int
+}
+
+// A policy in line with NIST SP 800-63B: at least 8 characters, not a common password, and not trivially guessable.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{MinLength: 8, Banned: CommonPasswords(), MinStrength: 2}
+}
+
+// Returns a list of frequently used passwords, bundled with the package.
+func CommonPasswords() []string {
+	var passwords []string
+	s := bufio.NewScanner(strings.NewReader(bundledCommonPasswords))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords = append(passwords, line)
+	}
+	return passwords
+}
+
+// Returns a *PasswordPolicyError listing every rule the password breaks, or nil if it follows the policy.
+func (p PasswordPolicy) Check(password string) error {
+	var problems []string
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %v characters", p.MinLength))
+	}
+	if p.MinClasses > 0 && characterClasses(password) < p.MinClasses {
+		problems = append(problems, fmt.Sprintf("must mix at least %v of lower case, upper case, digits and symbols", p.MinClasses))
+	}
+	for _, banned := range p.Banned {
+		if strings.EqualFold(password, banned) {
+			problems = append(problems, "is too common")
+			break
+		}
+	}
+	if p.MinStrength > 0 && PasswordStrength(password) < p.MinStrength {
+		problems = append(problems, "is too easy to guess")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return &PasswordPolicyError{Problems: problems}
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	n := 0
+	for _, has := range []bool{lower, upper, digit, other} {
+		if has {
+			n++
+		}
+	}
+	return n
+}
+
+// Scores how hard a password is to guess from 0 (trivial) to 4 (strong), like zxcvbn's scale. This is a rough entropy
+// estimate from the character classes used, which doesn't count repeated or sequential characters, e.g "aaaa" or "1234".
+func PasswordStrength(password string) int {
+	pool := 0
+	for _, c := range []struct {
+		in   func(rune) bool
+		size int
+	}{
+		{unicode.IsLower, 26},
+		{unicode.IsUpper, 26},
+		{unicode.IsDigit, 10},
+		{func(r rune) bool { return !unicode.IsLower(r) && !unicode.IsUpper(r) && !unicode.IsDigit(r) }, 33},
+	} {
+		if strings.IndexFunc(password, c.in) >= 0 {
+			pool += c.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	effective := 0
+	prev := rune(-1)
+	for _, r := range password {
+		if r != prev && r != prev+1 && r != prev-1 {
+			effective++
+		}
+		prev = r
+	}
+	bits := float64(effective) * math.Log2(float64(pool))
+	switch {
+	case math.IsNaN(bits) || bits < 28:
+		return 0
+	case bits < 36:
+		return 1
+	case bits < 60:
+		return 2
+	case bits < 80:
+		return 3
+	}
+	return 4
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	p := PasswordPolicy{MinLength: 8, MinClasses: 2, Banned: []string{"Password1"}}
+	for pw, want := range map[string][]string{
+		"a":                {"must be at least 8 characters", "must mix at least 2 of lower case, upper case, digits and symbols"},
+		"password1":        {"is too common"},
+		"abcdefghij":       {"must mix at least 2 of lower case, upper case, digits and symbols"},
+		"correct horse 42": nil,
+	} {
+		err := p.Check(pw)
+		var policyErr *PasswordPolicyError
+		if want == nil {
+			if err != nil {
+				t.Fatalf("%q: expected no error, got %v", pw, err)
+			}
+			continue
+		}
+		if !errors.As(err, &policyErr) || !errors.Is(err, ErrWeakPassword) {
+			t.Fatalf("%q: expected a policy error, got %v", pw, err)
+		}
+		if !reflect.DeepEqual(policyErr.Problems, want) {
+			t.Fatalf("%q: expected %v, got %v", pw, want, policyErr.Problems)
+		}
+	}
+	if err := (PasswordPolicy{}).Check(""); err != nil {
+		t.Fatalf("zero policy: expected no error, got %v", err)
+	}
+}
+
+func TestPasswordStrength(t *testing.T) {
+	for pw, want := range map[string]int{
+		"":                       0,
+		"a":                      0,
+		"aaaaaaaaaaaaaaaa":       0,
+		"12345678901234":         0,
+		"test123":                0,
+		"kx8Bq2mz":               2,
+		"correct horse battery":  4,
+		"kx8Bq2mzPw7":            3,
+		"Tr0ub4dor&3-staple-hrs": 4,
+	} {
+		if got := PasswordStrength(pw); got != want {
+			t.Fatalf("%q: expected %v, got %v", pw, want, got)
+		}
+	}
+	for _, pw := range CommonPasswords() {
+		if DefaultPasswordPolicy().Check(pw) == nil {
+			t.Fatalf("common password %q is allowed by the default policy", pw)
+		}
+	}
+}
+
+func TestPasswordPolicyEnforced(t *testing.T) {
+	db := newDB(t, "policy")
+	ctx := context.Background()
+	policy := DefaultPasswordPolicy()
+	a := DBAuthenticator{DB: db, PasswordPolicy: &policy}
+	if err := a.Register(ctx, "a@b.com", "password"); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("register: expected weak password, got %v", err)
+	}
+	if _, err := a.BeginRegister(ctx, "a@b.com", "pw"); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("begin register: expected weak password, got %v", err)
+	}
+	if err := a.Register(ctx, "a@b.com", "kx8Bq2mz-long"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// A rejected password doesn't spend the reset code.
+	code, err := a.BeginPasswordReset(ctx, "a@b.com")
+	if err != nil {
+		t.Fatalf("begin reset: %v", err)
+	}
+	if err = a.CompletePasswordReset(ctx, code, "123456"); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("reset: expected weak password, got %v", err)
+	}
+	if err = a.CompletePasswordReset(ctx, code, "another Good one"); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+
+	// The package-level functions setting passwords check the default policy.
+	if err := RegisterUser(ctx, db, "e@f.com", "e@f.com", ""); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("register user: expected weak password, got %v", err)
+	}
+	if err := ChangePassword(ctx, db, "a@b.com", "password", time.Now()); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("change password: expected weak password, got %v", err)
+	}
+	if err := ChangePassword(ctx, db, "a@b.com", "yet another Good one", time.Now()); err != nil {
+		t.Fatalf("change password: %v", err)
+	}
+
+	mux := AuthServer{Authenticator: a}.Handler("/auth")
+	form := url.Values{"email": {"c@d.com"}, "password": {"a"}}
+	r := httptest.NewRequest("POST", "/auth/signup", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Password must be at least 8 characters") {
+		t.Fatalf("expected the problems listed in a 400, got %v: %v", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A Store in Postgres. The caller opens DB with a Postgres driver of their choice, e.g github.com/jackc/pgx/v5/stdlib
+// or github.com/lib/pq. Table names are quoted, since USER is reserved in Postgres.
+//
+// It only keeps users and tokens, which is enough to register, log in, validate and revoke. Every other feature of
+// DBAuthenticator, e.g refresh tokens, sessions, roles or password resets, keeps its tables in SQLite, and returns
+// ErrDBRequired with a PostgresStore.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func (s PostgresStore) Initialize(ctx context.Context) error {
+	steps := []struct {
+		Name  string
+		Query string
+	}{
+		{
+			Name: "user",
+			Query: `
+CREATE TABLE IF NOT EXISTS "USER" (
+	ID TEXT NOT NULL PRIMARY KEY,
+	EMAIL TEXT NOT NULL UNIQUE,
+	BCRYPT BYTEA NOT NULL,
+	VALID BOOLEAN NOT NULL DEFAULT FALSE,
+	-- When the password was last changed, in unix millis. Tokens created before this are no longer valid.
+	PASSWORD_CHANGED_TIME BIGINT NOT NULL DEFAULT 0
+);`,
+		},
+		{
+			Name: "token",
+			Query: `
+CREATE TABLE IF NOT EXISTS "TOKEN" (
+	UID TEXT NOT NULL REFERENCES "USER"(ID),
+	-- SHA-256 of the token
+	TOKEN_HASH BYTEA NOT NULL PRIMARY KEY,
+	START_TIME BIGINT NOT NULL,
+	END_TIME BIGINT NOT NULL,
+	CREATED_TIME BIGINT NOT NULL
+);`,
+		},
+		{
+			Name:  "token_end_time",
+			Query: `CREATE INDEX IF NOT EXISTS TOKEN_END_TIME ON "TOKEN" (END_TIME);`,
+		},
+	}
+	for _, step := range steps {
+		_, err := s.DB.ExecContext(ctx, step.Query)
+		if err != nil {
+			return fmt.Errorf("create tables: %v: %w", step.Name, err)
+		}
+	}
+	err := s.hashTokenColumn(ctx)
+	if err != nil {
+		return fmt.Errorf("hash tokens: %w", err)
+	}
+	return nil
+}
+
+// Like hashTokenColumn, for tables created before tokens were stored hashed. Uses sha256(), from Postgres 11.
+func (s PostgresStore) hashTokenColumn(ctx context.Context) error {
+	row := s.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.columns
+WHERE table_schema = current_schema() AND table_name = 'TOKEN' AND column_name = 'token'`)
+	var n int
+	err := row.Scan(&n)
+	if err != nil {
+		return fmt.Errorf("check existing columns: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("open transaction: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `UPDATE "TOKEN" SET TOKEN = sha256(TOKEN) WHERE length(TOKEN) = $1;`, len(Token{}))
+	if err != nil {
+		return fmt.Errorf("update tokens: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `ALTER TABLE "TOKEN" RENAME COLUMN TOKEN TO TOKEN_HASH;`)
+	if err != nil {
+		return fmt.Errorf("rename column: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+func (s PostgresStore) InsertUser(ctx context.Context, id, email string, hash []byte) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO "USER" (ID, EMAIL, BCRYPT) VALUES ($1, $2, $3);`, id, email, hash)
+	if err != nil {
+		return fmt.Errorf("insert user: %w", err)
+	}
+	return nil
+}
+
+func (s PostgresStore) UserHash(ctx context.Context, idOrEmail string) (string, []byte, error) {
+	row := s.DB.QueryRowContext(ctx, `SELECT ID, BCRYPT FROM "USER" WHERE ID = $1 OR EMAIL = $1;`, idOrEmail)
+	return scanUserHash(row)
+}
+
+func (s PostgresStore) ReplaceHash(ctx context.Context, uid string, old, new []byte) error {
+	_, err := s.DB.ExecContext(ctx, `UPDATE "USER" SET BCRYPT = $1 WHERE ID = $2 AND BCRYPT = $3;`, new, uid, old)
+	if err != nil {
+		return fmt.Errorf("update user: %w", err)
+	}
+	return nil
+}
+
+func (s PostgresStore) InsertToken(ctx context.Context, uid string, t Token, start, end, created time.Time) error {
+	if !end.After(start) {
+		return fmt.Errorf("%w: cannot issue a token which ends at %v, before it starts", ErrIllegalTransition, end.UTC())
+	}
+	hash := sha256.Sum256(t[:])
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO "TOKEN" (UID, TOKEN_HASH, START_TIME, END_TIME, CREATED_TIME)
+	VALUES ($1, $2, $3, $4, $5);`, uid, hash[:], start.UnixMilli(), end.UnixMilli(), created.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+	return nil
+}
+
+// Matches tokens valid at $1, given their user, like tokenNotSuperseded.
+const postgresTokenValid = `START_TIME <= $1 AND END_TIME >= $1 AND
+("USER".PASSWORD_CHANGED_TIME IS NULL OR "TOKEN".CREATED_TIME >= "USER".PASSWORD_CHANGED_TIME)`
+
+func (s PostgresStore) LookupToken(ctx context.Context, t Token, now time.Time) (string, error) {
+	hash := sha256.Sum256(t[:])
+	row := s.DB.QueryRowContext(ctx, `SELECT UID FROM "TOKEN" JOIN "USER" ON "USER".ID = "TOKEN".UID WHERE
+`+postgresTokenValid+` AND TOKEN_HASH = $2`, now.UnixMilli(), hash[:])
+	var uid string
+	err := row.Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", fmt.Errorf("parse uid: %w", err)
+	}
+	return uid, nil
+}
+
+func (s PostgresStore) LookupTokens(ctx context.Context, ts []Token, now time.Time) (map[Token]string, error) {
+	uids := make(map[Token]string, len(ts))
+	for start := 0; start < len(ts); start += lookupBatchSize {
+		end := start + lookupBatchSize
+		if end > len(ts) {
+			end = len(ts)
+		}
+		chunk := ts[start:end]
+		args := make([]any, 0, len(chunk)+1)
+		args = append(args, now.UnixMilli())
+		placeholders := make([]string, len(chunk))
+		byHash := make(map[[sha256.Size]byte]Token, len(chunk))
+		for i, t := range chunk {
+			hash := sha256.Sum256(t[:])
+			byHash[hash] = t
+			args = append(args, hash[:])
+			placeholders[i] = fmt.Sprintf("$%v", i+2)
+		}
+		rows, err := s.DB.QueryContext(ctx, `SELECT TOKEN_HASH, UID FROM "TOKEN" JOIN "USER" ON "USER".ID = "TOKEN".UID WHERE
+`+postgresTokenValid+` AND TOKEN_HASH IN (`+strings.Join(placeholders, ",")+`)`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("query tokens: %w", err)
+		}
+		for rows.Next() {
+			var raw []byte
+			var uid string
+			err = rows.Scan(&raw, &uid)
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scan token: %w", err)
+			}
+			var hash [sha256.Size]byte
+			copy(hash[:], raw)
+			uids[byHash[hash]] = uid
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("iterate tokens: %w", err)
+		}
+	}
+	return uids, nil
+}
+
+func (s PostgresStore) DeleteToken(ctx context.Context, t Token) error {
+	hash := sha256.Sum256(t[:])
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM "TOKEN" WHERE TOKEN_HASH = $1;`, hash[:])
+	if err != nil {
+		return fmt.Errorf("delete token: %w", err)
+	}
+	return nil
+}
+
+// Deletes the user and their tokens. Returns ErrBadCredentials if there is no such user.
+func (s PostgresStore) DeleteUser(ctx context.Context, uid string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("open transaction: %w", err)
+	}
+	defer tx.Rollback()
+	// Locking the user first makes log ins inserting tokens for them wait, then fail, rather than add a token between
+	// deleting the tokens and the user, which the user's deletion would then violate.
+	var locked string
+	err = tx.QueryRowContext(ctx, `SELECT ID FROM "USER" WHERE ID = $1 FOR UPDATE;`, uid).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrBadCredentials
+	}
+	if err != nil {
+		return fmt.Errorf("lock user: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM "TOKEN" WHERE UID = $1;`, uid)
+	if err != nil {
+		return fmt.Errorf("delete tokens: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM "USER" WHERE ID = $1;`, uid)
+	if err != nil {
+		return fmt.Errorf("delete user: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+func (s PostgresStore) ReapTokens(ctx context.Context, olderThan, now time.Time) error {
+	if olderThan.After(now) {
+		return fmt.Errorf("%w: cannot reap tokens which expire before %v, in the future", ErrIllegalTransition, olderThan.UTC())
+	}
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM "TOKEN" WHERE END_TIME < $1;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned when a proof of work is missing, wrong, expired or already used.
+var ErrInvalidProofOfWork = errors.New("invalid proof of work")
+
+// A hashcash style client puzzle, a privacy preserving alternative to third party CAPTCHAs. The log in and sign up pages
+// carry a signed challenge, which the browser solves in the background while the user types: it finds a number whose
+// SHA-256, appended to the challenge, starts with Difficulty zero bits. That costs a browser about a second, but makes
+// bulk credential stuffing or sign up spam expensive. Challenges are stateless until used, and single use after. Spent
+// challenges are remembered in memory until they expire, so behind several instances a solution can be replayed once
+// against each of them within TTL. Safe for concurrent use.
+type ProofOfWork struct {
+	// Signs challenges. At least 32 random bytes.
+	Secret []byte
+	// Leading zero bits required of a solution. Each bit doubles the expected work. Defaults to 16.
+	Difficulty int
+	// How long a challenge may be solved for. Defaults to 10 minutes.
+	TTL time.Duration
+	// Decides, after the form is parsed, whether a request must carry a proof, e.g RiskyRequests. Defaults to every
+	// request.
+	Suspicious func(r *http.Request) bool
+
+	mu sync.Mutex
+	// Spent challenges by the unix minute they expire in, so expired ones are dropped a minute at a time.
+	spent map[int64]map[string]bool
+	swept int64
+}
+
+func (p *ProofOfWork) difficulty() int {
+	if p.Difficulty == 0 {
+		return 16
+	}
+	return p.Difficulty
+}
+
+func (p *ProofOfWork) ttl() time.Duration {
+	if p.TTL == 0 {
+		return 10 * time.Minute
+	}
+	return p.TTL
+}
+
+func (p *ProofOfWork) sign(payload string) string {
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issues a challenge, "<difficulty>.<expiry>.<nonce>.<signature>".
+func (p *ProofOfWork) Challenge(now time.Time) (string, error) {
+	if len(p.Secret) == 0 {
+		return "", fmt.Errorf("proof of work secret is empty")
+	}
+	nonce := make([]byte, 12)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+	payload := fmt.Sprintf("%v.%v.%v", p.difficulty(), now.Add(p.ttl()).Unix(), base64.RawURLEncoding.EncodeToString(nonce))
+	return payload + "." + p.sign(payload), nil
+}
+
+// Checks a solution to a challenge from Challenge, and spends the challenge. Challenges issued at a lower difficulty than
+// the current one are refused.
+func (p *ProofOfWork) Verify(challenge, solution string, now time.Time) error {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 || len(p.Secret) == 0 {
+		return ErrInvalidProofOfWork
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(p.sign(payload))) {
+		return ErrInvalidProofOfWork
+	}
+	difficulty, err := strconv.Atoi(parts[0])
+	if err != nil || difficulty < p.difficulty() {
+		return ErrInvalidProofOfWork
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return ErrInvalidProofOfWork
+	}
+	if leadingZeroBits(challenge, solution) < difficulty {
+		return ErrInvalidProofOfWork
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.spent == nil {
+		p.spent = make(map[int64]map[string]bool)
+	}
+	if minute := now.Unix() / 60; minute != p.swept {
+		p.swept = minute
+		for m := range p.spent {
+			if m < minute {
+				delete(p.spent, m)
+			}
+		}
+	}
+	bucket := p.spent[expires/60]
+	if bucket == nil {
+		bucket = make(map[string]bool)
+		p.spent[expires/60] = bucket
+	}
+	if bucket[challenge] {
+		return ErrInvalidProofOfWork
+	}
+	bucket[challenge] = true
+	return nil
+}
+
+func leadingZeroBits(challenge, solution string) int {
+	h := sha256.Sum256([]byte(challenge + ":" + solution))
+	n := 0
+	for _, b := range h {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// Finds a solution to a challenge, for Go clients. Browsers use the script on the log in and sign up pages.
+func SolveProofOfWork(challenge string) string {
+	difficulty, _ := strconv.Atoi(strings.SplitN(challenge, ".", 2)[0])
+	for i := 0; ; i++ {
+		solution := strconv.Itoa(i)
+		if leadingZeroBits(challenge, solution) >= difficulty {
+			return solution
+		}
+	}
+}
+
+// Renders a fresh challenge as hidden form inputs, with a script which solves it in the background.
+func (p *ProofOfWork) formHTML(now time.Time) (string, error) {
+	challenge, err := p.Challenge(now)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`<input id=pow_challenge name=pow_challenge type=hidden value="%v" />
+			<input id=pow_solution name=pow_solution type=hidden />
+			<script>
+			(async function() {
+				var challenge = document.getElementById("pow_challenge").value, bits = parseInt(challenge, 10);
+				var encoder = new TextEncoder();
+				for (var i = 0; ; i++) {
+					var h = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + i)));
+					var zeros = 0, j = 0;
+					for (; j < h.length && h[j] == 0; j++) zeros += 8;
+					if (j < h.length) zeros += Math.clz32(h[j]) - 24;
+					if (zeros >= bits) {
+						document.getElementById("pow_solution").value = i;
+						return;
+					}
+				}
+			})();
+			</script>`, html.EscapeString(challenge)), nil
+}
+
+// Flags requests from IPs or for emails with a live risk signal in schema scoring at least min, see PushRiskSignal.
+// Errors looking up signals are logged, and the request is treated as suspicious.
+func RiskyRequests(db *sql.DB, schema *Schema, min float64) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		risk, err := HighestRisk(r.Context(), schema.wrap(db), []string{r.PostFormValue("email"), requestIP(r)}, time.Now())
+		if err != nil {
+			log.Printf("error: check risk for proof of work: %v", err)
+			return true
+		}
+		return risk.Score >= min
+	}
+}
+
+// Renders the proof of work inputs for a form, or nothing if proof of work is off.
+func (a AuthServer) proofOfWorkHTML() template.HTML {
+	if a.ProofOfWork == nil {
+		return ""
+	}
+	s, err := a.ProofOfWork.formHTML(time.Now())
+	if err != nil {
+		log.Printf("error: render proof of work: %v", err)
+	}
+	return template.HTML(s)
+}
+
+// Checks the proof of work on a parsed form, if the request needs one. Otherwise responds with a 428 carrying a fresh
+// challenge in the Proof-Of-Work header, for clients which aren't using the form, and returns false.
+func (a AuthServer) checkProofOfWork(w http.ResponseWriter, r *http.Request) bool {
+	p := a.ProofOfWork
+	if p == nil || (p.Suspicious != nil && !p.Suspicious(r)) {
+		return true
+	}
+	now := time.Now()
+	err := p.Verify(r.PostFormValue("pow_challenge"), r.PostFormValue("pow_solution"), now)
+	if err == nil {
+		return true
+	}
+	challenge, cerr := p.Challenge(now)
+	if cerr != nil {
+		a.internalError(w, "proof of work", cerr)
+		return false
+	}
+	w.Header().Set("Proof-Of-Work", challenge)
+	http.Error(w, fmt.Sprintf("%v, wait a moment and try again", err), http.StatusPreconditionRequired)
+	return false
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProofOfWork(t *testing.T) {
+	p := &ProofOfWork{Secret: []byte("s3cret"), Difficulty: 8}
+	now := time.Unix(1000000, 0)
+	challenge, err := p.Challenge(now)
+	if err != nil {
+		t.Fatalf("challenge: %v", err)
+	}
+	solution := SolveProofOfWork(challenge)
+	if leadingZeroBits(challenge, solution) < 8 {
+		t.Fatalf("solution %v doesn't meet the difficulty", solution)
+	}
+	wrong := "x"
+	for leadingZeroBits(challenge, wrong) >= 8 {
+		wrong += "x"
+	}
+	for name, c := range map[string]struct {
+		challenge, solution string
+		at                  time.Time
+	}{
+		"wrong solution": {challenge, wrong, now},
+		"expired":        {challenge, solution, now.Add(11 * time.Minute)},
+		"forged":         {strings.Replace(challenge, "8.", "1.", 1), SolveProofOfWork(strings.Replace(challenge, "8.", "1.", 1)), now},
+		"empty":          {"", "", now},
+	} {
+		if err := p.Verify(c.challenge, c.solution, c.at); !errors.Is(err, ErrInvalidProofOfWork) {
+			t.Fatalf("%v: expected invalid proof, got %v", name, err)
+		}
+	}
+	if err = p.Verify(challenge, solution, now); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if err = p.Verify(challenge, solution, now); !errors.Is(err, ErrInvalidProofOfWork) {
+		t.Fatalf("reused: expected invalid proof, got %v", err)
+	}
+	// Spent challenges are forgotten once expired.
+	later := now.Add(11 * time.Minute)
+	fresh, _ := p.Challenge(later)
+	if err = p.Verify(fresh, SolveProofOfWork(fresh), later); err != nil {
+		t.Fatalf("verify later: %v", err)
+	}
+	if len(p.spent) != 1 {
+		t.Fatalf("expected only the fresh challenge's minute to be kept, got %v", p.spent)
+	}
+	p.Difficulty = 9
+	easy, _ := (&ProofOfWork{Secret: p.Secret, Difficulty: 8}).Challenge(now)
+	if err = p.Verify(easy, SolveProofOfWork(easy), now); !errors.Is(err, ErrInvalidProofOfWork) {
+		t.Fatalf("easier challenge after raising difficulty: expected invalid proof, got %v", err)
+	}
+}
+
+func TestProofOfWorkLogin(t *testing.T) {
+	db := newDB(t, "pow")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "a@b.com", "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	err = PushRiskSignal(ctx, db, RiskSignal{Subject: "a@b.com", Score: 0.8, Reason: "credential stuffing", Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("push risk: %v", err)
+	}
+	pow := &ProofOfWork{Secret: []byte("s3cret"), Difficulty: 8, Suspicious: RiskyRequests(db, nil, 0.5)}
+	mux := AuthServer{Authenticator: DBAuthenticator{DB: db}, ProofOfWork: pow}.Handler("/auth")
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login", nil))
+	m := regexp.MustCompile(`name=pow_challenge type=hidden value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("expected a challenge in the login page: %v", w.Body)
+	}
+
+	// Requests without risk signals don't need a proof.
+	if w := post(url.Values{"email": {"c@d.com"}, "password": {"pw"}}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unsuspicious: expected 401, got %v: %v", w.Code, w.Body)
+	}
+	w = post(url.Values{"email": {"a@b.com"}, "password": {"pw"}})
+	if w.Code != http.StatusPreconditionRequired || w.Header().Get("Proof-Of-Work") == "" {
+		t.Fatalf("suspicious without proof: expected 428 with a challenge, got %v %v", w.Code, w.Header())
+	}
+	challenge := w.Header().Get("Proof-Of-Work")
+	w = post(url.Values{"email": {"a@b.com"}, "password": {"pw"}, "pow_challenge": {challenge}, "pow_solution": {SolveProofOfWork(challenge)}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("suspicious with proof: expected redirect, got %v: %v", w.Code, w.Body)
+	}
+}
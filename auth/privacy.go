@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Everything kept about a user, for showing it to them or handing it over on request. Operator notes and tags, and the
+// events recording them, are left out, since they are never shown to the user they describe.
+type PersonalData struct {
+	ID         string            `json:"id"`
+	Email      string            `json:"email"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Roles      []string          `json:"roles,omitempty"`
+	// Log ins whose tokens are still stored, including expired ones not purged yet.
+	Sessions []SessionRecord `json:"sessions,omitempty"`
+	// Apps the user logged in to through this server, and what they were given, for as long as their tokens are stored.
+	Consents []ConsentRecord `json:"consents,omitempty"`
+	// Password resets asked for the email, and the IPs they came from.
+	ResetRequests []ResetRequestRecord `json:"reset_requests,omitempty"`
+	// Remembered devices which were signed out.
+	RevokedDevices []RevokedDeviceRecord `json:"revoked_devices,omitempty"`
+	// The history of changes to the account.
+	Events []UserEvent `json:"events,omitempty"`
+}
+
+type SessionRecord struct {
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// An app holding tokens for the user, see IdentityProvider. Clients are trusted by whoever registered them, so users
+// aren't asked, but they can see who was given what.
+type ConsentRecord struct {
+	ClientID string `json:"client_id"`
+	// Empty if the client was deleted.
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// When the oldest stored token was issued to the client.
+	Granted time.Time `json:"granted"`
+}
+
+type ResetRequestRecord struct {
+	IP      string    `json:"ip"`
+	Outcome string    `json:"outcome"`
+	Created time.Time `json:"created"`
+}
+
+type RevokedDeviceRecord struct {
+	ID      string    `json:"id"`
+	Revoked time.Time `json:"revoked"`
+}
+
+// Collects everything kept about the given user. Returns ErrBadCredentials if there is no such user. Use a transaction
+// for a consistent snapshot.
+func CollectPersonalData(ctx context.Context, db conn, uid string) (PersonalData, error) {
+	p := PersonalData{ID: uid}
+	err := db.QueryRowContext(ctx, `SELECT EMAIL FROM USER WHERE ID=?;`, uid).Scan(&p.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, ErrBadCredentials
+	}
+	if err != nil {
+		return p, fmt.Errorf("fetch user: %w", err)
+	}
+	p.Attributes, err = UserAttributes(ctx, db, uid)
+	if err != nil {
+		return p, err
+	}
+	p.Roles, err = UserRoles(ctx, db, uid)
+	if err != nil {
+		return p, err
+	}
+	err = queryRows(ctx, db, `SELECT CREATED_TIME, END_TIME, IP, USER_AGENT FROM TOKEN WHERE UID=? AND `+sessionToken+`
+ORDER BY CREATED_TIME;`,
+		[]any{uid}, func(rows *sql.Rows) error {
+			var created, expires int64
+			var ip, ua sql.NullString
+			err := rows.Scan(&created, &expires, &ip, &ua)
+			p.Sessions = append(p.Sessions, SessionRecord{Created: time.UnixMilli(created), Expires: time.UnixMilli(expires),
+				IP: ip.String, UserAgent: ua.String})
+			return err
+		})
+	if err != nil {
+		return p, fmt.Errorf("fetch sessions: %w", err)
+	}
+	p.Consents, err = consents(ctx, db, uid)
+	if err != nil {
+		return p, err
+	}
+	err = queryRows(ctx, db, `SELECT IP, OUTCOME, CREATED_TIME FROM RESET_REQUEST WHERE EMAIL=? ORDER BY CREATED_TIME;`,
+		[]any{strings.ToLower(p.Email)}, func(rows *sql.Rows) error {
+			var r ResetRequestRecord
+			var created int64
+			err := rows.Scan(&r.IP, &r.Outcome, &created)
+			r.Created = time.UnixMilli(created)
+			p.ResetRequests = append(p.ResetRequests, r)
+			return err
+		})
+	if err != nil {
+		return p, fmt.Errorf("fetch reset requests: %w", err)
+	}
+	err = queryRows(ctx, db, `SELECT DEVICE_ID, REVOKED_TIME FROM DEVICE_REVOCATION WHERE UID=? ORDER BY REVOKED_TIME;`,
+		[]any{uid}, func(rows *sql.Rows) error {
+			var d RevokedDeviceRecord
+			var revoked int64
+			err := rows.Scan(&d.ID, &revoked)
+			d.Revoked = time.UnixMilli(revoked)
+			p.RevokedDevices = append(p.RevokedDevices, d)
+			return err
+		})
+	if err != nil {
+		return p, fmt.Errorf("fetch revoked devices: %w", err)
+	}
+	events, err := UserEvents(ctx, db, uid)
+	if err != nil {
+		return p, err
+	}
+	for _, e := range events {
+		if !operatorEvent(e.Kind) {
+			p.Events = append(p.Events, e)
+		}
+	}
+	return p, nil
+}
+
+// Runs the query, calling scan for each row.
+func queryRows(ctx context.Context, db conn, query string, args []any, scan func(*sql.Rows) error) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = scan(rows)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Returns the apps holding tokens for the user, merging the scopes of each app's tokens, in the order they were first
+// given one.
+func consents(ctx context.Context, db conn, uid string) ([]ConsentRecord, error) {
+	var records []ConsentRecord
+	byClient := make(map[string]int)
+	granted := make(map[[2]string]bool)
+	err := queryRows(ctx, db, `SELECT TOKEN.CLIENT_ID, COALESCE(CLIENT.NAME, ''), TOKEN.CLIENT_SCOPE, TOKEN.CREATED_TIME
+FROM TOKEN LEFT JOIN CLIENT ON CLIENT.ID = TOKEN.CLIENT_ID WHERE TOKEN.UID=? AND `+clientToken+` ORDER BY TOKEN.CREATED_TIME;`,
+		[]any{uid}, func(rows *sql.Rows) error {
+			var c ConsentRecord
+			var scope sql.NullString
+			var created int64
+			err := rows.Scan(&c.ClientID, &c.Name, &scope, &created)
+			if err != nil {
+				return err
+			}
+			i, ok := byClient[c.ClientID]
+			if !ok {
+				c.Granted = time.UnixMilli(created)
+				i = len(records)
+				byClient[c.ClientID] = i
+				records = append(records, c)
+			}
+			for _, sc := range strings.Fields(scope.String) {
+				if !granted[[2]string{c.ClientID, sc}] {
+					granted[[2]string{c.ClientID, sc}] = true
+					records[i].Scopes = append(records[i].Scopes, sc)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("fetch consents: %w", err)
+	}
+	return records, nil
+}
+
+// Erases the given user and everything kept about them, including their history of changes, unfinished sign ups for
+// their email and their one time passcodes. Device revocations are kept until they expire, so a signed out device can't
+// come back. Stashed requests aren't tied to a user, and expire within minutes; the privacy route drops the browser's
+// own. Returns ErrBadCredentials if there is no such user. Use a transaction, so a failure doesn't leave the user half
+// deleted.
+func DeleteUser(ctx context.Context, db conn, uid string) error {
+	var email string
+	err := db.QueryRowContext(ctx, `SELECT EMAIL FROM USER WHERE ID=?;`, uid).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrBadCredentials
+	}
+	if err != nil {
+		return fmt.Errorf("fetch user: %w", err)
+	}
+	_, err = revokeTokens(ctx, db, `UID=?`, uid)
+	if err != nil {
+		return fmt.Errorf("delete user: %w", err)
+	}
+	for _, q := range []struct {
+		query string
+		arg   string
+	}{
+		{`DELETE FROM REFRESH_TOKEN WHERE UID=?;`, uid},
+		{`DELETE FROM AUTH_CODE WHERE UID=?;`, uid},
+		{`DELETE FROM GRANT_CODE WHERE UID=?;`, uid},
+		{`DELETE FROM USER_ROLE WHERE UID=?;`, uid},
+		{`DELETE FROM USER_EVENT WHERE UID=?;`, uid},
+		{`DELETE FROM USER_NOTE WHERE UID=?;`, uid},
+		{`DELETE FROM USER_TAG WHERE UID=?;`, uid},
+		{`DELETE FROM USER_ATTRIBUTE WHERE UID=?;`, uid},
+		{`DELETE FROM PASSWORD_RESET WHERE UID=?;`, uid},
+		{`DELETE FROM BREAK_GLASS WHERE UID=?;`, uid},
+		{`DELETE FROM RESET_REQUEST WHERE EMAIL=?;`, strings.ToLower(email)},
+		{`DELETE FROM FAILED_LOGIN WHERE SUBJECT=?;`, "email:" + strings.ToLower(email)},
+		{`DELETE FROM RISK_SIGNAL WHERE SUBJECT=?;`, strings.ToLower(email)},
+		{`DELETE FROM PENDING_SIGNUP WHERE lower(EMAIL)=?;`, strings.ToLower(email)},
+		{`DELETE FROM OTP WHERE SUBJECT=?;`, uid},
+		{`DELETE FROM OTP WHERE lower(SUBJECT)=?;`, strings.ToLower(email)},
+		{`DELETE FROM USER WHERE ID=?;`, uid},
+	} {
+		_, err = db.ExecContext(ctx, q.query, q.arg)
+		if err != nil {
+			return fmt.Errorf("delete user: %w", err)
+		}
+	}
+	return nil
+}
+
+// Implemented by Authenticators which can show users what is kept about them, and erase it, for the privacy route.
+type PrivacyManager interface {
+	// Returns everything kept about the user of a valid access token.
+	PersonalData(ctx context.Context, access Token) (PersonalData, error)
+	// Erases the user of a valid access token, and everything kept about them. Every token of theirs stops validating,
+	// including those cached by validators told of it, e.g through DBAuthenticator.OnRevokeUser.
+	DeleteAccount(ctx context.Context, access Token) error
+}
+
+// Serves the privacy dashboard: what is kept about the logged in user, a download of it, and a form to delete the
+// account. Deleting only happens on POST, and the user must type their email to confirm. Only the current token is
+// passed to OnRevoke, since the others are only known by their hashes; the DBAuthenticator's OnRevokeUser is told of
+// the user instead. The browser's stashed request, if any, is dropped too.
+func (a AuthServer) privacyHandler(w http.ResponseWriter, r *http.Request) {
+	pm, ok := a.Authenticator.(PrivacyManager)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	login := a.link(RouteLogin, url.Values{"redirect": {a.link(RoutePrivacy, "")}}.Encode())
+	t, err := a.sessionToken(r)
+	if err != nil {
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+	data, err := pm.PersonalData(r.Context(), t)
+	if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrBadCredentials) {
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+	if err != nil {
+		a.internalError(w, "privacy: collect personal data", err)
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Query().Get("download") != "":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="personal-data.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(data)
+	case r.Method == "GET":
+		a.privacyPage(w, r, data)
+	case r.Method == "POST":
+		err = r.ParseForm()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("parse form: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !strings.EqualFold(strings.TrimSpace(r.PostFormValue("confirm")), data.Email) {
+			http.Error(w, "type your email address to confirm deleting your account", http.StatusBadRequest)
+			return
+		}
+		err = pm.DeleteAccount(r.Context(), t)
+		if err != nil {
+			a.internalError(w, "privacy: delete account", err)
+			return
+		}
+		if a.OnRevoke != nil {
+			a.OnRevoke(t)
+		}
+		a.dropStash(w, r)
+		a.Cookies.clear(w)
+		a.flash(w, "Your account and everything we kept about you was deleted.")
+		redirect := a.link(RouteLogin, "")
+		if redirect == "" {
+			redirect = "/"
+		}
+		http.Redirect(w, r, redirect, http.StatusFound)
+	default:
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+	}
+}
+
+// Forgets the request stashed by the browser, if the Authenticator stashes them, since it may hold the user's data.
+func (a AuthServer) dropStash(w http.ResponseWriter, r *http.Request) {
+	stash, ok := a.Authenticator.(RequestStash)
+	c, err := r.Cookie("auth_resume")
+	if !ok || err != nil {
+		return
+	}
+	var id Token
+	if id.UnmarshalText([]byte(c.Value)) != nil {
+		return
+	}
+	_, err = stash.Unstash(r.Context(), id)
+	if err != nil && !errors.Is(err, ErrNoStashedRequest) {
+		log.Printf("error: privacy: drop stashed request: %v", err)
+	}
+	w.Header().Add("Set-Cookie", "auth_resume=; Max-Age=0; Secure; HttpOnly; Path=/")
+}
+
+func (a AuthServer) privacyPage(w http.ResponseWriter, r *http.Request, data PersonalData) {
+	a.render(w, r, http.StatusOK, PageData{Page: "privacy.html", Title: "Your Data", Action: a.link(RoutePrivacy, ""), Personal: &data})
+}
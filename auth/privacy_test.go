@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrivacyDashboard(t *testing.T) {
+	db := newDB(t, "privacy")
+	ctx := context.Background()
+	now := time.Now()
+	cache := &CachedValidator{TTL: time.Hour}
+	a := DBAuthenticator{DB: db, OnRevokeUser: cache.InvalidateUser}
+	cache.Validator = a
+	err := a.Register(ctx, "A@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	token, _, err := a.Authenticate(ctx, "A@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	other, _, err := a.Authenticate(ctx, "A@b.com", "pw")
+	if err == nil {
+		err = cache.Validate(ctx, other)
+	}
+	if err != nil {
+		t.Fatalf("other session: %v", err)
+	}
+	client, _, err := RegisterClient(ctx, db, "Wiki", []string{"https://wiki.example.com/callback"}, now)
+	if err != nil {
+		t.Fatalf("register client: %v", err)
+	}
+	_, err = GenerateClientToken(ctx, db, Grant{ClientID: client.ID, UID: "A@b.com", Scopes: []string{"openid", "email"}},
+		now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("client token: %v", err)
+	}
+	err = GrantRole(ctx, db, "A@b.com", "member", now)
+	if err == nil {
+		err = SetUserAttribute(ctx, db, "A@b.com", "display_name", "Ada")
+	}
+	if err == nil {
+		err = RecordResetRequest(ctx, db, "A@b.com", "192.0.2.7", ResetSent, now)
+	}
+	if err == nil {
+		err = AddUserNote(ctx, db, "A@b.com", "support", "called about billing", now)
+	}
+	if err == nil {
+		err = PushRiskSignal(ctx, db, RiskSignal{Subject: "A@b.com", Score: 0.1, Reason: "new device", Expires: now.Add(time.Hour)})
+	}
+	if err == nil {
+		_, err = CreatePendingSignup(ctx, db, "a@b.com", "correct horse battery", now, now.Add(time.Hour))
+	}
+	if err == nil {
+		_, err = IssueOTP(ctx, db, "email-login", "A@b.com", 6, 3, now.Add(time.Hour))
+	}
+	var stashed Token
+	if err == nil {
+		stashed, err = a.Stash(ctx, StashedRequest{Method: "POST", URL: "/notes", Body: []byte("note=private")})
+	}
+	if err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	mux := AuthServer{Authenticator: a}.Handler("/auth")
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		r.AddCookie(&http.Cookie{Name: "auth_token", Value: token.String()})
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/privacy", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/auth/login?redirect=%2Fauth%2Fprivacy" {
+		t.Fatalf("logged out: expected redirect to log in, got %v %v", w.Code, w.Header().Get("Location"))
+	}
+
+	w = do(httptest.NewRequest("GET", "/auth/privacy", nil))
+	body := w.Body.String()
+	for _, want := range []string{"A@b.com", "display_name: Ada", "member", "192.0.2.7", "Wiki, given openid, email"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected the dashboard to show %v: %v", want, body)
+		}
+	}
+	if strings.Contains(body, "billing") {
+		t.Fatalf("operator notes should not be shown: %v", body)
+	}
+
+	w = do(httptest.NewRequest("GET", "/auth/privacy?download=1", nil))
+	var data PersonalData
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil || !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment") {
+		t.Fatalf("download: expected a JSON attachment, got %v: %v", err, w.Body)
+	}
+	if data.Email != "A@b.com" || len(data.Sessions) != 2 || len(data.Consents) != 1 || len(data.ResetRequests) != 1 ||
+		len(data.Events) == 0 {
+		t.Fatalf("download: unexpected data %+v", data)
+	}
+
+	del := func(confirm string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/auth/privacy", strings.NewReader(url.Values{"confirm": {confirm}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return do(r)
+	}
+	if w := del("someone@else.com"); w.Code != http.StatusBadRequest {
+		t.Fatalf("delete without confirming: expected 400, got %v", w.Code)
+	}
+	r := httptest.NewRequest("POST", "/auth/privacy", strings.NewReader(url.Values{"confirm": {"a@B.com"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: "auth_resume", Value: stashed.String()})
+	w = do(r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("delete: expected redirect, got %v: %v", w.Code, w.Body)
+	}
+	if c := responseCookie(w, "auth_token"); c == nil || c.MaxAge >= 0 {
+		t.Fatalf("delete: expected the cookie to be cleared, got %+v", c)
+	}
+	if _, err := LookupByEmail(ctx, db, "A@b.com"); err != ErrBadCredentials {
+		t.Fatalf("expected the user to be gone, got %v", err)
+	}
+	if err := a.Validate(ctx, token); err != ErrInvalidToken {
+		t.Fatalf("expected the token to be gone, got %v", err)
+	}
+	if err := cache.Validate(ctx, other); err != ErrInvalidToken {
+		t.Fatalf("expected the cached session to be forgotten, got %v", err)
+	}
+	for _, table := range []string{"USER_ROLE", "USER_ATTRIBUTE", "USER_NOTE", "USER_EVENT", "RESET_REQUEST", "RISK_SIGNAL",
+		"TOKEN", "PENDING_SIGNUP", "OTP", "STASHED_REQUEST"} {
+		var n int
+		err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n)
+		if err != nil || n != 0 {
+			t.Fatalf("%v: expected no rows left, got %v %v", table, n, err)
+		}
+	}
+}
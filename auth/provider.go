@@ -0,0 +1,675 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// This server can be the OpenID Connect provider of other apps, e.g internal tools. Administrators register each app as
+// a Client, with the exact redirect URIs it uses. The app sends users to the authorize route, which has them log in if
+// they haven't already, then sends them back to the app with a single use code. The app's server exchanges the code at
+// the token route, authenticating with its client secret, for an access token and an ID token signed by
+// IdentityProvider.Key. Access tokens are kept in TOKEN, marked with their client, carry none of the user's roles, and
+// are only good for the userinfo route; Lookup and Validate refuse them, so they can't be used as the user's session.
+// Clients are trusted by whoever registered them, so users aren't asked for consent.
+
+// Returned when a client ID is unknown, or presented with the wrong secret.
+var ErrInvalidClient = errors.New("unknown client or wrong client secret")
+
+// Scopes clients may be granted. "openid" is required, "email" adds the user's email to their claims, and "roles"
+// their roles.
+var clientScopes = []string{"openid", "email", "roles"}
+
+// An app which logs its users in through this server, see AuthServer.IdentityProvider.
+type Client struct {
+	ID string
+	// Shown to administrators, e.g "Wiki".
+	Name string
+	// Where the authorize route may send users back to, matched exactly, e.g "https://wiki.example.com/callback".
+	RedirectURIs []string
+	Created      time.Time
+}
+
+// Reports whether uri is one of the client's redirect URIs.
+func (c Client) allowsRedirect(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if uri == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a random string safe to use unescaped in URLs and HTTP Basic auth.
+func newSecret() (string, error) {
+	t, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(t[:]), nil
+}
+
+// Registers an app as a client, returning it and its secret. Only a hash of the secret is kept, so it can't be shown
+// again.
+func RegisterClient(ctx context.Context, db conn, name string, redirectURIs []string, now time.Time) (Client, string, error) {
+	c := Client{Name: name, RedirectURIs: redirectURIs, Created: now}
+	if len(redirectURIs) == 0 {
+		return c, "", fmt.Errorf("client %v: no redirect uris", name)
+	}
+	for _, uri := range redirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" || u.Fragment != "" || strings.ContainsAny(uri, " \t\n") {
+			return c, "", fmt.Errorf("client %v: invalid redirect uri '%v'", name, uri)
+		}
+	}
+	id, err := newSecret()
+	if err != nil {
+		return c, "", err
+	}
+	c.ID = id
+	secret, err := newSecret()
+	if err != nil {
+		return c, "", err
+	}
+	secretHash := sha256.Sum256([]byte(secret))
+	_, err = db.ExecContext(ctx, `INSERT INTO CLIENT (ID, NAME, SECRET_HASH, REDIRECT_URIS, CREATED_TIME) VALUES (?, ?, ?, ?, ?);`,
+		c.ID, name, secretHash[:], strings.Join(redirectURIs, " "), now.UnixMilli())
+	if err != nil {
+		return c, "", fmt.Errorf("insert client: %w", err)
+	}
+	return c, secret, nil
+}
+
+// Returns the client with the given ID. Returns ErrInvalidClient if there is none.
+func LookupClient(ctx context.Context, db conn, id string) (Client, error) {
+	c, _, err := lookupClient(ctx, db, id)
+	return c, err
+}
+
+// Returns the client with the given ID if the secret is its own. Returns ErrInvalidClient otherwise.
+func AuthenticateClient(ctx context.Context, db conn, id, secret string) (Client, error) {
+	c, secretHash, err := lookupClient(ctx, db, id)
+	if err != nil {
+		return c, err
+	}
+	given := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(given[:], secretHash) != 1 {
+		return Client{}, ErrInvalidClient
+	}
+	return c, nil
+}
+
+func lookupClient(ctx context.Context, db conn, id string) (Client, []byte, error) {
+	c := Client{ID: id}
+	var secretHash []byte
+	var uris string
+	var created int64
+	row := db.QueryRowContext(ctx, `SELECT NAME, SECRET_HASH, REDIRECT_URIS, CREATED_TIME FROM CLIENT WHERE ID=?;`, id)
+	err := row.Scan(&c.Name, &secretHash, &uris, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, nil, ErrInvalidClient
+	}
+	if err != nil {
+		return c, nil, fmt.Errorf("parse client: %w", err)
+	}
+	c.RedirectURIs = strings.Fields(uris)
+	c.Created = time.UnixMilli(created)
+	return c, secretHash, nil
+}
+
+// Returns every registered client, oldest first.
+func ListClients(ctx context.Context, db conn) ([]Client, error) {
+	var clients []Client
+	err := queryRows(ctx, db, `SELECT ID, NAME, REDIRECT_URIS, CREATED_TIME FROM CLIENT ORDER BY CREATED_TIME, ID;`, nil,
+		func(rows *sql.Rows) error {
+			var c Client
+			var uris string
+			var created int64
+			err := rows.Scan(&c.ID, &c.Name, &uris, &created)
+			if err != nil {
+				return err
+			}
+			c.RedirectURIs = strings.Fields(uris)
+			c.Created = time.UnixMilli(created)
+			clients = append(clients, c)
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("list clients: %w", err)
+	}
+	return clients, nil
+}
+
+// Unregisters a client, revoking every access token and code it was issued. Returns ErrInvalidClient if there is no
+// such client. Use a transaction, so the client's tokens can't outlive it.
+func DeleteClient(ctx context.Context, db conn, id string) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM CLIENT WHERE ID=?;`, id)
+	if err != nil {
+		return fmt.Errorf("delete client: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete client: %w", err)
+	}
+	if n == 0 {
+		return ErrInvalidClient
+	}
+	_, err = revokeTokens(ctx, db, `CLIENT_ID=?`, id)
+	if err != nil {
+		return fmt.Errorf("revoke client tokens: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM GRANT_CODE WHERE CLIENT_ID=?;`, id)
+	if err != nil {
+		return fmt.Errorf("delete grant codes: %w", err)
+	}
+	return nil
+}
+
+// What a user granted a client at the authorize route.
+type Grant struct {
+	ClientID string
+	UID      string
+	// Where the code was sent, which the client must repeat when exchanging it.
+	RedirectURI string
+	// The granted scopes, e.g "openid" and "email".
+	Scopes []string
+	// From the authorization request, for the ID token.
+	Nonce string
+	// The S256 PKCE challenge, if the client sent one.
+	Challenge string
+}
+
+// Stores a single use code for the grant, and returns it. Only a hash of the code is stored.
+func CreateGrantCode(ctx context.Context, db conn, g Grant, now, expires time.Time) (Token, error) {
+	code, err := newToken()
+	if err != nil {
+		return code, err
+	}
+	codeHash := sha256.Sum256(code[:])
+	_, err = db.ExecContext(ctx, `INSERT INTO GRANT_CODE
+	(CODE_HASH, CLIENT_ID, UID, REDIRECT_URI, SCOPE, NONCE, CHALLENGE, CREATED_TIME, EXPIRES_TIME)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`, codeHash[:], g.ClientID, g.UID, g.RedirectURI, strings.Join(g.Scopes, " "),
+		g.Nonce, g.Challenge, now.UnixMilli(), expires.UnixMilli())
+	if err != nil {
+		return code, fmt.Errorf("insert grant code: %w", err)
+	}
+	return code, nil
+}
+
+// Spends a grant code, returning its grant if it was issued to the client for the redirect URI, and the verifier
+// matches its challenge. The code is spent even if they don't match, so it can't be guessed at. Returns
+// ErrInvalidAuthCode if anything isn't valid.
+func ConsumeGrantCode(ctx context.Context, db conn, code Token, clientID, redirectURI, verifier string, now time.Time) (Grant, error) {
+	codeHash := sha256.Sum256(code[:])
+	var g Grant
+	var scope string
+	row := db.QueryRowContext(ctx, `SELECT CLIENT_ID, UID, REDIRECT_URI, SCOPE, NONCE, CHALLENGE FROM GRANT_CODE
+	WHERE CODE_HASH=? AND EXPIRES_TIME >= ?`, codeHash[:], now.UnixMilli())
+	err := row.Scan(&g.ClientID, &g.UID, &g.RedirectURI, &scope, &g.Nonce, &g.Challenge)
+	if errors.Is(err, sql.ErrNoRows) {
+		return g, ErrInvalidAuthCode
+	}
+	if err != nil {
+		return g, fmt.Errorf("parse grant code: %w", err)
+	}
+	g.Scopes = strings.Fields(scope)
+	// Checking what the delete removed means a code which two exchanges both looked up is still only spent once.
+	res, err := db.ExecContext(ctx, `DELETE FROM GRANT_CODE WHERE CODE_HASH=?`, codeHash[:])
+	if err != nil {
+		return g, fmt.Errorf("delete grant code: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return g, fmt.Errorf("delete grant code: %w", err)
+	}
+	if n != 1 {
+		return Grant{}, ErrInvalidAuthCode
+	}
+	if g.ClientID != clientID || g.RedirectURI != redirectURI {
+		return Grant{}, ErrInvalidAuthCode
+	}
+	if g.Challenge != "" && subtle.ConstantTimeCompare([]byte(CodeChallenge(verifier)), []byte(g.Challenge)) != 1 {
+		return Grant{}, ErrInvalidAuthCode
+	}
+	return g, nil
+}
+
+// Drops grant codes which expired before the given time.
+func ReapGrantCodes(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM GRANT_CODE WHERE EXPIRES_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
+
+// Creates an access token for the grant's client, valid between the given times. The token carries none of the user's
+// roles. Use a transaction, so a token without its client is never stored.
+func GenerateClientToken(ctx context.Context, db conn, g Grant, start, end time.Time) (Token, error) {
+	t, err := GenerateScopedToken(ctx, db, g.UID, nil, start, end)
+	if err != nil {
+		return t, err
+	}
+	hash := sha256.Sum256(t[:])
+	_, err = db.ExecContext(ctx, `UPDATE TOKEN SET CLIENT_ID=?, CLIENT_SCOPE=? WHERE TOKEN_HASH=?;`, g.ClientID,
+		strings.Join(g.Scopes, " "), hash[:])
+	if err != nil {
+		return t, fmt.Errorf("set client: %w", err)
+	}
+	return t, nil
+}
+
+// Returns the client, user and scopes of an access token issued to a client, valid at the given time. Returns
+// ErrInvalidToken if it isn't valid, or wasn't issued to a client.
+func LookupClientToken(ctx context.Context, db conn, t Token, now time.Time) (Grant, error) {
+	var g Grant
+	uid, err := lookupToken(ctx, db, t, now, clientToken)
+	if err != nil {
+		return g, err
+	}
+	hash := sha256.Sum256(t[:])
+	var clientID, scope sql.NullString
+	err = db.QueryRowContext(ctx, `SELECT CLIENT_ID, CLIENT_SCOPE FROM TOKEN WHERE TOKEN_HASH=?;`, hash[:]).Scan(&clientID, &scope)
+	if err != nil {
+		return g, fmt.Errorf("lookup client: %w", err)
+	}
+	if !clientID.Valid {
+		return g, ErrInvalidToken
+	}
+	return Grant{ClientID: clientID.String, UID: uid, Scopes: strings.Fields(scope.String)}, nil
+}
+
+// Returns the claims about a user which the scopes grant: "sub" always, "email" and "email_verified" with the email
+// scope, and "roles" with the roles scope.
+func UserClaims(ctx context.Context, db conn, uid string, scopes []string) (map[string]any, error) {
+	claims := map[string]any{"sub": uid}
+	for _, scope := range scopes {
+		switch scope {
+		case "email":
+			var email string
+			var verified bool
+			err := db.QueryRowContext(ctx, `SELECT EMAIL, VALID FROM USER WHERE ID=?;`, uid).Scan(&email, &verified)
+			if err != nil {
+				return nil, fmt.Errorf("fetch user: %w", err)
+			}
+			claims["email"] = email
+			claims["email_verified"] = verified
+		case "roles":
+			roles, err := UserRoles(ctx, db, uid)
+			if err != nil {
+				return nil, err
+			}
+			if roles == nil {
+				roles = []string{}
+			}
+			claims["roles"] = roles
+		}
+	}
+	return claims, nil
+}
+
+// What the token route hands a client in exchange for a grant code.
+type ClientSession struct {
+	Grant
+	Access  Token
+	Expires time.Time
+	// The claims about the user the grant's scopes allow, see UserClaims.
+	Claims map[string]any
+}
+
+// Implemented by Authenticators which can log users in to registered Clients, for AuthServer.IdentityProvider.
+type ClientGranter interface {
+	// Returns the registered client with the ID. Returns ErrInvalidClient if there is none.
+	Client(ctx context.Context, id string) (Client, error)
+	// Issues a single use code granting a client access to the user of a valid access token.
+	IssueGrant(ctx context.Context, access Token, g Grant) (Token, error)
+	// Exchanges a code and the client's secret for an access token. The redirect URI and verifier must match the
+	// grant's. Returns ErrInvalidClient if the secret is wrong, and ErrInvalidAuthCode if anything else isn't valid.
+	ExchangeGrant(ctx context.Context, clientID, secret string, code Token, redirectURI, verifier string) (ClientSession, error)
+	// Returns the claims about the user of an access token issued to a client, see UserClaims. Returns ErrInvalidToken
+	// if the token isn't valid, or wasn't issued to a client.
+	UserInfo(ctx context.Context, access Token) (map[string]any, error)
+}
+
+// Makes AuthServer an OpenID Connect provider for registered Clients. Requires BaseURL, Key, and an Authenticator
+// implementing ClientGranter.
+type IdentityProvider struct {
+	// Signs ID tokens, with RS256. Clients fetch the public key from the JWKS route.
+	Key *rsa.PrivateKey
+	// Identifies this provider in ID tokens, and is where clients discover it, at
+	// Issuer+"/.well-known/openid-configuration". Defaults to BaseURL followed by the mount prefix, e.g
+	// "https://example.com/auth".
+	Issuer string
+	// How long ID tokens are valid for. Defaults to an hour.
+	IDTokenTTL time.Duration
+}
+
+const discoveryPath = "/.well-known/openid-configuration"
+
+func (p IdentityProvider) idTokenTTL() time.Duration {
+	if p.IDTokenTTL == 0 {
+		return time.Hour
+	}
+	return p.IDTokenTTL
+}
+
+// Returns the absolute URL of the named route.
+func (a AuthServer) absoluteLink(name string) string {
+	return strings.TrimSuffix(a.BaseURL, "/") + a.link(name, "")
+}
+
+func (a AuthServer) issuer() string {
+	if a.IdentityProvider.Issuer != "" {
+		return a.IdentityProvider.Issuer
+	}
+	return strings.TrimSuffix(a.absoluteLink(RouteDiscovery), discoveryPath)
+}
+
+// Returns the ClientGranter, or responds with a 404 and returns false if this server isn't an identity provider.
+func (a AuthServer) clientGranter(w http.ResponseWriter, r *http.Request) (ClientGranter, bool) {
+	cg, ok := a.Authenticator.(ClientGranter)
+	if a.IdentityProvider == nil || !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if a.BaseURL == "" {
+		a.internalError(w, "identity provider", fmt.Errorf("BaseURL must be set"))
+		return nil, false
+	}
+	if a.IdentityProvider.Key == nil {
+		a.internalError(w, "identity provider", fmt.Errorf("IdentityProvider.Key must be set"))
+		return nil, false
+	}
+	return cg, true
+}
+
+// Sends a logged in user back to a client with a code for the token route, or has them log in first. Requests which
+// can't be trusted to come from the client, because the client or redirect URI is unknown, are refused here rather
+// than sent back.
+func (a AuthServer) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	cg, ok := a.clientGranter(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	client, err := cg.Client(r.Context(), q.Get("client_id"))
+	if errors.Is(err, ErrInvalidClient) {
+		http.Error(w, "authorize: unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		a.internalError(w, "authorize: lookup client", err)
+		return
+	}
+	redirect := q.Get("redirect_uri")
+	callback, err := url.Parse(redirect)
+	if err != nil || !client.allowsRedirect(redirect) {
+		http.Error(w, "authorize: unregistered redirect_uri", http.StatusBadRequest)
+		return
+	}
+	respond := func(params url.Values) {
+		cq := callback.Query()
+		for k, v := range params {
+			cq[k] = v
+		}
+		if state := q.Get("state"); state != "" {
+			cq.Set("state", state)
+		}
+		callback.RawQuery = cq.Encode()
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		http.Redirect(w, r, callback.String(), http.StatusFound)
+	}
+	fail := func(code, description string) {
+		respond(url.Values{"error": {code}, "error_description": {description}})
+	}
+	if q.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only response_type=code is supported")
+		return
+	}
+	var scopes []string
+	requested := strings.Fields(q.Get("scope"))
+	for _, scope := range clientScopes {
+		for _, s := range requested {
+			if s == scope {
+				scopes = append(scopes, scope)
+				break
+			}
+		}
+	}
+	if len(scopes) == 0 || scopes[0] != "openid" {
+		fail("invalid_scope", "scope must include openid")
+		return
+	}
+	challenge := q.Get("code_challenge")
+	if challenge != "" && q.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "code_challenge_method must be S256")
+		return
+	}
+	login := a.link(RouteLogin, url.Values{"redirect": {r.URL.RequestURI()}}.Encode())
+	var code Token
+	t, err := a.sessionToken(r)
+	if err == nil {
+		code, err = cg.IssueGrant(r.Context(), t, Grant{ClientID: client.ID, RedirectURI: redirect, Scopes: scopes,
+			Nonce: q.Get("nonce"), Challenge: challenge})
+		if err != nil && !errors.Is(err, ErrInvalidToken) {
+			a.internalError(w, "authorize: issue grant", err)
+			return
+		}
+	}
+	if err != nil {
+		if q.Get("prompt") == "none" {
+			fail("login_required", "the user is not logged in")
+			return
+		}
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+	respond(url.Values{"code": {code.String()}})
+}
+
+// Responds to the token route for clients: a form with grant_type=authorization_code and a code from the authorize
+// route is exchanged for an access token and ID token. Clients authenticate with HTTP Basic auth or the client_id and
+// client_secret fields.
+func (a AuthServer) grantHandler(w http.ResponseWriter, r *http.Request) {
+	cg, ok := a.clientGranter(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<12)
+	err := r.ParseForm()
+	if err != nil {
+		grantError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("parse form: %v", err))
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		grantError(w, http.StatusBadRequest, "unsupported_grant_type", "only grant_type=authorization_code is supported")
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		// Basic auth credentials are form encoded first, see RFC 6749 section 2.3.1.
+		if s, err := url.QueryUnescape(id); err == nil {
+			id = s
+		}
+		if s, err := url.QueryUnescape(secret); err == nil {
+			secret = s
+		}
+	} else {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	var code Token
+	err = code.UnmarshalText([]byte(r.PostFormValue("code")))
+	if err != nil {
+		grantError(w, http.StatusBadRequest, "invalid_grant", ErrInvalidAuthCode.Error())
+		return
+	}
+	s, err := cg.ExchangeGrant(r.Context(), id, secret, code, r.PostFormValue("redirect_uri"), r.PostFormValue("code_verifier"))
+	if errors.Is(err, ErrInvalidClient) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		grantError(w, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	if errors.Is(err, ErrInvalidAuthCode) {
+		grantError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil {
+		a.internalError(w, "exchange grant", err)
+		return
+	}
+	now := time.Now()
+	claims := map[string]any{
+		"iss": a.issuer(),
+		"aud": s.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(a.IdentityProvider.idTokenTTL()).Unix(),
+	}
+	if s.Nonce != "" {
+		claims["nonce"] = s.Nonce
+	}
+	for k, v := range s.Claims {
+		claims[k] = v
+	}
+	idToken, err := signJWT(a.IdentityProvider.Key, claims)
+	if err != nil {
+		a.internalError(w, "sign id token", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": s.Access.String(),
+		"token_type":   "Bearer",
+		"expires_in":   int64(s.Expires.Sub(now).Seconds()),
+		"id_token":     idToken,
+		"scope":        strings.Join(s.Scopes, " "),
+	})
+}
+
+// Responds with an OAuth 2.0 error, see RFC 6749 section 5.2.
+func grantError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// Reports whether a request to the token route is a form, as clients send, rather than JSON.
+func isForm(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// Responds with the claims about the user of a client's access token, sent as a bearer token.
+func (a AuthServer) userinfoHandler(w http.ResponseWriter, r *http.Request) {
+	cg, ok := a.clientGranter(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	var t Token
+	text, ok := BearerTokenSource()(r)
+	err := t.UnmarshalText([]byte(text))
+	if !ok || err != nil {
+		err = ErrInvalidToken
+	}
+	var claims map[string]any
+	if err == nil {
+		claims, err = cg.UserInfo(r.Context(), t)
+	}
+	if errors.Is(err, ErrInvalidToken) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "userinfo: invalid access token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		a.internalError(w, "userinfo", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(claims)
+}
+
+// Serves the public key ID tokens are signed with, as a JSON Web Key Set.
+func (a AuthServer) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.clientGranter(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{publicJWK(&a.IdentityProvider.Key.PublicKey)}})
+}
+
+// Serves the OpenID Connect discovery document, which tells clients where everything else is.
+func (a AuthServer) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.clientGranter(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                a.issuer(),
+		"authorization_endpoint":                a.absoluteLink(RouteAuthorize),
+		"token_endpoint":                        a.absoluteLink(RouteToken),
+		"userinfo_endpoint":                     a.absoluteLink(RouteUserinfo),
+		"jwks_uri":                              a.absoluteLink(RouteJWKS),
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      clientScopes,
+		"claims_supported":                      []string{"sub", "email", "email_verified", "roles"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// Returns a JWT of the claims, signed with RS256.
+func signJWT(key *rsa.PrivateKey, claims map[string]any) (string, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": publicJWK(&key.PublicKey)["kid"]})
+	if err != nil {
+		return "", fmt.Errorf("marshal header: %w", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("marshal claims: %w", err)
+	}
+	signing := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+	return signing + "." + b64(sig), nil
+}
+
+// Returns the JSON Web Key of an RS256 public key. Its ID is the key's RFC 7638 thumbprint, so it changes with the key.
+func publicJWK(k *rsa.PublicKey) map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	n, e := b64(k.N.Bytes()), b64(big.NewInt(int64(k.E)).Bytes())
+	// The thumbprint is the hash of the required members, in lexical order with no whitespace.
+	thumbprint := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return map[string]string{"kty": "RSA", "alg": "RS256", "use": "sig", "kid": b64(thumbprint[:]), "n": n, "e": e}
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+func TestIdentityProvider(t *testing.T) {
+	db := newDB(t, "provider")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	err = GrantRole(ctx, db, "a@b.com", "admin", time.Now())
+	if err != nil {
+		t.Fatalf("grant role: %v", err)
+	}
+	wiki, secret, err := RegisterClient(ctx, db, "Wiki", []string{"https://wiki.example.com/callback"}, time.Now())
+	if err != nil {
+		t.Fatalf("register client: %v", err)
+	}
+	if _, _, err := RegisterClient(ctx, db, "Bad", []string{"/relative"}, time.Now()); err == nil {
+		t.Fatal("expected a relative redirect uri to be refused")
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	var mux http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { mux.ServeHTTP(w, r) }))
+	defer srv.Close()
+	mux = AuthServer{Authenticator: a, BaseURL: srv.URL, IdentityProvider: &IdentityProvider{Key: key}}.Handler("/auth")
+	ctx = oidc.ClientContext(ctx, srv.Client())
+	provider, err := oidc.NewProvider(ctx, srv.URL+"/auth")
+	if err != nil {
+		t.Fatalf("discover provider: %v", err)
+	}
+	config := oauth2.Config{
+		ClientID:     wiki.ID,
+		ClientSecret: secret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  "https://wiki.example.com/callback",
+		Scopes:       []string{oidc.ScopeOpenID, "email", "roles"},
+	}
+	do := func(r *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	// Returns the authorize route's redirect back to the client.
+	authorize := func(authURL string, cookies ...*http.Cookie) *url.URL {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			t.Fatalf("parse auth url: %v", err)
+		}
+		w := do(httptest.NewRequest("GET", u.RequestURI(), nil), cookies...)
+		callback, err := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusFound || err != nil || !strings.HasPrefix(callback.String(), config.RedirectURL+"?") {
+			t.Fatalf("authorize: expected a redirect to the client, got %v %v", w.Code, w.Header())
+		}
+		return callback
+	}
+
+	verifier := "a-verifier-long-enough-to-be-a-real-one-0123456789"
+	authURL := config.AuthCodeURL("st4te", oidc.Nonce("n0nce"),
+		oauth2.SetAuthURLParam("code_challenge", CodeChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	if q := authorize(authURL + "&prompt=none").Query(); q.Get("error") != "login_required" || q.Get("state") != "st4te" {
+		t.Fatalf("prompt=none while logged out: expected login_required, got %v", q)
+	}
+	u, _ := url.Parse(authURL)
+	w := do(httptest.NewRequest("GET", u.RequestURI(), nil))
+	login := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(login, "/auth/login?") {
+		t.Fatalf("logged out: expected a redirect to log in, got %v %v", w.Code, login)
+	}
+	form := url.Values{"email": {"a@b.com"}, "password": {"pw"}}
+	r := httptest.NewRequest("POST", login, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = do(r)
+	session := responseCookie(w, "auth_token")
+	if w.Code != http.StatusFound || session == nil || w.Header().Get("Location") != u.RequestURI() {
+		t.Fatalf("log in: expected a redirect back to authorize, got %v %v", w.Code, w.Header())
+	}
+	callback := authorize(authURL, session)
+	if callback.Query().Get("state") != "st4te" || callback.Query().Get("code") == "" {
+		t.Fatalf("expected a code and the state, got %v", callback)
+	}
+	code := callback.Query().Get("code")
+
+	if _, err := (&oauth2.Config{ClientID: wiki.ID, ClientSecret: "wrong", Endpoint: config.Endpoint,
+		RedirectURL: config.RedirectURL}).Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier)); err == nil {
+		t.Fatal("expected the wrong client secret to be refused")
+	}
+	if _, err := config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", "wrong")); err == nil {
+		t.Fatal("expected the wrong verifier to be refused")
+	}
+	// The code was spent by the wrong verifier.
+	if _, err := config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier)); err == nil {
+		t.Fatal("expected a spent code to be refused")
+	}
+	code = authorize(authURL, session).Query().Get("code")
+	tok, err := config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	raw, _ := tok.Extra("id_token").(string)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: wiki.ID}).Verify(ctx, raw)
+	if err != nil {
+		t.Fatalf("verify id token: %v", err)
+	}
+	var claims struct {
+		Email string   `json:"email"`
+		Roles []string `json:"roles"`
+	}
+	if err := idToken.Claims(&claims); err != nil || idToken.Subject != "a@b.com" || idToken.Nonce != "n0nce" ||
+		claims.Email != "a@b.com" || len(claims.Roles) != 1 || claims.Roles[0] != "admin" {
+		t.Fatalf("unexpected id token: %+v %+v %v", idToken, claims, err)
+	}
+	info, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(tok))
+	if err != nil || info.Subject != "a@b.com" || info.Email != "a@b.com" {
+		t.Fatalf("expected userinfo for the user, got %+v %v", info, err)
+	}
+	var access Token
+	if err := access.UnmarshalText([]byte(tok.AccessToken)); err != nil {
+		t.Fatalf("parse access token: %v", err)
+	}
+	if ok, err := a.HasRole(ctx, access, "admin"); ok || err != nil {
+		t.Fatalf("client access tokens should carry no roles, got %v %v", ok, err)
+	}
+	var sessionToken Token
+	sessionToken.UnmarshalText([]byte(session.Value))
+	if _, err := a.UserInfo(ctx, sessionToken); err != ErrInvalidToken {
+		t.Fatalf("userinfo should only accept client tokens, got %v", err)
+	}
+	// A client's token is only good for what the client was granted, not as the user's own session.
+	if err := a.Validate(ctx, access); err != ErrInvalidToken {
+		t.Fatalf("validate should refuse client tokens, got %v", err)
+	}
+	if res, err := a.ValidateBatch(ctx, []Token{access}); err != nil || res[0].Err != ErrInvalidToken {
+		t.Fatalf("validate batch should refuse client tokens, got %+v %v", res, err)
+	}
+	if _, err := a.IssueGrant(ctx, access, Grant{ClientID: wiki.ID, Scopes: []string{"openid"}}); err != ErrInvalidToken {
+		t.Fatalf("issuing a grant should refuse client tokens, got %v", err)
+	}
+	if _, err := a.Expiry(ctx, access); err != ErrInvalidToken {
+		t.Fatalf("expiry should refuse client tokens, got %v", err)
+	}
+	if _, err := a.Impersonation(ctx, access); err != ErrInvalidToken {
+		t.Fatalf("impersonation should refuse client tokens, got %v", err)
+	}
+	// Even unscoped, a client's token doesn't carry the user's roles.
+	_, err = db.ExecContext(ctx, `UPDATE TOKEN SET SCOPE=NULL WHERE CLIENT_ID IS NOT NULL;`)
+	if err != nil {
+		t.Fatalf("unscope client token: %v", err)
+	}
+	if ok, err := TokenHasRole(ctx, db, access, "admin"); ok || err != nil {
+		t.Fatalf("client access tokens should carry no roles, got %v %v", ok, err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		query url.Values
+	}{
+		{"unknown client", url.Values{"client_id": {"nope"}, "redirect_uri": {config.RedirectURL}, "response_type": {"code"}, "scope": {"openid"}}},
+		{"unregistered redirect", url.Values{"client_id": {wiki.ID}, "redirect_uri": {"https://evil.example.com/callback"}, "response_type": {"code"}, "scope": {"openid"}}},
+	} {
+		if w := do(httptest.NewRequest("GET", "/auth/authorize?"+tc.query.Encode(), nil), session); w.Code != http.StatusBadRequest {
+			t.Fatalf("%v: expected 400, got %v %v", tc.name, w.Code, w.Header())
+		}
+	}
+	q := url.Values{"client_id": {wiki.ID}, "redirect_uri": {config.RedirectURL}, "response_type": {"code"}, "scope": {"email"}}
+	if e := authorize("/auth/authorize?"+q.Encode(), session).Query().Get("error"); e != "invalid_scope" {
+		t.Fatalf("missing openid scope: expected invalid_scope, got %v", e)
+	}
+
+	err = DeleteClient(ctx, db, wiki.ID)
+	if err != nil {
+		t.Fatalf("delete client: %v", err)
+	}
+	if _, err := a.UserInfo(ctx, access); err != ErrInvalidToken {
+		t.Fatalf("deleting a client should revoke its tokens, got %v", err)
+	}
+	if err := a.Validate(ctx, sessionToken); err != nil {
+		t.Fatalf("deleting a client should keep the user's own session, got %v", err)
+	}
+}
+
+func TestIdentityProviderWithoutKey(t *testing.T) {
+	a := DBAuthenticator{DB: newDB(t, "nokey")}
+	mux := AuthServer{Authenticator: a, BaseURL: "https://example.com", IdentityProvider: &IdentityProvider{}}.Handler("/auth")
+	for _, path := range []string{"/auth/jwks", "/auth/authorize"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("%v: expected a configuration error, got %v", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Returned by FederatedLogin when the identity provider vouched for someone without an account, and Provisioning.Deny
+// forbids creating one.
+var ErrNotProvisioned = errors.New("no account for this user, ask an administrator for one")
+
+// A user as vouched for by an identity provider.
+type FederatedIdentity struct {
+	// Verified by the identity provider.
+	Email string
+	// Every claim in the ID token, e.g "name" or "groups".
+	Claims map[string]any
+}
+
+// Rules for creating users just in time, on their first SSO log in. The zero value creates every user the identity
+// provider vouches for, without roles or attributes.
+type Provisioning struct {
+	// Refuse users without an account, so accounts must be created beforehand, e.g with ImportAccounts.
+	Deny bool
+	// The claim listing the user's groups at the identity provider. Defaults to "groups".
+	GroupsClaim string
+	// Roles granted to new users in each group, by group name.
+	GroupRoles map[string][]string
+	// Roles granted to every new user.
+	DefaultRoles []string
+	// Attributes set on new users, by the claim they are copied from, e.g {"name": "display_name"}. Missing claims are
+	// skipped.
+	Attributes map[string]string
+	// Also bring existing users' roles in line with their groups at every log in, so removing someone from a group at the
+	// identity provider takes its roles away. Only roles some group in GroupRoles grants are synced: users get those
+	// their groups grant and lose the rest, while roles granted otherwise, e.g locally or by DefaultRoles, are left
+	// alone. Log ins whose ID token lacks the groups claim don't change roles at all, since the provider didn't say.
+	SyncGroups bool
+	// Roles SyncGroups never grants or revokes, e.g "admin" when admins are appointed locally.
+	ProtectedRoles []string
+}
+
+func (p Provisioning) groupsClaim() string {
+	if p.GroupsClaim == "" {
+		return "groups"
+	}
+	return p.GroupsClaim
+}
+
+// Returns the groups the identity provider put the user in. The claim may be a list of strings or a single string.
+func (p Provisioning) groups(id FederatedIdentity) []string {
+	switch v := id.Claims[p.groupsClaim()].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var groups []string
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// Returns the roles a new user gets, sorted and without duplicates.
+func (p Provisioning) roles(id FederatedIdentity) []string {
+	set := make(map[string]bool)
+	for _, r := range p.DefaultRoles {
+		set[r] = true
+	}
+	for _, g := range p.groups(id) {
+		for _, r := range p.GroupRoles[g] {
+			set[r] = true
+		}
+	}
+	var roles []string
+	for r := range set {
+		roles = append(roles, r)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Grants a new user their roles and copies their attributes from the identity provider's claims.
+func (p Provisioning) provision(ctx context.Context, db conn, uid string, id FederatedIdentity, now time.Time) error {
+	for _, role := range p.roles(id) {
+		err := GrantRole(ctx, db, uid, role, now)
+		if err != nil {
+			return fmt.Errorf("grant %v: %w", role, err)
+		}
+	}
+	for claim, name := range p.Attributes {
+		v, ok := id.Claims[claim]
+		if !ok {
+			continue
+		}
+		value, ok := v.(string)
+		if !ok {
+			value = fmt.Sprint(v)
+		}
+		err := SetUserAttribute(ctx, db, uid, name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Grants and revokes the roles groups grant so the user has those of their groups, leaving protected roles and roles no
+// group grants alone. Does nothing if the identity provider didn't send the groups claim.
+func (p Provisioning) syncRoles(ctx context.Context, db conn, uid string, id FederatedIdentity, now time.Time) error {
+	if _, ok := id.Claims[p.groupsClaim()]; !ok {
+		return nil
+	}
+	protected := make(map[string]bool)
+	for _, r := range p.ProtectedRoles {
+		protected[r] = true
+	}
+	synced := make(map[string]bool)
+	for _, roles := range p.GroupRoles {
+		for _, r := range roles {
+			synced[r] = !protected[r]
+		}
+	}
+	want := make(map[string]bool)
+	for _, g := range p.groups(id) {
+		for _, r := range p.GroupRoles[g] {
+			want[r] = synced[r]
+		}
+	}
+	have, err := UserRoles(ctx, db, uid)
+	if err != nil {
+		return err
+	}
+	for _, r := range have {
+		if want[r] {
+			delete(want, r)
+			continue
+		}
+		if !synced[r] {
+			continue
+		}
+		err = RevokeRole(ctx, db, uid, r)
+		if err != nil {
+			return fmt.Errorf("revoke %v: %w", r, err)
+		}
+	}
+	for r, grant := range want {
+		if !grant {
+			continue
+		}
+		err = GrantRole(ctx, db, uid, r, now)
+		if err != nil {
+			return fmt.Errorf("grant %v: %w", r, err)
+		}
+	}
+	return nil
+}
+
+// Sets a profile attribute of the given user, replacing its old value.
+func SetUserAttribute(ctx context.Context, db conn, uid, name, value string) error {
+	if name == "" {
+		return fmt.Errorf("empty attribute name")
+	}
+	_, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO USER_ATTRIBUTE (UID, NAME, VALUE) VALUES (?, ?, ?);`, uid, name, value)
+	if err != nil {
+		return fmt.Errorf("set attribute: %w", err)
+	}
+	return nil
+}
+
+// Returns the profile attributes of the given user, by name.
+func UserAttributes(ctx context.Context, db conn, uid string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT NAME, VALUE FROM USER_ATTRIBUTE WHERE UID=?;`, uid)
+	if err != nil {
+		return nil, fmt.Errorf("fetch attributes: %w", err)
+	}
+	defer rows.Close()
+	attrs := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			return nil, fmt.Errorf("scan attribute: %w", err)
+		}
+		attrs[name] = value
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate attributes: %w", err)
+	}
+	return attrs, nil
+}
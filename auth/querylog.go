@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Logs the statements run against the DB, with how long they took and how many rows they changed, to find what holds
+// SQLite's lock when requests queue up behind it. Open the DB with OpenDB, so every statement is logged, whoever runs
+// it. Queries are timed until their rows are closed, and transactions are logged as they begin, commit and roll back,
+// since that is where SQLite waits for its lock. Safe for concurrent use.
+type QueryLogger struct {
+	// Updated atomically, so first in the struct to be 64 bit aligned on 32 bit platforms.
+	queries, slow int64
+
+	// Statements taking at least this long are logged as slow. Defaults to 100ms.
+	Threshold time.Duration
+	// Log every statement, not just slow ones.
+	All bool
+}
+
+func (l *QueryLogger) threshold() time.Duration {
+	if l.Threshold == 0 {
+		return 100 * time.Millisecond
+	}
+	return l.Threshold
+}
+
+// Returns a DB on the given driver and data source with its statements logged, e.g:
+//
+//	db, err := sql.Open("sqlite", path)
+//	...
+//	db = l.OpenDB(db.Driver(), path)
+func (l *QueryLogger) OpenDB(d driver.Driver, dsn string) *sql.DB {
+	return sql.OpenDB(loggedConnector{d: d, dsn: dsn, l: l})
+}
+
+// Records a statement which took d, and changed the given rows, or -1 if it doesn't say.
+func (l *QueryLogger) record(query string, d time.Duration, rows int64, err error) {
+	atomic.AddInt64(&l.queries, 1)
+	slow := d >= l.threshold()
+	if slow {
+		atomic.AddInt64(&l.slow, 1)
+	}
+	if !slow && !l.All {
+		return
+	}
+	msg := fmt.Sprintf("query took %v", d.Round(time.Microsecond))
+	if rows >= 0 {
+		msg += fmt.Sprintf(", %v rows affected", rows)
+	}
+	if err != nil {
+		msg += fmt.Sprintf(", failed: %v", err)
+	}
+	if slow {
+		msg = "warning: slow " + msg
+	}
+	log.Printf("%v: %v", msg, strings.Join(strings.Fields(query), " "))
+}
+
+// Writes how many statements have run, and how many were slow, as counters in the Prometheus text format.
+func (l *QueryLogger) WriteMetrics(w io.Writer, now time.Time) {
+	fmt.Fprintf(w, "# HELP auth_db_queries_total Statements run against the DB.\n# TYPE auth_db_queries_total counter\n"+
+		"auth_db_queries_total %v\n", atomic.LoadInt64(&l.queries))
+	fmt.Fprintf(w, "# HELP auth_db_slow_queries_total Statements which took longer than the slow query threshold.\n"+
+		"# TYPE auth_db_slow_queries_total counter\nauth_db_slow_queries_total %v\n", atomic.LoadInt64(&l.slow))
+}
+
+type loggedConnector struct {
+	d   driver.Driver
+	dsn string
+	l   *QueryLogger
+}
+
+func (c loggedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.d.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return loggedDriverConn{Conn: conn, l: c.l}, nil
+}
+
+func (c loggedConnector) Driver() driver.Driver {
+	return c.d
+}
+
+// A driver connection whose statements and transactions are logged. Statements are always prepared, so database/sql
+// runs them through loggedStmt.
+type loggedDriverConn struct {
+	driver.Conn
+	l *QueryLogger
+}
+
+func (c loggedDriverConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c loggedDriverConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var s driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		s, err = p.PrepareContext(ctx, query)
+	} else {
+		s, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		c.l.record(query, 0, -1, err)
+		return nil, err
+	}
+	return loggedStmt{Stmt: s, query: query, l: c.l}, nil
+}
+
+func (c loggedDriverConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c loggedDriverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	start := time.Now()
+	var tx driver.Tx
+	var err error
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = b.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	c.l.record("BEGIN", time.Since(start), -1, err)
+	if err != nil {
+		return nil, err
+	}
+	return loggedTx{tx: tx, l: c.l}, nil
+}
+
+func (c loggedDriverConn) CheckNamedValue(v *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
+
+func (c loggedDriverConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c loggedDriverConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c loggedDriverConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+type loggedTx struct {
+	tx driver.Tx
+	l  *QueryLogger
+}
+
+func (t loggedTx) Commit() error {
+	start := time.Now()
+	err := t.tx.Commit()
+	t.l.record("COMMIT", time.Since(start), -1, err)
+	return err
+}
+
+func (t loggedTx) Rollback() error {
+	start := time.Now()
+	err := t.tx.Rollback()
+	t.l.record("ROLLBACK", time.Since(start), -1, err)
+	return err
+}
+
+type loggedStmt struct {
+	driver.Stmt
+	query string
+	l     *QueryLogger
+}
+
+func (s loggedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s loggedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var res driver.Result
+	var err error
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = e.ExecContext(ctx, args)
+	} else {
+		res, err = s.Stmt.Exec(driverValues(args))
+	}
+	d := time.Since(start)
+	rows := int64(-1)
+	if err == nil {
+		if n, rerr := res.RowsAffected(); rerr == nil {
+			rows = n
+		}
+	}
+	s.l.record(s.query, d, rows, err)
+	return res, err
+}
+
+func (s loggedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s loggedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(driverValues(args))
+	}
+	if err != nil {
+		s.l.record(s.query, time.Since(start), -1, err)
+		return nil, err
+	}
+	return &loggedRows{Rows: rows, stmt: s, start: start}, nil
+}
+
+// Rows which record their query once closed, so the time spent reading them is counted.
+type loggedRows struct {
+	driver.Rows
+	stmt  loggedStmt
+	start time.Time
+	err   error
+}
+
+func (r *loggedRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return err
+}
+
+func (r *loggedRows) Close() error {
+	err := r.Rows.Close()
+	if r.err == nil {
+		r.err = err
+	}
+	r.stmt.l.record(r.stmt.query, time.Since(r.start), -1, r.err)
+	return err
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+func driverValues(args []driver.NamedValue) []driver.Value {
+	vals := make([]driver.Value, len(args))
+	for i, a := range args {
+		vals[i] = a.Value
+	}
+	return vals
+}
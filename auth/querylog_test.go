@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLogger(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "querylog")
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ql := &QueryLogger{Threshold: time.Hour}
+	db := ql.OpenDB(raw.Driver(), path)
+	raw.Close()
+	defer db.Close()
+	err = Initialize(ctx, db)
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	a := DBAuthenticator{DB: db}
+	err = a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("expected fast statements to go unlogged, got %q", logs.String())
+	}
+
+	ql.All = true
+	err = a.Register(ctx, "c@d.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	tok, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	for _, want := range []string{"1 rows affected: INSERT INTO TOKEN", ": BEGIN\n", ": COMMIT\n"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Fatalf("expected every statement and transaction logged, missing %q in %q", want, logs.String())
+		}
+	}
+	if strings.Contains(logs.String(), "slow") {
+		t.Fatalf("expected nothing slow, got %q", logs.String())
+	}
+
+	logs.Reset()
+	ql.All, ql.Threshold = false, time.Nanosecond
+	err = a.Validate(ctx, tok)
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if !strings.Contains(logs.String(), "warning: slow query took") {
+		t.Fatalf("expected statements over the threshold to be flagged, got %q", logs.String())
+	}
+
+	var b strings.Builder
+	ql.WriteMetrics(&b, time.Now())
+	if !strings.Contains(b.String(), "auth_db_slow_queries_total 1\n") || strings.Contains(b.String(), "auth_db_queries_total 0\n") {
+		t.Fatalf("unexpected metrics:\n%v", b.String())
+	}
+
+	// Queries are timed until their rows are closed.
+	logs.Reset()
+	ql.All, ql.Threshold = false, 50*time.Millisecond
+	rows, err := db.QueryContext(ctx, `SELECT ID FROM USER;`)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	rows.Close()
+	if !strings.Contains(logs.String(), "warning: slow query took") || !strings.Contains(logs.String(), "SELECT ID FROM USER") {
+		t.Fatalf("expected reading the rows to count, got %q", logs.String())
+	}
+}
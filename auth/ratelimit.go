@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many requests are allowed per window.
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// A fixed window rate limiter keyed on the user making the request and the route they are requesting, so one noisy
+// client cannot exhaust the capacity of a route for everyone else. Safe for concurrent use.
+type RateLimiter struct {
+	// The limit applied to routes without an entry in Routes, counted together across them. If zero, those routes are not
+	// limited.
+	Default RateLimit
+	// Limits for specific routes, keyed by pattern as for http.ServeMux: "/login" matches only that path, and "/items/"
+	// every path under it unless a longer pattern matches, so /items/1 and /items/2 share one count. A zero limit exempts
+	// the route.
+	Routes map[string]RateLimit
+	// Limits for users with a role, replacing the route's limit on routes which are limited, e.g to give service accounts
+	// more room. If a user has several, the most generous applies. A zero limit exempts the role. Requires
+	// AuthFilter.Roles, or a Validator implementing UserValidator or RoleChecker.
+	Roles map[string]RateLimit
+	// Where counts are kept. Defaults to memory, so each replica counts separately; share a store between replicas to
+	// enforce one limit across them, e.g SQLCounters or RedisCounters. Requests are allowed if the store fails.
+	Store CounterStore
+
+	memory MemoryCounters
+}
+
+// Keeps fixed window request counts for a RateLimiter.
+type CounterStore interface {
+	// Counts a hit on key in its current window, starting a new window if the last one is over, and returns the number of
+	// hits in the window and when it started.
+	Increment(ctx context.Context, key string, window time.Duration, now time.Time) (int, time.Time, error)
+}
+
+// A CounterStore in memory, for a single replica. The zero value is ready to use. Safe for concurrent use.
+type MemoryCounters struct {
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+type rateWindow struct {
+	start  time.Time
+	length time.Duration
+	count  int
+}
+
+func (m *MemoryCounters) Increment(ctx context.Context, key string, window time.Duration, now time.Time) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.windows == nil {
+		m.windows = make(map[string]*rateWindow)
+	}
+	m.sweep(now)
+	w, ok := m.windows[key]
+	if !ok || now.Sub(w.start) >= window {
+		w = &rateWindow{start: now, length: window}
+		m.windows[key] = w
+	}
+	w.count++
+	return w.count, w.start, nil
+}
+
+// Drops windows that are over, so the map does not grow with every key ever seen. Runs at most once a minute. Must hold
+// mu.
+func (m *MemoryCounters) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for k, w := range m.windows {
+		if now.Sub(w.start) >= w.length {
+			delete(m.windows, k)
+		}
+	}
+}
+
+// A CounterStore in a SQL DB, so replicas sharing the DB share limits. Only hashes of keys are stored, since they may
+// contain tokens. Expired windows are dropped with ReapRateCounters.
+type SQLCounters struct {
+	DB *sql.DB
+	// Where the auth tables are, if they share the DB with an application.
+	Schema *Schema
+}
+
+func (s SQLCounters) Increment(ctx context.Context, key string, window time.Duration, now time.Time) (int, time.Time, error) {
+	keyHash := sha256.Sum256([]byte(key))
+	over := now.Add(-window).UnixMilli()
+	row := s.Schema.wrap(s.DB).QueryRowContext(ctx, `INSERT INTO RATE_COUNTER (KEY_HASH, START_TIME, END_TIME, COUNT) VALUES (?, ?, ?, 1)
+ON CONFLICT(KEY_HASH) DO UPDATE SET
+	COUNT = CASE WHEN START_TIME <= ? THEN 1 ELSE COUNT + 1 END,
+	END_TIME = CASE WHEN START_TIME <= ? THEN excluded.END_TIME ELSE END_TIME END,
+	START_TIME = CASE WHEN START_TIME <= ? THEN excluded.START_TIME ELSE START_TIME END
+RETURNING COUNT, START_TIME;`, keyHash[:], now.UnixMilli(), now.Add(window).UnixMilli(), over, over, over)
+	var count int
+	var start int64
+	err := row.Scan(&count, &start)
+	if err != nil {
+		return 0, now, fmt.Errorf("increment counter: %w", err)
+	}
+	return count, time.UnixMilli(start), nil
+}
+
+// A CounterStore in Redis, so replicas sharing it share limits. Only hashes of keys are stored, since they may contain
+// tokens. Windows expire on their own.
+type RedisCounters struct {
+	Client RedisClient
+	// Prefixed to stored keys, e.g to share a Redis with other applications. Defaults to "auth:rate:".
+	Prefix string
+}
+
+// The part of a Redis client RedisCounters uses, so this package needn't depend on one. For example, with go-redis:
+//
+//	func (c redisAdapter) Eval(ctx context.Context, script string, keys []string, args ...any) (any, error) {
+//		return c.Client.Eval(ctx, script, keys, args...).Result()
+//	}
+type RedisClient interface {
+	// Runs a Lua script as EVAL does, returning its reply with integers as int64 and arrays as []any.
+	Eval(ctx context.Context, script string, keys []string, args ...any) (any, error)
+}
+
+// Counts a hit on KEYS[1] at time ARGV[1] in a window of ARGV[2] milliseconds, as SQLCounters does, returning the count
+// and when the window started.
+const redisIncrement = `
+local start = tonumber(redis.call('HGET', KEYS[1], 'start'))
+if not start or start <= tonumber(ARGV[1]) - tonumber(ARGV[2]) then
+	start = tonumber(ARGV[1])
+	redis.call('HSET', KEYS[1], 'start', start, 'count', 0)
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return {redis.call('HINCRBY', KEYS[1], 'count', 1), start}`
+
+func (r RedisCounters) Increment(ctx context.Context, key string, window time.Duration, now time.Time) (int, time.Time, error) {
+	prefix := r.Prefix
+	if prefix == "" {
+		prefix = "auth:rate:"
+	}
+	keyHash := sha256.Sum256([]byte(key))
+	reply, err := r.Client.Eval(ctx, redisIncrement, []string{prefix + hex.EncodeToString(keyHash[:])},
+		now.UnixMilli(), window.Milliseconds())
+	if err != nil {
+		return 0, now, fmt.Errorf("increment counter: %w", err)
+	}
+	vals, ok := reply.([]any)
+	if !ok || len(vals) != 2 {
+		return 0, now, fmt.Errorf("increment counter: unexpected reply %v", reply)
+	}
+	count, ok := vals[0].(int64)
+	start, ok2 := vals[1].(int64)
+	if !ok || !ok2 {
+		return 0, now, fmt.Errorf("increment counter: unexpected reply %v", reply)
+	}
+	return int(count), time.UnixMilli(start), nil
+}
+
+// Drops rate limit windows which ended before the given time.
+func ReapRateCounters(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM RATE_COUNTER WHERE END_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
+
+// The outcome of a rate limit check.
+type rateDecision struct {
+	limit     RateLimit
+	remaining int
+	reset     time.Duration
+	allowed   bool
+}
+
+// Records a request by the principal for the path, and reports whether it is within the limit for the path's route, or
+// the most generous limit of the given roles.
+func (l *RateLimiter) allow(ctx context.Context, principal, path string, roles []string, now time.Time) rateDecision {
+	route, limit := l.route(path)
+	if limit.exempt() {
+		return rateDecision{allowed: true}
+	}
+	if len(roles) > 0 {
+		limit = l.Roles[roles[0]]
+		for _, role := range roles[1:] {
+			if rl := l.Roles[role]; rl.exempt() || !limit.exempt() && rl.rate() > limit.rate() {
+				limit = rl
+			}
+		}
+	}
+	if limit.exempt() {
+		return rateDecision{allowed: true}
+	}
+
+	var store CounterStore = &l.memory
+	if l.Store != nil {
+		store = l.Store
+	}
+	count, start, err := store.Increment(ctx, route+" "+principal, limit.Window, now)
+	if err != nil {
+		log.Printf("error: rate limit: %v", err)
+		return rateDecision{allowed: true}
+	}
+	d := rateDecision{
+		limit:     limit,
+		remaining: limit.Requests - count,
+		reset:     start.Add(limit.Window).Sub(now),
+		allowed:   count <= limit.Requests,
+	}
+	if d.remaining < 0 {
+		d.remaining = 0
+	}
+	return d
+}
+
+// Returns the pattern in Routes matching the path and its limit, as http.ServeMux would match it: the path itself, or
+// else the longest pattern ending in a slash which prefixes it. Returns "" and Default if none match.
+func (l *RateLimiter) route(path string) (string, RateLimit) {
+	if limit, ok := l.Routes[path]; ok {
+		return path, limit
+	}
+	route, limit := "", l.Default
+	for pattern, rl := range l.Routes {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) && len(pattern) > len(route) {
+			route, limit = pattern, rl
+		}
+	}
+	return route, limit
+}
+
+// Reports whether the limit allows everything, because it is zero.
+func (r RateLimit) exempt() bool {
+	return r.Requests <= 0 || r.Window <= 0
+}
+
+// Requests allowed per second.
+func (r RateLimit) rate() float64 {
+	return float64(r.Requests) / r.Window.Seconds()
+}
+
+// Applies the RateLimiter to a request with a valid token. Counts are kept per user if validation found who the token
+// belongs to, or the filter can find them as for UserHandler, so a user can't escape the limit by logging in again, and
+// per token otherwise. The request is allowed if the user or their roles can't be found. Returns false if the request
+// should not proceed.
+func (a AuthFilter) rateLimit(ctx context.Context, w http.ResponseWriter, r *http.Request, u User) bool {
+	principal := u.Token.String()
+	if u.ID != "" {
+		principal = "user:" + u.ID
+	} else if users := a.users(); users != nil {
+		res, err := users.ValidateBatch(ctx, []Token{u.Token})
+		if err == nil {
+			err = res[0].Err
+		}
+		if err != nil {
+			log.Printf("error: rate limit: find user: %v", err)
+		} else {
+			principal = "user:" + res[0].UID
+		}
+	}
+	return a.RateLimiter.allow(ctx, principal, r.URL.Path, a.limitedRoles(ctx, u), time.Now()).apply(w)
+}
+
+// Returns which of the roles with their own limit the user has, in sorted order.
+func (a AuthFilter) limitedRoles(ctx context.Context, u User) []string {
+	if len(a.RateLimiter.Roles) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(a.RateLimiter.Roles))
+	for role := range a.RateLimiter.Roles {
+		names = append(names, role)
+	}
+	// Map order is random; sorted so the same roles are checked in the same order each time.
+	sort.Strings(names)
+	checker := a.userRoleChecker(u)
+	if checker == nil {
+		log.Printf("error: rate limit: roles limited, but no RoleChecker configured")
+		return nil
+	}
+	var roles []string
+	for _, role := range names {
+		ok, err := checker.HasRole(ctx, u.Token, role)
+		if err != nil {
+			log.Printf("error: rate limit: check role %v: %v", role, err)
+		}
+		if ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// Sets the RateLimit-* headers describing the decision, and writes a 429 if the request is over the limit. Returns false if
+// the request should not proceed.
+func (d rateDecision) apply(w http.ResponseWriter) bool {
+	if d.limit.Requests <= 0 {
+		return true
+	}
+	reset := strconv.Itoa(int((d.reset + time.Second - 1) / time.Second))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.limit.Requests))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	w.Header().Set("RateLimit-Reset", reset)
+	if !d.allowed {
+		w.Header().Set("Retry-After", reset)
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Accepts every token.
+type allowValidator struct{}
+
+func (allowValidator) Validate(context.Context, Token) error { return nil }
+
+func TestRateLimitedFilter(t *testing.T) {
+	filter := AuthFilter{
+		Validator: allowValidator{},
+		LoginURL:  "/login",
+		RateLimiter: &RateLimiter{
+			Default: RateLimit{Requests: 2, Window: time.Hour},
+			Routes:  map[string]RateLimit{"/unlimited": {}, "/items/": {Requests: 2, Window: time.Hour}},
+		},
+	}
+	h := filter.Handler(func(Token, http.ResponseWriter, *http.Request) {})
+	get := func(token Token, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.AddCookie(&http.Cookie{Name: "auth_token", Value: token.String()})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	alice, bob := Token{1}, Token{2}
+	for i, remaining := range []string{"1", "0"} {
+		w := get(alice, "/secured")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %v: expected 200, got %v", i, w.Code)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != remaining {
+			t.Fatalf("request %v: expected %v remaining, got %v", i, remaining, got)
+		}
+	}
+	w := get(alice, "/secured")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over limit, got %v", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "3600" {
+		t.Fatalf("expected Retry-After 3600, got '%v'", w.Header().Get("Retry-After"))
+	}
+
+	// Other principals and routes have their own budget, but paths without a route share the default's.
+	if w := get(bob, "/secured"); w.Code != http.StatusOK {
+		t.Fatalf("other token: expected 200, got %v", w.Code)
+	}
+	if w := get(alice, "/other"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("other path: expected 429, got %v", w.Code)
+	}
+	for i, path := range []string{"/items/1", "/items/2"} {
+		if w := get(alice, path); w.Code != http.StatusOK {
+			t.Fatalf("route request %v: expected 200, got %v", i, w.Code)
+		}
+	}
+	if w := get(alice, "/items/3"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("route: expected paths under a pattern to share its limit, got %v", w.Code)
+	}
+	for i := 0; i < 5; i++ {
+		w := get(alice, "/unlimited")
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("unlimited route: got %v %v", w.Code, w.Header())
+		}
+	}
+}
+
+func TestCounterStores(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range map[string]CounterStore{
+		"memory": &MemoryCounters{},
+		"sql":    SQLCounters{DB: newDB(t, "counters")},
+		"redis":  RedisCounters{Client: &fakeRedis{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			start := time.UnixMilli(10000)
+			for i, at := range []int64{10000, 10500, 10999} {
+				count, got, err := store.Increment(ctx, "a", time.Second, time.UnixMilli(at))
+				if err != nil || count != i+1 || !got.Equal(start) {
+					t.Fatalf("hit %v: expected %v since %v, got %v since %v, %v", i, i+1, start, count, got, err)
+				}
+			}
+			if count, _, _ := store.Increment(ctx, "b", time.Second, time.UnixMilli(10999)); count != 1 {
+				t.Fatalf("other key: expected 1, got %v", count)
+			}
+			count, got, err := store.Increment(ctx, "a", time.Second, time.UnixMilli(11000))
+			if err != nil || count != 1 || !got.Equal(time.UnixMilli(11000)) {
+				t.Fatalf("next window: expected 1 since 11000, got %v since %v, %v", count, got.UnixMilli(), err)
+			}
+		})
+	}
+}
+
+func TestSharedRateLimit(t *testing.T) {
+	store := SQLCounters{DB: newDB(t, "shared")}
+	replicas := []*RateLimiter{
+		{Default: RateLimit{Requests: 2, Window: time.Hour}, Store: store},
+		{Default: RateLimit{Requests: 2, Window: time.Hour}, Store: store},
+	}
+	ctx := context.Background()
+	now := time.Now()
+	for i, l := range replicas {
+		if !l.allow(ctx, "alice", "/secured", nil, now).allowed {
+			t.Fatalf("replica %v: expected first requests allowed", i)
+		}
+	}
+	for i, l := range replicas {
+		if l.allow(ctx, "alice", "/secured", nil, now).allowed {
+			t.Fatalf("replica %v: expected the shared limit to be exhausted", i)
+		}
+	}
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	db := newDB(t, "ratelimituser")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	for _, email := range []string{"a@b.com", "svc@b.com"} {
+		if err := a.Register(ctx, email, "pw"); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	}
+	if err := GrantRole(ctx, db, "svc@b.com", "service", time.Now()); err != nil {
+		t.Fatalf("grant role: %v", err)
+	}
+	filter := AuthFilter{
+		Validator: a,
+		LoginURL:  "/login",
+		RateLimiter: &RateLimiter{
+			Default: RateLimit{Requests: 2, Window: time.Hour},
+			Roles:   map[string]RateLimit{"service": {Requests: 5, Window: time.Hour}},
+		},
+	}
+	h := filter.Handler(func(Token, http.ResponseWriter, *http.Request) {})
+	get := func(email string) int {
+		token, _, err := a.Authenticate(ctx, email, "pw")
+		if err != nil {
+			t.Fatalf("authenticate: %v", err)
+		}
+		r := httptest.NewRequest("GET", "/secured", nil)
+		r.AddCookie(&http.Cookie{Name: "auth_token", Value: token.String()})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Each request logs in again, so only counting per user limits them.
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if got := get("a@b.com"); got != want {
+			t.Fatalf("user request %v: expected %v, got %v", i, want, got)
+		}
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if got := get("svc@b.com"); got != want {
+			t.Fatalf("service request %v: expected %v, got %v", i, want, got)
+		}
+	}
+}
+
+// Runs the RedisCounters script against a map, as Redis would.
+type fakeRedis struct {
+	windows map[string][2]int64
+}
+
+func (f *fakeRedis) Eval(ctx context.Context, script string, keys []string, args ...any) (any, error) {
+	if script != redisIncrement {
+		return nil, fmt.Errorf("unexpected script %q", script)
+	}
+	if f.windows == nil {
+		f.windows = make(map[string][2]int64)
+	}
+	now, window := args[0].(int64), args[1].(int64)
+	w, ok := f.windows[keys[0]]
+	if !ok || w[0] <= now-window {
+		w = [2]int64{now, 0}
+	}
+	w[1]++
+	f.windows[keys[0]] = w
+	return []any{w[1], w[0]}, nil
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Returned when logging in with a password to an account whose email domain logs in with SSO, see
+// DBAuthenticator.SSODomains.
+var ErrSSORequired = errors.New("this account logs in with single sign on")
+
+// Returns the realm an email belongs to, and its identity provider, or nil if the user logs in with a password.
+func (a AuthServer) realm(email string) (string, *SSO) {
+	domain, err := emailDomain(email)
+	if err != nil {
+		return "", nil
+	}
+	return domain, a.Realms[domain]
+}
+
+// Renders the first step of home realm discovery, which only asks for the email address.
+func (a AuthServer) discoveryPage(w http.ResponseWriter, r *http.Request) {
+	a.render(w, r, http.StatusOK, PageData{Page: "discovery.html", Title: "Login", Action: a.link(RouteLogin, r.URL.RawQuery),
+		ProofOfWork: a.proofOfWorkHTML()})
+}
+
+// Sends the user on from the discovery step: to their realm's identity provider, or back to the log in page to enter
+// their password.
+func (a AuthServer) discover(w http.ResponseWriter, r *http.Request, email string) {
+	q := r.URL.Query()
+	realm, sso := a.realm(email)
+	if sso != nil {
+		q.Set("realm", realm)
+		q.Set("login_hint", email)
+		http.Redirect(w, r, a.link(RouteSSO, q.Encode()), http.StatusFound)
+		return
+	}
+	q.Set("email", email)
+	http.Redirect(w, r, a.link(RouteLogin, q.Encode()), http.StatusFound)
+}
+
+// Refuses a password sign up or log in for an email whose realm logs in with SSO. Returns false if it did.
+func (a AuthServer) checkRealm(w http.ResponseWriter, email string) bool {
+	realm, sso := a.realm(email)
+	if sso == nil {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("accounts at %v log in with %v", realm, sso.label()), http.StatusBadRequest)
+	return false
+}
+
+// Returns ErrSSORequired if the user's email is in one of SSODomains.
+func (d DBAuthenticator) checkSSODomain(ctx context.Context, uid string) error {
+	if len(d.SSODomains) == 0 {
+		return nil
+	}
+	if err := d.requireSQLiteStore(); err != nil {
+		return err
+	}
+	var email string
+	err := d.conn().QueryRowContext(ctx, `SELECT EMAIL FROM USER WHERE ID=?`, uid).Scan(&email)
+	if err != nil {
+		return fmt.Errorf("lookup email: %w", err)
+	}
+	domain, err := emailDomain(email)
+	if err != nil {
+		return nil
+	}
+	for _, sso := range d.SSODomains {
+		if strings.EqualFold(strings.TrimSuffix(sso, "."), domain) {
+			return ErrSSORequired
+		}
+	}
+	return nil
+}
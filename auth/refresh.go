@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Refresh tokens are long lived credentials which can only be exchanged for a new access token, so sessions can slide
+// forward without logging in again. Each is single use: refreshing returns a replacement. Only a hash is stored.
+
+// A freshly issued access token and refresh token.
+type Session struct {
+	Access         Token
+	AccessExpires  time.Time
+	Refresh        Token
+	RefreshExpires time.Time
+	// Whether the user logged in without asking to be remembered, see WithRememberMe, so the session's cookies should
+	// end with the browser session.
+	Transient bool
+}
+
+// Issues a refresh token for the given user, valid until expires, recording the client's IP and user agent if attached
+// to ctx, see WithClientIP and WithUserAgent, and whether the user asked to be remembered, see WithRememberMe.
+func IssueRefreshToken(ctx context.Context, db conn, uid string, now, expires time.Time) (Token, error) {
+	var t Token
+	_, err := rand.Read(t[:])
+	if err != nil {
+		return t, fmt.Errorf("read random: %w", err)
+	}
+	var remember sql.NullBool
+	remember.Bool, remember.Valid = rememberMe(ctx)
+	hash := sha256.Sum256(t[:])
+	_, err = db.ExecContext(ctx, `INSERT INTO REFRESH_TOKEN (TOKEN_HASH, UID, CREATED_TIME, EXPIRES_TIME, IP, USER_AGENT,
+	REMEMBER) VALUES (?, ?, ?, ?, ?, ?, ?);`, hash[:], uid, now.UnixMilli(), expires.UnixMilli(),
+		nullIfEmpty(ClientIP(ctx)), nullIfEmpty(UserAgent(ctx)), remember)
+	if err != nil {
+		return t, fmt.Errorf("insert refresh token: %w", err)
+	}
+	return t, nil
+}
+
+// Exchanges a refresh token for a new access token and a new refresh token, spending the old one. The access token
+// issued with the refresh token is rotated if it is still active, keeping its session data, and otherwise replaced by a
+// new one. Returns ErrInvalidToken if the refresh token is unknown, spent, expired, or older than the user's last
+// password change. The new tokens impersonate the user if the old ones did, see ImpersonateUser, and the new refresh
+// token remembers the user if the old one did. Use a transaction, so the old token isn't spent if the new ones can't be
+// issued.
+func RefreshToken(ctx context.Context, db conn, refresh Token, now, accessExpires, refreshExpires time.Time) (Session, error) {
+	hash := sha256.Sum256(refresh[:])
+	row := db.QueryRowContext(ctx, `SELECT UID, IMPERSONATOR, ACCESS_HASH, REMEMBER FROM REFRESH_TOKEN JOIN USER ON USER.ID = REFRESH_TOKEN.UID WHERE
+TOKEN_HASH=? AND
+EXPIRES_TIME >= ? AND
+(USER.PASSWORD_CHANGED_TIME IS NULL OR REFRESH_TOKEN.CREATED_TIME >= USER.PASSWORD_CHANGED_TIME)`, hash[:], now.UnixMilli())
+	var s Session
+	var uid string
+	var impersonator sql.NullString
+	var accessHash []byte
+	var remember sql.NullBool
+	err := row.Scan(&uid, &impersonator, &accessHash, &remember)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, ErrInvalidToken
+	}
+	if err != nil {
+		return s, fmt.Errorf("parse uid: %w", err)
+	}
+	// Spending it only succeeds once, so concurrent exchanges of the same token can't both pass the check above.
+	res, err := db.ExecContext(ctx, `DELETE FROM REFRESH_TOKEN WHERE TOKEN_HASH=?;`, hash[:])
+	if err != nil {
+		return s, fmt.Errorf("spend refresh token: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return s, fmt.Errorf("spend refresh token: %w", err)
+	}
+	if n != 1 {
+		return s, ErrInvalidToken
+	}
+	s.Access, err = refreshAccess(ctx, db, uid, accessHash, impersonator, now, accessExpires)
+	if err != nil {
+		return s, err
+	}
+	s.AccessExpires = accessExpires
+	if remember.Valid {
+		ctx = WithRememberMe(ctx, remember.Bool)
+		s.Transient = !remember.Bool
+	}
+	s.Refresh, err = IssueRefreshToken(ctx, db, uid, now, refreshExpires)
+	if err != nil {
+		return s, err
+	}
+	err = linkRefreshToken(ctx, db, s.Refresh, s.Access)
+	if err != nil {
+		return s, err
+	}
+	s.RefreshExpires = refreshExpires
+	return s, nil
+}
+
+// Attaches whether the user asked to be remembered when the refresh token was issued, if they were asked.
+func withRefreshRememberMe(ctx context.Context, db conn, refresh Token) (context.Context, error) {
+	hash := sha256.Sum256(refresh[:])
+	var remember sql.NullBool
+	err := db.QueryRowContext(ctx, `SELECT REMEMBER FROM REFRESH_TOKEN WHERE TOKEN_HASH=?;`, hash[:]).Scan(&remember)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return ctx, fmt.Errorf("find remember me: %w", err)
+	}
+	if remember.Valid {
+		ctx = WithRememberMe(ctx, remember.Bool)
+	}
+	return ctx, nil
+}
+
+// Rotates the access token with the given hash, or issues a new one if it is no longer active.
+func refreshAccess(ctx context.Context, db conn, uid string, hash []byte, impersonator sql.NullString, now,
+	expires time.Time) (Token, error) {
+	if hash != nil {
+		t, err := rotateHash(ctx, db, hash, now, expires)
+		if !errors.Is(err, ErrInvalidToken) {
+			return t, err
+		}
+	}
+	t, err := GenerateToken(ctx, db, uid, now.Add(-time.Second), expires)
+	if err != nil {
+		return t, fmt.Errorf("generate token: %w", err)
+	}
+	// An administrator's refreshed session still acts as the user, so it must stay marked as impersonated.
+	if impersonator.Valid {
+		accessHash := sha256.Sum256(t[:])
+		_, err = db.ExecContext(ctx, `UPDATE TOKEN SET IMPERSONATOR=? WHERE TOKEN_HASH=?;`, impersonator.String, accessHash[:])
+		if err != nil {
+			return t, fmt.Errorf("set impersonator: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// Deletes the given refresh token. Revoking an unknown token is not an error.
+func RevokeRefreshToken(ctx context.Context, db conn, refresh Token) error {
+	hash := sha256.Sum256(refresh[:])
+	_, err := db.ExecContext(ctx, `DELETE FROM REFRESH_TOKEN WHERE TOKEN_HASH=?;`, hash[:])
+	if err != nil {
+		return fmt.Errorf("delete refresh token: %w", err)
+	}
+	return nil
+}
+
+// Drops refresh tokens which expired before the given time.
+func ReapRefreshTokens(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM REFRESH_TOKEN WHERE EXPIRES_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
+
+// Returns when the given access token expires, or ErrInvalidToken if it doesn't exist or was issued to a client.
+func TokenExpiry(ctx context.Context, db conn, t Token) (time.Time, error) {
+	hash := sha256.Sum256(t[:])
+	row := db.QueryRowContext(ctx, `SELECT END_TIME FROM TOKEN WHERE TOKEN_HASH=? AND `+sessionToken, hash[:])
+	var end int64
+	err := row.Scan(&end)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrInvalidToken
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse end time: %w", err)
+	}
+	return time.UnixMilli(end), nil
+}
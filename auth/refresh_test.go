@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshToken(t *testing.T) {
+	db := newDB(t, "refresh")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register user: %v", err)
+	}
+	now := time.Now()
+	refresh, err := IssueRefreshToken(ctx, db, "user1", now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	s, err := RefreshToken(ctx, db, refresh, now, now.Add(time.Minute), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if uid, err := Lookup(ctx, db, s.Access, now); err != nil || uid != "user1" {
+		t.Fatalf("expected new access token for user1, got '%v', %v", uid, err)
+	}
+	if _, err := RefreshToken(ctx, db, refresh, now, now.Add(time.Minute), now.Add(time.Hour)); err != ErrInvalidToken {
+		t.Fatalf("reused refresh token: expected ErrInvalidToken, got %v", err)
+	}
+	if _, err := RefreshToken(ctx, db, s.Refresh, now.Add(2*time.Hour), now, now); err != ErrInvalidToken {
+		t.Fatalf("expired refresh token: expected ErrInvalidToken, got %v", err)
+	}
+
+	// Refreshing while the access token is active rotates it, so the session data moves to the new one.
+	err = SetSessionValue(ctx, db, s.Access, "theme", []byte("dark"))
+	if err != nil {
+		t.Fatalf("set session data: %v", err)
+	}
+	s2, err := RefreshToken(ctx, db, s.Refresh, now, now.Add(time.Minute), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if _, err := Lookup(ctx, db, s.Access, now); err != ErrInvalidToken {
+		t.Fatalf("rotated access token: expected ErrInvalidToken, got %v", err)
+	}
+	if v, err := SessionValue(ctx, db, s2.Access, "theme"); err != nil || string(v) != "dark" {
+		t.Fatalf("expected the session data on the rotated token, got %q %v", v, err)
+	}
+
+	// A password change ends sessions, including their refresh tokens.
+	err = ChangePasswordWith(ctx, db, PasswordOptions{}, "user1", "pw2", now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("change password: %v", err)
+	}
+	if _, err := RefreshToken(ctx, db, s2.Refresh, now.Add(2*time.Second), now, now); err != ErrInvalidToken {
+		t.Fatalf("superseded refresh token: expected ErrInvalidToken, got %v", err)
+	}
+	var n int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM TOKEN WHERE UID='user1';`).Scan(&n)
+	if err != nil || n != 0 {
+		t.Fatalf("expected the password change to revoke the access tokens, got %v %v", n, err)
+	}
+}
+
+// Returns the named cookie set by the response.
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestRefreshSessions(t *testing.T) {
+	db := newDB(t, "refresh_http")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	mux := AuthServer{Authenticator: a, IssueRefreshTokens: true}.Handler("/auth")
+	r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(url.Values{"email": {"a@b.com"}, "password": {"pw"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	refresh := responseCookie(w, "auth_refresh")
+	if w.Code != http.StatusFound || refresh == nil || !refresh.HttpOnly || responseCookie(w, "auth_token") == nil {
+		t.Fatalf("expected login to set both cookies, got %v %v", w.Code, w.Header()["Set-Cookie"])
+	}
+
+	// The filter swaps a missing access token for a new one.
+	filter := AuthFilter{Validator: a, LoginURL: "/auth/login", Refresher: a}
+	var got Token
+	h := filter.Handler(func(t Token, w http.ResponseWriter, r *http.Request) { got = t })
+	r = httptest.NewRequest("GET", "/secured", nil)
+	r.AddCookie(refresh)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	access := responseCookie(w, "auth_token")
+	if access == nil || got.String() != access.Value {
+		t.Fatalf("expected handler to be called with a refreshed token, got %v %v", w.Code, w.Header()["Set-Cookie"])
+	}
+	refresh = responseCookie(w, "auth_refresh")
+
+	// Near expiry, valid tokens are replaced too.
+	filter.RefreshWithin = 48 * time.Hour
+	h = filter.Handler(func(t Token, w http.ResponseWriter, r *http.Request) { got = t })
+	r = httptest.NewRequest("GET", "/secured", nil)
+	r.AddCookie(access)
+	r.AddCookie(refresh)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if c := responseCookie(w, "auth_token"); c == nil || c.Value == access.Value || got.String() != c.Value {
+		t.Fatalf("expected token near expiry to be replaced, got %v", w.Header()["Set-Cookie"])
+	}
+	refresh = responseCookie(w, "auth_refresh")
+
+	// The refresh route rotates both, and a spent token is refused.
+	r = httptest.NewRequest("POST", "/auth/refresh", nil)
+	r.AddCookie(refresh)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || responseCookie(w, "auth_refresh") == nil {
+		t.Fatalf("refresh: expected 204 with new cookies, got %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("spent refresh: expected 401, got %v", w.Code)
+	}
+}
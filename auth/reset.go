@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Password resets for users who forgot their password. A single use code is emailed to the account's address, and
+// presenting it with a new password changes the password, ending every existing session.
+
+// Returned when a reset code is unknown, already used or expired.
+var ErrInvalidResetCode = errors.New("invalid or expired password reset link")
+
+// Returned when a reset was already requested for the account recently, so the address can't be flooded with email.
+var ErrResetThrottled = errors.New("password reset requested too recently")
+
+// How long to wait before another reset may be requested for the same account.
+const passwordResetInterval = 5 * time.Minute
+
+// Stores a password reset for the account with the given email, replacing any earlier one, and returns the code to send
+// to the address. Only a hash of the code is stored. Returns ErrBadCredentials if there is no such account, and
+// ErrResetThrottled if a reset was created for it in the last 5 minutes.
+func CreatePasswordReset(ctx context.Context, db conn, email string, now, expires time.Time) (Token, error) {
+	var code Token
+	uid, err := LookupByEmail(ctx, db, email)
+	if err != nil {
+		return code, err
+	}
+	row := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM PASSWORD_RESET WHERE UID=? AND CREATED_TIME > ?`,
+		uid, now.Add(-passwordResetInterval).UnixMilli())
+	var recent int
+	err = row.Scan(&recent)
+	if err != nil {
+		return code, fmt.Errorf("count recent resets: %w", err)
+	}
+	if recent > 0 {
+		return code, ErrResetThrottled
+	}
+	_, err = rand.Read(code[:])
+	if err != nil {
+		return code, fmt.Errorf("read random: %w", err)
+	}
+	codeHash := sha256.Sum256(code[:])
+	_, err = db.ExecContext(ctx, `INSERT OR REPLACE INTO PASSWORD_RESET (UID, CODE_HASH, CREATED_TIME, EXPIRES_TIME)
+	VALUES (?, ?, ?, ?);`, uid, codeHash[:], now.UnixMilli(), expires.UnixMilli())
+	if err != nil {
+		return code, fmt.Errorf("insert password reset: %w", err)
+	}
+	return code, nil
+}
+
+// Sets a new password for the account a reset code was issued to, and returns its user ID. The code can only be used
+// once. Returns ErrInvalidResetCode if the code is unknown or expired. The password is hashed with bcrypt, and a
+// *PasswordPolicyError is returned if it doesn't follow DefaultPasswordPolicy. Use a transaction, so the code isn't
+// spent if the password can't be changed.
+func ConsumePasswordReset(ctx context.Context, db conn, code Token, password string, now time.Time) (string, error) {
+	return ConsumePasswordResetWith(ctx, db, defaultPasswordOptions(), code, password, now)
+}
+
+// Like ConsumePasswordReset, but hashes and checks the password as o says.
+func ConsumePasswordResetWith(ctx context.Context, db conn, o PasswordOptions, code Token, password string, now time.Time) (string, error) {
+	codeHash := sha256.Sum256(code[:])
+	row := db.QueryRowContext(ctx, `SELECT UID FROM PASSWORD_RESET WHERE CODE_HASH=? AND EXPIRES_TIME >= ?`,
+		codeHash[:], now.UnixMilli())
+	var uid string
+	err := row.Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidResetCode
+	}
+	if err != nil {
+		return "", fmt.Errorf("parse password reset: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM PASSWORD_RESET WHERE UID=?`, uid)
+	if err != nil {
+		return "", fmt.Errorf("delete password reset: %w", err)
+	}
+	err = ChangePasswordWith(ctx, db, o, uid, password, now)
+	if err != nil {
+		return "", err
+	}
+	return uid, nil
+}
+
+// Drops password resets which expired before the given time.
+func ReapPasswordResets(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM PASSWORD_RESET WHERE EXPIRES_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
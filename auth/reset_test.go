@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordReset(t *testing.T) {
+	db := newDB(t, "reset")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register user: %v", err)
+	}
+	token, err := GenerateToken(ctx, db, "user1", time.UnixMilli(0), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	now := time.Now()
+	if _, err := CreatePasswordReset(ctx, db, "nobody@localhost", now, now.Add(time.Hour)); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("unknown email: expected ErrBadCredentials, got %v", err)
+	}
+	code, err := CreatePasswordReset(ctx, db, "lol@localhost", now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("create reset: %v", err)
+	}
+	if _, err := CreatePasswordReset(ctx, db, "lol@localhost", now.Add(time.Minute), now.Add(time.Hour)); err != ErrResetThrottled {
+		t.Fatalf("repeated reset: expected ErrResetThrottled, got %v", err)
+	}
+	if _, err := ConsumePasswordResetWith(ctx, db, PasswordOptions{}, code, "pw2", now.Add(2*time.Hour)); err != ErrInvalidResetCode {
+		t.Fatalf("expired code: expected ErrInvalidResetCode, got %v", err)
+	}
+	uid, err := ConsumePasswordResetWith(ctx, db, PasswordOptions{}, code, "pw2", now.Add(time.Second))
+	if err != nil || uid != "user1" {
+		t.Fatalf("consume: got '%v', %v", uid, err)
+	}
+	if _, err := ConsumePasswordResetWith(ctx, db, PasswordOptions{}, code, "pw3", now.Add(time.Second)); err != ErrInvalidResetCode {
+		t.Fatalf("reused code: expected ErrInvalidResetCode, got %v", err)
+	}
+	if err := Authenticate(ctx, db, "lol@localhost", "pw2"); err != nil {
+		t.Fatalf("new password: %v", err)
+	}
+	if _, err := Lookup(ctx, db, token, now.Add(2*time.Second)); err != ErrInvalidToken {
+		t.Fatalf("expected reset to end old sessions, got %v", err)
+	}
+}
+
+// Delivers sent mail to a channel, for handlers which send in the background.
+type chanMailer chan string
+
+func (m chanMailer) Send(ctx context.Context, to, subject, body string) error {
+	m <- body
+	return nil
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	db := newDB(t, "reset_flow")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register user: %v", err)
+	}
+	mailer := make(chanMailer, 1)
+	mux := AuthServer{Authenticator: DBAuthenticator{DB: db}, Mailer: mailer, BaseURL: "https://example.com"}.Handler("/auth")
+	post := func(target string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login", nil))
+	if !strings.Contains(w.Body.String(), `href="/auth/forgot"`) {
+		t.Fatalf("login page should link to forgot password: %v", w.Body.String())
+	}
+
+	unknown := post("/auth/forgot", url.Values{"email": {"nobody@localhost"}})
+	known := post("/auth/forgot?redirect=%2Fsecured", url.Values{"email": {"lol@localhost"}})
+	if unknown.Code != http.StatusOK || unknown.Body.String() != known.Body.String() {
+		t.Fatalf("responses should not reveal whether the account exists: %v %q vs %v %q", unknown.Code, unknown.Body, known.Code, known.Body)
+	}
+	var body string
+	select {
+	case body = <-mailer:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reset email sent")
+	}
+	select {
+	case extra := <-mailer:
+		t.Fatalf("unexpected second email: %v", extra)
+	case <-time.After(50 * time.Millisecond):
+	}
+	i := strings.Index(body, "https://example.com/auth/reset?")
+	if i < 0 {
+		t.Fatalf("no reset link in email: %v", body)
+	}
+	link, err := url.Parse(strings.Fields(body[i:])[0])
+	if err != nil {
+		t.Fatalf("parse link: %v", err)
+	}
+
+	w = post(link.RequestURI(), url.Values{"password": {"pw2"}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/auth/login?redirect=%2Fsecured" {
+		t.Fatalf("expected redirect to login, got %v %v %v", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	if err := Authenticate(ctx, db, "lol@localhost", "pw2"); err != nil {
+		t.Fatalf("new password: %v", err)
+	}
+	if w := post(link.RequestURI(), url.Values{"password": {"pw3"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("reused link: expected 400, got %v", w.Code)
+	}
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What became of a password reset request.
+type ResetOutcome string
+
+const (
+	ResetSent           ResetOutcome = "sent"
+	ResetUnknownAccount ResetOutcome = "unknown_account"
+	ResetThrottled      ResetOutcome = "throttled"
+)
+
+// Logs a password reset request, for ResetAbuseReport. ip may be empty if it isn't known.
+func RecordResetRequest(ctx context.Context, db conn, email, ip string, outcome ResetOutcome, now time.Time) error {
+	email = strings.ToLower(email)
+	domain := email[strings.LastIndex(email, "@")+1:]
+	_, err := db.ExecContext(ctx, `INSERT INTO RESET_REQUEST (EMAIL, DOMAIN, IP, OUTCOME, CREATED_TIME) VALUES (?, ?, ?, ?, ?);`,
+		email, domain, ip, string(outcome), now.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("insert reset request: %w", err)
+	}
+	return nil
+}
+
+// Drops reset requests made before the given time.
+func ReapResetRequests(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM RESET_REQUEST WHERE CREATED_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
+
+// Password reset requests over a period, broken down to spot account takeover campaigns: one account targeted from many
+// IPs, or one IP or email domain working through many accounts.
+type ResetAbuseReport struct {
+	Since     time.Time            `json:"since"`
+	Until     time.Time            `json:"until"`
+	Requests  int                  `json:"requests"`
+	ByOutcome map[ResetOutcome]int `json:"by_outcome"`
+	// The busiest accounts, IPs and domains, most requests first.
+	Accounts []ResetCount `json:"accounts"`
+	IPs      []ResetCount `json:"ips"`
+	Domains  []ResetCount `json:"domains"`
+	// Requests per hour, oldest first. Hours without requests are left out.
+	Hourly []ResetHour `json:"hourly"`
+}
+
+type ResetCount struct {
+	Key      string `json:"key"`
+	Requests int    `json:"requests"`
+	// Distinct IPs for an account, or distinct accounts for an IP or domain.
+	Distinct int `json:"distinct"`
+	// Requests for accounts which don't exist, a sign of enumeration.
+	Unknown int `json:"unknown"`
+}
+
+type ResetHour struct {
+	Start    time.Time `json:"start"`
+	Requests int       `json:"requests"`
+}
+
+// Summarizes reset requests made in [since, until), listing up to top accounts, IPs and domains.
+func ResetReport(ctx context.Context, db conn, since, until time.Time, top int) (ResetAbuseReport, error) {
+	rep := ResetAbuseReport{Since: since, Until: until, ByOutcome: make(map[ResetOutcome]int)}
+	window := []any{since.UnixMilli(), until.UnixMilli()}
+	rows, err := db.QueryContext(ctx, `SELECT OUTCOME, COUNT(*) FROM RESET_REQUEST
+	WHERE CREATED_TIME >= ? AND CREATED_TIME < ? GROUP BY OUTCOME;`, window...)
+	if err != nil {
+		return rep, fmt.Errorf("count outcomes: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var outcome string
+		var n int
+		err = rows.Scan(&outcome, &n)
+		if err != nil {
+			return rep, fmt.Errorf("scan outcome: %w", err)
+		}
+		rep.ByOutcome[ResetOutcome(outcome)] = n
+		rep.Requests += n
+	}
+	if err = rows.Err(); err != nil {
+		return rep, fmt.Errorf("iterate outcomes: %w", err)
+	}
+
+	for _, g := range []struct {
+		name, key, distinct string
+		into                *[]ResetCount
+	}{
+		{"accounts", "EMAIL", "IP", &rep.Accounts},
+		{"ips", "IP", "EMAIL", &rep.IPs},
+		{"domains", "DOMAIN", "EMAIL", &rep.Domains},
+	} {
+		// The column names are constants above, never user input.
+		*g.into, err = resetCounts(ctx, db, fmt.Sprintf(`SELECT %v, COUNT(*), COUNT(DISTINCT %v), SUM(OUTCOME = ?)
+	FROM RESET_REQUEST WHERE CREATED_TIME >= ? AND CREATED_TIME < ? AND %v != ''
+	GROUP BY %v ORDER BY COUNT(*) DESC, %v LIMIT ?;`, g.key, g.distinct, g.key, g.key, g.key),
+			string(ResetUnknownAccount), since.UnixMilli(), until.UnixMilli(), top)
+		if err != nil {
+			return rep, fmt.Errorf("count %v: %w", g.name, err)
+		}
+	}
+
+	hours, err := db.QueryContext(ctx, `SELECT CREATED_TIME / 3600000, COUNT(*) FROM RESET_REQUEST
+	WHERE CREATED_TIME >= ? AND CREATED_TIME < ? GROUP BY 1 ORDER BY 1;`, window...)
+	if err != nil {
+		return rep, fmt.Errorf("count hours: %w", err)
+	}
+	defer hours.Close()
+	for hours.Next() {
+		var hour int64
+		var h ResetHour
+		err = hours.Scan(&hour, &h.Requests)
+		if err != nil {
+			return rep, fmt.Errorf("scan hour: %w", err)
+		}
+		h.Start = time.UnixMilli(hour * 3600000)
+		rep.Hourly = append(rep.Hourly, h)
+	}
+	if err = hours.Err(); err != nil {
+		return rep, fmt.Errorf("iterate hours: %w", err)
+	}
+	return rep, nil
+}
+
+func resetCounts(ctx context.Context, db conn, query string, args ...any) ([]ResetCount, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []ResetCount
+	for rows.Next() {
+		var c ResetCount
+		err = rows.Scan(&c.Key, &c.Requests, &c.Distinct, &c.Unknown)
+		if err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// Serves a ResetAbuseReport as JSON to requests bearing Secret as a bearer token. The "hours" query parameter sets how
+// far back it looks, default 24, and "top" how many accounts, IPs and domains it lists, default 20.
+type ResetReportHandler struct {
+	DB     *sql.DB
+	Secret string
+	// Where the auth tables are, if they share the DB with an application.
+	Schema *Schema
+}
+
+func (h ResetReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	if !checkBearer(w, r, h.Secret) {
+		return
+	}
+	q := r.URL.Query()
+	hours, top := 24, 20
+	for name, into := range map[string]*int{"hours": &hours, "top": &top} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, fmt.Sprintf("%v must be a positive integer, was '%v'", name, v), http.StatusBadRequest)
+				return
+			}
+			*into = n
+		}
+	}
+	now := time.Now()
+	rep, err := ResetReport(r.Context(), h.Schema.wrap(h.DB), now.Add(-time.Duration(hours)*time.Hour), now, top)
+	if err != nil {
+		log.Printf("error: reset report: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResetReport(t *testing.T) {
+	db := newDB(t, "resetreport")
+	ctx := WithClientIP(context.Background(), "10.0.0.1")
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "a@b.com", "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	a := DBAuthenticator{DB: db}
+	for _, email := range []string{"a@b.com", "A@b.com", "y@b.com"} {
+		_, _ = a.BeginPasswordReset(ctx, email)
+	}
+	_, _ = a.BeginPasswordReset(WithClientIP(context.Background(), "10.0.0.2"), "a@b.com")
+	now := time.Now()
+	err = RecordResetRequest(ctx, db, "old@c.com", "10.0.0.3", ResetSent, now.Add(-48*time.Hour))
+	if err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	rep, err := ResetReport(ctx, db, now.Add(-time.Hour), now.Add(time.Hour), 1)
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if rep.Requests != 4 || rep.ByOutcome[ResetSent] != 1 || rep.ByOutcome[ResetThrottled] != 1 || rep.ByOutcome[ResetUnknownAccount] != 2 {
+		t.Fatalf("unexpected totals: %+v", rep)
+	}
+	if len(rep.Accounts) != 1 || rep.Accounts[0] != (ResetCount{Key: "a@b.com", Requests: 3, Distinct: 2, Unknown: 1}) {
+		t.Fatalf("unexpected accounts: %+v", rep.Accounts)
+	}
+	if len(rep.IPs) != 1 || rep.IPs[0] != (ResetCount{Key: "10.0.0.1", Requests: 3, Distinct: 2, Unknown: 2}) {
+		t.Fatalf("unexpected IPs: %+v", rep.IPs)
+	}
+	if len(rep.Domains) != 1 || rep.Domains[0].Key != "b.com" || rep.Domains[0].Requests != 4 {
+		t.Fatalf("unexpected domains: %+v", rep.Domains)
+	}
+	if len(rep.Hourly) == 0 || rep.Hourly[len(rep.Hourly)-1].Start.After(now) {
+		t.Fatalf("unexpected hourly counts: %+v", rep.Hourly)
+	}
+
+	err = ReapResetRequests(ctx, db, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	rep, err = ResetReport(ctx, db, now.Add(-72*time.Hour), now.Add(time.Hour), 10)
+	if err != nil || rep.Requests != 4 {
+		t.Fatalf("expected only the old request reaped, got %v %v", rep.Requests, err)
+	}
+
+	h := ResetReportHandler{DB: db, Secret: "s3cret"}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/admin/reset-report", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the secret, got %v", w.Code)
+	}
+	r := httptest.NewRequest("GET", "/admin/reset-report?hours=1&top=5", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var got ResetAbuseReport
+	if err = json.NewDecoder(w.Body).Decode(&got); err != nil || got.Requests != 4 || len(got.Accounts) != 2 {
+		t.Fatalf("unexpected response %v: %+v %v", w.Code, got, err)
+	}
+}
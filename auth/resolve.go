@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Returned by a TenantResolver for requests to no known tenant, which get a 404.
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// Finds which tenant a request is for, e.g by its host or a path prefix, see Resolvers.
+type TenantResolver interface {
+	// Returns the tenant's ID, or an error wrapping ErrUnknownTenant if there is none.
+	ResolveTenant(r *http.Request) (string, error)
+}
+
+// Finds the locale to serve a request in, e.g from Accept-Language or a cookie, see Resolvers.
+type LocaleResolver interface {
+	// Returns a BCP 47 tag, e.g "en-GB".
+	ResolveLocale(r *http.Request) string
+}
+
+// Adapts a function to a TenantResolver.
+type TenantResolverFunc func(r *http.Request) (string, error)
+
+func (f TenantResolverFunc) ResolveTenant(r *http.Request) (string, error) {
+	return f(r)
+}
+
+// Adapts a function to a LocaleResolver.
+type LocaleResolverFunc func(r *http.Request) string
+
+func (f LocaleResolverFunc) ResolveLocale(r *http.Request) string {
+	return f(r)
+}
+
+type tenantKey struct{}
+
+type localeKey struct{}
+
+// Attaches the tenant a request is for.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// Returns the tenant attached by WithTenant, or "" if there is none.
+func Tenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// Attaches the locale to serve a request in.
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeKey{}, locale)
+}
+
+// Returns the locale attached by WithLocale, or "" if there is none.
+func Locale(ctx context.Context) string {
+	locale, _ := ctx.Value(localeKey{}).(string)
+	return locale
+}
+
+// Resolves the tenant and locale of each request once, before anything else looks at it, and attaches them to its
+// context, so templates, policies and stores can all find them with Tenant and Locale rather than each parsing the
+// request. Set on AuthServer and AuthFilter, or wrap other handlers with Middleware. The zero value resolves nothing.
+type Resolvers struct {
+	Tenant TenantResolver
+	Locale LocaleResolver
+}
+
+// Returns a handler which attaches the request's tenant and locale before calling next. Requests to unknown tenants
+// get a 404.
+func (rs Resolvers) Middleware(next http.Handler) http.Handler {
+	if rs.Tenant == nil && rs.Locale == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if rs.Tenant != nil {
+			tenant, err := rs.Tenant.ResolveTenant(r)
+			if errors.Is(err, ErrUnknownTenant) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("error: resolve tenant: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			ctx = WithTenant(ctx, tenant)
+		}
+		if rs.Locale != nil {
+			ctx = WithLocale(ctx, rs.Locale.ResolveLocale(r))
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// A LocaleResolver picking the best of the Supported locales by the request's Accept-Language header. A language
+// without a region matches any region, e.g "en" matches "en-GB", and the other way around. Falls back to Default.
+type AcceptLanguage struct {
+	// Tags, e.g "en", "fr-CA".
+	Supported []string
+	Default   string
+}
+
+func (al AcceptLanguage) ResolveLocale(r *http.Request) string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			var err error
+			q, err = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		if p.tag == "*" && al.Default != "" {
+			return al.Default
+		}
+		if match := al.match(p.tag); match != "" {
+			return match
+		}
+	}
+	return al.Default
+}
+
+// Returns the supported tag best matching tag, or "" if none do.
+func (al AcceptLanguage) match(tag string) string {
+	for _, s := range al.Supported {
+		if strings.EqualFold(s, tag) {
+			return s
+		}
+	}
+	base := baseLanguage(tag)
+	for _, s := range al.Supported {
+		if strings.EqualFold(baseLanguage(s), base) {
+			return s
+		}
+	}
+	return ""
+}
+
+func baseLanguage(tag string) string {
+	base, _, _ := strings.Cut(tag, "-")
+	return base
+}
+
+// Returns a TenantResolver taking the tenant from the request's host, by the given tenants' lower case hosts, e.g
+// {"acme.example.com": "acme"}. Ports are ignored.
+func HostTenants(hosts map[string]string) TenantResolver {
+	return TenantResolverFunc(func(r *http.Request) (string, error) {
+		host := hostname(r.Host)
+		tenant, ok := hosts[strings.ToLower(host)]
+		if !ok {
+			return "", fmt.Errorf("%w: %v", ErrUnknownTenant, host)
+		}
+		return tenant, nil
+	})
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAcceptLanguage(t *testing.T) {
+	al := AcceptLanguage{Supported: []string{"en", "fr-CA", "de"}, Default: "en"}
+	for header, want := range map[string]string{
+		"":                             "en",
+		"fr-CA":                        "fr-CA",
+		"fr-FR, de;q=0.5":              "fr-CA",
+		"de;q=0.9, fr-ca":              "fr-CA",
+		"es, de;q=0.8, en;q=0.7":       "de",
+		"en-GB,en;q=0.9":               "en",
+		"es":                           "en",
+		"de;q=0, fr;q=0.1":             "fr-CA",
+		"ja, *;q=0.5":                  "en",
+		"de;q=garbage, fr-CA;q=0.1":    "fr-CA",
+		" DE ; q=0.4 , en-US ; q=0.3 ": "de",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Language", header)
+		if got := al.ResolveLocale(r); got != want {
+			t.Fatalf("Accept-Language %q: expected %q, got %q", header, want, got)
+		}
+	}
+}
+
+func TestResolvers(t *testing.T) {
+	templates, err := ParseTemplates(fstest.MapFS{
+		"login.html": {Data: []byte(`{{.Tenant}} {{.Locale}}`)},
+	})
+	if err != nil {
+		t.Fatalf("parse templates: %v", err)
+	}
+	resolvers := Resolvers{
+		Tenant: HostTenants(map[string]string{"acme.example.com": "acme"}),
+		Locale: AcceptLanguage{Supported: []string{"en", "fr"}, Default: "en"},
+	}
+	mux := AuthServer{Authenticator: DBAuthenticator{DB: newDB(t, "resolve")}, Templates: templates, Resolvers: resolvers}.Handler("/auth")
+	r := httptest.NewRequest("GET", "http://acme.example.com:8080/auth/login", nil)
+	r.Header.Set("Accept-Language", "fr-FR")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "acme fr" {
+		t.Fatalf("expected the page rendered for the tenant and locale, got %v %q", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://other.example.com/auth/login", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown tenant to be refused, got %v", w.Code)
+	}
+
+	// Filtered handlers, and the validator, see them too.
+	var validated, handled string
+	f := AuthFilter{Validator: tenantValidator{&validated}, LoginURL: "/login", Resolvers: resolvers}
+	h := f.Handler(func(_ Token, w http.ResponseWriter, r *http.Request) {
+		handled = Tenant(r.Context()) + " " + Locale(r.Context())
+	})
+	r = httptest.NewRequest("GET", "http://acme.example.com/secured", nil)
+	r.Header.Set("Authorization", "Bearer "+Token{}.String())
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if validated != "acme" || handled != "acme en" {
+		t.Fatalf("expected the tenant and locale in the filter's contexts, got %q and %q", validated, handled)
+	}
+}
+
+type tenantValidator struct {
+	tenant *string
+}
+
+func (v tenantValidator) Validate(ctx context.Context, t Token) error {
+	*v.tenant = Tenant(ctx)
+	return nil
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// A kind of expiring data, and how long to keep it once it has expired.
+type RetentionClass struct {
+	Name string
+	// How long rows are kept after they expire, e.g to investigate abuse. Zero purges them as soon as they expire.
+	Retain time.Duration
+	// Deletes rows which expired before the given time, like ReapTokens.
+	Purge func(ctx context.Context, db conn, olderThan time.Time) error
+}
+
+// Returns a class for each table of expiring data in the DB. Nothing is kept past expiry except tokens, which are kept a
+// day to allow for clock skew between replicas, records of abuse, which are kept for investigation, and the audit
+// trail, which is kept a year.
+func DefaultRetention() []RetentionClass {
+	return []RetentionClass{
+		{Name: "tokens", Retain: 24 * time.Hour, Purge: reapTokens},
+		{Name: "refresh_tokens", Purge: ReapRefreshTokens},
+		{Name: "auth_codes", Purge: ReapAuthCodes},
+		{Name: "grant_codes", Purge: ReapGrantCodes},
+		{Name: "password_resets", Purge: ReapPasswordResets},
+		{Name: "pending_signups", Purge: ReapPendingSignups},
+		{Name: "otps", Purge: ReapOTPs},
+		{Name: "stashed_requests", Purge: ReapStashedRequests},
+		{Name: "risk_signals", Purge: ReapRiskSignals},
+		{Name: "device_revocations", Purge: ReapDeviceRevocations},
+		{Name: "rate_counters", Purge: ReapRateCounters},
+		{Name: "failed_logins", Retain: 24 * time.Hour, Purge: ReapFailedLogins},
+		// Reset requests expire as they are made, and are kept for ResetReport.
+		{Name: "reset_requests", Retain: 30 * 24 * time.Hour, Purge: ReapResetRequests},
+		// User events likewise expire as they happen.
+		{Name: "user_events", Retain: 365 * 24 * time.Hour, Purge: ReapUserEvents},
+		{Name: "break_glass", Retain: 365 * 24 * time.Hour, Purge: ReapBreakGlass},
+	}
+}
+
+// Reaps tokens for a Purger. Purgers only purge the past, so olderThan can stand in for now.
+func reapTokens(ctx context.Context, db conn, olderThan time.Time) error {
+	return ReapTokens(ctx, db, olderThan, olderThan)
+}
+
+// What a Purger has done for a class.
+type PurgeStats struct {
+	Runs     int
+	Failures int
+	// When the class was last purged successfully.
+	LastSuccess time.Time
+	// How long the last purge took.
+	LastDuration time.Duration
+	// The error from the last purge, or nil if it succeeded.
+	LastErr error
+	// Rows deleted by the last purge, and by every purge.
+	LastRows  int64
+	TotalRows int64
+}
+
+// Purges expired data on a schedule, according to retention classes. Safe for concurrent use.
+type Purger struct {
+	DB *sql.DB
+	// Where the auth tables are, if they share the DB with an application.
+	Schema *Schema
+	// Defaults to DefaultRetention.
+	Classes []RetentionClass
+	// How often to purge. Defaults to an hour.
+	Interval time.Duration
+
+	mu    sync.Mutex
+	stats map[string]PurgeStats
+}
+
+// Purges every class once. A failing class doesn't stop the others; failures are logged and counted in Stats.
+func (p *Purger) PurgeOnce(ctx context.Context, now time.Time) {
+	classes := p.Classes
+	if classes == nil {
+		classes = DefaultRetention()
+	}
+	for _, c := range classes {
+		start := time.Now()
+		db := &countingConn{conn: p.Schema.wrap(p.DB)}
+		err := c.Purge(ctx, db, now.Add(-c.Retain))
+		if err != nil {
+			log.Printf("error: purge %v: %v", c.Name, err)
+		} else if db.rows > 0 {
+			log.Printf("purged %v %v", db.rows, c.Name)
+		}
+		p.record(c.Name, start, db.rows, err)
+	}
+}
+
+// Counts the rows changed through it, so purges can report what they deleted.
+type countingConn struct {
+	conn
+	rows int64
+}
+
+func (c *countingConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	res, err := c.conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return res, err
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		c.rows += n
+	}
+	return res, nil
+}
+
+func (p *Purger) record(class string, start time.Time, rows int64, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stats == nil {
+		p.stats = make(map[string]PurgeStats)
+	}
+	s := p.stats[class]
+	s.Runs++
+	s.LastDuration = time.Since(start)
+	s.LastErr = err
+	s.LastRows = rows
+	s.TotalRows += rows
+	if err != nil {
+		s.Failures++
+	} else {
+		s.LastSuccess = start
+	}
+	p.stats[class] = s
+}
+
+// Purges every Interval until the context is done.
+func (p *Purger) Run(ctx context.Context) {
+	interval := p.Interval
+	if interval == 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.PurgeOnce(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Starts purging the tables in schema every interval in the background, until the context is done, keeping expired
+// tokens for grace and everything else per DefaultRetention. The returned channel is closed once the reaper has stopped, so shutdown can wait
+// for a purge in progress.
+func StartReaper(ctx context.Context, db *sql.DB, schema *Schema, interval, grace time.Duration) <-chan struct{} {
+	classes := DefaultRetention()
+	for i := range classes {
+		if classes[i].Name == "tokens" {
+			classes[i].Retain = grace
+		}
+	}
+	p := &Purger{DB: db, Schema: schema, Classes: classes, Interval: interval}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	return done
+}
+
+// Returns the stats for each class which has been purged, keyed by class name.
+func (p *Purger) Stats() map[string]PurgeStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make(map[string]PurgeStats, len(p.stats))
+	for class, s := range p.stats {
+		stats[class] = s
+	}
+	return stats
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPurger(t *testing.T) {
+	db := newDB(t, "purge")
+	ctx := context.Background()
+	now := time.Now()
+	old, err := GenerateToken(ctx, db, "user1", now.Add(-3*time.Hour), now.Add(-2*time.Hour))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	recent, err := GenerateToken(ctx, db, "user1", now.Add(-3*time.Hour), now.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	expiry := func(tok Token) error {
+		_, err := TokenExpiry(ctx, db, tok)
+		return err
+	}
+
+	classes := DefaultRetention()
+	classes[0].Retain = time.Hour
+	classes = append(classes, RetentionClass{Name: "broken", Purge: func(context.Context, conn, time.Time) error {
+		return errors.New("broken")
+	}})
+	p := &Purger{DB: db, Classes: classes}
+	p.PurgeOnce(ctx, now)
+	if err := expiry(old); err != ErrInvalidToken {
+		t.Fatalf("token expired past retention should be purged, got %v", err)
+	}
+	if err := expiry(recent); err != nil {
+		t.Fatalf("token within retention should be kept, got %v", err)
+	}
+
+	stats := p.Stats()
+	if len(stats) != len(classes) {
+		t.Fatalf("expected stats for %v classes, got %v", len(classes), stats)
+	}
+	if s := stats["tokens"]; s.Runs != 1 || s.Failures != 0 || s.LastSuccess.IsZero() || s.LastRows != 1 || s.TotalRows != 1 {
+		t.Fatalf("tokens stats: %+v", s)
+	}
+	if s := stats["broken"]; s.Runs != 1 || s.Failures != 1 || s.LastErr == nil || !s.LastSuccess.IsZero() {
+		t.Fatalf("broken stats: %+v", s)
+	}
+}
+
+func TestStartReaper(t *testing.T) {
+	db := newDB(t, "reaper")
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	tok, err := GenerateToken(ctx, db, "user1", now.Add(-3*time.Hour), now.Add(-2*time.Hour))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	done := StartReaper(ctx, db, nil, time.Hour, time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = TokenExpiry(context.Background(), db, tok)
+		if err == ErrInvalidToken {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the reaper to purge the token straight away, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaper didn't stop")
+	}
+}
+
+func TestAuditRetention(t *testing.T) {
+	db := newDB(t, "audit_retention")
+	ctx := context.Background()
+	now := time.Now()
+	old := now.Add(-2 * 365 * 24 * time.Hour)
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	for _, kind := range []string{RoleGranted, AccountLinked} {
+		err = recordUserEvent(ctx, db, "user1", kind, nil, old)
+		if err != nil {
+			t.Fatalf("record %v: %v", kind, err)
+		}
+	}
+	_, err = db.ExecContext(ctx, `UPDATE USER_EVENT SET CREATED_TIME=? WHERE KIND=?;`, old.UnixMilli(), UserCreated)
+	if err != nil {
+		t.Fatalf("age creation: %v", err)
+	}
+	_, err = IssueBreakGlass(ctx, db, "a@b.com", "lost phone", old, old.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("issue break glass: %v", err)
+	}
+
+	(&Purger{DB: db}).PurgeOnce(ctx, now)
+	events, err := UserEvents(ctx, db, "user1")
+	if err != nil {
+		t.Fatalf("user events: %v", err)
+	}
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+	}
+	if len(kinds) != 2 || kinds[0] != UserCreated || kinds[1] != AccountLinked {
+		t.Fatalf("expected only the creation and link to outlive retention, got %v", kinds)
+	}
+	var n int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM BREAK_GLASS;`).Scan(&n)
+	if err != nil || n != 0 {
+		t.Fatalf("expected the old break glass code to be purged, got %v %v", n, err)
+	}
+}
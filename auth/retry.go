@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Classes of DB writes, each retried by its own RetryPolicy, see DBAuthenticator.Retry.
+const (
+	// Issuing tokens at log in, and counting failed log ins.
+	RetryLogin = "login"
+	// Refreshing, exchanging and revoking tokens and codes.
+	RetryTokens = "tokens"
+	// Sign ups, password resets and deleting accounts.
+	RetryAccounts = "accounts"
+)
+
+// How to retry a write which found the DB busy, e.g because another connection holds SQLite's write lock.
+type RetryPolicy struct {
+	// Tries in all, counting the first. Zero or one never retries.
+	Attempts int
+	// The longest wait before the first retry. Each wait is random up to a cap, so writers contending for the lock spread
+	// out, and the cap doubles after each retry. Defaults to 10ms.
+	Backoff time.Duration
+	// The most the cap grows to. Defaults to no limit.
+	MaxBackoff time.Duration
+}
+
+// Returns the policies used when DBAuthenticator.Retry is nil. Log ins and tokens are retried quickly, since users wait
+// on them; account changes are rarer and get longer.
+func DefaultRetryPolicies() map[string]RetryPolicy {
+	return map[string]RetryPolicy{
+		RetryLogin:    {Attempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 200 * time.Millisecond},
+		RetryTokens:   {Attempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 200 * time.Millisecond},
+		RetryAccounts: {Attempts: 3, Backoff: 50 * time.Millisecond, MaxBackoff: 500 * time.Millisecond},
+	}
+}
+
+// Runs f, running it again after a jittered backoff while it fails because the DB is busy, up to Attempts times. Gives
+// up early with f's error if the context is done. f must be safe to repeat, e.g a whole transaction.
+func (p RetryPolicy) Do(ctx context.Context, f func() error) error {
+	wait := p.Backoff
+	if wait <= 0 {
+		wait = 10 * time.Millisecond
+	}
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= p.Attempts || !IsBusy(err) {
+			return err
+		}
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(wait))) + 1)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		wait *= 2
+		if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+			wait = p.MaxBackoff
+		}
+	}
+}
+
+// Reports whether err is SQLite finding the DB busy or a table locked, which passes once the other writer is done.
+// Recognizes drivers whose errors have a Code method, e.g modernc.org/sqlite, and otherwise SQLite's messages.
+func IsBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	var coded interface{ Code() int }
+	if errors.As(err, &coded) {
+		// The primary code is the low byte of extended codes, e.g SQLITE_BUSY_SNAPSHOT.
+		switch coded.Code() & 0xff {
+		case 5, 6: // SQLITE_BUSY, SQLITE_LOCKED
+			return true
+		}
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY")
+}
+
+// Runs a write of the given class under its retry policy.
+func (d DBAuthenticator) retry(ctx context.Context, class string, f func() error) error {
+	policies := d.Retry
+	if policies == nil {
+		policies = DefaultRetryPolicies()
+	}
+	return policies[class].Do(ctx, f)
+}
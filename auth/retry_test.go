@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type codedError int
+
+func (e codedError) Error() string { return fmt.Sprintf("sqlite error %d", int(e)) }
+func (e codedError) Code() int     { return int(e) }
+
+func TestIsBusy(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		busy bool
+	}{
+		{nil, false},
+		{codedError(5), true},
+		// SQLITE_BUSY_SNAPSHOT, an extended code.
+		{fmt.Errorf("commit: %w", codedError(517)), true},
+		{codedError(6), true},
+		{codedError(19), false},
+		{errors.New("database is locked (5) (SQLITE_BUSY)"), true},
+		{ErrInvalidToken, false},
+	} {
+		if got := IsBusy(tc.err); got != tc.busy {
+			t.Fatalf("IsBusy(%v): expected %v, got %v", tc.err, tc.busy, got)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	p := RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+	calls := 0
+	err := p.Do(ctx, func() error {
+		calls++
+		if calls < 3 {
+			return codedError(5)
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success on the third try, got %v after %v calls", err, calls)
+	}
+	calls = 0
+	err = p.Do(ctx, func() error {
+		calls++
+		return codedError(5)
+	})
+	if !IsBusy(err) || calls != 3 {
+		t.Fatalf("expected to give up after 3 tries, got %v after %v calls", err, calls)
+	}
+	calls = 0
+	err = p.Do(ctx, func() error {
+		calls++
+		return ErrBadCredentials
+	})
+	if err != ErrBadCredentials || calls != 1 {
+		t.Fatalf("expected other errors to be returned at once, got %v after %v calls", err, calls)
+	}
+}
+
+func TestRetryBusyLogin(t *testing.T) {
+	ctx := context.Background()
+	p := filepath.Join(t.TempDir(), "retry")
+	// No busy timeout, so writes fail at once while another connection holds the lock.
+	db, err := sql.Open("sqlite", p)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	err = Initialize(ctx, db)
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	err = DBAuthenticator{DB: db}.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	other, err := sql.Open("sqlite", p)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer other.Close()
+	lock, err := other.Conn(ctx)
+	if err != nil {
+		t.Fatalf("conn: %v", err)
+	}
+	defer lock.Close()
+	_, err = lock.ExecContext(ctx, `BEGIN IMMEDIATE;`)
+	if err != nil {
+		t.Fatalf("take write lock: %v", err)
+	}
+
+	_, _, err = DBAuthenticator{DB: db, Retry: map[string]RetryPolicy{}}.Authenticate(ctx, "a@b.com", "pw")
+	if !IsBusy(err) {
+		t.Fatalf("expected a busy error without retries, got %v", err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lock.ExecContext(ctx, `COMMIT;`)
+	}()
+	a := DBAuthenticator{DB: db, Retry: map[string]RetryPolicy{RetryLogin: {Attempts: 100, Backoff: 20 * time.Millisecond}}}
+	tok, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("expected the log in to succeed once the lock was released, got %v", err)
+	}
+	if err := a.Validate(ctx, tok); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Risk signals pushed by external fraud systems about an email or IP address, consulted before issuing tokens.
+
+// Returned when a login is refused because of a risk signal.
+var ErrRiskTooHigh = errors.New("login blocked, contact support")
+
+// An external assessment of how likely activity from a subject is fraudulent.
+type RiskSignal struct {
+	// An email or IP address.
+	Subject string
+	// From 0, benign, to 1, certainly fraudulent.
+	Score  float64
+	Reason string
+	// When the signal stops applying.
+	Expires time.Time
+}
+
+// Records a signal, replacing any earlier signal for the same subject.
+func PushRiskSignal(ctx context.Context, db conn, s RiskSignal) error {
+	if s.Subject == "" {
+		return fmt.Errorf("risk signal: empty subject")
+	}
+	if s.Score < 0 || s.Score > 1 {
+		return fmt.Errorf("risk signal: score must be between 0 and 1, was %v", s.Score)
+	}
+	_, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO RISK_SIGNAL (SUBJECT, SCORE, REASON, EXPIRES_TIME)
+	VALUES (?, ?, ?, ?);`, strings.ToLower(s.Subject), s.Score, s.Reason, s.Expires.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("insert risk signal: %w", err)
+	}
+	return nil
+}
+
+// Returns the highest scoring live signal about any of the given subjects. Returns a zero signal if there are none.
+func HighestRisk(ctx context.Context, db conn, subjects []string, now time.Time) (RiskSignal, error) {
+	var worst RiskSignal
+	for _, subject := range subjects {
+		if subject == "" {
+			continue
+		}
+		row := db.QueryRowContext(ctx, `SELECT SUBJECT, SCORE, REASON, EXPIRES_TIME FROM RISK_SIGNAL WHERE
+	SUBJECT=? AND
+	EXPIRES_TIME >= ?`, strings.ToLower(subject), now.UnixMilli())
+		var s RiskSignal
+		var expires int64
+		err := row.Scan(&s.Subject, &s.Score, &s.Reason, &expires)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return worst, fmt.Errorf("parse risk signal: %w", err)
+		}
+		s.Expires = time.UnixMilli(expires)
+		if s.Score > worst.Score {
+			worst = s
+		}
+	}
+	return worst, nil
+}
+
+// Drops signals which expired before the given time.
+func ReapRiskSignals(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM RISK_SIGNAL WHERE EXPIRES_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
+
+// An http handler through which external fraud systems push risk signals as JSON, e.g
+//
+//	POST {"subject": "1.2.3.4", "score": 0.9, "reason": "botnet", "ttl_seconds": 3600}
+//
+// Callers authenticate with the shared secret as a bearer token.
+type RiskHandler struct {
+	DB     *sql.DB
+	Secret string
+	// Where the auth tables are, if they share the DB with an application.
+	Schema *Schema
+}
+
+func (h RiskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	if !checkBearer(w, r, h.Secret) {
+		return
+	}
+	var req struct {
+		Subject    string  `json:"subject"`
+		Score      float64 `json:"score"`
+		Reason     string  `json:"reason"`
+		TTLSeconds int64   `json:"ttl_seconds"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parse body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.TTLSeconds <= 0 {
+		http.Error(w, "ttl_seconds must be positive", http.StatusBadRequest)
+		return
+	}
+	err = PushRiskSignal(r.Context(), h.Schema.wrap(h.DB), RiskSignal{
+		Subject: req.Subject,
+		Score:   req.Score,
+		Reason:  req.Reason,
+		Expires: time.Now().Add(time.Duration(req.TTLSeconds) * time.Second),
+	})
+	if err != nil {
+		log.Printf("error: push risk signal: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRiskSignals(t *testing.T) {
+	db := newDB(t, "risk")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register user: %v", err)
+	}
+	h := RiskHandler{DB: db, Secret: "s3cret"}
+	push := func(secret, body string) int {
+		r := httptest.NewRequest("POST", "/risk", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := push("wrong", `{"subject": "1.2.3.4", "score": 1, "reason": "botnet", "ttl_seconds": 60}`); code != http.StatusUnauthorized {
+		t.Fatalf("bad secret: expected 401, got %v", code)
+	}
+	if code := push("s3cret", `{"subject": "1.2.3.4", "score": 2, "reason": "botnet", "ttl_seconds": 60}`); code != http.StatusBadRequest {
+		t.Fatalf("bad score: expected 400, got %v", code)
+	}
+	if code := push("s3cret", `{"subject": "1.2.3.4", "score": 0.9, "reason": "botnet", "ttl_seconds": 60}`); code != http.StatusNoContent {
+		t.Fatalf("push: expected 204, got %v", code)
+	}
+
+	a := DBAuthenticator{DB: db, MaxRisk: 0.8}
+	_, _, err = a.Authenticate(WithClientIP(ctx, "1.2.3.4"), "lol@localhost", "pw1")
+	if !errors.Is(err, ErrRiskTooHigh) {
+		t.Fatalf("risky IP: expected blocked login, got %v", err)
+	}
+	_, _, err = a.Authenticate(WithClientIP(ctx, "5.6.7.8"), "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("other IP: %v", err)
+	}
+
+	// Signals about the email apply from any IP, and lower scores don't block
+	if code := push("s3cret", `{"subject": "LOL@localhost", "score": 0.5, "reason": "new device", "ttl_seconds": 60}`); code != http.StatusNoContent {
+		t.Fatalf("push: expected 204, got %v", code)
+	}
+	_, _, err = a.Authenticate(WithClientIP(ctx, "5.6.7.8"), "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("low risk email: %v", err)
+	}
+	a.MaxRisk = 0.5
+	_, _, err = a.Authenticate(WithClientIP(ctx, "5.6.7.8"), "lol@localhost", "pw1")
+	if !errors.Is(err, ErrRiskTooHigh) {
+		t.Fatalf("risky email: expected blocked login, got %v", err)
+	}
+}
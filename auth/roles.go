@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Role based access control. Users are granted roles, e.g "admin", and roles carry permissions, e.g "users:delete".
+// Tokens may be scoped to a subset of their user's roles, so e.g a token handed to a script can't do everything its user
+// can.
+
+// Role and permission names are case sensitive, and can't contain whitespace since scopes are space separated.
+func checkRoleName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("invalid role or permission name %q", name)
+	}
+	return nil
+}
+
+// Grants the role to the given user. Granting a role the user already has is a no-op.
+func GrantRole(ctx context.Context, db conn, uid, role string, now time.Time) error {
+	err := checkRoleName(role)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO USER_ROLE (UID, ROLE, CREATED_TIME) VALUES (?, ?, ?);`,
+		uid, role, now.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("insert role: %w", err)
+	}
+	return recordRoleEvent(ctx, db, res, uid, RoleGranted, role, now)
+}
+
+// Takes the role from the given user, if they have it. Their existing tokens lose it immediately.
+func RevokeRole(ctx context.Context, db conn, uid, role string) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM USER_ROLE WHERE UID=? AND ROLE=?;`, uid, role)
+	if err != nil {
+		return fmt.Errorf("delete role: %w", err)
+	}
+	return recordRoleEvent(ctx, db, res, uid, RoleRevoked, role, time.Now())
+}
+
+// Records a role change in the user's history, if it changed anything.
+func recordRoleEvent(ctx context.Context, db conn, res sql.Result, uid, kind, role string, now time.Time) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	return recordUserEvent(ctx, db, uid, kind, map[string]string{"role": role}, now)
+}
+
+// Returns the roles granted to the given user, sorted.
+func UserRoles(ctx context.Context, db conn, uid string) ([]string, error) {
+	return queryStrings(ctx, db, `SELECT ROLE FROM USER_ROLE WHERE UID=? ORDER BY ROLE;`, uid)
+}
+
+// Adds a permission to the role. Adding a permission the role already has is a no-op.
+func GrantPermission(ctx context.Context, db conn, role, permission string) error {
+	err := checkRoleName(role)
+	if err != nil {
+		return err
+	}
+	err = checkRoleName(permission)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `INSERT OR IGNORE INTO ROLE_PERMISSION (ROLE, PERMISSION) VALUES (?, ?);`, role, permission)
+	if err != nil {
+		return fmt.Errorf("insert permission: %w", err)
+	}
+	return nil
+}
+
+// Removes a permission from the role, if present.
+func RevokePermission(ctx context.Context, db conn, role, permission string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM ROLE_PERMISSION WHERE ROLE=? AND PERMISSION=?;`, role, permission)
+	if err != nil {
+		return fmt.Errorf("delete permission: %w", err)
+	}
+	return nil
+}
+
+// Creates a token like GenerateToken, which only carries the given roles of its user. Roles the user doesn't have, or
+// later loses, are not granted by the scope. Use a transaction, so an unscoped token is never stored.
+func GenerateScopedToken(ctx context.Context, db conn, uid string, roles []string, start, end time.Time) (Token, error) {
+	for _, role := range roles {
+		err := checkRoleName(role)
+		if err != nil {
+			return Token{}, err
+		}
+	}
+	t, err := GenerateToken(ctx, db, uid, start, end)
+	if err != nil {
+		return t, err
+	}
+	hash := sha256.Sum256(t[:])
+	_, err = db.ExecContext(ctx, `UPDATE TOKEN SET SCOPE=? WHERE TOKEN_HASH=?;`, strings.Join(roles, " "), hash[:])
+	if err != nil {
+		return t, fmt.Errorf("set scope: %w", err)
+	}
+	return t, nil
+}
+
+// Matches the roles a token carries: those granted to its user, limited to its scope if it has one. Tokens issued to
+// clients carry none.
+const tokenRoles = `SELECT USER_ROLE.ROLE FROM TOKEN JOIN USER_ROLE ON USER_ROLE.UID = TOKEN.UID WHERE
+TOKEN.TOKEN_HASH=? AND
+` + sessionToken + ` AND
+(TOKEN.SCOPE IS NULL OR instr(' ' || TOKEN.SCOPE || ' ', ' ' || USER_ROLE.ROLE || ' ') > 0)`
+
+// Reports whether the token carries the role. Does not check the token is valid; validate it first.
+func TokenHasRole(ctx context.Context, db conn, t Token, role string) (bool, error) {
+	hash := sha256.Sum256(t[:])
+	row := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM (`+tokenRoles+` AND USER_ROLE.ROLE=?)`, hash[:], role)
+	var n int
+	err := row.Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("count roles: %w", err)
+	}
+	return n > 0, nil
+}
+
+// Reports whether any role the token carries has the permission. Does not check the token is valid; validate it first.
+func TokenHasPermission(ctx context.Context, db conn, t Token, permission string) (bool, error) {
+	hash := sha256.Sum256(t[:])
+	row := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM ROLE_PERMISSION WHERE PERMISSION=? AND ROLE IN (`+tokenRoles+`)`,
+		permission, hash[:])
+	var n int
+	err := row.Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("count permissions: %w", err)
+	}
+	return n > 0, nil
+}
+
+// Implemented by Validators which know the roles tokens carry, for AuthFilter.RequireRole.
+type RoleChecker interface {
+	// Reports whether a valid token carries the role.
+	HasRole(ctx context.Context, t Token, role string) (bool, error)
+}
+
+// Returns a copy of the filter which also requires the token to carry every given role. Requests without them get a
+// 403. Requires Roles, or a Validator implementing RoleChecker.
+func (a AuthFilter) RequireRole(roles ...string) AuthFilter {
+	a.requiredRoles = append(append([]string(nil), a.requiredRoles...), roles...)
+	return a
+}
+
+// Returns Roles, or the Validator if it is a RoleChecker, or nil.
+func (a AuthFilter) roleChecker() RoleChecker {
+	if a.Roles != nil {
+		return a.Roles
+	}
+	checker, _ := a.Validator.(RoleChecker)
+	return checker
+}
+
+// Responds with a 403 and returns false unless the token carries the required roles. Uses the roles validation
+// reported, unless Roles is set, and otherwise asks the RoleChecker.
+func (a AuthFilter) checkRoles(ctx context.Context, w http.ResponseWriter, u User) bool {
+	if len(a.requiredRoles) == 0 {
+		return true
+	}
+	checker := a.userRoleChecker(u)
+	if checker == nil {
+		log.Printf("error: roles required, but no RoleChecker configured")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	for _, role := range a.requiredRoles {
+		ok, err := checker.HasRole(ctx, u.Token, role)
+		if err != nil {
+			log.Printf("error: check role %v: %v", role, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return false
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("forbidden: requires role %v", role), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// A RoleChecker for a token whose roles are already known.
+// Returns what checks the user's roles: Roles if set, else the roles found while validating, else the Validator if it
+// is a RoleChecker. Returns nil if there is none.
+func (a AuthFilter) userRoleChecker(u User) RoleChecker {
+	if a.Roles == nil && u.Roles != nil {
+		return userRoles(u.Roles)
+	}
+	return a.roleChecker()
+}
+
+type userRoles []string
+
+func (roles userRoles) HasRole(ctx context.Context, t Token, role string) (bool, error) {
+	for _, r := range roles {
+		if r == role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRoles(t *testing.T) {
+	db := newDB(t, "roles")
+	ctx := context.Background()
+	now := time.Now()
+	token, err := GenerateToken(ctx, db, "user1", now.Add(-time.Second), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	has := func(t *testing.T, token Token, role string) bool {
+		t.Helper()
+		ok, err := TokenHasRole(ctx, db, token, role)
+		if err != nil {
+			t.Fatalf("has role: %v", err)
+		}
+		return ok
+	}
+	if has(t, token, "admin") {
+		t.Fatalf("role should not be granted yet")
+	}
+	for _, role := range []string{"admin", "billing"} {
+		if err := GrantRole(ctx, db, "user1", role, now); err != nil {
+			t.Fatalf("grant %v: %v", role, err)
+		}
+	}
+	if err := GrantRole(ctx, db, "user1", "two words", now); err == nil {
+		t.Fatalf("expected an error granting a role with a space")
+	}
+	roles, err := UserRoles(ctx, db, "user1")
+	if err != nil || len(roles) != 2 || roles[0] != "admin" || roles[1] != "billing" {
+		t.Fatalf("user roles: %v %v", roles, err)
+	}
+	if !has(t, token, "admin") || !has(t, token, "billing") {
+		t.Fatalf("unscoped token should carry all the user's roles")
+	}
+
+	// Scoped tokens only carry the roles in their scope, and only while the user has them.
+	scoped, err := GenerateScopedToken(ctx, db, "user1", []string{"billing", "root"}, now.Add(-time.Second), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("generate scoped token: %v", err)
+	}
+	if has(t, scoped, "admin") || !has(t, scoped, "billing") || has(t, scoped, "root") {
+		t.Fatalf("scoped token should only carry billing")
+	}
+	if err := RevokeRole(ctx, db, "user1", "billing"); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if has(t, scoped, "billing") || has(t, token, "billing") {
+		t.Fatalf("revoked role should be gone from existing tokens")
+	}
+
+	if err := GrantPermission(ctx, db, "admin", "users:delete"); err != nil {
+		t.Fatalf("grant permission: %v", err)
+	}
+	for _, c := range []struct {
+		token Token
+		want  bool
+	}{{token, true}, {scoped, false}} {
+		ok, err := TokenHasPermission(ctx, db, c.token, "users:delete")
+		if err != nil || ok != c.want {
+			t.Fatalf("has permission: expected %v, got %v %v", c.want, ok, err)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	db := newDB(t, "require")
+	ctx := context.Background()
+	now := time.Now()
+	a := DBAuthenticator{DB: db}
+	addUsers(t, db, "user1")
+	token, err := GenerateToken(ctx, db, "user1", now.Add(-time.Second), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	filter := AuthFilter{Validator: a, LoginURL: "/login"}.RequireRole("admin")
+	serve := func() int {
+		r := httptest.NewRequest("GET", "/admin", nil)
+		r.AddCookie(&http.Cookie{Name: "auth_token", Value: token.String()})
+		w := httptest.NewRecorder()
+		filter.Handler(func(Token, http.ResponseWriter, *http.Request) {}).ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := serve(); code != http.StatusForbidden {
+		t.Fatalf("without role: expected 403, got %v", code)
+	}
+	if err := GrantRole(ctx, db, "user1", "admin", now); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("with role: expected 200, got %v", code)
+	}
+
+	// The roles found while validating are passed through the wrappers.
+	filter = AuthFilter{Validator: &CircuitBreaker{Validator: &StaleValidator{Validator: a}}, LoginURL: "/login"}.RequireRole("admin")
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("wrapped, with role: expected 200, got %v", code)
+	}
+	if err := RevokeRole(ctx, db, "user1", "admin"); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if code := serve(); code != http.StatusForbidden {
+		t.Fatalf("wrapped, without role: expected 403, got %v", code)
+	}
+
+	// Validators which can't check roles fail closed.
+	filter = AuthFilter{Validator: onlyValidator(token), LoginURL: "/login"}.RequireRole("admin")
+	if code := serve(); code != http.StatusInternalServerError {
+		t.Fatalf("without a RoleChecker: expected 500, got %v", code)
+	}
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The tables and indexes this package keeps, by the names its statements use.
+var tableNames = []string{
+	"AUTH_CODE", "BREAK_GLASS", "CLIENT", "DEVICE_REVOCATION", "FAILED_LOGIN", "GRANT_CODE", "OTP", "PASSWORD_RESET",
+	"PENDING_SIGNUP", "RATE_COUNTER", "REFRESH_TOKEN", "RESET_REQUEST", "RISK_SIGNAL", "ROLE_PERMISSION", "SESSION_DATA",
+	"STASHED_REQUEST", "TOKEN", "USER", "USER_ATTRIBUTE", "USER_EVENT", "USER_NOTE", "USER_ROLE", "USER_TAG",
+	"RESET_REQUEST_CREATED", "USER_EVENT_UID",
+}
+
+// Where the auth tables live, so they can share an application's DB without clashing with its own tables, e.g its USER
+// table. Pass the same Schema to Initialize with WithSchema, to the package's other functions by wrapping the DB with
+// Wrap, and to everything else using the DB: DBAuthenticator, SQLiteStore, Purger, StartReaper, TokenMonitor, Telemetry,
+// SQLCounters, RiskHandler, RiskyRequests and ResetReportHandler. The zero value, or nil, uses the tables as named. Safe
+// for concurrent use, but don't change it once used.
+type Schema struct {
+	// Prepended to every table name, e.g "auth_" keeps users in auth_USER. Letters, digits and underscores only.
+	Prefix string
+	// Renames tables, by the names this package uses, e.g {"USER": "auth_users"}. Renamed tables don't get the Prefix.
+	// Indexes can be renamed too, e.g USER_EVENT_UID. Names are letters, digits and underscores only.
+	Tables map[string]string
+
+	once     sync.Once
+	pattern  *regexp.Regexp
+	err      error
+	rewrites sync.Map
+}
+
+var validPrefix = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Returned by Wrap for a Schema with an invalid prefix or table name.
+var ErrInvalidSchema = errors.New("invalid schema")
+
+// Returns db with the package's statements rewritten to use the schema's tables, or ErrInvalidSchema if the prefix or a
+// table name is invalid.
+func (s *Schema) Wrap(db conn) (conn, error) {
+	if s == nil {
+		return db, nil
+	}
+	s.init()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.wrap(db), nil
+}
+
+// Returns db with the package's statements rewritten to use the schema's tables. Statements on an invalid schema fail
+// with a missing table naming the problem, so the types holding a Schema needn't check it up front.
+func (s *Schema) wrap(db conn) conn {
+	if s == nil || s.Prefix == "" && len(s.Tables) == 0 {
+		return db
+	}
+	return schemaConn{db: db, s: s}
+}
+
+// Checks the names, and compiles the pattern matching table names.
+func (s *Schema) init() {
+	s.once.Do(func() {
+		s.err = s.check()
+		names := append([]string(nil), tableNames...)
+		sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+		alt := strings.Join(names, "|")
+		s.pattern = regexp.MustCompile(`((?i:\b(?:FROM|JOIN|INTO|UPDATE|TABLE|EXISTS|ON|REFERENCES)\s+"?|pragma_table_info\('))(` +
+			alt + `)\b|\b(` + alt + `)("?\.)`)
+	})
+}
+
+func (s *Schema) check() error {
+	if !validPrefix.MatchString(s.Prefix) {
+		return fmt.Errorf("%w: invalid table prefix '%v'", ErrInvalidSchema, s.Prefix)
+	}
+	for table, name := range s.Tables {
+		if !isTableName(table) {
+			return fmt.Errorf("%w: no table named %v to rename", ErrInvalidSchema, table)
+		}
+		if !validTableName.MatchString(name) {
+			return fmt.Errorf("%w: invalid name '%v' for table %v", ErrInvalidSchema, name, table)
+		}
+	}
+	return nil
+}
+
+func isTableName(name string) bool {
+	for _, t := range tableNames {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the name of one of the package's tables in this schema.
+func (s *Schema) table(name string) string {
+	if renamed, ok := s.Tables[name]; ok {
+		return renamed
+	}
+	return s.Prefix + name
+}
+
+// Rewrites the table names in a statement. Table names are only recognized where a table is expected: after FROM, JOIN,
+// INTO, UPDATE, TABLE, EXISTS, ON and REFERENCES, in pragma_table_info, and qualifying a column, so the TOKEN column
+// isn't mistaken for the TOKEN table.
+func (s *Schema) rewrite(query string) string {
+	if q, ok := s.rewrites.Load(query); ok {
+		return q.(string)
+	}
+	s.init()
+	if s.err != nil {
+		// Quoted, so the message can't be taken for SQL.
+		return `SELECT * FROM "` + strings.ReplaceAll("auth: "+s.err.Error(), `"`, `""`) + `";`
+	}
+	q := s.pattern.ReplaceAllStringFunc(query, func(m string) string {
+		sub := s.pattern.FindStringSubmatch(m)
+		if sub[3] != "" {
+			return s.table(sub[3]) + sub[4]
+		}
+		return sub[1] + s.table(sub[2])
+	})
+	s.rewrites.Store(query, q)
+	return q
+}
+
+// Configures the tables Initialize creates.
+type InitializeOption func(s *Schema)
+
+// Creates the tables as laid out by the given Schema, which should then be passed to everything else using the DB.
+func WithSchema(schema *Schema) InitializeOption {
+	return func(s *Schema) {
+		s.Prefix = schema.Prefix
+		s.Tables = schema.Tables
+	}
+}
+
+// Prepends prefix to every table name, see Schema.Prefix.
+func WithTablePrefix(prefix string) InitializeOption {
+	return func(s *Schema) {
+		s.Prefix = prefix
+	}
+}
+
+// Creates one of the package's tables, e.g USER, under another name, see Schema.Tables.
+func WithTableName(table, name string) InitializeOption {
+	return func(s *Schema) {
+		tables := make(map[string]string, len(s.Tables)+1)
+		for k, v := range s.Tables {
+			tables[k] = v
+		}
+		tables[table] = name
+		s.Tables = tables
+	}
+}
+
+type schemaConn struct {
+	db conn
+	s  *Schema
+}
+
+func (c schemaConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return c.db.QueryContext(ctx, c.s.rewrite(query), args...)
+}
+
+func (c schemaConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.db.QueryRowContext(ctx, c.s.rewrite(query), args...)
+}
+
+func (c schemaConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.db.ExecContext(ctx, c.s.rewrite(query), args...)
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchemaRewrite(t *testing.T) {
+	s := &Schema{Prefix: "auth_"}
+	for query, want := range map[string]string{
+		`SELECT TOKEN FROM TOKEN JOIN USER ON TOKEN.UID = USER.ID`:           `SELECT TOKEN FROM auth_TOKEN JOIN auth_USER ON auth_TOKEN.UID = auth_USER.ID`,
+		`INSERT OR REPLACE INTO USER_ROLE (UID) VALUES (?)`:                  `INSERT OR REPLACE INTO auth_USER_ROLE (UID) VALUES (?)`,
+		`CREATE INDEX IF NOT EXISTS USER_EVENT_UID ON USER_EVENT (UID)`:      `CREATE INDEX IF NOT EXISTS auth_USER_EVENT_UID ON auth_USER_EVENT (UID)`,
+		`SELECT COUNT(*) FROM pragma_table_info('TOKEN') WHERE name='TOKEN'`: `SELECT COUNT(*) FROM pragma_table_info('auth_TOKEN') WHERE name='TOKEN'`,
+		`ALTER TABLE TOKEN RENAME COLUMN TOKEN TO TOKEN_HASH`:                `ALTER TABLE auth_TOKEN RENAME COLUMN TOKEN TO TOKEN_HASH`,
+		`UPDATE "USER" SET EMAIL=? WHERE "USER".ID=?`:                        `UPDATE "auth_USER" SET EMAIL=? WHERE "auth_USER".ID=?`,
+	} {
+		if got := s.rewrite(query); got != want {
+			t.Fatalf("rewrite %q:\nexpected %q\ngot      %q", query, want, got)
+		}
+	}
+	s = &Schema{Prefix: "auth_", Tables: map[string]string{"USER": "accounts"}}
+	query := `SELECT EMAIL FROM USER JOIN USER_ROLE ON USER.ID = USER_ROLE.UID`
+	want := `SELECT EMAIL FROM accounts JOIN auth_USER_ROLE ON accounts.ID = auth_USER_ROLE.UID`
+	if got := s.rewrite(query); got != want {
+		t.Fatalf("rewrite %q:\nexpected %q\ngot      %q", query, want, got)
+	}
+}
+
+func TestInitializeOptions(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "app")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	err = Initialize(ctx, db, WithTablePrefix("auth_"), WithTableName("USER", "accounts"))
+	if err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	s := &Schema{Prefix: "auth_", Tables: map[string]string{"USER": "accounts"}}
+	// The same layout, given as a Schema.
+	err = Initialize(ctx, db, WithSchema(s))
+	if err != nil {
+		t.Fatalf("initialize again: %v", err)
+	}
+	a := DBAuthenticator{DB: db, Schema: s}
+	err = a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	tok, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if err := a.Validate(ctx, tok); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	var email string
+	err = db.QueryRowContext(ctx, `SELECT EMAIL FROM accounts`).Scan(&email)
+	if err != nil || email != "a@b.com" {
+		t.Fatalf("expected the user in the renamed table, got %q %v", email, err)
+	}
+	var n int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_schema WHERE type='table' AND name IN ('USER', 'auth_USER', 'TOKEN')`).Scan(&n)
+	if err != nil || n != 0 {
+		t.Fatalf("expected no USER table besides the renamed one, got %v %v", n, err)
+	}
+
+	err = Initialize(ctx, db, WithTableName("USERS", "accounts"))
+	if !errors.Is(err, ErrInvalidSchema) {
+		t.Fatalf("expected renaming an unknown table to fail, got %v", err)
+	}
+	_, err = (&Schema{Prefix: "auth;"}).Wrap(db)
+	if !errors.Is(err, ErrInvalidSchema) {
+		t.Fatalf("expected an invalid prefix to fail, got %v", err)
+	}
+	bad := DBAuthenticator{DB: db, Schema: &Schema{Tables: map[string]string{"USER": "a b"}}}
+	err = bad.Register(ctx, "c@d.com", "pw")
+	if err == nil || !strings.Contains(err.Error(), "invalid name 'a b' for table USER") {
+		t.Fatalf("expected registering under an invalid schema to fail naming the problem, got %v", err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "app")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	// The application's own USER table, which looks nothing like ours.
+	_, err = db.ExecContext(ctx, `CREATE TABLE USER (ID INTEGER PRIMARY KEY, NICKNAME TEXT); INSERT INTO USER (NICKNAME) VALUES ('app');`)
+	if err != nil {
+		t.Fatalf("create app table: %v", err)
+	}
+	s := &Schema{Prefix: "auth_"}
+	for i := 0; i < 2; i++ {
+		err = Initialize(ctx, mustWrap(t, s, db))
+		if err != nil {
+			t.Fatalf("initialize: %v", err)
+		}
+	}
+
+	a := DBAuthenticator{DB: db, Schema: s}
+	err = a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	err = GrantRole(ctx, mustWrap(t, s, db), "a@b.com", "admin", time.Now())
+	if err != nil {
+		t.Fatalf("grant role: %v", err)
+	}
+	tok, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if ok, err := a.HasRole(ctx, tok, "admin"); !ok || err != nil {
+		t.Fatalf("expected the role, got %v %v", ok, err)
+	}
+	refresh, _, err := a.IssueRefresh(ctx, tok)
+	if err != nil {
+		t.Fatalf("issue refresh: %v", err)
+	}
+	session, err := a.Refresh(ctx, refresh)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if err := a.Validate(ctx, session.Access); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	p := &Purger{DB: db, Schema: s}
+	p.PurgeOnce(ctx, time.Now())
+	for class, stats := range p.Stats() {
+		if stats.LastErr != nil {
+			t.Fatalf("purge %v: %v", class, stats.LastErr)
+		}
+	}
+	err = a.DeleteAccount(ctx, session.Access)
+	if err != nil {
+		t.Fatalf("delete account: %v", err)
+	}
+
+	var nickname string
+	err = db.QueryRowContext(ctx, `SELECT NICKNAME FROM USER`).Scan(&nickname)
+	if err != nil || nickname != "app" {
+		t.Fatalf("expected the app's USER table untouched, got %q %v", nickname, err)
+	}
+	var n int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_schema WHERE type='table' AND name IN ('TOKEN', 'USER_ROLE')`).Scan(&n)
+	if err != nil || n != 0 {
+		t.Fatalf("expected no unprefixed auth tables, got %v %v", n, err)
+	}
+}
+
+func mustWrap(t *testing.T, s *Schema, db conn) conn {
+	t.Helper()
+	c, err := s.Wrap(db)
+	if err != nil {
+		t.Fatalf("wrap: %v", err)
+	}
+	return c
+}
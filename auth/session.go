@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Small key/value data attached to a token, so applications can keep per session state such as flash messages server
+// side. Data is tied to the access token: it is dropped when the token is revoked or reaped, and does not carry over to
+// the new token when a session is refreshed.
+
+// Returned when a session has no value for a key.
+var ErrNoSessionValue = errors.New("no session value")
+
+// Stores a value for the given token under key, replacing any earlier value.
+func SetSessionValue(ctx context.Context, db conn, t Token, key string, value []byte) error {
+	hash := sha256.Sum256(t[:])
+	_, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO SESSION_DATA (TOKEN_HASH, KEY, VALUE) VALUES (?, ?, ?);`,
+		hash[:], key, value)
+	if err != nil {
+		return fmt.Errorf("insert session value: %w", err)
+	}
+	return nil
+}
+
+// Returns the value stored for the given token under key, or ErrNoSessionValue.
+func SessionValue(ctx context.Context, db conn, t Token, key string) ([]byte, error) {
+	hash := sha256.Sum256(t[:])
+	row := db.QueryRowContext(ctx, `SELECT VALUE FROM SESSION_DATA WHERE TOKEN_HASH=? AND KEY=?`, hash[:], key)
+	var value []byte
+	err := row.Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoSessionValue
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse session value: %w", err)
+	}
+	return value, nil
+}
+
+// Deletes the value stored for the given token under key. Deleting a missing value is not an error.
+func DeleteSessionValue(ctx context.Context, db conn, t Token, key string) error {
+	hash := sha256.Sum256(t[:])
+	_, err := db.ExecContext(ctx, `DELETE FROM SESSION_DATA WHERE TOKEN_HASH=? AND KEY=?;`, hash[:], key)
+	if err != nil {
+		return fmt.Errorf("delete session value: %w", err)
+	}
+	return nil
+}
+
+// Stores v as JSON for the given token under key.
+func SetSessionJSON(ctx context.Context, db conn, t Token, key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode session value %v: %w", key, err)
+	}
+	return SetSessionValue(ctx, db, t, key, value)
+}
+
+// Decodes the JSON value stored for the given token under key into v. Returns ErrNoSessionValue if there is none.
+func SessionJSON(ctx context.Context, db conn, t Token, key string, v any) error {
+	value, err := SessionValue(ctx, db, t, key)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(value, v)
+	if err != nil {
+		return fmt.Errorf("decode session value %v: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSessionData(t *testing.T) {
+	db := newDB(t, "session")
+	ctx := context.Background()
+	token, err := GenerateToken(ctx, db, "test", time.UnixMilli(0), time.UnixMilli(1000))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	other, err := GenerateToken(ctx, db, "test", time.UnixMilli(0), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	if _, err := SessionValue(ctx, db, token, "theme"); err != ErrNoSessionValue {
+		t.Fatalf("missing value: expected ErrNoSessionValue, got %v", err)
+	}
+	err = SetSessionValue(ctx, db, token, "theme", []byte("dark"))
+	if err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	err = SetSessionValue(ctx, db, token, "theme", []byte("light"))
+	if err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if v, err := SessionValue(ctx, db, token, "theme"); err != nil || string(v) != "light" {
+		t.Fatalf("get: got %q, %v", v, err)
+	}
+	if _, err := SessionValue(ctx, db, other, "theme"); err != ErrNoSessionValue {
+		t.Fatalf("values should be per token, got %v", err)
+	}
+
+	type cart struct{ Items []string }
+	err = SetSessionJSON(ctx, db, token, "cart", cart{Items: []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("set json: %v", err)
+	}
+	var c cart
+	err = SessionJSON(ctx, db, token, "cart", &c)
+	if err != nil || len(c.Items) != 2 {
+		t.Fatalf("get json: got %v, %v", c, err)
+	}
+	err = DeleteSessionValue(ctx, db, token, "cart")
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := SessionJSON(ctx, db, token, "cart", &c); err != ErrNoSessionValue {
+		t.Fatalf("deleted value: expected ErrNoSessionValue, got %v", err)
+	}
+
+	// Data goes with its token.
+	err = SetSessionValue(ctx, db, other, "theme", []byte("dark"))
+	if err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	err = ReapTokens(ctx, db, time.UnixMilli(2000), time.Now())
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if _, err := SessionValue(ctx, db, token, "theme"); err != ErrNoSessionValue {
+		t.Fatalf("reaped token: expected ErrNoSessionValue, got %v", err)
+	}
+	err = RevokeToken(ctx, db, other)
+	if err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := SessionValue(ctx, db, other, "theme"); err != ErrNoSessionValue {
+		t.Fatalf("revoked token: expected ErrNoSessionValue, got %v", err)
+	}
+}
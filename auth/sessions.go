@@ -0,0 +1,421 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lets users see where they are logged in and end sessions they don't recognize. Each token records the IP and user
+// agent it was issued to, see WithClientIP and WithUserAgent, and when it was last used, see LastUsedTracker. Sessions
+// are named by the hash of their token, so they can be listed and revoked without exposing the tokens themselves.
+
+// Returned when a user has no active session with the given ID.
+var ErrNoSession = errors.New("no such session")
+
+// An active log in, as listed on the sessions page.
+type ActiveSession struct {
+	// Names the session for RevokeSession.
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// When the token was last used, to within LastUsedTracker.Interval, or nil if that isn't known.
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Expires  time.Time  `json:"expires"`
+	// The IP and user agent the token was issued to, or "" if unknown.
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// Whether this is the session the list was asked for with.
+	Current bool `json:"current"`
+}
+
+// Returns the ID of the session of the token with the given hash.
+func sessionID(hash []byte) string {
+	return hex.EncodeToString(hash)
+}
+
+// Returns the user's sessions valid at the given time, newest first.
+func ListSessions(ctx context.Context, db conn, uid string, now time.Time) ([]ActiveSession, error) {
+	var sessions []ActiveSession
+	err := queryRows(ctx, db, `SELECT TOKEN_HASH, CREATED_TIME, LAST_USED_TIME, END_TIME, IP, USER_AGENT FROM TOKEN
+JOIN USER ON USER.ID = TOKEN.UID WHERE
+UID=? AND
+START_TIME <= ? AND
+END_TIME >= ? AND
+`+tokenNotSuperseded+`
+ORDER BY CREATED_TIME DESC;`, []any{uid, now.UnixMilli(), now.UnixMilli()}, func(rows *sql.Rows) error {
+		var hash []byte
+		var created, expires int64
+		var lastUsed sql.NullInt64
+		var ip, ua sql.NullString
+		err := rows.Scan(&hash, &created, &lastUsed, &expires, &ip, &ua)
+		if err != nil {
+			return err
+		}
+		s := ActiveSession{
+			ID:        sessionID(hash),
+			Created:   time.UnixMilli(created),
+			Expires:   time.UnixMilli(expires),
+			IP:        ip.String,
+			UserAgent: ua.String,
+		}
+		if lastUsed.Valid {
+			t := time.UnixMilli(lastUsed.Int64)
+			s.LastUsed = &t
+		}
+		sessions = append(sessions, s)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// Revokes one of the user's sessions by its ID, along with the refresh token issued with it. Returns ErrNoSession if
+// the user has no such session. Use a transaction, so the session isn't left half revoked.
+func RevokeSession(ctx context.Context, db conn, uid, id string) error {
+	hash, err := hex.DecodeString(id)
+	if err != nil || len(hash) != sha256.Size {
+		return ErrNoSession
+	}
+	n, err := revokeTokens(ctx, db, `UID=? AND TOKEN_HASH=?`, uid, hash)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoSession
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM REFRESH_TOKEN WHERE UID=? AND ACCESS_HASH=?;`, uid, hash)
+	if err != nil {
+		return fmt.Errorf("delete refresh token: %w", err)
+	}
+	return nil
+}
+
+// Revokes every session of the user, and every refresh token, logging them out everywhere. Use a transaction.
+func RevokeAllSessions(ctx context.Context, db conn, uid string) error {
+	_, err := revokeTokens(ctx, db, `UID=?`, uid)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM REFRESH_TOKEN WHERE UID=?;`, uid)
+	if err != nil {
+		return fmt.Errorf("delete refresh tokens: %w", err)
+	}
+	return nil
+}
+
+// Records that a refresh token was issued alongside an access token, so revoking the access token's session revokes
+// the refresh token too.
+func linkRefreshToken(ctx context.Context, db conn, refresh, access Token) error {
+	refreshHash := sha256.Sum256(refresh[:])
+	accessHash := sha256.Sum256(access[:])
+	_, err := db.ExecContext(ctx, `UPDATE REFRESH_TOKEN SET ACCESS_HASH=?,
+IMPERSONATOR=(SELECT IMPERSONATOR FROM TOKEN WHERE TOKEN_HASH=?) WHERE TOKEN_HASH=?;`, accessHash[:], accessHash[:],
+		refreshHash[:])
+	if err != nil {
+		return fmt.Errorf("link refresh token: %w", err)
+	}
+	return nil
+}
+
+// Records that the tokens were used at now. Tokens whose last use was recorded after since are left alone, so
+// concurrent servers don't all write the same use.
+func TouchTokens(ctx context.Context, db conn, ts []Token, now, since time.Time) error {
+	for start := 0; start < len(ts); start += lookupBatchSize {
+		end := start + lookupBatchSize
+		if end > len(ts) {
+			end = len(ts)
+		}
+		chunk := ts[start:end]
+		args := make([]any, 0, len(chunk)+2)
+		args = append(args, now.UnixMilli(), since.UnixMilli())
+		for _, t := range chunk {
+			hash := sha256.Sum256(t[:])
+			args = append(args, hash[:])
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+		_, err := db.ExecContext(ctx, `UPDATE TOKEN SET LAST_USED_TIME=? WHERE
+(LAST_USED_TIME IS NULL OR LAST_USED_TIME <= ?) AND
+TOKEN_HASH IN (`+placeholders+`);`, args...)
+		if err != nil {
+			return fmt.Errorf("touch tokens: %w", err)
+		}
+	}
+	return nil
+}
+
+// How many tokens a LastUsedTracker remembers before it forgets the ones recorded over an Interval ago.
+const lastUsedEntries = 10000
+
+// Records when tokens are used, for the sessions page. Each token's use is written at most once per Interval, so busy
+// sessions don't write to the DB on every request. Set on DBAuthenticator. Safe for concurrent use.
+type LastUsedTracker struct {
+	// How stale a recorded use may get. Defaults to 5 minutes.
+	Interval time.Duration
+
+	mu      sync.Mutex
+	written map[Token]time.Time
+}
+
+func (l *LastUsedTracker) interval() time.Duration {
+	if l.Interval == 0 {
+		return 5 * time.Minute
+	}
+	return l.Interval
+}
+
+// Returns which of the tokens are due to have their use recorded, and assumes they will be.
+func (l *LastUsedTracker) due(ts []Token, now time.Time) []Token {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	interval := l.interval()
+	if l.written == nil {
+		l.written = make(map[Token]time.Time)
+	}
+	if len(l.written) >= lastUsedEntries {
+		for t, at := range l.written {
+			if now.Sub(at) >= interval {
+				delete(l.written, t)
+			}
+		}
+	}
+	var due []Token
+	for _, t := range ts {
+		if at, ok := l.written[t]; ok && now.Sub(at) < interval {
+			continue
+		}
+		l.written[t] = now
+		due = append(due, t)
+	}
+	return due
+}
+
+// Records the use of the tokens, if due. Failures are only logged, since they shouldn't fail the request.
+func (l *LastUsedTracker) touch(ctx context.Context, db conn, ts []Token, now time.Time) {
+	if l == nil {
+		return
+	}
+	due := l.due(ts, now)
+	if len(due) == 0 {
+		return
+	}
+	err := TouchTokens(ctx, db, due, now, now.Add(-l.interval()))
+	if err != nil {
+		log.Printf("warning: record token use: %v", err)
+	}
+}
+
+// Implemented by Authenticators which can list and end a user's sessions, for the sessions route.
+type SessionManager interface {
+	// Lists the active sessions of the user of a valid access token, newest first, marking its own as Current.
+	Sessions(ctx context.Context, access Token) ([]ActiveSession, error)
+	// Ends one of the sessions of the user of a valid access token, by its ID. Returns ErrNoSession if there is none.
+	RevokeSession(ctx context.Context, access Token, id string) error
+	// Ends every session of the user of a valid access token, including its own.
+	RevokeAllSessions(ctx context.Context, access Token) error
+}
+
+func (d DBAuthenticator) Sessions(ctx context.Context, access Token) ([]ActiveSession, error) {
+	if err := d.requireSQLiteStore(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	uid, err := Lookup(ctx, d.conn(), access, now)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := ListSessions(ctx, d.conn(), uid, now)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(access[:])
+	current := sessionID(hash[:])
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	return sessions, nil
+}
+
+// Ends the session and records it in the user's history.
+func (d DBAuthenticator) RevokeSession(ctx context.Context, access Token, id string) error {
+	if err := d.requireSQLiteStore(); err != nil {
+		return err
+	}
+	return d.revokeSessions(ctx, access, func(db conn, uid string, now time.Time) error {
+		err := RevokeSession(ctx, db, uid, id)
+		if err != nil {
+			return err
+		}
+		return recordUserEvent(ctx, db, uid, SessionRevoked, map[string]string{"session": id, "ip": ClientIP(ctx)}, now)
+	})
+}
+
+// Ends every session and records it in the user's history.
+func (d DBAuthenticator) RevokeAllSessions(ctx context.Context, access Token) error {
+	if err := d.requireSQLiteStore(); err != nil {
+		return err
+	}
+	var revoked string
+	err := d.revokeSessions(ctx, access, func(db conn, uid string, now time.Time) error {
+		revoked = uid
+		err := RevokeAllSessions(ctx, db, uid)
+		if err != nil {
+			return err
+		}
+		return recordUserEvent(ctx, db, uid, SessionsRevoked, map[string]string{"ip": ClientIP(ctx)}, now)
+	})
+	if err != nil {
+		return err
+	}
+	d.revokedUser(revoked)
+	return nil
+}
+
+// Runs revoke in a transaction, for the user of the access token.
+func (d DBAuthenticator) revokeSessions(ctx context.Context, access Token, revoke func(db conn, uid string, now time.Time) error) error {
+	return d.retry(ctx, RetryTokens, func() error {
+		tx, err := d.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		now := time.Now()
+		uid, err := Lookup(ctx, d.wrap(tx), access, now)
+		if err != nil {
+			return err
+		}
+		err = revoke(d.wrap(tx), uid, now)
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
+}
+
+// Returns whether the client asked for JSON rather than a page.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// Serves the logged in user's sessions. GET lists them, as JSON if the client accepts it and otherwise as a page. POST
+// ends the session named by the "session" form value, or every session if "all" is set, responding 204 to JSON clients
+// and otherwise returning to the list. Ending the current session clears its cookies. Only the current token is passed to
+// OnRevoke, since the others are only known by their hashes; ending every session also calls the DBAuthenticator's
+// OnRevokeUser, but a CachedValidator may accept a single other session until its entry expires.
+func (a AuthServer) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sm, ok := a.Authenticator.(SessionManager)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	login := a.link(RouteLogin, url.Values{"redirect": {a.link(RouteSessions, "")}}.Encode())
+	t, err := a.sessionToken(r)
+	if err != nil {
+		a.sessionsUnauthorized(w, r, login)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		sessions, err := sm.Sessions(r.Context(), t)
+		if errors.Is(err, ErrInvalidToken) {
+			a.sessionsUnauthorized(w, r, login)
+			return
+		}
+		if err != nil {
+			a.internalError(w, "sessions: list", err)
+			return
+		}
+		if wantsJSON(r) {
+			if sessions == nil {
+				sessions = []ActiveSession{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(sessions)
+			return
+		}
+		a.render(w, r, http.StatusOK, PageData{Page: "sessions.html", Title: "Your Sessions",
+			Action: a.link(RouteSessions, ""), Sessions: sessions})
+	case "POST":
+		err = r.ParseForm()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("parse form: %v", err), http.StatusBadRequest)
+			return
+		}
+		ctx := withClient(r.Context(), r)
+		hash := sha256.Sum256(t[:])
+		id := r.PostFormValue("session")
+		all := r.PostFormValue("all") != ""
+		switch {
+		case all:
+			err = sm.RevokeAllSessions(ctx, t)
+		case id != "":
+			err = sm.RevokeSession(ctx, t, id)
+		default:
+			http.Error(w, "choose a session to end", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ErrInvalidToken) {
+			a.sessionsUnauthorized(w, r, login)
+			return
+		}
+		if errors.Is(err, ErrNoSession) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			a.internalError(w, "sessions: revoke", err)
+			return
+		}
+		ended := all || id == sessionID(hash[:])
+		if ended {
+			if a.OnRevoke != nil {
+				a.OnRevoke(t)
+			}
+			a.Cookies.clear(w)
+		}
+		if wantsJSON(r) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		redirect := a.link(RouteSessions, "")
+		switch {
+		case all:
+			a.flash(w, "You were logged out everywhere.")
+			redirect = login
+		case ended:
+			redirect = login
+		default:
+			a.flash(w, "The session was ended.")
+		}
+		if redirect == "" {
+			redirect = "/"
+		}
+		http.Redirect(w, r, redirect, http.StatusFound)
+	default:
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+	}
+}
+
+// Sends users who aren't logged in to log in, or tells JSON clients they aren't.
+func (a AuthServer) sessionsUnauthorized(w http.ResponseWriter, r *http.Request, login string) {
+	if wantsJSON(r) || login == "" {
+		http.Error(w, ErrInvalidToken.Error(), http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, login, http.StatusFound)
+}
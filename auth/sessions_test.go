@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	db := newDB(t, "sessions")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db, LastUsed: &LastUsedTracker{}}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	mux := AuthServer{Authenticator: a, IssueRefreshTokens: true}.Handler("/auth")
+	login := func(ip, ua string) (access, refresh *http.Cookie) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(url.Values{"email": {"a@b.com"}, "password": {"pw"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("User-Agent", ua)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		access, refresh = responseCookie(w, "auth_token"), responseCookie(w, "auth_refresh")
+		if access == nil || refresh == nil {
+			t.Fatalf("expected to be logged in, got %v %v", w.Code, w.Header()["Set-Cookie"])
+		}
+		return access, refresh
+	}
+	serve := func(method string, access *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/auth/sessions", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept", "application/json")
+		if access != nil {
+			r.AddCookie(access)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	list := func(access *http.Cookie) []ActiveSession {
+		t.Helper()
+		w := serve("GET", access, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list sessions: expected 200, got %v: %v", w.Code, w.Body)
+		}
+		var sessions []ActiveSession
+		err := json.NewDecoder(w.Body).Decode(&sessions)
+		if err != nil {
+			t.Fatalf("decode sessions: %v", err)
+		}
+		return sessions
+	}
+	token := func(c *http.Cookie) Token {
+		t.Helper()
+		var tok Token
+		if err := tok.UnmarshalText([]byte(c.Value)); err != nil {
+			t.Fatalf("parse token: %v", err)
+		}
+		return tok
+	}
+
+	laptop, _ := login("10.0.0.1", "Laptop")
+	phone, phoneRefresh := login("10.0.0.2", "Phone")
+	if w := serve("GET", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected JSON clients without a session to get 401, got %v", w.Code)
+	}
+	sessions := list(laptop)
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+	if s := sessions[0]; s.IP != "10.0.0.2" || s.UserAgent != "Phone" || s.Current {
+		t.Fatalf("expected the phone's session first, got %+v", s)
+	}
+	if s := sessions[1]; s.IP != "10.0.0.1" || s.UserAgent != "Laptop" || !s.Current {
+		t.Fatalf("expected the laptop's session to be current, got %+v", s)
+	}
+	// Listing validated neither token.
+	if sessions[0].LastUsed != nil {
+		t.Fatalf("expected the phone's session not to be used yet, got %v", sessions[0].LastUsed)
+	}
+	if err := a.Validate(ctx, token(phone)); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if s := list(laptop)[0]; s.LastUsed == nil || time.Since(*s.LastUsed) > time.Minute {
+		t.Fatalf("expected the phone's use to be recorded, got %+v", s)
+	}
+
+	// The page lists them too.
+	r := httptest.NewRequest("GET", "/auth/sessions", nil)
+	r.AddCookie(laptop)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Phone") || !strings.Contains(w.Body.String(), "this session") {
+		t.Fatalf("expected the sessions page, got %v: %v", w.Code, w.Body)
+	}
+
+	if w := serve("POST", laptop, url.Values{"session": {"nope"}}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown session to be refused, got %v", w.Code)
+	}
+	if w := serve("POST", laptop, url.Values{"session": {sessions[0].ID}}); w.Code != http.StatusNoContent {
+		t.Fatalf("end the phone's session: expected 204, got %v: %v", w.Code, w.Body)
+	}
+	if err := a.Validate(ctx, token(phone)); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected the phone's token to be revoked, got %v", err)
+	}
+	if _, err := a.Refresh(ctx, token(phoneRefresh)); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected the phone's refresh token to be revoked with it, got %v", err)
+	}
+	if err := a.Validate(ctx, token(laptop)); err != nil {
+		t.Fatalf("expected the laptop to stay logged in, got %v", err)
+	}
+
+	// Sessions started by refreshing are linked to their refresh token too.
+	_, tabletRefresh := login("10.0.0.3", "Tablet")
+	s, err := a.Refresh(ctx, token(tabletRefresh))
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	hash := sha256.Sum256(s.Access[:])
+	err = a.RevokeSession(ctx, token(laptop), sessionID(hash[:]))
+	if err != nil {
+		t.Fatalf("revoke refreshed session: %v", err)
+	}
+	if _, err := a.Refresh(ctx, s.Refresh); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected the refreshed session's refresh token to be revoked, got %v", err)
+	}
+
+	w = serve("POST", laptop, url.Values{"all": {"1"}})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("log out everywhere: expected 204, got %v: %v", w.Code, w.Body)
+	}
+	if c := responseCookie(w, "auth_token"); c == nil || c.MaxAge >= 0 {
+		t.Fatalf("expected the token cookie to be cleared, got %v", c)
+	}
+	if err := a.Validate(ctx, token(laptop)); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected the laptop to be logged out, got %v", err)
+	}
+	uid, err := LookupByEmail(ctx, db, "a@b.com")
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	events, err := UserEvents(ctx, db, uid)
+	if err != nil {
+		t.Fatalf("events: %v", err)
+	}
+	if last := events[len(events)-1]; last.Kind != SessionsRevoked || last.Data["ip"] != "192.0.2.1" {
+		t.Fatalf("expected logging out everywhere to be recorded, got %+v", last)
+	}
+}
+
+func TestLastUsedTrackerThrottles(t *testing.T) {
+	var l LastUsedTracker
+	now := time.Now()
+	a, b := Token{1}, Token{2}
+	if due := l.due([]Token{a}, now); len(due) != 1 {
+		t.Fatalf("expected the first use to be due, got %v", due)
+	}
+	if due := l.due([]Token{a, b}, now.Add(time.Minute)); len(due) != 1 || due[0] != b {
+		t.Fatalf("expected only the new token to be due, got %v", due)
+	}
+	if due := l.due([]Token{a}, now.Add(6*time.Minute)); len(due) != 1 {
+		t.Fatalf("expected a use after the interval to be due, got %v", due)
+	}
+}
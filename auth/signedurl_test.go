@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedURL(t *testing.T) {
+	s := URLSigner{Key: []byte("0123456789abcdef0123456789abcdef")}
+	signed, err := s.SignURL("/files/report.pdf?inline=1", "user1", time.Minute)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	var got string
+	h := s.Handler(func(uid string, w http.ResponseWriter, r *http.Request) { got = uid })
+	get := func(target string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Code
+	}
+	if code := get(signed); code != http.StatusOK || got != "user1" {
+		t.Fatalf("valid url: got %v for '%v'", code, got)
+	}
+	for name, target := range map[string]string{
+		"other path":  strings.Replace(signed, "report.pdf", "secret.pdf", 1),
+		"other user":  strings.Replace(signed, "auth_uid=user1", "auth_uid=user2", 1),
+		"other query": strings.Replace(signed, "inline=1", "inline=0", 1),
+		"unsigned":    "/files/report.pdf?auth_uid=user1",
+	} {
+		if code := get(target); code != http.StatusForbidden {
+			t.Fatalf("%v: expected 403, got %v", name, code)
+		}
+	}
+	r := httptest.NewRequest("GET", signed, nil)
+	if _, err := s.Verify(r, time.Now().Add(2*time.Minute)); err != ErrInvalidSignedURL {
+		t.Fatalf("expired: expected ErrInvalidSignedURL, got %v", err)
+	}
+	if _, err := (URLSigner{Key: []byte("other")}).Verify(r, time.Now()); err != ErrInvalidSignedURL {
+		t.Fatalf("other key: expected ErrInvalidSignedURL, got %v", err)
+	}
+}
@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The targets an auth endpoint is held to. The zero value uses the defaults.
+type Objective struct {
+	// Fraction of requests which must not fail with a 5xx. Defaults to 0.999.
+	Availability float64
+	// Requests taking longer than this count against the latency objective. Defaults to 500ms.
+	Latency time.Duration
+	// Fraction of requests which must finish within Latency. Defaults to 0.99.
+	LatencyTarget float64
+}
+
+func (o Objective) availability() float64 {
+	if o.Availability == 0 {
+		return 0.999
+	}
+	return o.Availability
+}
+
+func (o Objective) latency() time.Duration {
+	if o.Latency == 0 {
+		return 500 * time.Millisecond
+	}
+	return o.Latency
+}
+
+func (o Objective) latencyTarget() float64 {
+	if o.LatencyTarget == 0 {
+		return 0.99
+	}
+	return o.LatencyTarget
+}
+
+// Upper bounds of the latency histogram buckets. Slower requests land in a final, unbounded bucket.
+var latencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// The windows burn rates are reported over: the short and long windows of the usual multiwindow burn-rate alerts.
+var BurnWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+// How many minutes of counts are kept, enough for the longest burn window.
+const sloMinutes = 6 * 60
+
+// Measures availability and latency of each auth endpoint against its Objective, and how fast each is burning its error
+// budget, so operators can alert on SLOs without instrumenting the server themselves. Wrap handlers with Track, or set
+// AuthServer.SLO, and read the results from Report or MetricsHandler. Safe for concurrent use.
+type SLOTracker struct {
+	// Objectives by route name, e.g RouteLogin. Other routes use Default.
+	Objectives map[string]Objective
+	Default    Objective
+
+	mu     sync.Mutex
+	routes map[string]*sloRoute
+}
+
+type sloRoute struct {
+	// Cumulative since the tracker started, like a Prometheus histogram.
+	buckets  []int64
+	sum      time.Duration
+	requests int64
+	errors   int64
+	slow     int64
+	// A ring of per minute counts, indexed by unix minute.
+	minutes [sloMinutes]sloMinute
+}
+
+type sloMinute struct {
+	minute   int64
+	requests int64
+	errors   int64
+	slow     int64
+}
+
+func (t *SLOTracker) objective(route string) Objective {
+	if o, ok := t.Objectives[route]; ok {
+		return o
+	}
+	return t.Default
+}
+
+// Counts a request to the route. Responses with a 5xx status count against availability, and those slower than the
+// route's Objective.Latency against latency.
+func (t *SLOTracker) Record(route string, status int, latency time.Duration, now time.Time) {
+	failed := status >= 500
+	slow := latency > t.objective(route).latency()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.routes == nil {
+		t.routes = make(map[string]*sloRoute)
+	}
+	r, ok := t.routes[route]
+	if !ok {
+		r = &sloRoute{buckets: make([]int64, len(latencyBuckets)+1)}
+		t.routes[route] = r
+	}
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return latency <= latencyBuckets[i] })
+	r.buckets[i]++
+	r.sum += latency
+	minute := now.Unix() / 60
+	m := &r.minutes[minute%sloMinutes]
+	if m.minute != minute {
+		*m = sloMinute{minute: minute}
+	}
+	r.requests++
+	m.requests++
+	if failed {
+		r.errors++
+		m.errors++
+	}
+	if slow {
+		r.slow++
+		m.slow++
+	}
+}
+
+// Wraps a handler so its requests are recorded against the route.
+func (t *SLOTracker) Track(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		end := time.Now()
+		t.Record(route, sw.status, end.Sub(start), end)
+	})
+}
+
+// Remembers the status code a handler responds with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.status = code
+		w.wrote = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flushes the underlying writer if it can, so streaming handlers still stream when tracked.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wrote = true
+		f.Flush()
+	}
+}
+
+// Returns the underlying writer, for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// The service level indicators of one route.
+type SLIReport struct {
+	Route     string
+	Objective Objective
+	// Counts since the tracker started.
+	Requests int64
+	Errors   int64
+	Slow     int64
+	// Fractions of requests which succeeded and were fast enough, since the tracker started. 1 if there were none.
+	Availability float64
+	Fast         float64
+	// Request counts by latency, one per latencyBuckets bound plus a final count of slower requests. Not cumulative.
+	Histogram  []int64
+	LatencySum time.Duration
+	BurnRates  []BurnRate
+}
+
+// How fast a route is spending its error budgets over a window. A rate of 1 spends the budget exactly over the
+// objective's period; the usual page-worthy thresholds are 14.4 over 1 hour and 6 over 6 hours. An objective of 1 has no
+// budget, so any bad request burns it at +Inf.
+type BurnRate struct {
+	Window       time.Duration
+	Requests     int64
+	Availability float64
+	Latency      float64
+}
+
+// Returns the indicators of every route seen so far, sorted by route.
+func (t *SLOTracker) Report(now time.Time) []SLIReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var reports []SLIReport
+	for route, r := range t.routes {
+		o := t.objective(route)
+		rep := SLIReport{
+			Route:        route,
+			Objective:    Objective{Availability: o.availability(), Latency: o.latency(), LatencyTarget: o.latencyTarget()},
+			Requests:     r.requests,
+			Errors:       r.errors,
+			Slow:         r.slow,
+			Availability: 1 - ratio(r.errors, r.requests),
+			Fast:         1 - ratio(r.slow, r.requests),
+			Histogram:    append([]int64(nil), r.buckets[:]...),
+			LatencySum:   r.sum,
+		}
+		minute := now.Unix() / 60
+		for _, window := range BurnWindows {
+			var requests, errors, slow int64
+			since := minute - int64(window/time.Minute)
+			for _, m := range r.minutes {
+				if m.minute > since && m.minute <= minute {
+					requests += m.requests
+					errors += m.errors
+					slow += m.slow
+				}
+			}
+			rep.BurnRates = append(rep.BurnRates, BurnRate{
+				Window:       window,
+				Requests:     requests,
+				Availability: burnRate(errors, requests, rep.Objective.Availability),
+				Latency:      burnRate(slow, requests, rep.Objective.LatencyTarget),
+			})
+		}
+		reports = append(reports, rep)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Route < reports[j].Route })
+	return reports
+}
+
+// Returns how many times faster than the target allows bad requests are happening. A target of 1 leaves no budget, so
+// the rate is 0 if there were no bad requests and +Inf otherwise.
+func burnRate(bad, of int64, target float64) float64 {
+	if target >= 1 {
+		if bad == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return ratio(bad, of) / (1 - target)
+}
+
+func ratio(n, of int64) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) / float64(of)
+}
+
+// Serves the report in the Prometheus text format, to requests bearing the secret as a bearer token.
+func (t *SLOTracker) MetricsHandler(secret string) http.Handler {
+	return MetricsHandler(secret, t)
+}
+
+// Writes the report in the Prometheus text format.
+func (t *SLOTracker) WriteMetrics(w io.Writer, now time.Time) {
+	io.WriteString(w, t.metrics(now))
+}
+
+// Anything which reports metrics in the Prometheus text format, e.g SLOTracker or TokenMonitor.
+type MetricsSource interface {
+	WriteMetrics(w io.Writer, now time.Time)
+}
+
+// Serves the metrics of every source in the Prometheus text format, to requests bearing the secret as a bearer token.
+func MetricsHandler(secret string, sources ...MetricsSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkBearer(w, r, secret) {
+			return
+		}
+		if r.Method != "GET" {
+			http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		now := time.Now()
+		for _, s := range sources {
+			s.WriteMetrics(w, now)
+		}
+	})
+}
+
+func (t *SLOTracker) metrics(now time.Time) string {
+	reports := t.Report(now)
+	var b strings.Builder
+	family := func(name, kind, help string, each func(rep SLIReport)) {
+		fmt.Fprintf(&b, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+		for _, rep := range reports {
+			each(rep)
+		}
+	}
+	family("auth_requests_total", "counter", "Requests to auth endpoints.", func(rep SLIReport) {
+		fmt.Fprintf(&b, "auth_requests_total{route=%q} %v\n", rep.Route, rep.Requests)
+	})
+	family("auth_request_errors_total", "counter", "Requests to auth endpoints which failed with a 5xx.", func(rep SLIReport) {
+		fmt.Fprintf(&b, "auth_request_errors_total{route=%q} %v\n", rep.Route, rep.Errors)
+	})
+	family("auth_request_duration_seconds", "histogram", "Latency of requests to auth endpoints.", func(rep SLIReport) {
+		var cumulative int64
+		for i, n := range rep.Histogram {
+			cumulative += n
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = fmt.Sprint(latencyBuckets[i].Seconds())
+			}
+			fmt.Fprintf(&b, "auth_request_duration_seconds_bucket{route=%q,le=%q} %v\n", rep.Route, le, cumulative)
+		}
+		fmt.Fprintf(&b, "auth_request_duration_seconds_sum{route=%q} %v\n", rep.Route, rep.LatencySum.Seconds())
+		fmt.Fprintf(&b, "auth_request_duration_seconds_count{route=%q} %v\n", rep.Route, rep.Requests)
+	})
+	family("auth_slo_objective", "gauge", "Target fraction of good requests, by SLI.", func(rep SLIReport) {
+		fmt.Fprintf(&b, "auth_slo_objective{route=%q,sli=\"availability\"} %v\n", rep.Route, rep.Objective.Availability)
+		fmt.Fprintf(&b, "auth_slo_objective{route=%q,sli=\"latency\"} %v\n", rep.Route, rep.Objective.LatencyTarget)
+	})
+	family("auth_slo_latency_threshold_seconds", "gauge", "Requests slower than this count against the latency SLO.", func(rep SLIReport) {
+		fmt.Fprintf(&b, "auth_slo_latency_threshold_seconds{route=%q} %v\n", rep.Route, rep.Objective.Latency.Seconds())
+	})
+	family("auth_slo_burn_rate", "gauge", "How fast the error budget is being spent over the window, by SLI. 1 spends it exactly.", func(rep SLIReport) {
+		for _, burn := range rep.BurnRates {
+			window := fmt.Sprintf("%vm", int(burn.Window/time.Minute))
+			if burn.Window%time.Hour == 0 {
+				window = fmt.Sprintf("%vh", int(burn.Window/time.Hour))
+			}
+			fmt.Fprintf(&b, "auth_slo_burn_rate{route=%q,sli=\"availability\",window=%q} %v\n", rep.Route, window, burn.Availability)
+			fmt.Fprintf(&b, "auth_slo_burn_rate{route=%q,sli=\"latency\",window=%q} %v\n", rep.Route, window, burn.Latency)
+		}
+	})
+	return b.String()
+}
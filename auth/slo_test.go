@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLOTrackerReport(t *testing.T) {
+	s := &SLOTracker{Objectives: map[string]Objective{RouteLogin: {Availability: 0.75, Latency: 100 * time.Millisecond, LatencyTarget: 0.5}}}
+	now := time.Unix(1000000*60, 0)
+	for i := 0; i < 8; i++ {
+		s.Record(RouteLogin, http.StatusOK, 20*time.Millisecond, now.Add(-2*time.Hour))
+	}
+	s.Record(RouteLogin, http.StatusInternalServerError, 20*time.Millisecond, now)
+	s.Record(RouteLogin, http.StatusOK, 300*time.Millisecond, now)
+	s.Record(RouteSignup, http.StatusBadRequest, time.Minute, now)
+
+	reports := s.Report(now)
+	if len(reports) != 2 || reports[0].Route != RouteLogin || reports[1].Route != RouteSignup {
+		t.Fatalf("expected login and signup reports, got %+v", reports)
+	}
+	login := reports[0]
+	if login.Requests != 10 || login.Errors != 1 || login.Slow != 1 || login.Availability != 0.9 || login.Fast != 0.9 {
+		t.Fatalf("unexpected totals: %+v", login)
+	}
+	if login.Histogram[2] != 9 || login.Histogram[6] != 1 {
+		t.Fatalf("unexpected histogram: %v", login.Histogram)
+	}
+	// In the last hour, 1 of 2 requests failed against a 25% budget, and 1 of 2 was slow against a 50% budget.
+	hour := login.BurnRates[2]
+	if hour.Window != time.Hour || hour.Requests != 2 || hour.Availability != 2 || hour.Latency != 1 {
+		t.Fatalf("unexpected hourly burn rate: %+v", hour)
+	}
+	if six := login.BurnRates[3]; six.Requests != 10 {
+		t.Fatalf("expected all requests in the 6 hour window, got %+v", six)
+	}
+
+	// Client errors don't count against availability, and the default objective applies.
+	signup := reports[1]
+	if signup.Errors != 0 || signup.Slow != 1 || signup.Objective.Availability != 0.999 || signup.Histogram[len(latencyBuckets)] != 1 {
+		t.Fatalf("unexpected signup report: %+v", signup)
+	}
+}
+
+func TestSLOTrackerMount(t *testing.T) {
+	s := &SLOTracker{}
+	mux := AuthServer{Authenticator: DBAuthenticator{DB: newDB(t, "slo")}, SLO: s}.Handler("/auth")
+	for _, method := range []string{"GET", "PUT"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, "/auth/login", nil))
+	}
+	reports := s.Report(time.Now())
+	if len(reports) != 1 || reports[0].Route != RouteLogin || reports[0].Requests != 2 || reports[0].Errors != 0 {
+		t.Fatalf("expected two good login requests, got %+v", reports)
+	}
+
+	metrics := s.MetricsHandler("secret")
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the secret, got %v", w.Code)
+	}
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	metrics.ServeHTTP(w, r)
+	for _, want := range []string{
+		`auth_requests_total{route="login"} 2`,
+		`auth_request_duration_seconds_bucket{route="login",le="+Inf"} 2`,
+		`auth_slo_objective{route="login",sli="availability"} 0.999`,
+		`auth_slo_burn_rate{route="login",sli="availability",window="30m"} 0`,
+		`auth_slo_burn_rate{route="login",sli="latency",window="6h"} 0`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("expected %q in metrics, got:\n%v", want, w.Body)
+		}
+	}
+}
+
+func TestSLOTrackerPerfectObjective(t *testing.T) {
+	s := &SLOTracker{Default: Objective{Availability: 1, LatencyTarget: 1}}
+	now := time.Unix(1000000*60, 0)
+	s.Record(RouteLogin, http.StatusOK, time.Millisecond, now)
+	s.Record(RouteSignup, http.StatusInternalServerError, time.Millisecond, now)
+	reports := s.Report(now)
+	if burn := reports[0].BurnRates[0]; burn.Availability != 0 || burn.Latency != 0 {
+		t.Fatalf("expected no burn without failures, got %+v", burn)
+	}
+	if burn := reports[1].BurnRates[0]; !math.IsInf(burn.Availability, 1) || burn.Latency != 0 {
+		t.Fatalf("expected an infinite availability burn, got %+v", burn)
+	}
+}
+
+func TestSLOTrackerFlush(t *testing.T) {
+	s := &SLOTracker{}
+	h := s.Track(RouteLogin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !w.Flushed {
+		t.Fatalf("expected the flush to reach the underlying writer")
+	}
+}
@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Implemented by Authenticators which can log in users vouched for by an identity provider, see SSO.
+type FederatedAuthenticator interface {
+	// Issues a token for the user with the identity's email. New users are created without a password, following the
+	// Provisioning rules, or refused with ErrNotProvisioned.
+	FederatedLogin(ctx context.Context, id FederatedIdentity, p Provisioning) (Token, time.Time, error)
+}
+
+// Federates every log in to an upstream OpenID Connect identity provider, e.g a corporate IdP. When set on an AuthServer,
+// there is no local password authentication at all: the log in page is a single button, the sign up and password reset
+// pages are disabled, and local users exist only to own tokens and roles. Users are matched by their verified email.
+// Requires an Authenticator implementing FederatedAuthenticator.
+type SSO struct {
+	// The identity provider, from oidc.NewProvider.
+	Provider *oidc.Provider
+	// The client registered with the identity provider.
+	ClientID     string
+	ClientSecret string
+	// The full URL of the SSO route, where the identity provider sends users back, e.g "https://example.com/auth/sso".
+	RedirectURL string
+	// Scopes requested besides "openid" and "email".
+	Scopes []string
+	// Text of the log in button. Defaults to "Continue with SSO".
+	Label string
+	// How users logging in for the first time are created.
+	Provisioning Provisioning
+}
+
+func (s *SSO) config() oauth2.Config {
+	return oauth2.Config{
+		ClientID:     s.ClientID,
+		ClientSecret: s.ClientSecret,
+		Endpoint:     s.Provider.Endpoint(),
+		RedirectURL:  s.RedirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID, "email"}, s.Scopes...),
+	}
+}
+
+func (s *SSO) label() string {
+	if s.Label == "" {
+		return "Continue with SSO"
+	}
+	return s.Label
+}
+
+// Checks the ID token in a token response against the nonce, and returns the identity it vouches for, which must have a
+// verified email.
+func (s *SSO) verify(ctx context.Context, tok *oauth2.Token, nonce string) (FederatedIdentity, error) {
+	var id FederatedIdentity
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return id, fmt.Errorf("no id_token in token response")
+	}
+	idToken, err := s.Provider.Verifier(&oidc.Config{ClientID: s.ClientID}).Verify(ctx, raw)
+	if err != nil {
+		return id, fmt.Errorf("verify id token: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return id, fmt.Errorf("id token nonce mismatch")
+	}
+	err = idToken.Claims(&id.Claims)
+	if err != nil {
+		return id, fmt.Errorf("parse claims: %w", err)
+	}
+	id.Email, _ = id.Claims["email"].(string)
+	if verified, _ := id.Claims["email_verified"].(bool); id.Email == "" || !verified {
+		return id, fmt.Errorf("identity provider did not vouch for an email address")
+	}
+	return id, nil
+}
+
+// Renders the SSO log in page, a single button.
+func (a AuthServer) ssoLoginPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "password log in is disabled, log in with SSO", http.StatusBadRequest)
+		return
+	}
+	a.render(w, r, http.StatusOK, PageData{Page: "sso.html", Title: "Login", Action: a.link(RouteSSO, r.URL.RawQuery),
+		SSOLabel: a.SSO.label()})
+}
+
+// Returns the identity provider for a realm, the email domain of a user logging in, or nil if there is none.
+func (a AuthServer) ssoFor(realm string) *SSO {
+	if a.SSO != nil {
+		return a.SSO
+	}
+	return a.Realms[realm]
+}
+
+// Sends the user to the identity provider, or, when they come back with a code, logs them in. Unless every log in goes
+// through SSO, the realm parameter picks the provider, see AuthServer.Realms.
+func (a AuthServer) ssoHandler(w http.ResponseWriter, r *http.Request) {
+	if a.SSO == nil && len(a.Realms) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("invalid method: %v", r.Method), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("state") != "" {
+		a.ssoCallback(w, r)
+		return
+	}
+	realm := r.URL.Query().Get("realm")
+	sso := a.ssoFor(realm)
+	if sso == nil {
+		http.Error(w, fmt.Sprintf("sso: unknown realm '%v'", realm), http.StatusNotFound)
+		return
+	}
+	var opts []oauth2.AuthCodeOption
+	if hint := r.URL.Query().Get("login_hint"); hint != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", hint))
+	}
+	a.beginFederated(w, r, RouteSSO, realm, sso.config(), opts...)
+}
+
+func (a AuthServer) ssoCallback(w http.ResponseWriter, r *http.Request) {
+	attempt, ok := a.federatedCallback(w, r, RouteSSO)
+	if !ok {
+		return
+	}
+	realm := attempt.key
+	sso := a.ssoFor(realm)
+	if sso == nil {
+		http.Error(w, "sso: unknown or expired log in attempt, please try again", http.StatusBadRequest)
+		return
+	}
+	config := sso.config()
+	tok, ok := a.exchangeCode(w, r, RouteSSO, config, attempt.verifier)
+	if !ok {
+		return
+	}
+	id, err := sso.verify(r.Context(), tok, attempt.nonce)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("sso: %v", err), http.StatusUnauthorized)
+		return
+	}
+	// A realm's provider may only vouch for its own domain, or it could log in as anyone.
+	if domain, _ := emailDomain(id.Email); a.SSO == nil && domain != realm {
+		http.Error(w, fmt.Sprintf("sso: identity provider for %v vouched for %v", realm, id.Email), http.StatusUnauthorized)
+		return
+	}
+	a.federatedLogin(w, r, RouteSSO, id, sso.Provisioning, attempt.query)
+}
+
+// A log in at an upstream provider, kept in a short lived cookie while the user is away, so the callback can be tied to
+// this browser and finish the log in as the log in page's query asked.
+type federatedAttempt struct {
+	nonce, verifier string
+	query           url.Values
+	// Which provider the attempt is for, e.g a realm.
+	key string
+}
+
+// Sends the user to an upstream provider to log in, remembering the attempt in a cookie scoped to the route.
+func (a AuthServer) beginFederated(w http.ResponseWriter, r *http.Request, route, key string, config oauth2.Config,
+	opts ...oauth2.AuthCodeOption) {
+	var parts []string
+	for i := 0; i < 3; i++ {
+		t, err := newToken()
+		if err != nil {
+			a.internalError(w, route+": start log in", err)
+			return
+		}
+		parts = append(parts, t.String())
+	}
+	state, nonce, verifier := parts[0], parts[1], parts[2]
+	value := strings.Join(append(parts, base64.RawURLEncoding.EncodeToString([]byte(r.URL.RawQuery)),
+		base64.RawURLEncoding.EncodeToString([]byte(key))), ".")
+	http.SetCookie(w, a.Cookies.stateCookie("auth_"+route, value, a.link(route, ""), 600))
+	opts = append(opts, oidc.Nonce(nonce),
+		oauth2.SetAuthURLParam("code_challenge", CodeChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	http.Redirect(w, r, config.AuthCodeURL(state, opts...), http.StatusFound)
+}
+
+// Reads back and clears the attempt the provider is returning from. Responds with an error and returns false if there
+// is no such attempt in this browser, or the provider refused.
+func (a AuthServer) federatedCallback(w http.ResponseWriter, r *http.Request, route string) (federatedAttempt, bool) {
+	var attempt federatedAttempt
+	q := r.URL.Query()
+	c, err := r.Cookie("auth_" + route)
+	var parts []string
+	if err == nil {
+		parts = strings.Split(c.Value, ".")
+	}
+	if len(parts) != 5 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(q.Get("state"))) != 1 {
+		http.Error(w, fmt.Sprintf("%v: unknown or expired log in attempt, please try again", route), http.StatusBadRequest)
+		return attempt, false
+	}
+	http.SetCookie(w, a.Cookies.stateCookie("auth_"+route, "", a.link(route, ""), -1))
+	attempt.nonce, attempt.verifier = parts[1], parts[2]
+	rawQuery, err := base64.RawURLEncoding.DecodeString(parts[3])
+	var key []byte
+	if err == nil {
+		key, err = base64.RawURLEncoding.DecodeString(parts[4])
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v: unknown or expired log in attempt, please try again", route), http.StatusBadRequest)
+		return attempt, false
+	}
+	attempt.query, _ = url.ParseQuery(string(rawQuery))
+	attempt.key = string(key)
+	if e := q.Get("error"); e != "" {
+		http.Error(w, fmt.Sprintf("%v: identity provider refused: %v %v", route, e, q.Get("error_description")), http.StatusUnauthorized)
+		return attempt, false
+	}
+	return attempt, true
+}
+
+// Exchanges the callback's code with the provider. Responds with an error and returns false if that fails.
+func (a AuthServer) exchangeCode(w http.ResponseWriter, r *http.Request, route string, config oauth2.Config, verifier string) (*oauth2.Token, bool) {
+	tok, err := config.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		var re *oauth2.RetrieveError
+		if errors.As(err, &re) {
+			http.Error(w, fmt.Sprintf("%v: exchange code: %v", route, err), http.StatusUnauthorized)
+			return nil, false
+		}
+		a.internalError(w, route+": exchange code", err)
+		return nil, false
+	}
+	return tok, true
+}
+
+// Logs in the user a provider vouched for, creating them as provisioned if they are new.
+func (a AuthServer) federatedLogin(w http.ResponseWriter, r *http.Request, route string, id FederatedIdentity, p Provisioning,
+	query url.Values) {
+	fed, ok := a.Authenticator.(FederatedAuthenticator)
+	if !ok {
+		a.internalError(w, route, fmt.Errorf("authenticator %T does not support federated log in", a.Authenticator))
+		return
+	}
+	t, expires, err := fed.FederatedLogin(withClient(r.Context(), r), id, p)
+	if errors.Is(err, ErrNotProvisioned) {
+		http.Error(w, fmt.Sprintf("%v: %v", route, ErrNotProvisioned), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		a.internalError(w, route+": log in", err)
+		return
+	}
+	a.finishLogin(w, r, query, t, expires)
+}
+
+// Refuses the password account pages in SSO mode.
+func ssoOnly(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "password accounts are disabled, log in with SSO", http.StatusNotFound)
+}
@@ -0,0 +1,421 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// A minimal identity provider, which vouches for email for the client "app", with any extra claims.
+func fakeIdP(t *testing.T, email string, extra map[string]any) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	var srv *httptest.Server
+	var nonce, challenge string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                srv.URL,
+			"authorization_endpoint":                srv.URL + "/authorize",
+			"token_endpoint":                        srv.URL + "/token",
+			"jwks_uri":                              srv.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "k1",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		nonce, challenge = q.Get("nonce"), q.Get("code_challenge")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=code1&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "app" || secret != "s3cret" || r.PostFormValue("code") != "code1" || CodeChallenge(r.PostFormValue("code_verifier")) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		challenge = ""
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+		claims := map[string]any{
+			"iss": srv.URL, "sub": "123", "aud": "app", "nonce": nonce,
+			"exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix(),
+			"email": email, "email_verified": true,
+		}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		payload, _ := json.Marshal(claims)
+		signing := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signing))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Errorf("sign: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "at", "token_type": "Bearer", "expires_in": 3600, "id_token": signing + "." + b64(sig),
+		})
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSSOLogin(t *testing.T) {
+	db := newDB(t, "sso")
+	idp := fakeIdP(t, "a@b.com", nil)
+	provider, err := oidc.NewProvider(context.Background(), idp.URL)
+	if err != nil {
+		t.Fatalf("discover provider: %v", err)
+	}
+	a := DBAuthenticator{DB: db}
+	sso := &SSO{Provider: provider, ClientID: "app", ClientSecret: "s3cret", RedirectURL: "https://example.com/auth/sso"}
+	mux := AuthServer{Authenticator: a, SSO: sso}.Handler("/auth")
+	get := func(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/auth/login?redirect=%2Fsecured")
+	if !strings.Contains(w.Body.String(), `href="/auth/sso?redirect=%2Fsecured"`) || strings.Contains(w.Body.String(), "password") {
+		t.Fatalf("expected a single SSO button: %v", w.Body)
+	}
+	form := url.Values{"email": {"a@b.com"}, "password": {"pw"}}
+	r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("password log in: expected 400, got %v", w.Code)
+	}
+	for _, page := range []string{"/auth/signup", "/auth/forgot", "/auth/reset"} {
+		if w := get(page); w.Code != http.StatusNotFound {
+			t.Fatalf("%v: expected 404, got %v", page, w.Code)
+		}
+	}
+
+	// Follow the redirects through the identity provider.
+	w = get("/auth/sso?redirect=%2Fsecured")
+	if w.Code != http.StatusFound {
+		t.Fatalf("start: expected redirect, got %v: %v", w.Code, w.Body)
+	}
+	state := responseCookie(w, "auth_sso")
+	if state == nil || !state.Secure {
+		t.Fatalf("expected a secure state cookie: %v", w.Header())
+	}
+	insecure := httptest.NewRecorder()
+	AuthServer{Authenticator: a, SSO: sso, Cookies: CookieOptions{Insecure: true}}.Handler("/auth").ServeHTTP(insecure,
+		httptest.NewRequest("GET", "/auth/sso", nil))
+	if c := responseCookie(insecure, "auth_sso"); c == nil || c.Secure {
+		t.Fatalf("expected the state cookie to follow CookieOptions.Insecure: %v", insecure.Header())
+	}
+	resp, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}).Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parse callback: %v", err)
+	}
+	if w := get(callback.RequestURI()); w.Code != http.StatusBadRequest {
+		t.Fatalf("callback without the state cookie: expected 400, got %v", w.Code)
+	}
+	w = get(callback.RequestURI(), state)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/secured" {
+		t.Fatalf("callback: expected redirect to /secured, got %v %v: %v", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	var tok Token
+	if c := responseCookie(w, "auth_token"); c == nil || tok.UnmarshalText([]byte(c.Value)) != nil {
+		t.Fatalf("expected a token cookie: %v", w.Header())
+	}
+	uid, err := a.store().LookupToken(context.Background(), tok, time.Now())
+	if err != nil || uid != "a@b.com" {
+		t.Fatalf("expected a token for the new user, got %v %v", uid, err)
+	}
+	// The user has no password to log in with.
+	if err = Authenticate(context.Background(), db, "a@b.com", ""); err != ErrBadCredentials {
+		t.Fatalf("expected bad credentials for an SSO user, got %v", err)
+	}
+	// Users are found by email alone, never by an ID which happens to look like it.
+	err = insertUser(context.Background(), db, "c@b.com", "other@b.com", noPassword, true, time.Now())
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	prefixed := DBAuthenticator{DB: db, IDPrefix: "sso"}
+	tok, _, err = prefixed.FederatedLogin(context.Background(), FederatedIdentity{Email: "c@b.com"}, Provisioning{})
+	if err != nil {
+		t.Fatalf("federated log in: %v", err)
+	}
+	if uid, err := Lookup(context.Background(), db, tok, time.Now()); err != nil || uid == "c@b.com" {
+		t.Fatalf("expected a new user for c@b.com, got %v %v", uid, err)
+	}
+	// The code is single use at the provider.
+	if w := get(callback.RequestURI(), state); w.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed callback: expected 401, got %v", w.Code)
+	}
+}
+
+// Starts an SSO log in at start, follows the identity provider's redirect, and returns the response to the callback.
+func followSSO(t *testing.T, mux http.Handler, start string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", start, nil))
+	state := responseCookie(w, "auth_sso")
+	if w.Code != http.StatusFound || state == nil {
+		t.Fatalf("start: expected redirect with a state cookie, got %v: %v", w.Code, w.Body)
+	}
+	resp, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}).Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parse callback: %v", err)
+	}
+	r := httptest.NewRequest("GET", callback.RequestURI(), nil)
+	r.AddCookie(state)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestHomeRealmDiscovery(t *testing.T) {
+	db := newDB(t, "realms")
+	ctx := context.Background()
+	provider := func(email string) *SSO {
+		p, err := oidc.NewProvider(ctx, fakeIdP(t, email, nil).URL)
+		if err != nil {
+			t.Fatalf("discover provider: %v", err)
+		}
+		return &SSO{Provider: p, ClientID: "app", ClientSecret: "s3cret", RedirectURL: "https://example.com/auth/sso"}
+	}
+	a := DBAuthenticator{DB: db, SSODomains: []string{"acme.com", "evil.com"}}
+	err := a.Register(ctx, "p@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	// Made before the realm was, with a password and an ID which doesn't give away its domain.
+	err = RegisterUserWith(ctx, db, PasswordOptions{}, "user7", "c@acme.com", "pw")
+	if err != nil {
+		t.Fatalf("register realm user: %v", err)
+	}
+	mux := AuthServer{Authenticator: a, Realms: map[string]*SSO{
+		"acme.com": provider("a@acme.com"),
+		// Vouches for an address outside its realm.
+		"evil.com": provider("p@b.com"),
+	}}.Handler("/auth")
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login?redirect=%2Fsecured", nil))
+	if body := w.Body.String(); strings.Contains(body, "password") || !strings.Contains(body, "Continue") {
+		t.Fatalf("expected the log in page to ask only for the email: %v", body)
+	}
+
+	// Other domains are sent on to enter a password.
+	w = post("/auth/login?redirect=%2Fsecured", url.Values{"email": {"p@b.com"}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/auth/login?email=p%40b.com&redirect=%2Fsecured" {
+		t.Fatalf("expected redirect to the password form, got %v %v", w.Code, w.Header().Get("Location"))
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login?email=p%40b.com&redirect=%2Fsecured", nil))
+	if body := w.Body.String(); !strings.Contains(body, `value="p@b.com"`) || !strings.Contains(body, "type=password") {
+		t.Fatalf("expected a password form for p@b.com: %v", body)
+	}
+	w = post("/auth/login?email=p%40b.com&redirect=%2Fsecured", url.Values{"email": {"p@b.com"}, "password": {"pw"}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/secured" {
+		t.Fatalf("password log in: expected redirect to /secured, got %v %v", w.Code, w.Header().Get("Location"))
+	}
+
+	// Realm users can't use passwords.
+	if w := post("/auth/login", url.Values{"email": {"a@ACME.com"}, "password": {"pw"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("password log in for a realm: expected 400, got %v", w.Code)
+	}
+	if w := post("/auth/signup", url.Values{"email": {"b@acme.com"}, "password": {"correct horse battery"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("sign up for a realm: expected 400, got %v", w.Code)
+	}
+	if w := post("/auth/login", url.Values{"email": {"user7"}, "password": {"pw"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("password log in by ID for a realm: expected 400, got %v", w.Code)
+	}
+	if _, _, err := a.Authenticate(ctx, "user7", "pw"); !errors.Is(err, ErrSSORequired) {
+		t.Fatalf("authenticate by ID for a realm: expected ErrSSORequired, got %v", err)
+	}
+
+	w = post("/auth/login?redirect=%2Fsecured", url.Values{"email": {"a@acme.com"}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/auth/sso?login_hint=a%40acme.com&realm=acme.com&redirect=%2Fsecured" {
+		t.Fatalf("expected redirect to the realm's provider, got %v %v", w.Code, w.Header().Get("Location"))
+	}
+	w = followSSO(t, mux, w.Header().Get("Location"))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/secured" {
+		t.Fatalf("sso: expected redirect to /secured, got %v %v: %v", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	if _, err := LookupByEmail(ctx, db, "a@acme.com"); err != nil {
+		t.Fatalf("expected the realm user to be created: %v", err)
+	}
+
+	if w := followSSO(t, mux, "/auth/sso?realm=evil.com"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("provider vouching outside its realm: expected 401, got %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/sso?realm=other.com", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown realm: expected 404, got %v", w.Code)
+	}
+}
+
+func TestProvisioning(t *testing.T) {
+	db := newDB(t, "provision")
+	ctx := context.Background()
+	claims := map[string]any{"name": "Ada", "groups": []string{"eng", "everyone"}}
+	provider, err := oidc.NewProvider(ctx, fakeIdP(t, "a@b.com", claims).URL)
+	if err != nil {
+		t.Fatalf("discover provider: %v", err)
+	}
+	a := DBAuthenticator{DB: db}
+	sso := &SSO{Provider: provider, ClientID: "app", ClientSecret: "s3cret", RedirectURL: "https://example.com/auth/sso",
+		Provisioning: Provisioning{Deny: true}}
+
+	if w := followSSO(t, AuthServer{Authenticator: a, SSO: sso}.Handler("/auth"), "/auth/sso"); w.Code != http.StatusForbidden {
+		t.Fatalf("deny: expected 403 for a user without an account, got %v", w.Code)
+	}
+	if _, err := LookupByEmail(ctx, db, "a@b.com"); err != ErrBadCredentials {
+		t.Fatalf("deny: expected no user to be created, got %v", err)
+	}
+
+	// A user who can't be provisioned isn't created at all.
+	broken := Provisioning{DefaultRoles: []string{"member"}, Attributes: map[string]string{"name": ""}}
+	if _, _, err := a.FederatedLogin(ctx, FederatedIdentity{Email: "a@b.com", Claims: claims}, broken); err == nil {
+		t.Fatal("broken provisioning: expected an error")
+	}
+	if _, err := LookupByEmail(ctx, db, "a@b.com"); err != ErrBadCredentials {
+		t.Fatalf("broken provisioning: expected no user to be created, got %v", err)
+	}
+
+	sso.Provisioning = Provisioning{
+		GroupRoles:   map[string][]string{"eng": {"developer", "member"}, "ops": {"admin"}},
+		DefaultRoles: []string{"member"},
+		Attributes:   map[string]string{"name": "display_name", "missing": "nickname"},
+	}
+	if w := followSSO(t, AuthServer{Authenticator: a, SSO: sso}.Handler("/auth"), "/auth/sso"); w.Code != http.StatusFound {
+		t.Fatalf("provision: expected a log in, got %v: %v", w.Code, w.Body)
+	}
+	roles, err := UserRoles(ctx, db, "a@b.com")
+	if err != nil || strings.Join(roles, ",") != "developer,member" {
+		t.Fatalf("expected roles from groups and defaults, got %v %v", roles, err)
+	}
+	attrs, err := UserAttributes(ctx, db, "a@b.com")
+	if err != nil || len(attrs) != 1 || attrs["display_name"] != "Ada" {
+		t.Fatalf("expected the mapped attributes, got %v %v", attrs, err)
+	}
+
+	// Existing users are let in whatever the rules, and aren't provisioned again.
+	err = RevokeRole(ctx, db, "a@b.com", "developer")
+	if err != nil {
+		t.Fatalf("revoke role: %v", err)
+	}
+	sso.Provisioning.Deny = true
+	if w := followSSO(t, AuthServer{Authenticator: a, SSO: sso}.Handler("/auth"), "/auth/sso"); w.Code != http.StatusFound {
+		t.Fatalf("existing user: expected a log in, got %v: %v", w.Code, w.Body)
+	}
+	if roles, _ := UserRoles(ctx, db, "a@b.com"); strings.Join(roles, ",") != "member" {
+		t.Fatalf("expected roles to be left alone, got %v", roles)
+	}
+}
+
+func TestSyncGroups(t *testing.T) {
+	db := newDB(t, "sync_groups")
+	ctx := context.Background()
+	claims := map[string]any{"groups": "ops"}
+	provider, err := oidc.NewProvider(ctx, fakeIdP(t, "a@b.com", claims).URL)
+	if err != nil {
+		t.Fatalf("discover provider: %v", err)
+	}
+	a := DBAuthenticator{DB: db}
+	err = a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	for _, role := range []string{"admin", "developer", "legacy"} {
+		err = GrantRole(ctx, db, "a@b.com", role, time.Now())
+		if err != nil {
+			t.Fatalf("grant role: %v", err)
+		}
+	}
+	sso := &SSO{Provider: provider, ClientID: "app", ClientSecret: "s3cret", RedirectURL: "https://example.com/auth/sso",
+		Provisioning: Provisioning{
+			GroupRoles:     map[string][]string{"eng": {"developer"}, "ops": {"oncall", "admin"}},
+			DefaultRoles:   []string{"member"},
+			SyncGroups:     true,
+			ProtectedRoles: []string{"admin", "auditor"},
+		}}
+	mux := AuthServer{Authenticator: a, SSO: sso}.Handler("/auth")
+	login := func() []string {
+		if w := followSSO(t, mux, "/auth/sso"); w.Code != http.StatusFound {
+			t.Fatalf("expected a log in, got %v: %v", w.Code, w.Body)
+		}
+		roles, err := UserRoles(ctx, db, "a@b.com")
+		if err != nil {
+			t.Fatalf("user roles: %v", err)
+		}
+		return roles
+	}
+
+	// Roles no group grants, like legacy, and default roles are left alone.
+	if roles := login(); strings.Join(roles, ",") != "admin,legacy,oncall" {
+		t.Fatalf("expected roles synced to the ops group, keeping admin and legacy, got %v", roles)
+	}
+	// Leaving ops at the identity provider takes its roles away, except the protected admin role.
+	claims["groups"] = []string{"eng"}
+	if roles := login(); strings.Join(roles, ",") != "admin,developer,legacy" {
+		t.Fatalf("expected roles synced to the eng group, got %v", roles)
+	}
+	// Without the groups claim, the provider hasn't said which groups the user is in, so nothing changes.
+	delete(claims, "groups")
+	if roles := login(); strings.Join(roles, ",") != "admin,developer,legacy" {
+		t.Fatalf("expected roles left alone without a groups claim, got %v", roles)
+	}
+	// Protected roles aren't granted by groups either.
+	err = RevokeRole(ctx, db, "a@b.com", "admin")
+	if err != nil {
+		t.Fatalf("revoke role: %v", err)
+	}
+	claims["groups"] = []string{"ops"}
+	if roles := login(); strings.Join(roles, ",") != "legacy,oncall" {
+		t.Fatalf("expected the protected admin role not to be granted, got %v", roles)
+	}
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// A Validator wrapper which keeps read traffic alive during brief store outages. Every call still goes to the backing
+// validator, but if it fails with anything other than an invalid token (e.g the DB is unreachable, or a CircuitBreaker is
+// open), tokens which validated successfully within Window are accepted anyway and the error is logged. Safe for
+// concurrent use.
+type StaleValidator struct {
+	Validator
+	// How long after a successful validation a token may still be accepted during an outage.
+	Window time.Duration
+
+	mu        sync.Mutex
+	validated map[Token]staleUser
+	lastSweep time.Time
+}
+
+// When a token last validated, and the user it found, if the backing validator is a UserValidator.
+type staleUser struct {
+	user User
+	at   time.Time
+}
+
+func (s *StaleValidator) Validate(ctx context.Context, t Token) error {
+	_, err := s.ValidateUser(ctx, t)
+	return err
+}
+
+// Validates the token like Validate, returning its user if the backing validator is a UserValidator. During an outage
+// the user found by the last successful validation is returned.
+func (s *StaleValidator) ValidateUser(ctx context.Context, t Token) (User, error) {
+	u, err := validateUser(ctx, s.Validator, t)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.validated == nil {
+		s.validated = make(map[Token]staleUser)
+	}
+	s.sweep(now)
+	if err == nil {
+		s.validated[t] = staleUser{user: u, at: now}
+		return u, nil
+	}
+	if errors.Is(err, ErrInvalidToken) {
+		delete(s.validated, t)
+		return u, err
+	}
+	last, ok := s.validated[t]
+	if !ok || now.Sub(last.at) > s.Window {
+		return u, err
+	}
+	log.Printf("error: accepting token validated %v ago: %v", now.Sub(last.at), err)
+	return last.user, nil
+}
+
+// Drops tokens which are too old to be accepted, at most once per window. Must hold mu.
+func (s *StaleValidator) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.Window {
+		return
+	}
+	s.lastSweep = now
+	for t, last := range s.validated {
+		if now.Sub(last.at) > s.Window {
+			delete(s.validated, t)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStaleValidator(t *testing.T) {
+	ctx := context.Background()
+	store := &stubValidator{}
+	s := &StaleValidator{Validator: store, Window: 20 * time.Millisecond}
+
+	known, revoked := Token{1}, Token{2}
+	for _, token := range []Token{known, revoked} {
+		if err := s.Validate(ctx, token); err != nil {
+			t.Fatalf("validate: %v", err)
+		}
+	}
+	store.err = ErrInvalidToken
+	if err := s.Validate(ctx, revoked); err != ErrInvalidToken {
+		t.Fatalf("expected revoked token to be rejected, got %v", err)
+	}
+
+	// Outage: recently validated tokens are accepted, others are not
+	store.err = ErrCircuitOpen
+	if err := s.Validate(ctx, known); err != nil {
+		t.Fatalf("expected stale acceptance, got %v", err)
+	}
+	if err := s.Validate(ctx, revoked); err != ErrCircuitOpen {
+		t.Fatalf("expected revoked token to stay rejected, got %v", err)
+	}
+	if err := s.Validate(ctx, Token{3}); err != ErrCircuitOpen {
+		t.Fatalf("expected unknown token to be rejected, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := s.Validate(ctx, known); err != ErrCircuitOpen {
+		t.Fatalf("expected token past the window to be rejected, got %v", err)
+	}
+}
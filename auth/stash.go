@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Requests interrupted by a login redirect, e.g a form POST made after the session expired. The request is stashed
+// before redirecting, and handed back to the handler once the user is back with a valid token, so their submission
+// isn't lost. It is never submitted again on its own: any site can send a logged out user's browser to post a form, so
+// the stashed request may not be the user's. Handlers show the form filled in with it, and the user submits it.
+
+// Returned when a stashed request is unknown, already resumed or expired.
+var ErrNoStashedRequest = errors.New("no stashed request")
+
+// A request saved to be handed back after logging in.
+type StashedRequest struct {
+	Method      string
+	URL         string
+	ContentType string
+	Body        []byte
+}
+
+// Saves a request, returning the ID to resume it with. Only a hash of the ID is stored.
+func StashRequest(ctx context.Context, db conn, req StashedRequest, now, expires time.Time) (Token, error) {
+	id, err := newToken()
+	if err != nil {
+		return id, err
+	}
+	idHash := sha256.Sum256(id[:])
+	_, err = db.ExecContext(ctx, `INSERT INTO STASHED_REQUEST (ID_HASH, METHOD, URL, CONTENT_TYPE, BODY, CREATED_TIME, EXPIRES_TIME)
+	VALUES (?, ?, ?, ?, ?, ?, ?);`, idHash[:], req.Method, req.URL, req.ContentType, req.Body, now.UnixMilli(), expires.UnixMilli())
+	if err != nil {
+		return id, fmt.Errorf("insert stashed request: %w", err)
+	}
+	return id, nil
+}
+
+// Returns and deletes a stashed request, so it is only resumed once. Returns ErrNoStashedRequest if there is none.
+func UnstashRequest(ctx context.Context, db conn, id Token, now time.Time) (StashedRequest, error) {
+	idHash := sha256.Sum256(id[:])
+	row := db.QueryRowContext(ctx, `SELECT METHOD, URL, CONTENT_TYPE, BODY FROM STASHED_REQUEST WHERE ID_HASH=? AND EXPIRES_TIME >= ?`,
+		idHash[:], now.UnixMilli())
+	var req StashedRequest
+	err := row.Scan(&req.Method, &req.URL, &req.ContentType, &req.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return req, ErrNoStashedRequest
+	}
+	if err != nil {
+		return req, fmt.Errorf("parse stashed request: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM STASHED_REQUEST WHERE ID_HASH=?`, idHash[:])
+	if err != nil {
+		return req, fmt.Errorf("delete stashed request: %w", err)
+	}
+	return req, nil
+}
+
+// Drops stashed requests which expired before the given time.
+func ReapStashedRequests(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM STASHED_REQUEST WHERE EXPIRES_TIME < ?;`, olderThan.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
+
+// Keeps requests interrupted by a login redirect, so AuthFilter can hand them back afterwards.
+type RequestStash interface {
+	// Saves a request, returning the ID to resume it with.
+	Stash(ctx context.Context, req StashedRequest) (Token, error)
+	// Returns and forgets a stashed request. Returns ErrNoStashedRequest if there is none.
+	Unstash(ctx context.Context, id Token) (StashedRequest, error)
+}
+
+// Bodies larger than this aren't stashed by default.
+const defaultMaxStashBody = 64 << 10
+
+type resumedKey struct{}
+
+// Returns the request interrupted by logging in, if the user has just come back to its URL, e.g to fill its form in
+// again with Form. The request itself is the browser's GET, which must not act on the stashed one.
+func Resumed(ctx context.Context) (StashedRequest, bool) {
+	stashed, ok := ctx.Value(resumedKey{}).(StashedRequest)
+	return stashed, ok
+}
+
+// Returns the fields of a stashed form post. Returns an error if the body isn't a URL encoded form.
+func (s StashedRequest) Form() (url.Values, error) {
+	mt, _, err := mime.ParseMediaType(s.ContentType)
+	if err != nil || mt != "application/x-www-form-urlencoded" {
+		return nil, fmt.Errorf("stashed request is not a form: %q", s.ContentType)
+	}
+	return url.ParseQuery(string(s.Body))
+}
+
+// Stashes a request which is about to be redirected to log in, and remembers it in a cookie. The ID is kept in a
+// cookie rather than the URL so that links can't hand users a stashed request, but a cross site post sets it too, which
+// is why stashed requests are only shown to the user and never replayed.
+func (a AuthFilter) stashRequest(w http.ResponseWriter, r *http.Request) {
+	limit := a.MaxStashBody
+	if limit == 0 {
+		limit = defaultMaxStashBody
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		log.Printf("error: not stashing request: read body: %v", err)
+		return
+	}
+	if int64(len(body)) > limit {
+		log.Printf("not stashing request to %v: body larger than %v bytes", r.URL, limit)
+		return
+	}
+	id, err := a.Stash.Stash(r.Context(), StashedRequest{
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		ContentType: r.Header.Get("Content-Type"),
+		Body:        body,
+	})
+	if err != nil {
+		log.Printf("error: stash request: %v", err)
+		return
+	}
+	w.Header().Add("Set-Cookie", fmt.Sprintf("auth_resume=%v; Max-Age=600; Secure; HttpOnly; SameSite=Strict; Path=/", id))
+}
+
+// Returns r with the stashed request attached for Resumed, if the browser is returning to the URL of one. Otherwise
+// returns r.
+func (a AuthFilter) resumeRequest(w http.ResponseWriter, r *http.Request) *http.Request {
+	c, err := r.Cookie("auth_resume")
+	if err != nil || r.Method != "GET" {
+		return r
+	}
+	var id Token
+	if id.UnmarshalText([]byte(c.Value)) != nil {
+		return r
+	}
+	stashed, err := a.Stash.Unstash(r.Context(), id)
+	w.Header().Add("Set-Cookie", "auth_resume=; Max-Age=0; Secure; HttpOnly; Path=/")
+	if err != nil {
+		if !errors.Is(err, ErrNoStashedRequest) {
+			log.Printf("error: unstash request: %v", err)
+		}
+		return r
+	}
+	if stashed.URL != r.URL.String() {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), resumedKey{}, stashed))
+}
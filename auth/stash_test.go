@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStashInterruptedPost(t *testing.T) {
+	db := newDB(t, "stash")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	token, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	filter := AuthFilter{Validator: a, LoginURL: "/login", Stash: a, MaxStashBody: 100}
+	var gotMethod string
+	var stashed StashedRequest
+	var resumed bool
+	h := filter.Handler(func(t Token, w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		stashed, resumed = Resumed(r.Context())
+	})
+
+	// Logged out, the POST is stashed on the way to log in.
+	r := httptest.NewRequest("POST", "/comment?post=1", strings.NewReader("text=hello"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	resume := responseCookie(w, "auth_resume")
+	if w.Code != http.StatusFound || resume == nil {
+		t.Fatalf("expected redirect with resume cookie, got %v %v", w.Code, w.Header())
+	}
+
+	// Back at the URL after logging in, the handler gets the POST to fill the form in with, once, but the request is
+	// still the GET, so nothing is submitted without the user.
+	r = httptest.NewRequest("GET", "/comment?post=1", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_token", Value: token.String()})
+	r.AddCookie(resume)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	form, err := stashed.Form()
+	if gotMethod != "GET" || !resumed || stashed.Method != "POST" || err != nil || form.Get("text") != "hello" {
+		t.Fatalf("expected the stashed POST alongside the GET, got %v %+v %v resumed=%v", gotMethod, stashed, err, resumed)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if gotMethod != "GET" || resumed {
+		t.Fatalf("expected stash to be used once, got %v resumed=%v", gotMethod, resumed)
+	}
+
+	// Oversized bodies are not stashed.
+	r = httptest.NewRequest("POST", "/comment", strings.NewReader(strings.Repeat("x", 101)))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if responseCookie(w, "auth_resume") != nil {
+		t.Fatalf("oversized body should not be stashed")
+	}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+)
+
+// Persists the accounts and tokens DBAuthenticator needs to register users, log them in, and validate their tokens, so
+// those can run on databases other than SQLite. Other features, e.g refresh tokens or password resets, still use
+// DBAuthenticator.DB, and return ErrDBRequired when it doesn't hold the Store's users and tokens.
+type Store interface {
+	// Creates the tables if they don't exist.
+	Initialize(ctx context.Context) error
+	// Stores a new user with an already hashed password.
+	InsertUser(ctx context.Context, id, email string, hash []byte) error
+	// Returns the ID and password hash of the user with the given ID or email. Returns ErrBadCredentials if there is no
+	// such user.
+	UserHash(ctx context.Context, idOrEmail string) (string, []byte, error)
+	// Stores a token for the user, valid between start and end.
+	InsertToken(ctx context.Context, uid string, t Token, start, end, created time.Time) error
+	// Returns the user of a token valid at now. Returns ErrInvalidToken if it isn't.
+	LookupToken(ctx context.Context, t Token, now time.Time) (string, error)
+	// Like LookupToken for many tokens. Invalid tokens are absent from the result.
+	LookupTokens(ctx context.Context, ts []Token, now time.Time) (map[Token]string, error)
+	// Deletes a token. Deleting an unknown token is not an error.
+	DeleteToken(ctx context.Context, t Token) error
+	// Deletes tokens which expired before the given time, which mustn't be after now.
+	ReapTokens(ctx context.Context, olderThan, now time.Time) error
+}
+
+// A Store using this package's SQLite schema, see Initialize.
+type SQLiteStore struct {
+	DB *sql.DB
+	// Where the auth tables are, if they share the DB with an application.
+	Schema *Schema
+}
+
+// Returns the DB, in the Schema.
+func (s SQLiteStore) conn() conn {
+	return s.Schema.wrap(s.DB)
+}
+
+func (s SQLiteStore) Initialize(ctx context.Context) error {
+	return Initialize(ctx, s.conn())
+}
+
+// Inserts the user and its creation event in one transaction, so a busy DB can't leave one without the other.
+func (s SQLiteStore) InsertUser(ctx context.Context, id, email string, hash []byte) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("open transaction: %w", err)
+	}
+	defer tx.Rollback()
+	err = insertUser(ctx, s.Schema.wrap(tx), id, email, hash, false, time.Now())
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+func (s SQLiteStore) UserHash(ctx context.Context, idOrEmail string) (string, []byte, error) {
+	row := s.conn().QueryRowContext(ctx, `SELECT ID, BCRYPT FROM USER WHERE ID = ? OR EMAIL = ?;`, idOrEmail, idOrEmail)
+	return scanUserHash(row)
+}
+
+func (s SQLiteStore) InsertToken(ctx context.Context, uid string, t Token, start, end, created time.Time) error {
+	return insertToken(ctx, s.conn(), uid, t, start, end, created)
+}
+
+func (s SQLiteStore) LookupToken(ctx context.Context, t Token, now time.Time) (string, error) {
+	return Lookup(ctx, s.conn(), t, now)
+}
+
+func (s SQLiteStore) LookupTokens(ctx context.Context, ts []Token, now time.Time) (map[Token]string, error) {
+	return LookupBatch(ctx, s.conn(), ts, now)
+}
+
+func (s SQLiteStore) DeleteToken(ctx context.Context, t Token) error {
+	return RevokeToken(ctx, s.conn(), t)
+}
+
+func (s SQLiteStore) ReapTokens(ctx context.Context, olderThan, now time.Time) error {
+	return ReapTokens(ctx, s.conn(), olderThan, now)
+}
+
+// Deletes the user, their tokens and everything else kept about them, see DeleteUser.
+func (s SQLiteStore) DeleteUser(ctx context.Context, uid string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("open transaction: %w", err)
+	}
+	defer tx.Rollback()
+	err = DeleteUser(ctx, s.Schema.wrap(tx), uid)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+func (s SQLiteStore) ReplaceHash(ctx context.Context, uid string, old, new []byte) error {
+	return replaceHash(ctx, s.conn(), uid, old, new)
+}
+
+// Validates the email of a new user and hashes their password.
+func hashNewUser(h Hasher, email, password string) ([]byte, error) {
+	_, err := mail.ParseAddress(email)
+	if err != nil {
+		return nil, fmt.Errorf("parsing email address '%v': %w", email, err)
+	}
+	return h.Hash(password)
+}
+
+// Reads an ID and password hash, translating a missing row to ErrBadCredentials.
+func scanUserHash(row *sql.Row) (string, []byte, error) {
+	var uid string
+	var hash []byte
+	err := row.Scan(&uid, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, ErrBadCredentials
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("parse bcrypt: %w", err)
+	}
+	return uid, hash, nil
+}
+
+// Returns a new random token.
+func newToken() (Token, error) {
+	var t Token
+	_, err := rand.Read(t[:])
+	if err != nil {
+		return t, fmt.Errorf("read random: %w", err)
+	}
+	return t, nil
+}
+
+// Returns s, or nil to store NULL if it is empty.
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Stores a newly issued token, with the client's IP and user agent if attached to ctx, see WithClientIP and WithUserAgent.
+func insertToken(ctx context.Context, db conn, uid string, t Token, start, end, created time.Time) error {
+	if !end.After(start) {
+		return fmt.Errorf("%w: cannot issue a token which ends at %v, before it starts", ErrIllegalTransition, end.UTC())
+	}
+	hash := sha256.Sum256(t[:])
+	_, err := db.ExecContext(ctx, `INSERT INTO TOKEN (UID, TOKEN_HASH, START_TIME, END_TIME, CREATED_TIME, IP, USER_AGENT)
+	VALUES (?, ?, ?, ?, ?, ?, ?);`,
+		uid, hash[:], start.UnixMilli(), end.UnixMilli(), created.UnixMilli(), nullIfEmpty(ClientIP(ctx)),
+		nullIfEmpty(UserAgent(ctx)))
+	if err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+	return nil
+}
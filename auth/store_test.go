@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDBAuthenticatorStore(t *testing.T) {
+	// Logging in and validating only needs the Store.
+	a := DBAuthenticator{Store: SQLiteStore{DB: newDB(t, "authstore")}}
+	ctx := context.Background()
+	err := a.Register(ctx, "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if _, _, err := a.Authenticate(ctx, "lol@localhost", "wrong"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("wrong password: expected ErrBadCredentials, got %v", err)
+	}
+	tok, _, err := a.Authenticate(ctx, "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if err := a.Validate(ctx, tok); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if err := a.Revoke(ctx, tok); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := a.Validate(ctx, tok); err != ErrInvalidToken {
+		t.Fatalf("revoked: expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestDBRequired(t *testing.T) {
+	ctx := context.Background()
+	other := SQLiteStore{DB: newDB(t, "other")}
+	for _, c := range []struct {
+		name string
+		a    DBAuthenticator
+	}{
+		{"no DB", DBAuthenticator{Store: other}},
+		{"users and tokens elsewhere", DBAuthenticator{DB: newDB(t, "features"), Store: other}},
+	} {
+		err := c.a.Register(ctx, "lol@localhost", "pw1")
+		if err != nil {
+			t.Fatalf("%v: register: %v", c.name, err)
+		}
+		tok, _, err := c.a.Authenticate(ctx, "lol@localhost", "pw1")
+		if err != nil {
+			t.Fatalf("%v: authenticate: %v", c.name, err)
+		}
+		if _, _, err := c.a.IssueRefresh(ctx, tok); !errors.Is(err, ErrDBRequired) {
+			t.Fatalf("%v: refresh: expected ErrDBRequired, got %v", c.name, err)
+		}
+		if _, err := c.a.Sessions(ctx, tok); !errors.Is(err, ErrDBRequired) {
+			t.Fatalf("%v: sessions: expected ErrDBRequired, got %v", c.name, err)
+		}
+		// Failed log ins are kept apart from users, so only need DB set.
+		c.a.Lockout = &LoginLockout{}
+		_, _, err = c.a.Authenticate(ctx, "lol@localhost", "pw1")
+		if c.a.DB == nil && !errors.Is(err, ErrDBRequired) || c.a.DB != nil && err != nil {
+			t.Fatalf("%v: authenticate with lockout: %v", c.name, err)
+		}
+		if err := other.DeleteUser(ctx, "lol@localhost"); err != nil {
+			t.Fatalf("%v: delete user: %v", c.name, err)
+		}
+	}
+
+	// The Store may be given explicitly, as long as it is DB.
+	db := newDB(t, "same")
+	a := DBAuthenticator{DB: db, Store: SQLiteStore{DB: db}}
+	if err := a.Register(ctx, "lol@localhost", "pw1"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	tok, _, err := a.Authenticate(ctx, "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if _, _, err := a.IssueRefresh(ctx, tok); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Anonymous usage reports, which help the maintainers see which features and backends are used. Off unless a Telemetry
+// is configured and run. Reports are a TelemetryReport and nothing else: no emails, user IDs, IPs, hostnames or
+// configuration. Counts are rounded down to a power of ten, and the installation ID is random and replaced every
+// Rotation, so reports can't be tied to a deployment for long.
+
+// An anonymous usage report. These fields are all that is ever sent.
+type TelemetryReport struct {
+	// Random, and replaced every Telemetry.Rotation.
+	Installation string `json:"installation"`
+	// Access tokens issued to users since the last report, including by refreshing, rounded down to a power of ten.
+	Logins int64 `json:"logins"`
+	// Users, rounded down to a power of ten.
+	Users int64 `json:"users"`
+	// Where users and tokens are kept: "sqlite", "postgres" or "custom".
+	Backend string `json:"backend"`
+}
+
+// Sends a TelemetryReport to Endpoint every Interval. Safe for concurrent use.
+type Telemetry struct {
+	// Where reports are POSTed, as JSON.
+	Endpoint string
+	DB       *sql.DB
+	// Where the auth tables are, if they share the DB with an application.
+	Schema *Schema
+	// The Store the authenticator uses, only to report which kind it is. Defaults to SQLite in DB.
+	Store Store
+	// How often to report. Defaults to a day.
+	Interval time.Duration
+	// How often the installation ID is replaced. Defaults to 30 days.
+	Rotation time.Duration
+	// Defaults to a client with a 10 second timeout.
+	Client *http.Client
+
+	mu         sync.Mutex
+	id         string
+	idCreated  time.Time
+	lastReport time.Time
+}
+
+func (t *Telemetry) interval() time.Duration {
+	if t.Interval == 0 {
+		return 24 * time.Hour
+	}
+	return t.Interval
+}
+
+func (t *Telemetry) rotation() time.Duration {
+	if t.Rotation == 0 {
+		return 30 * 24 * time.Hour
+	}
+	return t.Rotation
+}
+
+// Returns the installation ID, replacing it if it is older than Rotation.
+func (t *Telemetry) installation(now time.Time) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.id != "" && now.Sub(t.idCreated) < t.rotation() {
+		return t.id, nil
+	}
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+	t.id, t.idCreated = hex.EncodeToString(b), now
+	return t.id, nil
+}
+
+// Returns the report covering the time since the last one sent, or since an Interval ago for the first.
+func (t *Telemetry) Collect(ctx context.Context, now time.Time) (TelemetryReport, error) {
+	var r TelemetryReport
+	t.mu.Lock()
+	since := t.lastReport
+	t.mu.Unlock()
+	if since.IsZero() {
+		since = now.Add(-t.interval())
+	}
+	var err error
+	r.Installation, err = t.installation(now)
+	if err != nil {
+		return r, err
+	}
+	db := t.Schema.wrap(t.DB)
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM TOKEN WHERE CLIENT_ID IS NULL AND CREATED_TIME > ? AND
+CREATED_TIME <= ?;`, since.UnixMilli(), now.UnixMilli()).Scan(&r.Logins)
+	if err != nil {
+		return r, fmt.Errorf("count logins: %w", err)
+	}
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM USER;`).Scan(&r.Users)
+	if err != nil {
+		return r, fmt.Errorf("count users: %w", err)
+	}
+	r.Logins, r.Users = magnitude(r.Logins), magnitude(r.Users)
+	switch t.Store.(type) {
+	case nil, SQLiteStore, *SQLiteStore:
+		r.Backend = "sqlite"
+	case PostgresStore, *PostgresStore:
+		r.Backend = "postgres"
+	default:
+		r.Backend = "custom"
+	}
+	return r, nil
+}
+
+// Rounds n down to a power of ten, leaving 0 alone.
+func magnitude(n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	m := int64(1)
+	for m <= n/10 {
+		m *= 10
+	}
+	return m
+}
+
+// Collects a report and sends it. If sending fails, the next report covers this one's period too.
+func (t *Telemetry) Send(ctx context.Context, now time.Time) error {
+	r, err := t.Collect(ctx, now)
+	if err != nil {
+		return err
+	}
+	err = postWebhook(ctx, t.Client, t.Endpoint, r)
+	if err != nil {
+		return fmt.Errorf("send telemetry: %w", err)
+	}
+	t.mu.Lock()
+	t.lastReport = now
+	t.mu.Unlock()
+	return nil
+}
+
+// Reports every Interval until the context is done. The first report is sent after an Interval, not at start, so
+// restarts don't send extra reports.
+func (t *Telemetry) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := t.Send(ctx, time.Now())
+		if err != nil {
+			log.Printf("warning: %v", err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTelemetry(t *testing.T) {
+	db := newDB(t, "telemetry")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	for _, email := range []string{"a@b.com", "b@b.com"} {
+		if err := a.Register(ctx, email, "pw"); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	}
+	for i := 0; i < 12; i++ {
+		if _, _, err := a.Authenticate(ctx, "a@b.com", "pw"); err != nil {
+			t.Fatalf("authenticate: %v", err)
+		}
+	}
+	var got []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("decode report: %v", err)
+		}
+		got = append(got, report)
+	}))
+	defer srv.Close()
+
+	tel := &Telemetry{Endpoint: srv.URL, DB: db, Rotation: 48 * time.Hour}
+	now := time.Now()
+	err := tel.Send(ctx, now)
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	var keys []string
+	for k := range got[0] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "backend,installation,logins,users" {
+		t.Fatalf("expected only the allowed fields to be sent, got %v", got[0])
+	}
+	if got[0]["logins"] != 10.0 || got[0]["users"] != 1.0 || got[0]["backend"] != "sqlite" {
+		t.Fatalf("expected rounded counts, got %v", got[0])
+	}
+
+	// Later reports only count logins since the last, and the installation ID is replaced after the rotation.
+	err = tel.Send(ctx, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got[1]["logins"] != 0.0 || got[1]["installation"] != got[0]["installation"] {
+		t.Fatalf("expected no new logins from the same installation, got %v then %v", got[0], got[1])
+	}
+	err = tel.Send(ctx, now.Add(72*time.Hour))
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got[2]["installation"] == got[0]["installation"] {
+		t.Fatalf("expected the installation ID to rotate, got %v", got[2])
+	}
+}
+
+func TestMagnitude(t *testing.T) {
+	for n, want := range map[int64]int64{0: 0, 1: 1, 9: 1, 10: 10, 99: 10, 100: 100, 12345: 10000} {
+		if got := magnitude(n); got != want {
+			t.Errorf("magnitude(%v): expected %v, got %v", n, want, got)
+		}
+	}
+}
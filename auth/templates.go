@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed templates/*.html
+var bundledTemplates embed.FS
+
+// Functions available to page templates besides the builtins.
+var templateFuncs = template.FuncMap{
+	"date": func(t time.Time) string { return t.UTC().Format(time.RFC1123) },
+	"join": strings.Join,
+}
+
+var defaultTemplates = template.Must(template.New("").Funcs(templateFuncs).ParseFS(bundledTemplates, "templates/*.html"))
+
+// Parses the pages AuthServer renders, replacing the bundled templates with the *.html files in fsys. Files are named
+// after the page they render, e.g "login.html", and pages missing from fsys keep the bundled version. Every page starts
+// with {{template "head" .}} and ends with {{template "foot" .}}, from "layout.html", so overriding that file alone is
+// enough to brand every page. Pages are rendered with a PageData.
+func ParseTemplates(fsys fs.FS) (*template.Template, error) {
+	t, err := template.New("").Funcs(templateFuncs).ParseFS(bundledTemplates, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("parse bundled templates: %w", err)
+	}
+	t, err = t.ParseFS(fsys, "*.html")
+	if err != nil {
+		return nil, fmt.Errorf("parse templates: %w", err)
+	}
+	return t, nil
+}
+
+// What a page template is rendered with.
+type PageData struct {
+	// The template being rendered, e.g "login.html".
+	Page string
+	// The page's heading.
+	Title string
+	// Where the page's form posts to, or on the SSO page where its button leads, or on the password error page where to
+	// try again.
+	Action string
+	// Paths of the enabled routes by name, with the page's query, e.g Links.signup. Disabled routes are missing.
+	Links map[string]string
+	// The pending flash message, if any.
+	Flash string
+	// Why the form was refused, e.g ErrBadCredentials, shown by its Error text. TemplateData may replace it to reword
+	// the message.
+	Error error
+	// The text of a message page, e.g "Check your email".
+	Message string
+	// The email to fill in on the log in page.
+	Email string
+	// Why a password was refused, e.g "must be at least 8 characters".
+	Problems []string
+	// The hidden inputs and script of a proof of work, if needed.
+	ProofOfWork template.HTML
+	// Buttons to log in with the OAuth providers.
+	OAuth []OAuthLink
+	// Whether to show the "Remember me" box.
+	RememberMe bool
+	// Text of the SSO log in button.
+	SSOLabel string
+	// The user's own data, on the privacy page.
+	Personal *PersonalData
+	// The user's active sessions, on the sessions page.
+	Sessions []ActiveSession
+	// On the operator notes page, the user being looked at, or the IDs of the users with the tag looked up.
+	Account *AccountNotes
+	Tagged  []string
+	// The request's tenant and locale, from AuthServer.Resolvers.
+	Tenant string
+	Locale string
+	// Anything else the templates need, e.g a logo or terms of service link, from AuthServer.TemplateData.
+	Extra map[string]any
+}
+
+// Renders a page with the configured templates. The page is rendered in full before anything is written, so a broken
+// template is a clean 500.
+func (a AuthServer) render(w http.ResponseWriter, r *http.Request, status int, data PageData) {
+	t := a.Templates
+	if t == nil {
+		t = defaultTemplates
+	}
+	data.Links = make(map[string]string)
+	for _, name := range []string{RouteLogin, RouteSignup, RouteLogout, RouteForgot, RoutePrivacy, RouteSessions} {
+		if href := a.link(name, r.URL.RawQuery); href != "" {
+			data.Links[name] = href
+		}
+	}
+	data.Flash = a.popFlash(w, r)
+	data.RememberMe = a.RememberMe
+	data.OAuth = a.oauthLinks(r.URL.RawQuery)
+	data.Tenant = Tenant(r.Context())
+	data.Locale = Locale(r.Context())
+	if a.TemplateData != nil {
+		a.TemplateData(r, &data)
+	}
+	var b bytes.Buffer
+	err := t.ExecuteTemplate(&b, data.Page, data)
+	if err != nil {
+		a.internalError(w, "render "+data.Page, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTemplates(t *testing.T) {
+	templates, err := ParseTemplates(fstest.MapFS{
+		"layout.html": {Data: []byte(`{{define "head"}}<html><body><img src="{{.Extra.Logo}}" /><h1> {{.Title}} </h1>{{end}}` +
+			`{{define "foot"}}</body></html>{{end}}`)},
+	})
+	if err != nil {
+		t.Fatalf("parse templates: %v", err)
+	}
+	mux := AuthServer{Templates: templates, TemplateData: func(r *http.Request, data *PageData) {
+		data.Extra = map[string]any{"Logo": "/logo.png"}
+		if data.Page == "login.html" {
+			data.Title = "Welcome back"
+		}
+	}}.Handler("/auth")
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login?email=%3Cscript%3E", nil))
+	body := w.Body.String()
+	for _, want := range []string{`<img src="/logo.png" />`, "Welcome back", "autocomplete=current-password", `value="&lt;script&gt;"`} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected the login page to contain %v: %v", want, body)
+		}
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Fatalf("expected an html content type, got %v", ct)
+	}
+
+	if _, err := ParseTemplates(fstest.MapFS{"login.html": {Data: []byte(`{{.Missing`)}}); err == nil {
+		t.Fatal("expected a broken template to fail to parse")
+	}
+	broken, err := ParseTemplates(fstest.MapFS{"login.html": {Data: []byte(`{{.Missing}}`)}})
+	if err != nil {
+		t.Fatalf("parse templates: %v", err)
+	}
+	w = httptest.NewRecorder()
+	AuthServer{Templates: broken}.Handler("/auth").ServeHTTP(w, httptest.NewRequest("GET", "/auth/login", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected a failing template to be a 500, got %v: %v", w.Code, w.Body)
+	}
+}
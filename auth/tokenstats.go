@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// How big the TOKEN table is, and how much of it the reaper should already have deleted.
+type TokenTableStats struct {
+	// Every token, expired or not.
+	Total int64
+	// Tokens which expired long enough ago that an on schedule reaper would have deleted them.
+	Unreaped int64
+	// The 95th percentile of unexpired tokens per user, among users with any.
+	PerUserP95 int64
+	// Size of the DB file, from SQLite's page count.
+	DBBytes int64
+}
+
+// Measures the TOKEN table at the given time. Tokens which expired before overdue count as unreaped.
+func CollectTokenStats(ctx context.Context, db conn, now, overdue time.Time) (TokenTableStats, error) {
+	var s TokenTableStats
+	row := db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(END_TIME < ?), 0) FROM TOKEN;`, overdue.UnixMilli())
+	err := row.Scan(&s.Total, &s.Unreaped)
+	if err != nil {
+		return s, fmt.Errorf("count tokens: %w", err)
+	}
+	// The nearest rank percentile, found in the DB rather than fetching every user's count.
+	const perUser = `SELECT COUNT(*) AS N FROM TOKEN WHERE END_TIME >= ? GROUP BY UID`
+	var users int64
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM (`+perUser+`);`, now.UnixMilli()).Scan(&users)
+	if err != nil {
+		return s, fmt.Errorf("count users with tokens: %w", err)
+	}
+	if users > 0 {
+		rank := int64(math.Ceil(0.95*float64(users))) - 1
+		row = db.QueryRowContext(ctx, `SELECT N FROM (`+perUser+`) ORDER BY N LIMIT 1 OFFSET ?;`, now.UnixMilli(), rank)
+		err = row.Scan(&s.PerUserP95)
+		if err != nil {
+			return s, fmt.Errorf("rank tokens per user: %w", err)
+		}
+	}
+	var pages, pageSize int64
+	err = db.QueryRowContext(ctx, `PRAGMA page_count;`).Scan(&pages)
+	if err == nil {
+		err = db.QueryRowContext(ctx, `PRAGMA page_size;`).Scan(&pageSize)
+	}
+	if err != nil {
+		return s, fmt.Errorf("measure db: %w", err)
+	}
+	s.DBBytes = pages * pageSize
+	return s, nil
+}
+
+// Samples the TOKEN table on a schedule, for metrics and to warn when the reaper falls behind. Tokens which expired
+// more than Grace plus ReapInterval ago have missed a purge, so the monitor logs a warning whenever more of them pile up.
+// Safe for concurrent use.
+type TokenMonitor struct {
+	DB *sql.DB
+	// Where the auth tables are, if they share the DB with an application.
+	Schema *Schema
+	// How long the reaper keeps expired tokens, see StartReaper.
+	Grace time.Duration
+	// How often the reaper runs. Defaults to an hour.
+	ReapInterval time.Duration
+	// How often to sample. Defaults to 5 minutes.
+	Interval time.Duration
+
+	mu      sync.Mutex
+	last    TokenTableStats
+	sampled bool
+}
+
+func (m *TokenMonitor) reapInterval() time.Duration {
+	if m.ReapInterval == 0 {
+		return time.Hour
+	}
+	return m.ReapInterval
+}
+
+// Measures the table, warning if the unreaped tokens have grown since the last sample.
+func (m *TokenMonitor) Sample(ctx context.Context, now time.Time) (TokenTableStats, error) {
+	s, err := CollectTokenStats(ctx, m.Schema.wrap(m.DB), now, now.Add(-m.Grace-m.reapInterval()))
+	if err != nil {
+		return s, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sampled && s.Unreaped > m.last.Unreaped {
+		log.Printf("warning: %v expired tokens are overdue for reaping, up from %v, with %v tokens in total. Is the reaper "+
+			"running and succeeding?", s.Unreaped, m.last.Unreaped, s.Total)
+	}
+	m.last, m.sampled = s, true
+	return s, nil
+}
+
+// Samples every Interval until the context is done.
+func (m *TokenMonitor) Run(ctx context.Context) {
+	interval := m.Interval
+	if interval == 0 {
+		interval = 5 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := m.Sample(ctx, time.Now())
+		if err != nil {
+			log.Printf("error: sample token table: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the latest sample.
+func (m *TokenMonitor) Stats() TokenTableStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+// Writes the latest sample as gauges in the Prometheus text format. Writes nothing before the first sample.
+func (m *TokenMonitor) WriteMetrics(w io.Writer, now time.Time) {
+	m.mu.Lock()
+	s, sampled := m.last, m.sampled
+	m.mu.Unlock()
+	if !sampled {
+		return
+	}
+	gauge := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n%v %v\n", name, help, name, name, v)
+	}
+	gauge("auth_tokens", "Tokens in the DB, expired or not.", s.Total)
+	gauge("auth_tokens_unreaped", "Expired tokens which the reaper should already have deleted.", s.Unreaped)
+	gauge("auth_tokens_per_user_p95", "95th percentile of unexpired tokens per user.", s.PerUserP95)
+	gauge("auth_db_size_bytes", "Size of the DB file.", s.DBBytes)
+}
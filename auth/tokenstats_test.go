@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenMonitor(t *testing.T) {
+	db := newDB(t, "tokenstats")
+	ctx := context.Background()
+	now := time.Now()
+	generate := func(uid string, end time.Time) {
+		_, err := GenerateToken(ctx, db, uid, now.Add(-6*time.Hour), end)
+		if err != nil {
+			t.Fatalf("generate token: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		generate("user1", now.Add(time.Hour))
+	}
+	generate("user2", now.Add(time.Hour))
+	// Expired, but still within the grace period plus a reap interval.
+	generate("user2", now.Add(-90*time.Minute))
+	generate("user3", now.Add(-3*time.Hour))
+
+	m := &TokenMonitor{DB: db, Grace: time.Hour, ReapInterval: time.Hour}
+	var b strings.Builder
+	m.WriteMetrics(&b, now)
+	if b.Len() != 0 {
+		t.Fatalf("expected no metrics before sampling, got %v", b.String())
+	}
+	s, err := m.Sample(ctx, now)
+	if err != nil {
+		t.Fatalf("sample: %v", err)
+	}
+	if s.Total != 6 || s.Unreaped != 1 || s.PerUserP95 != 3 || s.DBBytes <= 0 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+	generate("user3", now.Add(-5*time.Hour))
+	if _, err := m.Sample(ctx, now); err != nil {
+		t.Fatalf("sample: %v", err)
+	}
+	if !strings.Contains(logs.String(), "warning: 2 expired tokens are overdue") {
+		t.Fatalf("expected a warning once unreaped tokens grew, got %q", logs.String())
+	}
+	logs.Reset()
+	if err := ReapTokens(ctx, db, now.Add(-time.Hour), now); err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if s, err := m.Sample(ctx, now); err != nil || s.Unreaped != 0 || logs.Len() != 0 {
+		t.Fatalf("expected no warning once reaped, got %+v %v %q", s, err, logs.String())
+	}
+
+	b.Reset()
+	m.WriteMetrics(&b, now)
+	for _, want := range []string{"auth_tokens 4\n", "auth_tokens_unreaped 0\n", "auth_tokens_per_user_p95 3\n", "# TYPE auth_db_size_bytes gauge"} {
+		if !strings.Contains(b.String(), want) {
+			t.Fatalf("expected %q in metrics, got:\n%v", want, b.String())
+		}
+	}
+}
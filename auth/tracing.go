@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry tracing, so time spent in auth shows up in an application's distributed traces. Set AuthServer.Tracing
+// to trace the auth pages; requests carrying a trace context, e.g a traceparent header, continue that trace. The DB
+// functions Authenticate, GenerateToken and Lookup, and DBAuthenticator.Authenticate, add spans to whichever trace their
+// context carries, using its provider, so they show up under the auth pages or the application's own spans, and cost
+// next to nothing when the context has no span.
+
+// The instrumentation name spans are recorded under.
+const tracerName = "github.com/hherman1/auth/auth"
+
+// Traces the auth pages. The zero value uses the global provider and propagator, see otel.SetTracerProvider.
+type Tracing struct {
+	Provider trace.TracerProvider
+	// Reads the trace context of incoming requests. Defaults to the global propagator, and to W3C trace context and
+	// baggage if none was set.
+	Propagator propagation.TextMapPropagator
+}
+
+func (t *Tracing) provider() trace.TracerProvider {
+	if t.Provider == nil {
+		return otel.GetTracerProvider()
+	}
+	return t.Provider
+}
+
+func (t *Tracing) propagator() propagation.TextMapPropagator {
+	if t.Propagator != nil {
+		return t.Propagator
+	}
+	p := otel.GetTextMapPropagator()
+	if len(p.Fields()) == 0 {
+		return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	}
+	return p
+}
+
+// Wraps a handler so each request is a server span named for the route, e.g "/auth/login", continuing any trace the
+// request carries. Responses with a 5xx status mark the span failed.
+func (t *Tracing) Handler(route string, h http.Handler) http.Handler {
+	tracer := t.provider().Tracer(tracerName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := t.propagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPRouteKey.String(route),
+			semconv.HTTPTargetKey.String(r.URL.Path),
+		))
+		defer span.End()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// Starts a span as a child of the one in ctx, with its provider. If ctx carries no span, nothing is recorded.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name)
+}
+
+// Ends a span, marking it failed if err is set. Wrong credentials and invalid tokens are the check working, not failing,
+// so they are only noted as an attribute.
+func endSpan(span trace.Span, err error) {
+	switch {
+	case errors.Is(err, ErrBadCredentials) || errors.Is(err, ErrInvalidToken):
+		span.SetAttributes(attribute.Bool("auth.refused", true))
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
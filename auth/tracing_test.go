@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	a := DBAuthenticator{DB: newDB(t, "tracing")}
+	ctx := context.Background()
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	mux := AuthServer{Authenticator: a, Tracing: &Tracing{Provider: tp}}.Handler("/auth")
+
+	login := func(password string) {
+		form := url.Values{"email": {"a@b.com"}, "password": {password}}
+		r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		mux.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	login("pw")
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected a span for the request and one for authenticating, got %v", len(spans))
+	}
+	auth, req := spans[0], spans[1]
+	if req.Name != "/auth/login" || req.SpanKind != trace.SpanKindServer || auth.Name != "auth.DBAuthenticator.Authenticate" {
+		t.Fatalf("unexpected spans: %v, %v", req.Name, auth.Name)
+	}
+	if req.SpanContext.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" || req.Parent.SpanID().String() != "b7ad6b7169203331" {
+		t.Fatalf("expected the request to continue the incoming trace, got %v", req.SpanContext.TraceID())
+	}
+	if auth.Parent.SpanID() != req.SpanContext.SpanID() {
+		t.Fatalf("expected authenticating to be under the request")
+	}
+
+	// A wrong password is refused, not an error.
+	exporter.Reset()
+	login("wrong")
+	spans = exporter.GetSpans()
+	if len(spans) != 2 || spans[0].Status.Code != 0 || len(spans[0].Attributes) != 1 || spans[0].Attributes[0].Key != "auth.refused" {
+		t.Fatalf("expected a refused, unfailed span, got %+v", spans)
+	}
+
+	// The DB functions add spans to the trace in their context, and record nothing without one.
+	exporter.Reset()
+	ctx, span := tp.Tracer("test").Start(ctx, "parent")
+	tok, err := GenerateToken(ctx, a.DB, "a@b.com", time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	_, err = Lookup(context.Background(), a.DB, tok, time.Now())
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	span.End()
+	spans = exporter.GetSpans()
+	if len(spans) != 2 || spans[0].Name != "auth.GenerateToken" || spans[0].Parent.SpanID() != span.SpanContext().SpanID() {
+		t.Fatalf("expected only the generate token span under the parent, got %+v", spans)
+	}
+}
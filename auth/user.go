@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// The user a request's token belongs to, see AuthFilter.UserHandler.
+type User struct {
+	ID    string
+	Token Token
+	// The roles the token carries, or nil if the Validator didn't report them.
+	Roles []string
+}
+
+// A Validator which also reports who a valid token belongs to, so AuthFilter can hand handlers the user, check roles
+// and rate limit without asking the store again. CachedValidator, CircuitBreaker and StaleValidator forward it.
+type UserValidator interface {
+	// Validates the token like Validate, returning its user with ID set, and Roles if they are known.
+	ValidateUser(ctx context.Context, t Token) (User, error)
+}
+
+// Validates the token with v, returning its user if v is a UserValidator, and otherwise a User with only the token set.
+func validateUser(ctx context.Context, v Validator, t Token) (User, error) {
+	if uv, ok := v.(UserValidator); ok {
+		return uv.ValidateUser(ctx, t)
+	}
+	return User{Token: t}, v.Validate(ctx, t)
+}
+
+type userKey struct{}
+
+// Attaches the user a request is made by.
+func WithUser(ctx context.Context, u User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// Returns the user attached by WithUser, or false if there is none.
+func UserFrom(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(userKey{}).(User)
+	return u, ok
+}
+
+// Like Handler, but also finds who the token belongs to, for handlers which need the user rather than the token. The
+// request's context carries both, see UserFrom and TokenFromContext. Requires a Validator implementing UserValidator,
+// or else Users or a Validator implementing BatchValidator, which costs another round trip.
+func (a AuthFilter) UserHandler(h func(User, http.ResponseWriter, *http.Request)) http.Handler {
+	return a.handle(func(u User, w http.ResponseWriter, r *http.Request) {
+		if u.ID == "" {
+			var ok bool
+			u, ok = a.findUser(w, r, u.Token)
+			if !ok {
+				return
+			}
+		}
+		h(u, w, r.WithContext(WithUser(WithToken(r.Context(), u.Token), u)))
+	})
+}
+
+// Finds the user of a token which was validated without finding them, with Users. Responds with an error and returns
+// false if it can't.
+func (a AuthFilter) findUser(w http.ResponseWriter, r *http.Request, t Token) (User, bool) {
+	users := a.users()
+	if users == nil {
+		log.Printf("error: user required, but no BatchValidator configured")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return User{}, false
+	}
+	res, err := users.ValidateBatch(r.Context(), []Token{t})
+	if err != nil {
+		log.Printf("error: find user: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return User{}, false
+	}
+	if res[0].Err != nil {
+		// Revoked since it was validated.
+		log.Printf("error: find user: %v", res[0].Err)
+		http.Error(w, ErrInvalidToken.Error(), http.StatusUnauthorized)
+		return User{}, false
+	}
+	return User{ID: res[0].UID, Token: t}, true
+}
+
+// Returns Users, or the Validator if it is a BatchValidator, or nil.
+func (a AuthFilter) users() BatchValidator {
+	if a.Users != nil {
+		return a.Users
+	}
+	users, _ := a.Validator.(BatchValidator)
+	return users
+}
+
+// Like Middleware, but the wrapped handler also finds the user with UserFrom. See UserHandler.
+func (a AuthFilter) UserMiddleware(next http.Handler) http.Handler {
+	return a.UserHandler(func(u User, w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserHandler(t *testing.T) {
+	db := newDB(t, "user")
+	ctx := context.Background()
+	a := DBAuthenticator{DB: db}
+	err := a.Register(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	tok, _, err := a.Authenticate(ctx, "a@b.com", "pw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	var got User
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := UserFrom(r.Context())
+		if !ok {
+			t.Errorf("expected a user in the context")
+		}
+		if ct, _ := TokenFromContext(r.Context()); ct != tok {
+			t.Errorf("expected the token in the context, got %v", ct)
+		}
+		got = u
+	})
+	serve := func(f AuthFilter) int {
+		r := httptest.NewRequest("GET", "/secured", nil)
+		r.AddCookie(&http.Cookie{Name: "auth_token", Value: tok.String()})
+		w := httptest.NewRecorder()
+		f.UserMiddleware(h).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve(AuthFilter{Validator: a, LoginURL: "/login"}); code != http.StatusOK {
+		t.Fatalf("expected the handler to be called, got %v", code)
+	}
+	if got.ID != "a@b.com" || got.Token != tok {
+		t.Fatalf("expected the token's user, got %+v", got)
+	}
+	// The wrappers pass the user found while validating through.
+	got = User{}
+	breaker := &CircuitBreaker{Validator: &CachedValidator{Validator: &StaleValidator{Validator: a}}}
+	if code := serve(AuthFilter{Validator: breaker, LoginURL: "/login"}); code != http.StatusOK || got.ID != "a@b.com" {
+		t.Fatalf("expected the user found through the wrappers, got %v %+v", code, got)
+	}
+	// A validator which can't find users needs Users.
+	got = User{}
+	if code := serve(AuthFilter{Validator: onlyValidator(tok), LoginURL: "/login"}); code != http.StatusInternalServerError {
+		t.Fatalf("expected an error without a way to find users, got %v", code)
+	}
+	if code := serve(AuthFilter{Validator: onlyValidator(tok), Users: a, LoginURL: "/login"}); code != http.StatusOK || got.ID != "a@b.com" {
+		t.Fatalf("expected the user found with Users, got %v %+v", code, got)
+	}
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// An append only history of changes to user accounts, for support and compliance investigations. Every function in this
+// package which changes a USER row or a user's roles records an event alongside it; use a transaction so the change and
+// its event are stored together. Events are never changed. They are only deleted by retention, which drops them after a
+// year (see ReapUserEvents), and when their user is erased, see DeleteUser.
+
+// Kinds of user events.
+const (
+	UserCreated     = "user_created"
+	PasswordChanged = "password_changed"
+	RoleGranted     = "role_granted"
+	RoleRevoked     = "role_revoked"
+	// A break glass code was issued for the user, or used to log in as them, see IssueBreakGlass.
+	BreakGlassIssued = "break_glass_issued"
+	BreakGlassUsed   = "break_glass_used"
+	// The user ended one of their sessions, or all of them, see SessionManager.
+	SessionRevoked  = "session_revoked"
+	SessionsRevoked = "sessions_revoked"
+	// An administrator was issued a token acting as the user, see ImpersonateUser.
+	Impersonated = "impersonated"
+	// An identity provider's log in was first linked to the user's password account, see FederatedLogin.
+	AccountLinked = "account_linked"
+	// Log ins for the user were locked out after too many failures, see LoginLockout.
+	AccountLocked = "account_locked"
+	// An operator left a note on the user, or tagged or untagged them, see AddUserNote and TagUser. Like the notes and
+	// tags themselves, these are never shown to the user.
+	NoteAdded = "note_added"
+	Tagged    = "tagged"
+	Untagged  = "untagged"
+)
+
+// Reports whether events of the kind record operators' notes on the user, which the user isn't shown.
+func operatorEvent(kind string) bool {
+	return kind == NoteAdded || kind == Tagged || kind == Untagged
+}
+
+// A recorded change to a user.
+type UserEvent struct {
+	UID  string
+	Kind string
+	// Details of the change, e.g the email of a created user or the role granted.
+	Data    map[string]string
+	Created time.Time
+}
+
+// Appends an event to the user's history.
+func recordUserEvent(ctx context.Context, db conn, uid, kind string, data map[string]string, now time.Time) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO USER_EVENT (UID, KIND, DATA, CREATED_TIME) VALUES (?, ?, ?, ?);`,
+		uid, kind, string(b), now.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("insert user event: %w", err)
+	}
+	return nil
+}
+
+// Drops events recorded before the given time, except each user's creation and account link, which stay as long as the
+// user: FederatedLogin relies on the link having been recorded, and the creation dates the account.
+func ReapUserEvents(ctx context.Context, db conn, olderThan time.Time) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM USER_EVENT WHERE CREATED_TIME < ? AND KIND NOT IN (?, ?);`,
+		olderThan.UnixMilli(), UserCreated, AccountLinked)
+	if err != nil {
+		return fmt.Errorf("drop rows: %w", err)
+	}
+	return nil
+}
+
+// Returns the user's history, oldest first.
+func UserEvents(ctx context.Context, db conn, uid string) ([]UserEvent, error) {
+	return userEventsBefore(ctx, db, uid, time.UnixMilli(1<<62))
+}
+
+func userEventsBefore(ctx context.Context, db conn, uid string, at time.Time) ([]UserEvent, error) {
+	rows, err := db.QueryContext(ctx, `SELECT UID, KIND, DATA, CREATED_TIME FROM USER_EVENT WHERE UID=? AND CREATED_TIME <= ?
+ORDER BY CREATED_TIME, ROWID;`, uid, at.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("fetch events: %w", err)
+	}
+	defer rows.Close()
+	var events []UserEvent
+	for rows.Next() {
+		var e UserEvent
+		var data string
+		var created int64
+		err = rows.Scan(&e.UID, &e.Kind, &data, &created)
+		if err != nil {
+			return nil, fmt.Errorf("scan event: %w", err)
+		}
+		err = json.Unmarshal([]byte(data), &e.Data)
+		if err != nil {
+			return nil, fmt.Errorf("parse event data: %w", err)
+		}
+		e.Created = time.UnixMilli(created)
+		events = append(events, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate events: %w", err)
+	}
+	return events, nil
+}
+
+// A user account as it was at some point in time, rebuilt from its history.
+type UserState struct {
+	// False if the user had not been created yet.
+	Exists bool
+	Email  string
+	Valid  bool
+	// When the password was last changed, or the zero time if never.
+	PasswordChanged time.Time
+	// Sorted.
+	Roles []string
+}
+
+// Rebuilds the user's account as it was at the given time by replaying their history. Users created before history was
+// recorded have a backfilled creation event at the unix epoch.
+func UserStateAt(ctx context.Context, db conn, uid string, at time.Time) (UserState, error) {
+	var s UserState
+	events, err := userEventsBefore(ctx, db, uid, at)
+	if err != nil {
+		return s, err
+	}
+	roles := make(map[string]bool)
+	for _, e := range events {
+		switch e.Kind {
+		case UserCreated:
+			s.Exists = true
+			s.Email = e.Data["email"]
+			s.Valid = e.Data["valid"] == "true"
+		case PasswordChanged:
+			s.PasswordChanged = e.Created
+		case RoleGranted:
+			roles[e.Data["role"]] = true
+		case RoleRevoked:
+			delete(roles, e.Data["role"])
+		}
+	}
+	for role := range roles {
+		s.Roles = append(s.Roles, role)
+	}
+	sort.Strings(s.Roles)
+	return s, nil
+}
+
+// Inserts a user row and records its creation.
+func insertUser(ctx context.Context, db conn, id, email string, hash []byte, valid bool, now time.Time) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO USER(ID, EMAIL, BCRYPT, VALID) VALUES (?,?,?,?);`, id, email, hash, valid)
+	if err != nil {
+		return fmt.Errorf("insert user: %w", err)
+	}
+	return recordUserEvent(ctx, db, id, UserCreated, map[string]string{"email": email, "valid": fmt.Sprint(valid)}, now)
+}
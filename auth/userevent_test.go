@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUserStateAt(t *testing.T) {
+	db := newDB(t, "events")
+	ctx := context.Background()
+	err := RegisterUserWith(ctx, db, PasswordOptions{}, "user1", "lol@localhost", "pw1")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	created := time.Now()
+	steps := []func(now time.Time) error{
+		func(now time.Time) error { return GrantRole(ctx, db, "user1", "admin", now) },
+		func(now time.Time) error { return ChangePasswordWith(ctx, db, PasswordOptions{}, "user1", "pw2", now) },
+		func(now time.Time) error { return RevokeRole(ctx, db, "user1", "admin") },
+	}
+	var times []time.Time
+	for i, step := range steps {
+		time.Sleep(5 * time.Millisecond)
+		now := time.Now()
+		if err := step(now); err != nil {
+			t.Fatalf("step %v: %v", i, err)
+		}
+		times = append(times, now)
+	}
+	// Revoking a role the user doesn't have changes nothing, so isn't recorded.
+	err = RevokeRole(ctx, db, "user1", "admin")
+	if err != nil {
+		t.Fatalf("revoke again: %v", err)
+	}
+	events, err := UserEvents(ctx, db, "user1")
+	if err != nil || len(events) != 4 {
+		t.Fatalf("expected 4 events, got %v %v", events, err)
+	}
+
+	s, err := UserStateAt(ctx, db, "user1", created.Add(-time.Hour))
+	if err != nil || s.Exists {
+		t.Fatalf("before creation: %+v %v", s, err)
+	}
+	s, err = UserStateAt(ctx, db, "user1", times[0])
+	if err != nil || !s.Exists || s.Email != "lol@localhost" || len(s.Roles) != 1 || !s.PasswordChanged.IsZero() {
+		t.Fatalf("after grant: %+v %v", s, err)
+	}
+	s, err = UserStateAt(ctx, db, "user1", times[1])
+	if err != nil || len(s.Roles) != 1 || s.PasswordChanged.UnixMilli() != times[1].UnixMilli() {
+		t.Fatalf("after password change: %+v %v", s, err)
+	}
+	s, err = UserStateAt(ctx, db, "user1", time.Now())
+	if err != nil || len(s.Roles) != 0 {
+		t.Fatalf("after revoke: %+v %v", s, err)
+	}
+}
+
+func TestUserEventBackfill(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "old"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ctx := context.Background()
+	_, err = db.ExecContext(ctx, `
+CREATE TABLE USER (ID TEXT NOT NULL PRIMARY KEY, EMAIL TEXT NOT NULL UNIQUE, BCRYPT BLOB NOT NULL, VALID BOOLEAN DEFAULT FALSE NOT NULL);
+INSERT INTO USER (ID, EMAIL, BCRYPT, VALID) VALUES ('user1', 'lol@localhost', '', TRUE);`)
+	if err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+	// Backfilling twice is fine
+	for i := 0; i < 2; i++ {
+		err = Initialize(ctx, db)
+		if err != nil {
+			t.Fatalf("initialize %v: %v", i, err)
+		}
+	}
+	events, err := UserEvents(ctx, db, "user1")
+	if err != nil || len(events) != 1 {
+		t.Fatalf("expected one backfilled event, got %v %v", events, err)
+	}
+	s, err := UserStateAt(ctx, db, "user1", time.Now())
+	if err != nil || !s.Exists || s.Email != "lol@localhost" || !s.Valid {
+		t.Fatalf("backfilled state: %+v %v", s, err)
+	}
+}
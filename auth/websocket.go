@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Browsers can't set an Authorization header on WebSocket handshakes, so clients either offer the token as a
+// subprotocol, e.g
+//
+//	new WebSocket(url, ["auth_token", base64url(token)])
+//
+// or send it as the first message once connected. Either way the token is checked with a Validator before the
+// connection is trusted.
+
+// The subprotocol clients offer before their token. The upgrade must select it, since browsers close connections which
+// don't agree on a subprotocol they offered. The token itself must never be echoed back.
+const WebSocketProtocol = "auth_token"
+
+// Reads the token offered after WebSocketProtocol in a Sec-WebSocket-Protocol header. Subprotocols can't contain '+',
+// '/' or '=', so the token is base64url encoded without padding.
+func WebSocketTokenSource() TokenSource {
+	return func(r *http.Request) (string, bool) {
+		var offered []string
+		for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+			for _, p := range strings.Split(h, ",") {
+				offered = append(offered, strings.TrimSpace(p))
+			}
+		}
+		for i := 0; i+1 < len(offered); i++ {
+			if offered[i] != WebSocketProtocol {
+				continue
+			}
+			raw, err := base64.RawURLEncoding.DecodeString(offered[i+1])
+			if err != nil {
+				return "", false
+			}
+			return base64.StdEncoding.EncodeToString(raw), true
+		}
+		return "", false
+	}
+}
+
+// Validates the token offered in a WebSocket handshake, before upgrading it. Returns the token, which identifies the
+// connection's user. Returns ErrInvalidToken if no valid token was offered.
+func ValidateWebSocket(ctx context.Context, v Validator, r *http.Request) (Token, error) {
+	text, ok := WebSocketTokenSource()(r)
+	if !ok {
+		return Token{}, ErrInvalidToken
+	}
+	return validateWebSocketToken(ctx, v, []byte(text))
+}
+
+// Validates a token sent as the first message of an upgraded connection, for clients which don't offer it in the
+// handshake. The message is the token's text form. Connections should be closed if it isn't valid, and unauthenticated
+// connections should be given a short deadline to send it.
+func ValidateWebSocketMessage(ctx context.Context, v Validator, msg []byte) (Token, error) {
+	return validateWebSocketToken(ctx, v, bytes.TrimSpace(msg))
+}
+
+func validateWebSocketToken(ctx context.Context, v Validator, text []byte) (Token, error) {
+	var t Token
+	if t.UnmarshalText(text) != nil {
+		return t, ErrInvalidToken
+	}
+	err := v.Validate(ctx, t)
+	if err != nil {
+		return t, fmt.Errorf("invalid token: %w", err)
+	}
+	return t, nil
+}
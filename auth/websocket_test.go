@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateWebSocket(t *testing.T) {
+	ctx := context.Background()
+	good := Token{1}
+	v := onlyValidator(good)
+	offer := func(protocols ...string) *http.Request {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		for _, p := range protocols {
+			r.Header.Add("Sec-WebSocket-Protocol", p)
+		}
+		return r
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(good[:])
+
+	for _, r := range []*http.Request{
+		offer("chat, " + WebSocketProtocol + ", " + encoded),
+		offer(WebSocketProtocol, encoded),
+	} {
+		got, err := ValidateWebSocket(ctx, v, r)
+		if err != nil || got != good {
+			t.Fatalf("%v: expected %v, got %v, %v", r.Header, good, got, err)
+		}
+	}
+	for _, r := range []*http.Request{
+		offer(),
+		offer(encoded),
+		offer(WebSocketProtocol),
+		offer(WebSocketProtocol + ", " + good.String()),
+		offer(WebSocketProtocol + ", " + base64.RawURLEncoding.EncodeToString([]byte{2})),
+	} {
+		_, err := ValidateWebSocket(ctx, v, r)
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("%v: expected ErrInvalidToken, got %v", r.Header, err)
+		}
+	}
+
+	got, err := ValidateWebSocketMessage(ctx, v, []byte(good.String()+"\n"))
+	if err != nil || got != good {
+		t.Fatalf("first message: expected %v, got %v, %v", good, got, err)
+	}
+	_, err = ValidateWebSocketMessage(ctx, v, []byte("hello"))
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("first message: expected ErrInvalidToken, got %v", err)
+	}
+}
+
+// A connection from a WebSocket library, e.g github.com/gorilla/websocket.
+type wsConn interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(msg []byte) error
+	Close() error
+}
+
+// Stands in for the library's upgrade, which must select the given subprotocol.
+var upgrade func(w http.ResponseWriter, r *http.Request, subprotocol string) (wsConn, error)
+
+// An echo server which only accepts authenticated connections.
+func ExampleValidateWebSocket() {
+	var v Validator = DBAuthenticator{}
+	http.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		// The token identifies the connection's user, e.g to look up their SessionValue.
+		_, err := ValidateWebSocket(r.Context(), v, r)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrade(w, r, WebSocketProtocol)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			err = conn.WriteMessage(msg)
+			if err != nil {
+				return
+			}
+		}
+	})
+}
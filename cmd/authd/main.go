@@ -0,0 +1,1017 @@
+// Command authd serves the auth package's login and sign up pages from a SQLite database. Its OTLP exporter, and the
+// grpc-gateway that brings in, are required by this module rather than by applications importing auth.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/hherman1/auth/auth"
+	"github.com/hherman1/auth/auth/authgrpc"
+	"github.com/hherman1/auth/auth/authgrpc/authpb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+
+	_ "modernc.org/sqlite"
+)
+
+var mode = flag.String("mode", "prod", "'prod' or 'dev'. Dev mode seeds a test user, enables verbose logging and error pages, and allows -clear")
+var clear = flag.Bool("clear", false, "TEST ONLY: Drops the database on start. Dev mode only")
+var logFlag = flag.Bool("v", false, "Enable verbose logging")
+var dbfile = flag.String("f", "auth.sqlite", "DB file location")
+var tablePrefix = flag.String("table-prefix", "", "Prepended to the auth tables' names, so they can share -f with an application's own tables, e.g 'auth_'")
+var idPrefix = flag.String("id-prefix", "", "If set, new users are given generated IDs with this prefix, e.g 'acme'")
+var validateTimeout = flag.Duration("validate-timeout", 200*time.Millisecond, "How long token validation may take before protected pages fail with a 503. 0 disables the limit")
+var staleWindow = flag.Duration("stale-window", 0, "During store outages, keep accepting tokens validated within this window. 0 disables")
+var validateCacheTTL = flag.Duration("validate-cache-ttl", 0, "Remember valid tokens for this long rather than querying the DB on every request. Tokens revoked by another process may be accepted until then. 0 disables")
+var tokenTTL = flag.Duration("token-ttl", 24*time.Hour, "How long a log in lasts")
+var rememberTTL = flag.Duration("remember-ttl", 0, "If set, the log in page has a 'Remember me' box, and remembered log ins last this long")
+var bindIP = flag.Bool("bind-ip", false, "Refuse tokens at /secured, and refresh tokens, when presented from another IP than they were issued to, so stolen cookies are useless elsewhere. Users whose IP changes must log in again")
+var bindUserAgent = flag.Bool("bind-user-agent", false, "Refuse tokens at /secured, and refresh tokens, when presented by another user agent than they were issued to. Browser updates log users out")
+var refreshTTL = flag.Duration("refresh-ttl", 0, "If set, logins also get a refresh token lasting this long, and sessions are extended while in use. 0 disables")
+var disableSignup = flag.Bool("disable-signup", false, "Turn off the public sign up page. Accounts can then only be created by importing them")
+var baseURL = flag.String("base-url", "http://localhost:8090", "Public URL of this server, used in links sent by email")
+var cookieDomain = flag.String("cookie-domain", "", "If set, the token cookies are shared with subdomains of this domain, e.g 'example.com'")
+var redirectHosts = flag.String("redirect-hosts", "", "Comma separated hosts besides -base-url's which users may be sent on to after logging in, e.g 'app.example.com'. A leading dot allows subdomains, e.g '.example.com'")
+var handoffApps = flag.String("handoff-apps", "", "Comma separated callback URLs of web apps on other sites which share this log in through a code handoff, e.g 'https://app.example.net/auth/callback'")
+var cookieSubdomains = flag.String("cookie-subdomains", "", "Comma separated hosts under -cookie-domain which may use the shared session, e.g 'app.example.com,api.example.com'. Only -cookie-domain itself may otherwise")
+var appRedirects = flag.String("app-redirects", "", "Comma separated callback URLs of native apps, e.g 'myapp://callback', which receive the token when used as the login redirect")
+var requirePKCE = flag.Bool("require-pkce", false, "Only send apps in -app-redirects a PKCE bound code to exchange at /auth/token, never the token itself")
+var admissionLimit = flag.Int("admission-limit", 0, "How many log ins, sign ups and password resets may hash passwords at once. Bursts beyond this queue briefly, then get a 503. 0 disables")
+var lockoutThreshold = flag.Int("lockout-threshold", 5, "Failed log ins before an account is locked out for a while, doubling with further failures. IPs are locked after 4x as many. 0 disables")
+var passwordPolicy = flag.Bool("password-policy", true, "Require new passwords to be at least 8 characters, not a common password, and not easily guessed")
+var sloAvailability = flag.Float64("slo-availability", 0.999, "Fraction of requests to each auth page which should succeed. SLIs and burn rates are served at /metrics when $METRICS_SECRET is set, along with the size of the token table")
+var sloLatency = flag.Duration("slo-latency", 500*time.Millisecond, "Requests to auth pages slower than this count against the latency SLO, which expects 99% to be faster")
+var passwordHash = flag.String("password-hash", "bcrypt", "How new passwords are hashed: 'bcrypt' or 'argon2id'. Existing hashes are upgraded when their users next log in")
+var bcryptCost = flag.Int("bcrypt-cost", 0, "bcrypt cost for new passwords, 4 to 31. Defaults to 10. Hashes with another cost are upgraded when their users next log in")
+var pepperFile = flag.String("pepper-file", "", "File holding a secret key mixed into every new password hash, read from $PASSWORD_PEPPER if unset. Keep it outside the DB, and never change it: users who haven't logged in since can't log in")
+var powDifficulty = flag.Int("pow-difficulty", 0, "If set, log ins and sign ups must solve a proof of work puzzle needing this many leading zero bits, about 1s in a browser at 16. Challenges are signed and spent per process, so several instances need sticky sessions. 0 disables")
+var powMinRisk = flag.Float64("pow-min-risk", 0, "Only require proof of work when a pushed risk signal for the email or IP scores at least this much. 0 requires it always")
+var ssoIssuer = flag.String("sso-issuer", "", "If set, turns off password log in: every log in goes through this OpenID Connect provider, e.g 'https://accounts.google.com'. The client secret is read from $SSO_CLIENT_SECRET")
+var ssoRealms = flag.String("sso-realms", "", "Comma separated domain=issuer pairs, e.g 'acme.com=https://idp.acme.com'. If set, the log in page first asks for the email, and sends users in these domains to their OpenID Connect provider; everyone else logs in with a password. Uses -sso-client-id and $SSO_CLIENT_SECRET")
+var ssoClientID = flag.String("sso-client-id", "", "Client ID registered with the -sso-issuer or -sso-realms providers")
+var ssoDenyUnknown = flag.Bool("sso-deny-unknown", false, "Refuse SSO log ins for emails without an account, rather than creating one")
+var ssoDefaultRoles = flag.String("sso-default-roles", "", "Comma separated roles granted to users created at their first SSO log in")
+var ssoGroupRoles = flag.String("sso-group-roles", "", "Comma separated group=role pairs, granting users created at their first SSO log in roles by the groups their provider puts them in, e.g 'eng=developer'")
+var ssoSyncGroups = flag.Bool("sso-sync-groups", false, "At every SSO log in, grant and revoke the roles in -sso-group-roles so users have exactly those their groups give them. Other roles are left alone, as are all roles when the ID token has no groups claim")
+var ssoProtectedRoles = flag.String("sso-protected-roles", "", "Comma separated roles -sso-sync-groups never grants or revokes, e.g 'admin'")
+var googleClientID = flag.String("google-client-id", "", "If set, users may log in with their Google account. The client secret is read from $GOOGLE_CLIENT_SECRET, and the redirect URL is -base-url's /auth/oauth/google")
+var githubClientID = flag.String("github-client-id", "", "If set, users may log in with their GitHub account. The client secret is read from $GITHUB_CLIENT_SECRET, and the redirect URL is -base-url's /auth/oauth/github")
+var templatesDir = flag.String("templates", "", "Directory of *.html templates replacing the bundled log in, sign up and account pages by file name")
+var verifySignups = flag.Bool("verify-signups", false, "Require new users to verify their email before their account is created")
+var smtpAddr = flag.String("smtp-addr", "", "host:port of the SMTP server used to send email. In dev mode, email is logged if unset")
+var smtpFrom = flag.String("smtp-from", "", "Sender address for email")
+var smtpUser = flag.String("smtp-user", "", "SMTP username. The password is read from $SMTP_PASSWORD")
+var dkimKey = flag.String("dkim-key", "", "PEM file holding the RSA or Ed25519 private key used to DKIM sign email")
+var dkimSelector = flag.String("dkim-selector", "", "DKIM selector; the public key is published at <selector>._domainkey.<domain>")
+var dkimDomain = flag.String("dkim-domain", "", "DKIM signing domain. Defaults to the domain of -smtp-from")
+var maxRisk = flag.Float64("max-risk", 0, "Refuse logins when a pushed risk signal for the email or IP scores at least this much. 0 disables. Signals are accepted at /risk when $RISK_API_SECRET is set")
+var notifyEmail = flag.String("notify-email", "", "Email security events, e.g blocked logins, to this address. Events are also posted to $SLACK_WEBHOOK_URL and $DISCORD_WEBHOOK_URL when set")
+var checkMX = flag.Bool("check-mx", false, "Reject sign ups whose email domain has no mail server in DNS")
+var blockDisposable = flag.Bool("block-disposable", false, "Reject sign ups from disposable email providers. The list is managed at /admin/disposable-domains when $ADMIN_API_SECRET is set")
+var reapInterval = flag.Duration("reap-interval", time.Hour, "How often expired tokens and other expired data are deleted")
+var tokenGrace = flag.Duration("token-grace", 24*time.Hour, "How long expired tokens are kept before they are deleted, to allow for clock skew between replicas")
+var oidcKey = flag.String("oidc-key", "", "PEM file holding the RSA private key which signs ID tokens. If set, this server is an OpenID Connect provider for the clients registered with -register-client, discovered under -base-url's /auth")
+var jwtKey = flag.String("jwt-key", "", "PEM file holding the Ed25519 private key which signs access tokens as EdDSA JWTs, so services can validate them with the public key and no DB. Alternatively set $JWT_SECRET to sign them with HS256, which lets every service holding it read the tokens sealed in them")
+var slowQuery = flag.Duration("slow-query", 0, "If set, statements taking at least this long are logged as slow, with their rows affected, to debug SQLite lock contention")
+var logQueries = flag.Bool("log-queries", false, "Log every statement run against the DB, with its duration and rows affected")
+var grpcAddr = flag.String("grpc-addr", "", "If set, also serve Authenticate, Register, Validate and Revoke over gRPC on this address, e.g 'localhost:8091', sharing the HTTP pages' users and tokens. The service is defined in auth/authgrpc/authpb/auth.proto. Plaintext, so keep it on a private network. Can't be combined with -disable-signup, -verify-signups, -sso-issuer, -sso-realms, -pow-difficulty or -admission-limit, which only the HTTP pages enforce")
+var telemetryEndpoint = flag.String("telemetry-endpoint", "", "Off unless set. If set, POST an anonymous usage report here daily: logins and users rounded down to a power of ten, the backend, and a random ID replaced monthly. Nothing else is sent")
+var traceExporter = flag.String("trace-exporter", "", "Off unless set. Where OpenTelemetry spans of the auth pages and their DB calls go: 'stdout', or 'otlp' to send them over OTLP/HTTP as configured by $OTEL_EXPORTER_OTLP_ENDPOINT and the other standard variables. Requests carrying a W3C traceparent header continue that trace")
+var registerClient = flag.String("register-client", "", "Register an OpenID Connect client as name=redirect_uri[,redirect_uri...], print its ID and secret, and exit")
+var deleteClient = flag.String("delete-client", "", "Unregister the OpenID Connect client with this ID, revoking its tokens, and exit")
+var breakGlass = flag.String("break-glass", "", "EMERGENCY ONLY: Print a single use link logging in as the user with this email for 15 minutes, announce it to the -notify-email and webhook operators, and exit. For when every administrator is locked out. Requires -break-glass-reason")
+var breakGlassReason = flag.String("break-glass-reason", "", "Why -break-glass is needed, recorded in the user's history")
+var breakGlassTTL = flag.Duration("break-glass-ttl", time.Hour, "How long the -break-glass link may be used for")
+var backupDir = flag.String("backup", "", "Snapshot the DB into this directory and exit. The DB may be in use by a running server meanwhile")
+var incremental = flag.Bool("incremental", false, "With -backup, keep only the pages changed since the latest full snapshot, rather than a new full snapshot. Take a full one now and then, e.g daily, and incremental ones in between")
+var backupKeep = flag.Int("backup-keep", 7, "With -backup, how many full snapshots to keep, with the incremental backups taken after them")
+var restoreDir = flag.String("restore", "", "Rebuild the DB at -f from the backups in this directory, and exit. -f must not exist, so move the damaged DB aside first")
+var restoreAt = flag.String("restore-at", "", "With -restore, the RFC 3339 time to restore the DB as of, e.g '2024-01-02T15:04:05Z', using the latest backup taken by then. Defaults to the latest backup")
+var exportFile = flag.String("export", "", "Write all accounts to this archive file and exit")
+var importFile = flag.String("import", "", "Load all accounts from this archive file and exit")
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx)
+	stop()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context) error {
+	flag.Parse()
+	err := validateFlags()
+	if err != nil {
+		return err
+	}
+
+	dev := *mode == "dev"
+
+	// Configure log
+	if !*logFlag && !dev {
+		log.SetOutput(io.Discard)
+	}
+
+	// Maybe clear the DB
+	if *clear {
+		err = os.Remove(*dbfile)
+		if err != nil {
+			return fmt.Errorf("-clear: remove %v: %w", *dbfile, err)
+		}
+	}
+
+	if *restoreDir != "" {
+		return restoreBackup(ctx)
+	}
+
+	db, err := sql.Open("sqlite", *dbfile)
+	if err != nil {
+		return fmt.Errorf("connect to SQLite3 DB: %w", err)
+	}
+	var queryLog *auth.QueryLogger
+	if *slowQuery > 0 || *logQueries {
+		// Reopened through the logger, so every statement and transaction is logged, not just the authenticator's.
+		queryLog = &auth.QueryLogger{Threshold: *slowQuery, All: *logQueries}
+		d := db.Driver()
+		db.Close()
+		db = queryLog.OpenDB(d, *dbfile)
+	}
+	defer db.Close()
+
+	schema := &auth.Schema{Prefix: *tablePrefix}
+	inSchema, err := schema.Wrap(db)
+	if err != nil {
+		return fmt.Errorf("-table-prefix: %w", err)
+	}
+	// Create table
+	err = auth.Initialize(ctx, db, auth.WithSchema(schema))
+	if err != nil {
+		return fmt.Errorf("initialize schema: %w", err)
+	}
+
+	if *backupDir != "" {
+		return backup(ctx, db)
+	}
+	if *exportFile != "" {
+		return exportAccounts(ctx, db, schema, *exportFile)
+	}
+	if *importFile != "" {
+		return importAccounts(ctx, db, schema, *importFile)
+	}
+	if *registerClient != "" {
+		name, uris, _ := strings.Cut(*registerClient, "=")
+		c, secret, err := auth.RegisterClient(ctx, inSchema, name, strings.Split(uris, ","), time.Now())
+		if err != nil {
+			return fmt.Errorf("-register-client: %w", err)
+		}
+		fmt.Printf("registered %v\nclient_id: %v\nclient_secret: %v\n", c.Name, c.ID, secret)
+		return nil
+	}
+	if *deleteClient != "" {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("-delete-client: open transaction: %w", err)
+		}
+		defer tx.Rollback()
+		c, err := schema.Wrap(tx)
+		if err != nil {
+			return fmt.Errorf("-delete-client: %w", err)
+		}
+		err = auth.DeleteClient(ctx, c, *deleteClient)
+		if err != nil {
+			return fmt.Errorf("-delete-client: %w", err)
+		}
+		return tx.Commit()
+	}
+	if *breakGlass != "" {
+		return issueBreakGlass(ctx, db, schema)
+	}
+
+	// serve traffic
+	m, err := mailer()
+	if err != nil {
+		return err
+	}
+	// Set once the validator is built, if validations are cached.
+	var cache *auth.CachedValidator
+	authenticator := auth.DBAuthenticator{
+		DB:          db,
+		Schema:      schema,
+		IDPrefix:    *idPrefix,
+		MaxRisk:     *maxRisk,
+		Notifiers:   notifiers(m),
+		RefreshTTL:  *refreshTTL,
+		TokenTTL:    *tokenTTL,
+		RememberTTL: *rememberTTL,
+		LastUsed:    &auth.LastUsedTracker{},
+	}
+	authenticator.Hasher, err = hasher()
+	if err != nil {
+		return err
+	}
+	if dev {
+		err = seedTestUser(ctx, db, schema, authenticator.Hasher)
+		if err != nil {
+			return fmt.Errorf("test user: %w", err)
+		}
+	}
+	if *lockoutThreshold > 0 {
+		authenticator.Lockout = &auth.LoginLockout{AccountThreshold: *lockoutThreshold, IPThreshold: 4 * *lockoutThreshold}
+	}
+	if *jwtKey != "" {
+		key, err := loadEd25519Key(*jwtKey)
+		if err != nil {
+			return fmt.Errorf("-jwt-key: %w", err)
+		}
+		authenticator.JWT = &auth.JWTKey{PrivateKey: key}
+	} else if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		if len(secret) < 32 {
+			return errors.New("$JWT_SECRET must be at least 32 bytes")
+		}
+		authenticator.JWT = &auth.JWTKey{Secret: []byte(secret)}
+	}
+	if *passwordPolicy {
+		policy := auth.DefaultPasswordPolicy()
+		authenticator.PasswordPolicy = &policy
+	}
+	if *blockDisposable {
+		disposable := auth.NewDisposableDomainChecker()
+		authenticator.EmailCheckers = append(authenticator.EmailCheckers, disposable)
+		if secret := os.Getenv("ADMIN_API_SECRET"); secret != "" {
+			http.Handle("/admin/disposable-domains", disposable.Handler(secret))
+		}
+	}
+	if *checkMX {
+		authenticator.EmailCheckers = append(authenticator.EmailCheckers, &auth.MXChecker{})
+	}
+	authenticator.OnRevokeUser = func(uid string) {
+		if cache != nil {
+			cache.InvalidateUser(uid)
+		}
+	}
+	if *ssoRealms != "" {
+		// Refuses passwords for realm accounts however they are named, not only by email on the log in page.
+		for _, pair := range strings.Split(*ssoRealms, ",") {
+			domain, _, _ := strings.Cut(pair, "=")
+			authenticator.SSODomains = append(authenticator.SSODomains, domain)
+		}
+	}
+	// Flash messages only live for a minute, so a per process key is fine.
+	flash := &auth.Flasher{Key: make([]byte, 32)}
+	_, err = rand.Read(flash.Key)
+	if err != nil {
+		return fmt.Errorf("flash key: %w", err)
+	}
+	server := auth.AuthServer{
+		Authenticator:      authenticator,
+		Debug:              dev,
+		DisableSignup:      *disableSignup,
+		VerifySignups:      *verifySignups,
+		Mailer:             m,
+		BaseURL:            *baseURL,
+		IssueRefreshTokens: *refreshTTL > 0,
+		RememberMe:         *rememberTTL > 0,
+		Cookies:            auth.CookieOptions{Domain: *cookieDomain},
+		Flash:              flash,
+	}
+	newSSO := func(issuer string) (*auth.SSO, error) {
+		provider, err := oidc.NewProvider(ctx, issuer)
+		if err != nil {
+			return nil, fmt.Errorf("discover sso provider %v: %w", issuer, err)
+		}
+		return &auth.SSO{
+			Provider:     provider,
+			ClientID:     *ssoClientID,
+			ClientSecret: os.Getenv("SSO_CLIENT_SECRET"),
+			RedirectURL:  strings.TrimSuffix(*baseURL, "/") + "/auth/sso",
+			Provisioning: provisioning(),
+		}, nil
+	}
+	if *ssoIssuer != "" {
+		server.SSO, err = newSSO(*ssoIssuer)
+		if err != nil {
+			return err
+		}
+	}
+	if *ssoRealms != "" {
+		server.Realms = make(map[string]*auth.SSO)
+		for _, pair := range strings.Split(*ssoRealms, ",") {
+			domain, issuer, _ := strings.Cut(pair, "=")
+			server.Realms[strings.ToLower(domain)], err = newSSO(issuer)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if *oidcKey != "" {
+		key, err := loadRSAKey(*oidcKey)
+		if err != nil {
+			return fmt.Errorf("-oidc-key: %w", err)
+		}
+		server.IdentityProvider = &auth.IdentityProvider{Key: key}
+	}
+	if *googleClientID != "" || *githubClientID != "" {
+		server.OAuth = make(map[string]*auth.OAuthProvider)
+	}
+	if *googleClientID != "" {
+		server.OAuth["google"], err = auth.GoogleProvider(ctx, *googleClientID, os.Getenv("GOOGLE_CLIENT_SECRET"),
+			strings.TrimSuffix(*baseURL, "/")+"/auth/oauth/google")
+		if err != nil {
+			return err
+		}
+	}
+	if *githubClientID != "" {
+		server.OAuth["github"] = auth.GitHubProvider(*githubClientID, os.Getenv("GITHUB_CLIENT_SECRET"),
+			strings.TrimSuffix(*baseURL, "/")+"/auth/oauth/github")
+	}
+	if *admissionLimit > 0 {
+		server.Admission = &auth.AdmissionLimiter{Concurrency: *admissionLimit}
+	}
+	tokens := &auth.TokenMonitor{DB: db, Schema: schema, Grace: *tokenGrace, ReapInterval: *reapInterval}
+	if secret := os.Getenv("METRICS_SECRET"); secret != "" {
+		server.SLO = &auth.SLOTracker{Default: auth.Objective{Availability: *sloAvailability, Latency: *sloLatency}}
+		sources := []auth.MetricsSource{server.SLO, tokens}
+		if queryLog != nil {
+			sources = append(sources, queryLog)
+		}
+		http.Handle("/metrics", auth.MetricsHandler(secret, sources...))
+	}
+	if *powDifficulty > 0 {
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return fmt.Errorf("proof of work secret: %w", err)
+		}
+		server.ProofOfWork = &auth.ProofOfWork{Secret: secret, Difficulty: *powDifficulty}
+		if *powMinRisk > 0 {
+			server.ProofOfWork.Suspicious = auth.RiskyRequests(db, schema, *powMinRisk)
+		}
+	}
+	if *cookieSubdomains != "" {
+		server.Cookies.Subdomains = strings.Split(*cookieSubdomains, ",")
+	}
+	if *redirectHosts != "" {
+		server.RedirectHosts = strings.Split(*redirectHosts, ",")
+	}
+	if *templatesDir != "" {
+		server.Templates, err = auth.ParseTemplates(os.DirFS(*templatesDir))
+		if err != nil {
+			return err
+		}
+	}
+	if *handoffApps != "" {
+		server.HandoffApps = strings.Split(*handoffApps, ",")
+	}
+	if *appRedirects != "" {
+		server.AppRedirects = strings.Split(*appRedirects, ",")
+		server.RequirePKCE = *requirePKCE
+	}
+	var validator auth.Validator = &auth.StaleValidator{
+		Validator: &auth.CircuitBreaker{Validator: authenticator},
+		Window:    *staleWindow,
+	}
+	if *validateCacheTTL > 0 {
+		cache = &auth.CachedValidator{Validator: validator, TTL: *validateCacheTTL}
+		server.OnRevoke = cache.Invalidate
+		validator = cache
+	}
+	if *traceExporter != "" {
+		tp, err := tracerProvider(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// The context is done by now, but spans still buffered should be sent.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tp.Shutdown(shutdownCtx); err != nil {
+				log.Printf("warning: flush traces: %v", err)
+			}
+		}()
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+		server.Tracing = &auth.Tracing{}
+	}
+	if *bindIP || *bindUserAgent {
+		server.Binding = &auth.TokenBinding{IP: *bindIP, UserAgent: *bindUserAgent, Clients: authenticator}
+	}
+	server.Mount(http.DefaultServeMux, "/auth")
+	filter := auth.AuthFilter{
+		Validator:       validator,
+		LoginURL:        strings.TrimSuffix(*baseURL, "/") + "/auth/login",
+		ValidateTimeout: *validateTimeout,
+		Flash:           flash,
+		Cookies:         server.Cookies,
+		Binding:         server.Binding,
+	}
+	if *refreshTTL > 0 {
+		filter.Refresher = authenticator
+		filter.RefreshWithin = time.Hour
+	}
+	if secret := os.Getenv("RISK_API_SECRET"); secret != "" {
+		http.Handle("/risk", auth.RiskHandler{DB: db, Schema: schema, Secret: secret})
+	}
+	if secret := os.Getenv("ADMIN_API_SECRET"); secret != "" {
+		http.Handle("/admin/reset-report", auth.ResetReportHandler{DB: db, Schema: schema, Secret: secret})
+		http.Handle("/admin/notes", auth.NotesHandler{DB: db, Schema: schema, Secret: secret, Templates: server.Templates})
+	}
+	http.Handle("/secured", filter.Handler(func(t auth.Token, w http.ResponseWriter, r *http.Request) {
+		w.Write(t[:])
+	}))
+	// Closed once in flight gRPC calls are over, so the DB isn't closed under them.
+	grpcStopped := make(chan struct{})
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			return fmt.Errorf("-grpc-addr: %w", err)
+		}
+		g := grpc.NewServer()
+		authpb.RegisterAuthServer(g, &authgrpc.Server{Authenticator: authenticator, OnRevoke: server.OnRevoke})
+		go func() {
+			defer close(grpcStopped)
+			<-ctx.Done()
+			g.GracefulStop()
+		}()
+		go func() {
+			err := g.Serve(lis)
+			if err != nil {
+				log.Printf("error: grpc: %v", err)
+			}
+		}()
+	}
+	reaped := auth.StartReaper(ctx, db, schema, *reapInterval, *tokenGrace)
+	go tokens.Run(ctx)
+	if *telemetryEndpoint != "" {
+		log.Printf("reporting anonymous usage to %v", *telemetryEndpoint)
+		go (&auth.Telemetry{Endpoint: *telemetryEndpoint, DB: db, Schema: schema}).Run(ctx)
+	}
+	srv := &http.Server{Addr: "localhost:8090"}
+	// ListenAndServe returns as soon as Shutdown begins, so this is closed once it has finished with in flight requests.
+	shutDown := make(chan struct{})
+	go func() {
+		defer close(shutDown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("warning: shut down: %v", err)
+		}
+	}()
+	err = srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-shutDown
+	if *grpcAddr != "" {
+		<-grpcStopped
+	}
+	<-reaped
+	return nil
+}
+
+// Returns a tracer provider sending spans to the -trace-exporter.
+func tracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch *traceExporter {
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trace exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("authd")))
+	if err != nil {
+		return nil, fmt.Errorf("trace resource: %w", err)
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// Returns the rules for creating users at their first SSO log in, from the flags.
+func provisioning() auth.Provisioning {
+	p := auth.Provisioning{Deny: *ssoDenyUnknown, GroupRoles: make(map[string][]string), SyncGroups: *ssoSyncGroups}
+	if *ssoDefaultRoles != "" {
+		p.DefaultRoles = strings.Split(*ssoDefaultRoles, ",")
+	}
+	if *ssoProtectedRoles != "" {
+		p.ProtectedRoles = strings.Split(*ssoProtectedRoles, ",")
+	}
+	if *ssoGroupRoles != "" {
+		for _, pair := range strings.Split(*ssoGroupRoles, ",") {
+			group, role, _ := strings.Cut(pair, "=")
+			p.GroupRoles[group] = append(p.GroupRoles[group], role)
+		}
+	}
+	return p
+}
+
+// Checks the flags for problems at boot, reporting all of them at once rather than failing at first use.
+func validateFlags() error {
+	var problems []string
+	if *mode != "prod" && *mode != "dev" {
+		problems = append(problems, fmt.Sprintf("-mode: must be 'prod' or 'dev', was '%v'", *mode))
+	}
+	if *clear && *mode != "dev" {
+		problems = append(problems, "-clear: only allowed with -mode=dev")
+	}
+	if *dbfile == "" {
+		problems = append(problems, "-f: must not be empty")
+	}
+	if *backupDir != "" && *restoreDir != "" {
+		problems = append(problems, "-backup and -restore: only one may be set")
+	}
+	if *incremental && *backupDir == "" {
+		problems = append(problems, "-incremental: only applies with -backup")
+	}
+	if *backupKeep < 1 {
+		problems = append(problems, fmt.Sprintf("-backup-keep: must be at least 1, was %v", *backupKeep))
+	}
+	if *traceExporter != "" && *traceExporter != "stdout" && *traceExporter != "otlp" {
+		problems = append(problems, fmt.Sprintf("-trace-exporter: must be 'stdout' or 'otlp', was '%v'", *traceExporter))
+	}
+	if *restoreAt != "" && *restoreDir == "" {
+		problems = append(problems, "-restore-at: only applies with -restore")
+	}
+	if *idPrefix != "" {
+		_, err := auth.NewUserID(*idPrefix, time.Now())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("-id-prefix: %v", err))
+		}
+	}
+	if *validateTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("-validate-timeout: must not be negative, was %v", *validateTimeout))
+	}
+	if *tokenTTL <= 0 {
+		problems = append(problems, fmt.Sprintf("-token-ttl: must be positive, was %v", *tokenTTL))
+	}
+	if *rememberTTL < 0 {
+		problems = append(problems, fmt.Sprintf("-remember-ttl: must not be negative, was %v", *rememberTTL))
+	}
+	if *refreshTTL < 0 {
+		problems = append(problems, fmt.Sprintf("-refresh-ttl: must not be negative, was %v", *refreshTTL))
+	}
+	if *passwordHash != "bcrypt" && *passwordHash != "argon2id" {
+		problems = append(problems, fmt.Sprintf("-password-hash: must be 'bcrypt' or 'argon2id', was '%v'", *passwordHash))
+	}
+	if *bcryptCost != 0 && (*bcryptCost < bcrypt.MinCost || *bcryptCost > bcrypt.MaxCost) {
+		problems = append(problems, fmt.Sprintf("-bcrypt-cost: must be between %v and %v, was %v", bcrypt.MinCost, bcrypt.MaxCost, *bcryptCost))
+	}
+	if *bcryptCost != 0 && *passwordHash != "bcrypt" {
+		problems = append(problems, "-bcrypt-cost: only applies with -password-hash=bcrypt")
+	}
+	if *powDifficulty < 0 || *powDifficulty > 32 {
+		problems = append(problems, fmt.Sprintf("-pow-difficulty: must be between 0 and 32, was %v", *powDifficulty))
+	}
+	if *powMinRisk < 0 {
+		problems = append(problems, fmt.Sprintf("-pow-min-risk: must not be negative, was %v", *powMinRisk))
+	}
+	if *grpcAddr != "" {
+		// gRPC calls the authenticator directly, so it would let clients around the policies of the HTTP pages.
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{
+			{"-disable-signup", *disableSignup},
+			{"-verify-signups", *verifySignups},
+			{"-sso-issuer", *ssoIssuer != ""},
+			{"-sso-realms", *ssoRealms != ""},
+			{"-pow-difficulty", *powDifficulty > 0},
+			{"-admission-limit", *admissionLimit > 0},
+		} {
+			if f.set {
+				problems = append(problems, fmt.Sprintf("-grpc-addr: can't be used with %v, which gRPC does not enforce", f.name))
+			}
+		}
+	}
+	if *reapInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("-reap-interval: must be positive, was %v", *reapInterval))
+	}
+	if *tokenGrace < 0 {
+		problems = append(problems, fmt.Sprintf("-token-grace: must not be negative, was %v", *tokenGrace))
+	}
+	if *ssoIssuer != "" && *ssoClientID == "" {
+		problems = append(problems, "-sso-issuer: requires -sso-client-id")
+	}
+	if *ssoIssuer != "" && (*googleClientID != "" || *githubClientID != "") {
+		problems = append(problems, "-google-client-id, -github-client-id: can't be used with -sso-issuer, which federates every log in")
+	}
+	if *ssoRealms != "" {
+		for _, pair := range strings.Split(*ssoRealms, ",") {
+			domain, issuer, ok := strings.Cut(pair, "=")
+			if u, err := url.Parse(issuer); !ok || domain == "" || strings.Contains(domain, "@") || err != nil || u.Scheme != "https" {
+				problems = append(problems, fmt.Sprintf("-sso-realms: must be domain=issuer pairs with https issuers, was '%v'", pair))
+			}
+		}
+		if *ssoClientID == "" {
+			problems = append(problems, "-sso-realms: requires -sso-client-id")
+		}
+		if *ssoIssuer != "" {
+			problems = append(problems, "-sso-realms: can't be used with -sso-issuer, which turns off password log in")
+		}
+	}
+	if *ssoGroupRoles != "" {
+		for _, pair := range strings.Split(*ssoGroupRoles, ",") {
+			group, role, ok := strings.Cut(pair, "=")
+			if !ok || group == "" || role == "" {
+				problems = append(problems, fmt.Sprintf("-sso-group-roles: must be group=role pairs, was '%v'", pair))
+			}
+		}
+	}
+	if *ssoClientID != "" && *ssoIssuer == "" && *ssoRealms == "" {
+		problems = append(problems, "-sso-client-id: requires -sso-issuer or -sso-realms")
+	}
+	if *lockoutThreshold < 0 {
+		problems = append(problems, fmt.Sprintf("-lockout-threshold: must not be negative, was %v", *lockoutThreshold))
+	}
+	if *sloAvailability <= 0 || *sloAvailability >= 1 {
+		problems = append(problems, fmt.Sprintf("-slo-availability: must be between 0 and 1, was %v", *sloAvailability))
+	}
+	if *sloLatency <= 0 {
+		problems = append(problems, fmt.Sprintf("-slo-latency: must be positive, was %v", *sloLatency))
+	}
+	if *admissionLimit < 0 {
+		problems = append(problems, fmt.Sprintf("-admission-limit: must not be negative, was %v", *admissionLimit))
+	}
+	if *staleWindow < 0 {
+		problems = append(problems, fmt.Sprintf("-stale-window: must not be negative, was %v", *staleWindow))
+	}
+	if _, err := url.Parse(*baseURL); err != nil || *baseURL == "" {
+		problems = append(problems, fmt.Sprintf("-base-url: must be a URL, was '%v'", *baseURL))
+	}
+	if *appRedirects != "" {
+		for _, callback := range strings.Split(*appRedirects, ",") {
+			u, err := url.Parse(callback)
+			if err != nil || u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https" {
+				problems = append(problems, fmt.Sprintf("-app-redirects: must be URLs with an app scheme, was '%v'", callback))
+			}
+		}
+	}
+	if *cookieSubdomains != "" {
+		for _, host := range strings.Split(*cookieSubdomains, ",") {
+			if *cookieDomain == "" || host != *cookieDomain && !strings.HasSuffix(host, "."+strings.TrimPrefix(*cookieDomain, ".")) {
+				problems = append(problems, fmt.Sprintf("-cookie-subdomains: must be hosts under -cookie-domain, was '%v'", host))
+			}
+		}
+	}
+	if *requirePKCE && *appRedirects == "" {
+		problems = append(problems, "-require-pkce: requires -app-redirects")
+	}
+	if *verifySignups && *mode != "dev" && (*smtpAddr == "" || *smtpFrom == "") {
+		problems = append(problems, "-verify-signups: requires -smtp-addr and -smtp-from to send email")
+	}
+	if *notifyEmail != "" && *mode != "dev" && *smtpAddr == "" {
+		problems = append(problems, "-notify-email: requires -smtp-addr to send email")
+	}
+	if *smtpAddr != "" && *smtpFrom == "" {
+		problems = append(problems, "-smtp-addr: requires -smtp-from")
+	}
+	if (*dkimKey == "") != (*dkimSelector == "") {
+		problems = append(problems, "-dkim-key and -dkim-selector: must be set together")
+	}
+	if *dkimKey != "" && *smtpAddr == "" {
+		problems = append(problems, "-dkim-key: requires -smtp-addr")
+	}
+	if *maxRisk < 0 || *maxRisk > 1 {
+		problems = append(problems, fmt.Sprintf("-max-risk: must be between 0 and 1, was %v", *maxRisk))
+	}
+	if *exportFile != "" && *importFile != "" {
+		problems = append(problems, "-export and -import: only one may be set")
+	}
+	if *clear && *exportFile != "" {
+		problems = append(problems, "-clear and -export: would export an empty database")
+	}
+	if *registerClient != "" {
+		if name, uris, ok := strings.Cut(*registerClient, "="); !ok || name == "" || uris == "" {
+			problems = append(problems, fmt.Sprintf("-register-client: must be name=redirect_uri[,redirect_uri...], was '%v'", *registerClient))
+		}
+	}
+	if *breakGlass != "" && strings.TrimSpace(*breakGlassReason) == "" {
+		problems = append(problems, "-break-glass: requires -break-glass-reason")
+	}
+	if *breakGlassTTL <= 0 {
+		problems = append(problems, fmt.Sprintf("-break-glass-ttl: must be positive, was %v", *breakGlassTTL))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid flags:\n\t%v", strings.Join(problems, "\n\t"))
+}
+
+// Sends email over SMTP if configured. Otherwise email is logged in dev mode, and features which send email are off in
+// prod.
+func mailer() (auth.Mailer, error) {
+	if *smtpAddr == "" && *mode == "dev" {
+		return auth.LogMailer{}, nil
+	}
+	if *smtpAddr == "" {
+		return nil, nil
+	}
+	m := auth.SMTPMailer{Addr: *smtpAddr, From: *smtpFrom}
+	if *smtpUser != "" {
+		host, _, _ := net.SplitHostPort(*smtpAddr)
+		m.Auth = smtp.PlainAuth("", *smtpUser, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	if *dkimKey != "" {
+		pemBytes, err := os.ReadFile(*dkimKey)
+		if err != nil {
+			return nil, fmt.Errorf("-dkim-key: %w", err)
+		}
+		key, err := auth.LoadDKIMKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("-dkim-key: %w", err)
+		}
+		domain := *dkimDomain
+		if domain == "" {
+			addr, err := mail.ParseAddress(*smtpFrom)
+			if err != nil {
+				return nil, fmt.Errorf("-smtp-from: %w", err)
+			}
+			domain = addr.Address[strings.LastIndex(addr.Address, "@")+1:]
+		}
+		m.DKIM = &auth.DKIMSigner{Domain: domain, Selector: *dkimSelector, Key: key}
+	}
+	return m, nil
+}
+
+// Returns the sinks for security events configured by flags and environment.
+func notifiers(m auth.Mailer) []auth.Notifier {
+	var ns []auth.Notifier
+	if *notifyEmail != "" {
+		ns = append(ns, auth.MailNotifier{Mailer: m, To: *notifyEmail})
+	}
+	if u := os.Getenv("SLACK_WEBHOOK_URL"); u != "" {
+		ns = append(ns, auth.SlackNotifier{WebhookURL: u})
+	}
+	if u := os.Getenv("DISCORD_WEBHOOK_URL"); u != "" {
+		ns = append(ns, auth.DiscordNotifier{WebhookURL: u})
+	}
+	return ns
+}
+
+// Prints a break glass link for the -break-glass user, and tells the operators it was issued.
+func issueBreakGlass(ctx context.Context, db *sql.DB, schema *auth.Schema) error {
+	m, err := mailer()
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("-break-glass: open transaction: %w", err)
+	}
+	defer tx.Rollback()
+	c, err := schema.Wrap(tx)
+	if err != nil {
+		return fmt.Errorf("-break-glass: %w", err)
+	}
+	now := time.Now()
+	code, err := auth.IssueBreakGlass(ctx, c, *breakGlass, *breakGlassReason, now, now.Add(*breakGlassTTL))
+	if errors.Is(err, auth.ErrBadCredentials) {
+		return fmt.Errorf("-break-glass: no user with email %v", *breakGlass)
+	}
+	if err != nil {
+		return fmt.Errorf("-break-glass: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("-break-glass: commit: %w", err)
+	}
+	host, _ := os.Hostname()
+	n := auth.Notification{
+		Subject: fmt.Sprintf("Break glass link issued for %v", *breakGlass),
+		Body:    fmt.Sprintf("Issued on %v, usable until %v. Reason given: %v", host, now.Add(*breakGlassTTL).Format(time.RFC3339), *breakGlassReason),
+	}
+	for _, notifier := range notifiers(m) {
+		err := notifier.Notify(ctx, n)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: notify %T: %v\n", notifier, err)
+		}
+	}
+	link := strings.TrimSuffix(*baseURL, "/") + "/auth/breakglass?code=" + url.QueryEscape(code.String())
+	fmt.Printf("break glass link for %v, usable once until %v. It is not stored, and can't be shown again:\n%v\n",
+		*breakGlass, now.Add(*breakGlassTTL).Format(time.RFC3339), link)
+	return nil
+}
+
+// Creates a well known user for local testing, hunter@hherman.com with password "correct-horse-battery-staple", if it
+// doesn't already exist.
+func seedTestUser(ctx context.Context, db *sql.DB, schema *auth.Schema, h auth.Hasher) error {
+	c, err := schema.Wrap(db)
+	if err != nil {
+		return err
+	}
+	_, err = auth.LookupByEmail(ctx, c, "hunter@hherman.com")
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, auth.ErrBadCredentials) {
+		return err
+	}
+	return auth.RegisterUserWith(ctx, c, auth.PasswordOptions{Hasher: h}, "hunter", "hunter@hherman.com", "correct-horse-battery-staple")
+}
+
+// Takes a backup into -backup, and prunes the oldest.
+func backup(ctx context.Context, db *sql.DB) error {
+	b, err := auth.Backup(ctx, db, *backupDir, *incremental, time.Now())
+	if err != nil {
+		return fmt.Errorf("-backup: %w", err)
+	}
+	err = auth.PruneBackups(*backupDir, *backupKeep)
+	if err != nil {
+		return fmt.Errorf("-backup: %w", err)
+	}
+	fmt.Printf("backed up to %v\n", b.Path)
+	return nil
+}
+
+// Rebuilds -f from the backups in -restore, and checks the result.
+func restoreBackup(ctx context.Context) error {
+	at := time.Now()
+	if *restoreAt != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, *restoreAt)
+		if err != nil {
+			return fmt.Errorf("-restore-at: %w", err)
+		}
+	}
+	b, err := auth.RestoreBackup(*restoreDir, at, *dbfile)
+	if err != nil {
+		return fmt.Errorf("-restore: %w", err)
+	}
+	db, err := sql.Open("sqlite", *dbfile)
+	if err != nil {
+		return fmt.Errorf("-restore: connect to SQLite3 DB: %w", err)
+	}
+	defer db.Close()
+	var result string
+	err = db.QueryRowContext(ctx, `PRAGMA integrity_check;`).Scan(&result)
+	if err != nil {
+		return fmt.Errorf("-restore: check integrity: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("-restore: restored DB at %v is corrupt: %v", *dbfile, result)
+	}
+	fmt.Printf("restored %v as of %v from %v\n", *dbfile, b.Taken.UTC().Format(time.RFC3339), b.Path)
+	return nil
+}
+
+// Writes every account to the given file as a JSON archive.
+func exportAccounts(ctx context.Context, db *sql.DB, schema *auth.Schema, path string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("export: open transaction: %w", err)
+	}
+	defer tx.Rollback()
+	c, err := schema.Wrap(tx)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	a, err := auth.Export(ctx, c, time.Now())
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	b, err := json.MarshalIndent(a, "", "\t")
+	if err != nil {
+		return fmt.Errorf("export: marshal: %w", err)
+	}
+	err = os.WriteFile(path, b, 0600)
+	if err != nil {
+		return fmt.Errorf("export: write %v: %w", path, err)
+	}
+	fmt.Printf("exported %v users to %v\n", len(a.Users), path)
+	return nil
+}
+
+// Reads a PEM encoded PKCS#1 or PKCS#8 RSA private key.
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an RSA key, was %T", k)
+	}
+	return rk, nil
+}
+
+// Reads a PKCS #8 Ed25519 private key from a PEM file, e.g made by "openssl genpkey -algorithm ed25519".
+func loadEd25519Key(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	ek, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 key, was %T", k)
+	}
+	return ek, nil
+}
+
+// Builds the hasher for new passwords from the flags, peppered if a pepper is configured.
+func hasher() (auth.Hasher, error) {
+	var h auth.Hasher = auth.BcryptHasher{Cost: *bcryptCost}
+	if *passwordHash == "argon2id" {
+		h = auth.Argon2idHasher{}
+	}
+	pepper := []byte(os.Getenv("PASSWORD_PEPPER"))
+	if *pepperFile != "" {
+		b, err := os.ReadFile(*pepperFile)
+		if err != nil {
+			return nil, fmt.Errorf("-pepper-file: %w", err)
+		}
+		pepper = bytes.TrimSpace(b)
+	}
+	if len(pepper) == 0 {
+		return h, nil
+	}
+	if len(pepper) < 32 {
+		return nil, fmt.Errorf("pepper must be at least 32 bytes, was %v", len(pepper))
+	}
+	return auth.PepperedHasher{Hasher: h, Pepper: pepper}, nil
+}
+
+// Loads every account in the given archive file. Nothing is imported if any account conflicts.
+func importAccounts(ctx context.Context, db *sql.DB, schema *auth.Schema, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("import: read %v: %w", path, err)
+	}
+	var a auth.Archive
+	err = json.Unmarshal(b, &a)
+	if err != nil {
+		return fmt.Errorf("import: parse %v: %w", path, err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("import: open transaction: %w", err)
+	}
+	defer tx.Rollback()
+	c, err := schema.Wrap(tx)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	err = auth.Import(ctx, c, a)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("import: commit: %w", err)
+	}
+	fmt.Printf("imported %v users from %v\n", len(a.Users), path)
+	return nil
+}